@@ -2,194 +2,661 @@
 package api
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/carlostbanks/pickle/auth"
-	"github.com/carlostbanks/pickle/db"
+	"github.com/carlostbanks/pickle/config"
+	"github.com/carlostbanks/pickle/storage"
 	"github.com/google/uuid"
 )
 
+// User is a user as returned by /api/users/me
+type User struct {
+	ID        string       `json:"id"`
+	Email     string       `json:"email"`
+	Name      string       `json:"name"`
+	Picture   string       `json:"picture"`
+	CreatedAt time.Time    `json:"created_at"`
+	Roles     []auth.Grant `json:"roles"`
+}
+
 // AuthHandler handles all authentication related endpoints
-type AuthHandler struct{}
+type AuthHandler struct {
+	users       storage.UserRepository
+	sessions    *auth.SessionStore
+	magicLinks  *auth.MagicLinks // Nil when magic link login is disabled
+	trusted     map[string]bool  // Providers whose verified emails link to existing users
+	frontendURL string
+	cookies     config.CookieConfig
+}
 
-// NewAuthHandler creates a new AuthHandler
-func NewAuthHandler() *AuthHandler {
-	return &AuthHandler{}
+// NewAuthHandler creates a new AuthHandler issuing tokens for sessions kept
+// in the given store and reading profiles from users. Users log in with the
+// providers configured in the auth package, and with magic links unless
+// magicLinks is nil.
+func NewAuthHandler(cfg config.AuthConfig, users storage.UserRepository, sessions *auth.SessionStore, magicLinks *auth.MagicLinks) *AuthHandler {
+	// Magic links prove the user reads the mail of their address
+	trusted := map[string]bool{auth.MagicLinkProvider: true}
+	for _, provider := range cfg.Providers {
+		if provider.TrustEmail {
+			trusted[provider.Name] = true
+		}
+	}
+
+	return &AuthHandler{
+		users:       users,
+		sessions:    sessions,
+		magicLinks:  magicLinks,
+		trusted:     trusted,
+		frontendURL: cfg.FrontendURL,
+		cookies:     cfg.Cookies,
+	}
 }
 
-// RegisterRoutes registers all authentication routes
-func (h *AuthHandler) RegisterRoutes(mux *http.ServeMux) {
-	mux.HandleFunc("/auth/google/login", h.googleLogin)
-	mux.HandleFunc("/auth/google/callback", h.googleCallback)
-	mux.HandleFunc("/auth/refresh", h.refreshToken)
-	mux.HandleFunc("/auth/logout", h.logout)
+// RegisterRoutes registers all authentication routes, wrapping each handler
+// with wrap
+func (h *AuthHandler) RegisterRoutes(mux *http.ServeMux, wrap func(http.HandlerFunc) http.HandlerFunc) {
+	mux.HandleFunc("GET /auth/providers", wrap(h.providers))
+	mux.HandleFunc("GET /auth/{provider}/login", wrap(h.login))
+	mux.HandleFunc("GET /auth/{provider}/callback", wrap(h.callback))
+	mux.HandleFunc("POST /auth/email/login", wrap(h.emailLogin))
+	mux.HandleFunc("GET /auth/email/callback", wrap(h.emailCallback))
+	mux.HandleFunc("POST /auth/exchange", wrap(h.exchange))
+	mux.HandleFunc("POST /auth/refresh", wrap(h.refresh))
+	mux.HandleFunc("POST /auth/logout", wrap(h.logout))
+	mux.HandleFunc("POST /auth/logout-all", wrap(h.logoutAll))
+	mux.HandleFunc("GET /api/users/me", wrap(h.currentUser))
 }
 
-// googleLogin initiates the Google OAuth flow
-func (h *AuthHandler) googleLogin(w http.ResponseWriter, r *http.Request) {
-	// Generate a state token to prevent CSRF
-	state := uuid.New().String()
+// loginCookie carries the sealed secrets of a login in progress, from the
+// login redirect to the provider's callback. It is only sent to the
+// provider's paths.
+const loginCookie = "oauthState"
 
-	// Create a cookie to store the state
-	http.SetCookie(w, &http.Cookie{
-		Name:     "oauthState",
-		Value:    state,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   r.TLS != nil, // Set secure flag if using HTTPS
-		MaxAge:   int(time.Now().Add(5 * time.Minute).Unix()),
+// errUnverifiedEmail is returned for identities seen for the first time
+// without a verified email address
+var errUnverifiedEmail = errors.New("email address is not verified")
+
+// errUntrustedEmail is returned for identities seen for the first time
+// whose email address belongs to a user, from providers not trusted to
+// link them
+var errUntrustedEmail = errors.New("email address belongs to another login")
+
+// providers lists the ways users can log in
+func (h *AuthHandler) providers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"providers":  auth.ProviderNames(),
+		"magic_link": h.magicLinks != nil,
 	})
+}
 
-	// Redirect to Google's OAuth page
-	url := auth.GetGoogleLoginURL(state)
-	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+// login starts logging in with an identity provider, redirecting to it. An
+// optional login_hint parameter suggests the account to log in with.
+func (h *AuthHandler) login(w http.ResponseWriter, r *http.Request) {
+	provider, ok := auth.LookupProvider(r.PathValue("provider"))
+	if !ok {
+		http.Error(w, "Unknown identity provider", http.StatusNotFound)
+		return
+	}
+
+	params, err := auth.NewLoginParams()
+	if err != nil {
+		log.Printf("Failed to start login: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	params.LoginHint = r.URL.Query().Get("login_hint")
+
+	loginURL, err := provider.AuthCodeURL(r.Context(), params)
+	if err != nil {
+		log.Printf("Failed to reach identity provider %s: %v", provider.Name(), err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	// Store the state to prevent CSRF, with the nonce and PKCE verifier the
+	// callback needs, sealed so they cannot be swapped
+	sealed, err := auth.SealLogin(provider.Name(), params)
+	if err != nil {
+		log.Printf("Failed to seal login: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	cookie := h.cookie(loginCookie, sealed, "/auth/"+provider.Name()+"/", auth.LoginTTL)
+	if cookie.SameSite == http.SameSiteStrictMode {
+		// The provider redirects back from another site
+		cookie.SameSite = http.SameSiteLaxMode
+	}
+	http.SetCookie(w, cookie)
+
+	http.Redirect(w, r, loginURL, http.StatusTemporaryRedirect)
 }
 
-// googleCallback handles the callback from Google OAuth
-func (h *AuthHandler) googleCallback(w http.ResponseWriter, r *http.Request) {
-	// Get the state from the cookie
-	stateCookie, err := r.Cookie("oauthState")
+// callback handles the redirect back from an identity provider, starting a
+// session for the user
+func (h *AuthHandler) callback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := auth.LookupProvider(r.PathValue("provider"))
+	if !ok {
+		http.Error(w, "Unknown identity provider", http.StatusNotFound)
+		return
+	}
+
+	// Get the state from the cookie; the login can only be completed once
+	cookie, err := r.Cookie(loginCookie)
 	if err != nil {
 		http.Error(w, "State not found", http.StatusBadRequest)
 		return
 	}
+	http.SetCookie(w, h.cookie(loginCookie, "", "/auth/"+provider.Name()+"/", -1))
+
+	params, err := auth.OpenLogin(provider.Name(), cookie.Value)
+	if err != nil {
+		http.Error(w, "Invalid state", http.StatusBadRequest)
+		return
+	}
 
 	// Compare the state from the cookie with the state from the callback
-	if r.URL.Query().Get("state") != stateCookie.Value {
+	query := r.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(params.State)) != 1 {
 		http.Error(w, "Invalid state", http.StatusBadRequest)
 		return
 	}
+	if reason := query.Get("error"); reason != "" {
+		log.Printf("Login with %s failed: %s", provider.Name(), reason)
+		http.Error(w, "Login failed", http.StatusBadRequest)
+		return
+	}
+
+	identity, err := provider.Exchange(r.Context(), query.Get("code"), params)
+	if err != nil {
+		log.Printf("Login with %s failed: %v", provider.Name(), err)
+		http.Error(w, "Login failed", http.StatusBadRequest)
+		return
+	}
+
+	h.completeLogin(w, r, identity)
+}
+
+// emailLoginRequest is the body of magic link requests
+type emailLoginRequest struct {
+	Email string `json:"email"`
+}
+
+// emailLogin handles POST requests sending a magic link to an email address.
+// The response does not tell whether the address belongs to a user.
+func (h *AuthHandler) emailLogin(w http.ResponseWriter, r *http.Request) {
+	if h.magicLinks == nil {
+		http.NotFound(w, r)
+		return
+	}
 
-	// Get the authorization code from the callback
-	code := r.URL.Query().Get("code")
-	if code == "" {
-		http.Error(w, "Code not found", http.StatusBadRequest)
+	var req emailLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	// Exchange the code for a token
-	token, err := auth.ExchangeCodeForToken(code)
+	if err := h.magicLinks.Send(r.Context(), req.Email); err != nil {
+		if errors.Is(err, auth.ErrInvalidEmail) {
+			http.Error(w, "Invalid email address", http.StatusBadRequest)
+			return
+		}
+		log.Printf("Failed to send login link: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]bool{
+		"success": true,
+	})
+}
+
+// emailCallback handles magic links, starting a session for their owner
+func (h *AuthHandler) emailCallback(w http.ResponseWriter, r *http.Request) {
+	if h.magicLinks == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	identity, err := h.magicLinks.Consume(r.Context(), r.URL.Query().Get("token"))
 	if err != nil {
-		http.Error(w, "Failed to exchange code for token", http.StatusInternalServerError)
-		log.Printf("Failed to exchange code for token: %v", err)
+		if errors.Is(err, auth.ErrInvalidMagicLink) {
+			http.Error(w, "Invalid or expired login link", http.StatusBadRequest)
+			return
+		}
+		log.Printf("Failed to check login link: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	// Get the user info from Google
-	googleUser, err := auth.GetUserInfo(token)
+	h.completeLogin(w, r, identity)
+}
+
+// completeLogin starts a session for the user with an identity and sends
+// them back to the frontend
+func (h *AuthHandler) completeLogin(w http.ResponseWriter, r *http.Request, identity *auth.Identity) {
+	userID, err := h.userForIdentity(r.Context(), identity)
 	if err != nil {
-		http.Error(w, "Failed to get user info", http.StatusInternalServerError)
-		log.Printf("Failed to get user info: %v", err)
+		if errors.Is(err, errUnverifiedEmail) {
+			http.Error(w, "Email address is not verified", http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, errUntrustedEmail) {
+			http.Error(w, "An account already uses this email address; log in the way you did before", http.StatusConflict)
+			return
+		}
+		log.Printf("Failed to save user: %v", err)
+		http.Error(w, "Failed to save user", http.StatusInternalServerError)
 		return
 	}
 
-	// Check if the user exists in the database
-	var userExists bool
-	err = db.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", googleUser.ID).Scan(&userExists)
+	// Start a session and issue its tokens
+	session, refreshToken, err := h.sessions.Start(r.Context(), userID, r.UserAgent())
 	if err != nil {
-		http.Error(w, "Failed to check if user exists", http.StatusInternalServerError)
-		log.Printf("Failed to check if user exists: %v", err)
+		log.Printf("Failed to start session: %v", err)
+		http.Error(w, "Failed to start session", http.StatusInternalServerError)
 		return
 	}
 
-	// If the user doesn't exist, create a new user
-	if !userExists {
-		_, err = db.DB.Exec(`
-			INSERT INTO users (id, email, name, picture, created_at)
-			VALUES ($1, $2, $3, $4, $5)
-		`, googleUser.ID, googleUser.Email, googleUser.Name, googleUser.Picture, time.Now().Format(time.RFC3339))
-		if err != nil {
-			http.Error(w, "Failed to create user", http.StatusInternalServerError)
-			log.Printf("Failed to create user: %v", err)
+	tokenString, err := h.issueAccessToken(r.Context(), userID, session.ID)
+	if err != nil {
+		log.Printf("Failed to generate JWT: %v", err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	code, err := h.sessions.IssueLoginCode(r.Context(), session.ID)
+	if err != nil {
+		log.Printf("Failed to issue login code: %v", err)
+		http.Error(w, "Failed to start session", http.StatusInternalServerError)
+		return
+	}
+
+	h.setAuthCookies(w, tokenString, refreshToken)
+
+	// Redirect back to the frontend with a one-time code it exchanges for
+	// the access token, which is kept out of URLs and browser history
+	redirectURL := fmt.Sprintf("%s/auth-callback?code=%s", h.frontendURL, url.QueryEscape(code))
+	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+}
+
+// exchangeRequest is the body of login code exchanges
+type exchangeRequest struct {
+	Code string `json:"code"`
+}
+
+// exchange handles POST requests redeeming the one-time code the frontend
+// was sent back with after login for the session's access token
+func (h *AuthHandler) exchange(w http.ResponseWriter, r *http.Request) {
+	var req exchangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	session, err := h.sessions.RedeemLoginCode(r.Context(), req.Code)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidLoginCode) {
+			http.Error(w, "Invalid or expired login code", http.StatusBadRequest)
 			return
 		}
+		log.Printf("Failed to redeem login code: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
 
-	// Generate a JWT token
-	jwtToken, err := auth.GenerateJWT(googleUser)
+	accessToken, err := h.issueAccessToken(r.Context(), session.UserID, session.ID)
 	if err != nil {
-		http.Error(w, "Failed to generate JWT", http.StatusInternalServerError)
 		log.Printf("Failed to generate JWT: %v", err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 
-	// Set the JWT token as a cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    jwtToken,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   r.TLS != nil, // Set secure flag if using HTTPS
-		MaxAge:   int(time.Now().Add(24 * time.Hour).Unix()),
-	})
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      accessToken,
+		"expires_in": int(auth.AccessTokenTTL.Seconds()),
+	}); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// userForIdentity returns the user an identity belongs to. Identities seen
+// for the first time are linked to a new user or, if their provider is
+// trusted with email addresses, to the user with the same verified one.
+func (h *AuthHandler) userForIdentity(ctx context.Context, identity *auth.Identity) (string, error) {
+	linked, err := h.users.GetIdentity(ctx, identity.Provider, identity.Subject)
+	if err == nil {
+		// Keep the profile up to date with the provider
+		if err := h.users.UpdateProfile(ctx, linked.UserID, identity.Name, identity.Picture); err != nil {
+			return "", err
+		}
+		return linked.UserID, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return "", err
+	}
 
-	// Redirect to the frontend
-	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	if identity.Email == "" || !identity.EmailVerified {
+		return "", errUnverifiedEmail
+	}
+
+	user, err := h.users.GetUserByEmail(ctx, identity.Email)
+	if err == nil && !h.trusted[identity.Provider] {
+		return "", errUntrustedEmail
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		name := identity.Name
+		if name == "" {
+			name = strings.SplitN(identity.Email, "@", 2)[0]
+		}
+
+		user = &storage.User{
+			ID:        uuid.New().String(),
+			Email:     identity.Email,
+			Name:      name,
+			Picture:   identity.Picture,
+			CreatedAt: time.Now(),
+		}
+		err = h.users.CreateUser(ctx, user)
+		if errors.Is(err, storage.ErrConflict) {
+			// A concurrent first login created the user
+			if !h.trusted[identity.Provider] {
+				return "", errUntrustedEmail
+			}
+			user, err = h.users.GetUserByEmail(ctx, identity.Email)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	err = h.users.LinkIdentity(ctx, &storage.Identity{
+		Provider:  identity.Provider,
+		Subject:   identity.Subject,
+		UserID:    user.ID,
+		CreatedAt: time.Now(),
+	})
+	if errors.Is(err, storage.ErrConflict) {
+		// A concurrent first login linked the identity
+		linked, err = h.users.GetIdentity(ctx, identity.Provider, identity.Subject)
+		if err != nil {
+			return "", err
+		}
+		return linked.UserID, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return user.ID, nil
 }
 
-// refreshToken refreshes the JWT token
-func (h *AuthHandler) refreshToken(w http.ResponseWriter, r *http.Request) {
-	// Get the token from the cookie
-	tokenCookie, err := r.Cookie("token")
+// currentUser returns the authenticated user and their roles
+func (h *AuthHandler) currentUser(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromRequest(r)
+	if userID == "" {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	// Get user from database
+	stored, err := h.users.GetUser(r.Context(), userID)
 	if err != nil {
-		http.Error(w, "Token not found", http.StatusUnauthorized)
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			log.Printf("Database error: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+		}
 		return
 	}
+	user := User{
+		ID:        stored.ID,
+		Email:     stored.Email,
+		Name:      stored.Name,
+		Picture:   stored.Picture,
+		CreatedAt: stored.CreatedAt,
+	}
+
+	user.Roles, err = auth.LoadGrants(r.Context(), h.users, user.ID)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Return user as JSON
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(user); err != nil {
+		log.Printf("Error encoding user: %v", err)
+	}
+}
+
+// getUserIDFromRequest returns the ID of the user authenticated by the
+// request's bearer token, API key or token cookie, or "" if there is none
+func getUserIDFromRequest(r *http.Request) string {
+	principal, err := principalFromRequest(r)
+	if err != nil {
+		return ""
+	}
+	return principal.UserID
+}
+
+// principalFromRequest authenticates the request's bearer token, API key or
+// token cookie
+func principalFromRequest(r *http.Request) (*auth.Principal, error) {
+	// Get token from Authorization header
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		// Try to get from cookie as fallback
+		cookie, err := r.Cookie("token")
+		if err != nil {
+			return nil, err
+		}
+		authHeader = "Bearer " + cookie.Value
+	}
+
+	// Extract token from Bearer prefix
+	return auth.Authenticate(r.Context(), strings.TrimPrefix(authHeader, "Bearer "))
+}
+
+// refreshTokenCookie holds the refresh token of browser sessions. It is only
+// sent to the /auth endpoints.
+const refreshTokenCookie = "refresh_token"
+
+// setAuthCookies stores the tokens of a session in cookies
+func (h *AuthHandler) setAuthCookies(w http.ResponseWriter, accessToken, refreshToken string) {
+	http.SetCookie(w, h.cookie("token", accessToken, "/", auth.AccessTokenTTL))
+	http.SetCookie(w, h.cookie(refreshTokenCookie, refreshToken, "/auth", auth.SessionTTL))
+}
+
+// clearAuthCookies deletes the cookies set by setAuthCookies
+func (h *AuthHandler) clearAuthCookies(w http.ResponseWriter) {
+	http.SetCookie(w, h.cookie("token", "", "/", -1))
+	http.SetCookie(w, h.cookie(refreshTokenCookie, "", "/auth", -1))
+}
+
+// cookie returns an HTTP-only cookie with the configured attributes, lasting
+// maxAge or, if it is negative, deleting the cookie
+func (h *AuthHandler) cookie(name, value, path string, maxAge time.Duration) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   h.cookies.Domain,
+		HttpOnly: true,
+		Secure:   h.cookies.Secure,
+		MaxAge:   int(maxAge.Seconds()),
+	}
+	if maxAge < 0 {
+		cookie.MaxAge = -1
+	}
 
-	// Validate the token
-	claims, err := auth.ValidateJWT(tokenCookie.Value)
+	switch h.cookies.SameSite {
+	case "strict":
+		cookie.SameSite = http.SameSiteStrictMode
+	case "none":
+		cookie.SameSite = http.SameSiteNoneMode
+	default:
+		cookie.SameSite = http.SameSiteLaxMode
+	}
+	return cookie
+}
+
+// issueAccessToken creates an access token for a session of a user, with the
+// roles the user holds now
+func (h *AuthHandler) issueAccessToken(ctx context.Context, userID, sessionID string) (string, error) {
+	stored, err := h.users.GetUser(ctx, userID)
 	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return "", err
+	}
+	roles, err := auth.LoadGrants(ctx, h.users, userID)
+	if err != nil {
+		return "", err
+	}
+
+	return auth.GenerateJWT(&auth.User{ID: stored.ID, Email: stored.Email, Roles: roles}, sessionID)
+}
+
+// refreshRequest is the body of refresh requests from clients that keep the
+// refresh token themselves rather than in a cookie
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// refresh handles POST requests exchanging a refresh token, from the
+// refresh_token cookie or the request body, for a new access token and a
+// new refresh token
+func (h *AuthHandler) refresh(w http.ResponseWriter, r *http.Request) {
+	var refreshToken string
+	var fromBody bool
+	if cookie, err := r.Cookie(refreshTokenCookie); err == nil {
+		refreshToken = cookie.Value
+	} else {
+		var req refreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err == nil {
+			refreshToken, fromBody = req.RefreshToken, true
+		}
+	}
+	if refreshToken == "" {
+		http.Error(w, "Missing refresh token", http.StatusUnauthorized)
 		return
 	}
 
-	// Get the user from the database
-	var user auth.User
-	err = db.DB.QueryRow("SELECT id, email, name, picture FROM users WHERE id = $1", claims.UserID).Scan(
-		&user.ID, &user.Email, &user.Name, &user.Picture)
+	session, next, err := h.sessions.Refresh(r.Context(), refreshToken)
 	if err != nil {
-		http.Error(w, "User not found", http.StatusUnauthorized)
+		if errors.Is(err, auth.ErrRefreshTokenReused) {
+			log.Printf("Refresh token reused; revoked its session")
+		}
+		if errors.Is(err, auth.ErrInvalidRefreshToken) || errors.Is(err, auth.ErrRefreshTokenReused) {
+			h.clearAuthCookies(w)
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("Failed to refresh session: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	// Generate a new JWT token
-	jwtToken, err := auth.GenerateJWT(&user)
+	accessToken, err := h.issueAccessToken(r.Context(), session.UserID, session.ID)
 	if err != nil {
-		http.Error(w, "Failed to generate JWT", http.StatusInternalServerError)
+		log.Printf("Failed to generate JWT: %v", err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 
-	// Set the new JWT token as a cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    jwtToken,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   r.TLS != nil, // Set secure flag if using HTTPS
-		MaxAge:   int(time.Now().Add(24 * time.Hour).Unix()),
-	})
+	h.setAuthCookies(w, accessToken, next)
 
-	// Return a success response
+	response := map[string]interface{}{
+		"token":      accessToken,
+		"expires_in": int(auth.AccessTokenTTL.Seconds()),
+	}
+	if fromBody {
+		response["refresh_token"] = next
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
 }
 
-// logout logs the user out
+// requestSessionID finds the session a request belongs to, from its access
+// token or, once that expired, its refresh token
+func (h *AuthHandler) requestSessionID(r *http.Request) string {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		if cookie, err := r.Cookie("token"); err == nil {
+			authHeader = "Bearer " + cookie.Value
+		}
+	}
+	if claims, err := auth.ValidateJWT(strings.TrimPrefix(authHeader, "Bearer ")); err == nil && claims.SessionID != "" {
+		return claims.SessionID
+	}
+
+	if cookie, err := r.Cookie(refreshTokenCookie); err == nil {
+		if session, err := h.sessions.SessionOf(r.Context(), cookie.Value); err == nil {
+			return session.ID
+		}
+	}
+	return ""
+}
+
+// logout handles POST requests to log out a user, ending the session
+// of the request
 func (h *AuthHandler) logout(w http.ResponseWriter, r *http.Request) {
-	// Clear the token cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    "",
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   r.TLS != nil, // Set secure flag if using HTTPS
-		MaxAge:   -1,
+	if sessionID := h.requestSessionID(r); sessionID != "" {
+		if err := h.sessions.Revoke(r.Context(), sessionID); err != nil {
+			log.Printf("Failed to revoke session: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Clear the token cookies
+	h.clearAuthCookies(w)
+
+	// Return success response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{
+		"success": true,
 	})
+}
+
+// logoutAll handles POST requests to log a user out everywhere,
+// ending all of their sessions
+func (h *AuthHandler) logoutAll(w http.ResponseWriter, r *http.Request) {
+	principal, err := principalFromRequest(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+	if principal.KeyID != "" {
+		http.Error(w, "API keys cannot end sessions", http.StatusForbidden)
+		return
+	}
+
+	if err := h.sessions.RevokeAll(r.Context(), principal.UserID); err != nil {
+		log.Printf("Failed to revoke sessions: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.clearAuthCookies(w)
 
-	// Return a success response
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+	json.NewEncoder(w).Encode(map[string]bool{
+		"success": true,
+	})
 }
@@ -0,0 +1,372 @@
+// pickle/backend/api/auth_handler_test.go
+package api
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/carlostbanks/pickle/auth"
+	"github.com/carlostbanks/pickle/auth/fakeoidc"
+	"github.com/carlostbanks/pickle/config"
+	"github.com/carlostbanks/pickle/db"
+	"github.com/carlostbanks/pickle/storage"
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+)
+
+// newLoginServer serves the auth endpoints next to the fake OpenID Connect
+// issuer, logging in with it as the "fake" provider, trusted with email
+// addresses, and as the "partner" provider, which is not, and returns its URL
+func newLoginServer(t *testing.T, users storage.UserRepository, sessions *auth.SessionStore) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	issuer, err := fakeoidc.NewIssuer(srv.URL+config.FakeIssuerPath, config.FakeClientID, config.FakeClientSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.Handle(config.FakeIssuerPath+"/", http.StripPrefix(config.FakeIssuerPath, issuer))
+
+	cfg := config.AuthConfig{
+		JWTSecret:   "test-secret-at-least-32-bytes-long",
+		BaseURL:     srv.URL,
+		FrontendURL: "http://frontend.example.com",
+		Providers: []config.OIDCProviderConfig{{
+			Name:         "fake",
+			Issuer:       srv.URL + config.FakeIssuerPath,
+			ClientID:     config.FakeClientID,
+			ClientSecret: config.FakeClientSecret,
+			RedirectURL:  srv.URL + "/auth/fake/callback",
+			Scopes:       []string{"email", "profile"},
+			TrustEmail:   true,
+		}, {
+			Name:         "partner",
+			Issuer:       srv.URL + config.FakeIssuerPath,
+			ClientID:     config.FakeClientID,
+			ClientSecret: config.FakeClientSecret,
+			RedirectURL:  srv.URL + "/auth/partner/callback",
+			Scopes:       []string{"email", "profile"},
+		}},
+	}
+	auth.InitAuth(cfg)
+	NewAuthHandler(cfg, users, sessions, nil).RegisterRoutes(mux, func(h http.HandlerFunc) http.HandlerFunc { return h })
+
+	return srv.URL
+}
+
+// newBrowser returns a client keeping cookies that does not follow redirects
+func newBrowser(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{
+		Jar:     jar,
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// get requests a URL, expecting a status, and returns where it redirects to
+func get(t *testing.T, browser *http.Client, target string, want int) *url.URL {
+	t.Helper()
+	resp, err := browser.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != want {
+		t.Fatalf("%s got %d, expected %d", target, resp.StatusCode, want)
+	}
+	location, _ := resp.Location()
+	return location
+}
+
+// authorize starts a login with the "fake" provider and approves it at the
+// fake issuer, returning the callback URL the issuer redirects back to
+func authorize(t *testing.T, browser *http.Client, baseURL, email string) *url.URL {
+	t.Helper()
+	return authorizeWith(t, browser, baseURL, "fake", email)
+}
+
+// authorizeWith is authorize for a login with any provider of the fake issuer
+func authorizeWith(t *testing.T, browser *http.Client, baseURL, provider, email string) *url.URL {
+	t.Helper()
+	issuer := get(t, browser, baseURL+"/auth/"+provider+"/login?login_hint="+url.QueryEscape(email), http.StatusTemporaryRedirect)
+	return get(t, browser, issuer.String(), http.StatusFound)
+}
+
+// codeFrom returns the login code of a redirect to the frontend
+func codeFrom(t *testing.T, location *url.URL) string {
+	t.Helper()
+	if location == nil || !strings.HasSuffix(location.Path, "/auth-callback") {
+		t.Fatalf("login redirected to %v, expected the frontend", location)
+	}
+	if location.Query().Has("token") {
+		t.Fatal("login put the access token in the URL")
+	}
+	code := location.Query().Get("code")
+	if code == "" {
+		t.Fatal("login redirected to the frontend without a code")
+	}
+	return code
+}
+
+// exchange redeems a login code, expecting a status, and returns the token
+func exchange(t *testing.T, baseURL, code string, want int) string {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"code": code})
+	resp, err := http.Post(baseURL+"/auth/exchange", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != want {
+		t.Fatalf("exchanging a login code got %d, expected %d", resp.StatusCode, want)
+	}
+
+	var exchanged struct {
+		Token string `json:"token"`
+	}
+	if want == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&exchanged); err != nil || exchanged.Token == "" {
+			t.Fatalf("exchanging a login code returned no token (%v)", err)
+		}
+	}
+	return exchanged.Token
+}
+
+// logIn logs in with the fake issuer from a new browser, returning it with
+// the access token of its session
+func logIn(t *testing.T, baseURL, email string) (*http.Client, string) {
+	t.Helper()
+	browser := newBrowser(t)
+	callback := authorize(t, browser, baseURL, email)
+	code := codeFrom(t, get(t, browser, callback.String(), http.StatusSeeOther))
+	return browser, exchange(t, baseURL, code, http.StatusOK)
+}
+
+// refresh posts the refresh token cookie of a browser, expecting a status,
+// and returns the new access token
+func refresh(t *testing.T, browser *http.Client, baseURL string, want int) string {
+	t.Helper()
+	resp, err := browser.Post(baseURL+"/auth/refresh", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != want {
+		t.Fatalf("refresh got %d, expected %d", resp.StatusCode, want)
+	}
+
+	var refreshed struct {
+		Token string `json:"token"`
+	}
+	if want == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&refreshed); err != nil || refreshed.Token == "" {
+			t.Fatalf("refresh returned no token (%v)", err)
+		}
+	}
+	return refreshed.Token
+}
+
+// currentUser gets the user of an access token, expecting a status
+func currentUser(t *testing.T, baseURL, token string, want int) User {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/api/users/me", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != want {
+		t.Fatalf("getting the current user got %d, expected %d", resp.StatusCode, want)
+	}
+
+	var user User
+	if want == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return user
+}
+
+func TestLoginState(t *testing.T) {
+	baseURL := newLoginServer(t, storage.NewMemory().Users, nil)
+	email := "player@example.com"
+
+	// Callbacks need the state of a login started in the same browser
+	callback := authorize(t, newBrowser(t), baseURL, email)
+	get(t, newBrowser(t), callback.String(), http.StatusBadRequest)
+
+	// and their state must match it
+	browser := newBrowser(t)
+	tampered := authorize(t, browser, baseURL, email)
+	query := tampered.Query()
+	query.Set("state", "made-up")
+	tampered.RawQuery = query.Encode()
+	get(t, browser, tampered.String(), http.StatusBadRequest)
+}
+
+func TestLinkByEmail(t *testing.T) {
+	store := storage.NewMemory()
+	sessions := auth.NewSessionStore(store.Sessions)
+	baseURL := newLoginServer(t, store.Users, sessions)
+
+	_, token := logIn(t, baseURL, "player@example.com")
+	user := currentUser(t, baseURL, token, http.StatusOK)
+
+	// An untrusted provider cannot take over a user by vouching for their
+	// email address
+	browser := newBrowser(t)
+	callback := authorizeWith(t, browser, baseURL, "partner", "player@example.com")
+	get(t, browser, callback.String(), http.StatusConflict)
+	if _, err := store.Users.GetIdentity(context.Background(), "partner", "player@example.com"); err != storage.ErrNotFound {
+		t.Fatalf("untrusted identity linked: %v", err)
+	}
+
+	// but it signs up new users
+	browser = newBrowser(t)
+	callback = authorizeWith(t, browser, baseURL, "partner", "partner@example.com")
+	code := codeFrom(t, get(t, browser, callback.String(), http.StatusSeeOther))
+	if got := currentUser(t, baseURL, exchange(t, baseURL, code, http.StatusOK), http.StatusOK); got.ID == user.ID || got.Email != "partner@example.com" {
+		t.Fatalf("partner login got user %q (%s), expected a new one", got.ID, got.Email)
+	}
+
+	// Trusted providers link to existing users
+	invited := &storage.User{ID: uuid.New().String(), Email: "invited@example.com", Name: "Invited", CreatedAt: time.Now()}
+	if err := store.Users.CreateUser(context.Background(), invited); err != nil {
+		t.Fatal(err)
+	}
+	_, token = logIn(t, baseURL, invited.Email)
+	if got := currentUser(t, baseURL, token, http.StatusOK); got.ID != invited.ID {
+		t.Fatalf("trusted login got user %q, expected %q", got.ID, invited.ID)
+	}
+}
+
+// TestLogin logs in against the migrated database at DATABASE_URL. The users
+// and sessions it creates are left behind.
+func TestLogin(t *testing.T) {
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+	conn, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := db.CheckMigrations(context.Background(), conn); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := auth.NewSessionStore(storage.NewPostgres(conn).Sessions)
+	auth.UseSessions(sessions)
+	t.Cleanup(func() { auth.UseSessions(nil) })
+	baseURL := newLoginServer(t, storage.NewPostgres(conn).Users, sessions)
+	email := fmt.Sprintf("login-%d@example.com", time.Now().UnixNano())
+
+	browser := newBrowser(t)
+	callback := authorize(t, browser, baseURL, email)
+	loginCookies := browser.Jar.Cookies(callback)
+	token := exchange(t, baseURL, codeFrom(t, get(t, browser, callback.String(), http.StatusSeeOther)), http.StatusOK)
+	user := currentUser(t, baseURL, token, http.StatusOK)
+	if user.Email != email {
+		t.Fatalf("logged in as %q, expected %q", user.Email, email)
+	}
+
+	// The callback cannot be replayed, not even with the login cookie
+	get(t, browser, callback.String(), http.StatusBadRequest)
+	replay := newBrowser(t)
+	replay.Jar.SetCookies(callback, loginCookies)
+	get(t, replay, callback.String(), http.StatusBadRequest)
+
+	// Logging in again, from another browser, finds the same user
+	again := newBrowser(t)
+	code := codeFrom(t, get(t, again, authorize(t, again, baseURL, email).String(), http.StatusSeeOther))
+	if got := currentUser(t, baseURL, exchange(t, baseURL, code, http.StatusOK), http.StatusOK); got.ID != user.ID {
+		t.Fatalf("second login got user %q, expected %q", got.ID, user.ID)
+	}
+
+	// Login codes are single-use, and replaying one ends the session
+	replayed := newBrowser(t)
+	code = codeFrom(t, get(t, replayed, authorize(t, replayed, baseURL, email).String(), http.StatusSeeOther))
+	replayedToken := exchange(t, baseURL, code, http.StatusOK)
+	exchange(t, baseURL, code, http.StatusBadRequest)
+	currentUser(t, baseURL, replayedToken, http.StatusUnauthorized)
+
+	// The refresh token cookie gets a new access token
+	refreshed := refresh(t, browser, baseURL, http.StatusOK)
+
+	// Logging out ends the session, so its access tokens stop working
+	resp, err := browser.Post(baseURL+"/auth/logout", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	currentUser(t, baseURL, refreshed, http.StatusUnauthorized)
+}
+
+func TestLogoutAll(t *testing.T) {
+	store := storage.NewMemory()
+	sessions := auth.NewSessionStore(store.Sessions)
+	auth.UseSessions(sessions)
+	t.Cleanup(func() { auth.UseSessions(nil) })
+	baseURL := newLoginServer(t, store.Users, sessions)
+
+	// Log in from two browsers, and as someone else from a third
+	phone, phoneToken := logIn(t, baseURL, "player@example.com")
+	laptop, laptopToken := logIn(t, baseURL, "player@example.com")
+	other, otherToken := logIn(t, baseURL, "partner@example.com")
+
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/auth/logout-all", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+phoneToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("logging out everywhere got %d, expected %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// Every session of the user ended, on both browsers
+	for _, token := range []string{phoneToken, laptopToken} {
+		currentUser(t, baseURL, token, http.StatusUnauthorized)
+	}
+	refresh(t, phone, baseURL, http.StatusUnauthorized)
+	refresh(t, laptop, baseURL, http.StatusUnauthorized)
+
+	// but other users stay logged in
+	currentUser(t, baseURL, otherToken, http.StatusOK)
+	refresh(t, other, baseURL, http.StatusOK)
+}
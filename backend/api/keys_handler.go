@@ -0,0 +1,190 @@
+// pickle/backend/api/keys_handler.go
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/carlostbanks/pickle/auth"
+	"github.com/lib/pq"
+)
+
+// KeysHandler handles the endpoints managing API keys. Users manage their
+// own keys, and facility admins the keys of their facilities' service
+// accounts. Keys are managed with access tokens only, so a leaked key
+// cannot mint more.
+type KeysHandler struct {
+	keys *auth.KeyStore
+}
+
+// NewKeysHandler creates a new KeysHandler managing keys in the given store
+func NewKeysHandler(keys *auth.KeyStore) *KeysHandler {
+	return &KeysHandler{keys: keys}
+}
+
+// RegisterRoutes registers the API key routes, wrapping each handler with
+// wrap
+func (h *KeysHandler) RegisterRoutes(mux *http.ServeMux, wrap func(http.HandlerFunc) http.HandlerFunc) {
+	mux.HandleFunc("GET /api/keys", wrap(h.list))
+	mux.HandleFunc("POST /api/keys", wrap(h.create))
+	mux.HandleFunc("DELETE /api/keys/{id}", wrap(h.revoke))
+}
+
+// createKeyRequest is the body of API key creation requests
+type createKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	CourtID   string     `json:"court_id"`   // Set for a facility's service account
+	RateLimit int        `json:"rate_limit"` // Requests per minute
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// createKeyResponse returns a new key with its secret, which is never shown
+// again
+type createKeyResponse struct {
+	Key    auth.APIKey `json:"key"`
+	Secret string      `json:"secret"`
+}
+
+// list returns the caller's keys or, given a court_id parameter, the keys of
+// a facility's service accounts
+func (h *KeysHandler) list(w http.ResponseWriter, r *http.Request) {
+	principal, ok := keyManager(w, r)
+	if !ok {
+		return
+	}
+
+	var keys []auth.APIKey
+	var err error
+	if courtID := r.URL.Query().Get("court_id"); courtID != "" {
+		if !principal.HasRole(auth.RoleFacilityAdmin, courtID) {
+			http.Error(w, "Not authorized to manage this court", http.StatusForbidden)
+			return
+		}
+		keys, err = h.keys.ListForCourt(r.Context(), courtID)
+	} else {
+		keys, err = h.keys.ListForUser(r.Context(), principal.UserID)
+	}
+	if err != nil {
+		log.Printf("Failed to list API keys: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+// create creates a key for the caller or for a facility's new service
+// account
+func (h *KeysHandler) create(w http.ResponseWriter, r *http.Request) {
+	principal, ok := keyManager(w, r)
+	if !ok {
+		return
+	}
+
+	var req createKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		http.Error(w, "Expiry must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	if req.CourtID != "" && !principal.HasRole(auth.RoleFacilityAdmin, req.CourtID) {
+		http.Error(w, "Not authorized to manage this court", http.StatusForbidden)
+		return
+	}
+
+	key, secret, err := h.keys.Create(r.Context(), auth.NewAPIKey{
+		Name:      req.Name,
+		UserID:    principal.UserID,
+		CourtID:   req.CourtID,
+		Scopes:    req.Scopes,
+		RateLimit: req.RateLimit,
+		ExpiresAt: req.ExpiresAt,
+		CreatedBy: principal.UserID,
+	})
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.Is(err, auth.ErrInvalidScope):
+			http.Error(w, "Scopes must be one or more of bookings:read, bookings:write and courts:manage", http.StatusBadRequest)
+		case errors.Is(err, auth.ErrInvalidRateLimit):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.As(err, &pqErr) && pqErr.Code == "23503":
+			http.Error(w, "Court not found", http.StatusNotFound)
+		default:
+			log.Printf("Failed to create API key: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(createKeyResponse{Key: key, Secret: secret})
+}
+
+// revoke revokes one of the caller's keys, or a key of a facility the caller
+// administers
+func (h *KeysHandler) revoke(w http.ResponseWriter, r *http.Request) {
+	principal, ok := keyManager(w, r)
+	if !ok {
+		return
+	}
+
+	key, err := h.keys.Get(r.Context(), r.PathValue("id"))
+	if err == nil && !canManageKey(principal, key) {
+		// Keys of others are not found rather than forbidden, so their IDs
+		// cannot be probed
+		err = auth.ErrAPIKeyNotFound
+	}
+	if err == nil {
+		err = h.keys.Revoke(r.Context(), key.ID)
+	}
+	if err != nil {
+		if errors.Is(err, auth.ErrAPIKeyNotFound) {
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to revoke API key: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// keyManager authenticates a request managing API keys, which must be made
+// with an access token. It answers the request and returns false otherwise.
+func keyManager(w http.ResponseWriter, r *http.Request) (*auth.Principal, bool) {
+	principal, err := principalFromRequest(r)
+	if err != nil {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return nil, false
+	}
+	if principal.KeyID != "" {
+		http.Error(w, "API keys cannot manage API keys", http.StatusForbidden)
+		return nil, false
+	}
+	return principal, true
+}
+
+// canManageKey reports whether the principal may manage a key: its own
+// personal keys, and the keys of facilities it administers
+func canManageKey(principal *auth.Principal, key auth.APIKey) bool {
+	if key.CourtID != "" {
+		return principal.HasRole(auth.RoleFacilityAdmin, key.CourtID)
+	}
+	return key.UserID == principal.UserID
+}
@@ -0,0 +1,147 @@
+// pickle/backend/api/keys_handler_test.go
+package api
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/carlostbanks/pickle/auth"
+	"github.com/carlostbanks/pickle/config"
+	"github.com/carlostbanks/pickle/db"
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/storage"
+	"github.com/google/uuid"
+)
+
+// TestKeysHandler manages keys against the migrated database at
+// DATABASE_URL. The records it creates are left behind.
+func TestKeysHandler(t *testing.T) {
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+	conn, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ctx := context.Background()
+	if err := db.CheckMigrations(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+
+	auth.InitAuth(config.AuthConfig{JWTSecret: "test-secret-at-least-32-bytes-long"})
+	store := storage.NewPostgres(conn)
+	keys := auth.NewKeyStore(store.APIKeys, store.Users)
+	auth.UseAPIKeys(keys)
+	t.Cleanup(func() { auth.UseAPIKeys(nil) })
+
+	mux := http.NewServeMux()
+	NewKeysHandler(keys).RegisterRoutes(mux, func(h http.HandlerFunc) http.HandlerFunc { return h })
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	court := &proto.Court{Id: uuid.New().String(), Name: "Riverside", Address: "1 River Rd, Springfield",
+		NumberOfCourts: 1, MaxPlayers: 4}
+	if err := store.Courts.CreateCourt(ctx, court); err != nil {
+		t.Fatal(err)
+	}
+	token := func(roles ...auth.Grant) string {
+		id := uuid.New().String()
+		user := &storage.User{ID: id, Email: id + "@example.com", Name: "Key manager", CreatedAt: time.Now()}
+		if err := store.Users.CreateUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		signed, err := auth.GenerateJWT(&auth.User{ID: user.ID, Email: user.Email, Roles: roles}, "session-"+id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	player := token()
+	admin := token(auth.Grant{Role: auth.RoleFacilityAdmin, CourtID: court.Id})
+
+	// call makes a JSON request with a credential, expecting a status, and
+	// decodes the response into out unless it is nil
+	call := func(method, path, credential string, body interface{}, want int, out interface{}) {
+		t.Helper()
+		var encoded []byte
+		if body != nil {
+			encoded, _ = json.Marshal(body)
+		}
+		req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+credential)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != want {
+			t.Fatalf("%s %s got %d, expected %d", method, path, resp.StatusCode, want)
+		}
+		if out != nil {
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var created createKeyResponse
+	call(http.MethodPost, "/api/keys", player, map[string]interface{}{
+		"name":   "League spreadsheet",
+		"scopes": []string{auth.ScopeBookingsRead},
+	}, http.StatusCreated, &created)
+	call(http.MethodPost, "/api/keys", player, map[string]interface{}{
+		"name":   "Made up",
+		"scopes": []string{"everything"},
+	}, http.StatusBadRequest, nil)
+
+	// Keys cannot mint more keys
+	call(http.MethodPost, "/api/keys", created.Secret, map[string]interface{}{
+		"name":   "Escalation",
+		"scopes": []string{auth.ScopeBookingsWrite},
+	}, http.StatusForbidden, nil)
+	call(http.MethodGet, "/api/keys", created.Secret, nil, http.StatusForbidden, nil)
+
+	var listed struct {
+		Keys []auth.APIKey `json:"keys"`
+	}
+	call(http.MethodGet, "/api/keys", player, nil, http.StatusOK, &listed)
+	if len(listed.Keys) != 1 || listed.Keys[0].ID != created.Key.ID {
+		t.Fatalf("listed %+v, expected the new key", listed.Keys)
+	}
+
+	// Facility keys are managed by the facility's admins
+	facilityKey := map[string]interface{}{
+		"name":     "Front desk",
+		"court_id": court.Id,
+		"scopes":   []string{auth.ScopeBookingsRead},
+	}
+	call(http.MethodPost, "/api/keys", player, facilityKey, http.StatusForbidden, nil)
+	var facility createKeyResponse
+	call(http.MethodPost, "/api/keys", admin, facilityKey, http.StatusCreated, &facility)
+	if facility.Key.CourtID != court.Id {
+		t.Fatalf("facility key is %+v, expected a key of the facility", facility.Key)
+	}
+	call(http.MethodGet, "/api/keys?court_id="+court.Id, player, nil, http.StatusForbidden, nil)
+
+	// Keys of others are not found
+	call(http.MethodDelete, "/api/keys/"+facility.Key.ID, player, nil, http.StatusNotFound, nil)
+	call(http.MethodDelete, "/api/keys/"+created.Key.ID, admin, nil, http.StatusNotFound, nil)
+	call(http.MethodDelete, "/api/keys/"+facility.Key.ID, admin, nil, http.StatusNoContent, nil)
+	call(http.MethodDelete, "/api/keys/"+created.Key.ID, player, nil, http.StatusNoContent, nil)
+	if _, err := keys.Authenticate(ctx, created.Secret); err != auth.ErrInvalidAPIKey {
+		t.Errorf("authenticating a revoked key: %v, expected ErrInvalidAPIKey", err)
+	}
+}
@@ -0,0 +1,325 @@
+// pickle/backend/auth/apikeys.go
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/carlostbanks/pickle/storage"
+	"github.com/google/uuid"
+)
+
+// Scopes limit what an API key may do, on top of the roles of its user
+const (
+	ScopeBookingsRead  = "bookings:read"  // See bookings, series, payments and waitlist entries
+	ScopeBookingsWrite = "bookings:write" // Book, change and cancel, and manage the waitlist
+	ScopeCourtsManage  = "courts:manage"  // Create, edit and archive facilities
+)
+
+// Scopes lists every scope an API key can be given
+var Scopes = []string{ScopeBookingsRead, ScopeBookingsWrite, ScopeCourtsManage}
+
+// APIKeyPrefix starts every API key, telling them apart from access tokens
+const APIKeyPrefix = "pk_"
+
+// Rate limits of API keys, in requests per minute
+const (
+	DefaultKeyRateLimit = 60
+	MaxKeyRateLimit     = 600
+)
+
+// lastUsedPrecision bounds how often the last use of a key is written
+const lastUsedPrecision = time.Minute
+
+var (
+	// ErrInvalidAPIKey is returned for unknown, revoked and expired keys
+	ErrInvalidAPIKey = errors.New("invalid API key")
+
+	// ErrRateLimited is returned when a key made too many requests in the
+	// current minute
+	ErrRateLimited = errors.New("API key rate limit exceeded")
+
+	// ErrInvalidScope is returned when creating a key with an unknown scope
+	// or none at all
+	ErrInvalidScope = errors.New("invalid scope")
+
+	// ErrInvalidRateLimit is returned when creating a key with a rate limit
+	// out of range
+	ErrInvalidRateLimit = fmt.Errorf("rate limit must be between 1 and %d requests per minute", MaxKeyRateLimit)
+
+	// ErrAPIKeyNotFound is returned for unknown key IDs
+	ErrAPIKeyNotFound = errors.New("API key not found")
+)
+
+// APIKey describes an API key; its secret is only shown once, on creation
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	UserID     string     `json:"user_id"`
+	CourtID    string     `json:"court_id,omitempty"` // Facility of service account keys
+	Scopes     []string   `json:"scopes"`
+	RateLimit  int        `json:"rate_limit"` // Requests per minute
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// NewAPIKey describes a key to create. Keys with a CourtID belong to a new
+// service account of the facility instead of a user: a staff member, or a
+// facility admin if the key may manage courts.
+type NewAPIKey struct {
+	Name      string
+	UserID    string // Owner of personal keys
+	CourtID   string
+	Scopes    []string
+	RateLimit int // Zero for DefaultKeyRateLimit
+	ExpiresAt *time.Time
+	CreatedBy string
+}
+
+// KeyStore checks API keys and manages them. Only hashes of their secrets
+// are stored.
+type KeyStore struct {
+	keys    storage.APIKeyRepository
+	users   storage.UserRepository // Holds the roles keys act with
+	limiter *rateLimiter
+}
+
+// NewKeyStore creates a key store keeping keys in the given repository,
+// loading the roles of key owners from users
+func NewKeyStore(keys storage.APIKeyRepository, users storage.UserRepository) *KeyStore {
+	return &KeyStore{keys: keys, users: users, limiter: &rateLimiter{windows: make(map[string]*rateWindow)}}
+}
+
+// IsAPIKey reports whether a credential looks like an API key rather than
+// an access token
+func IsAPIKey(credential string) bool {
+	return strings.HasPrefix(credential, APIKeyPrefix)
+}
+
+// Create creates an API key and returns it with its secret
+func (s *KeyStore) Create(ctx context.Context, params NewAPIKey) (APIKey, string, error) {
+	scopes, err := normalizeScopes(params.Scopes)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+
+	rateLimit := params.RateLimit
+	if rateLimit == 0 {
+		rateLimit = DefaultKeyRateLimit
+	}
+	if rateLimit < 1 || rateLimit > MaxKeyRateLimit {
+		return APIKey{}, "", ErrInvalidRateLimit
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return APIKey{}, "", err
+	}
+	secret, err := randomToken()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+
+	key := &storage.APIKey{
+		ID:         hex.EncodeToString(id),
+		UserID:     params.UserID,
+		CourtID:    params.CourtID,
+		Name:       params.Name,
+		SecretHash: hashToken(secret),
+		Scopes:     scopes,
+		RateLimit:  rateLimit,
+		CreatedBy:  params.CreatedBy,
+		CreatedAt:  time.Now(),
+		ExpiresAt:  params.ExpiresAt,
+	}
+
+	// Keys of a facility act as a new service account. Service accounts
+	// have no identity, so nobody can log in as them.
+	var account *storage.User
+	role := RoleStaff
+	if key.CourtID != "" {
+		key.UserID = "svc-" + uuid.New().String()
+		account = &storage.User{
+			ID:             key.UserID,
+			Email:          key.UserID + "@service-accounts.invalid",
+			Name:           key.Name,
+			ServiceAccount: true,
+			CreatedAt:      key.CreatedAt,
+		}
+		for _, scope := range key.Scopes {
+			if scope == ScopeCourtsManage {
+				role = RoleFacilityAdmin
+			}
+		}
+	}
+
+	if err := s.keys.CreateAPIKey(ctx, key, account, role); err != nil {
+		return APIKey{}, "", err
+	}
+	return apiKeyOf(key), APIKeyPrefix + key.ID + "_" + secret, nil
+}
+
+// Get returns an API key
+func (s *KeyStore) Get(ctx context.Context, id string) (APIKey, error) {
+	key, err := s.keys.GetAPIKey(ctx, id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+	return apiKeyOf(key), nil
+}
+
+// ListForUser returns the personal API keys of a user, newest first
+func (s *KeyStore) ListForUser(ctx context.Context, userID string) ([]APIKey, error) {
+	return apiKeysOf(s.keys.ListUserAPIKeys(ctx, userID))
+}
+
+// ListForCourt returns the service account keys of a facility, newest first
+func (s *KeyStore) ListForCourt(ctx context.Context, courtID string) ([]APIKey, error) {
+	return apiKeysOf(s.keys.ListCourtAPIKeys(ctx, courtID))
+}
+
+// Revoke makes an API key unusable
+func (s *KeyStore) Revoke(ctx context.Context, id string) error {
+	err := s.keys.RevokeAPIKey(ctx, id, time.Now())
+	if errors.Is(err, storage.ErrNotFound) {
+		return ErrAPIKeyNotFound
+	}
+	return err
+}
+
+// Authenticate checks an API key and its rate limit, and returns the
+// principal it acts for: its user, with the user's current roles, limited
+// to the key's scopes
+func (s *KeyStore) Authenticate(ctx context.Context, credential string) (*Principal, error) {
+	if !IsAPIKey(credential) {
+		return nil, ErrInvalidAPIKey
+	}
+	id, secret, ok := strings.Cut(strings.TrimPrefix(credential, APIKeyPrefix), "_")
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+
+	key, err := s.keys.GetAPIKey(ctx, id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(key.SecretHash)) != 1 ||
+		key.RevokedAt != nil || (key.ExpiresAt != nil && now.After(*key.ExpiresAt)) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	if !s.limiter.allow(id, key.RateLimit, now) {
+		return nil, ErrRateLimited
+	}
+
+	if err := s.keys.MarkAPIKeyUsed(ctx, id, now, now.Add(-lastUsedPrecision)); err != nil {
+		return nil, err
+	}
+
+	user, err := s.users.GetUser(ctx, key.UserID)
+	if err != nil {
+		return nil, err
+	}
+	principal := &Principal{UserID: user.ID, Email: user.Email, Scopes: key.Scopes, KeyID: id}
+	if principal.Roles, err = LoadGrants(ctx, s.users, principal.UserID); err != nil {
+		return nil, err
+	}
+	return principal, nil
+}
+
+// apiKeyOf describes a stored API key
+func apiKeyOf(key *storage.APIKey) APIKey {
+	return APIKey{
+		ID:         key.ID,
+		Name:       key.Name,
+		UserID:     key.UserID,
+		CourtID:    key.CourtID,
+		Scopes:     key.Scopes,
+		RateLimit:  key.RateLimit,
+		CreatedAt:  key.CreatedAt,
+		LastUsedAt: key.LastUsedAt,
+		ExpiresAt:  key.ExpiresAt,
+		RevokedAt:  key.RevokedAt,
+	}
+}
+
+// apiKeysOf describes the stored API keys a repository listed
+func apiKeysOf(keys []*storage.APIKey, err error) ([]APIKey, error) {
+	if err != nil {
+		return nil, err
+	}
+	described := []APIKey{}
+	for _, key := range keys {
+		described = append(described, apiKeyOf(key))
+	}
+	return described, nil
+}
+
+// normalizeScopes validates scopes and removes duplicates
+func normalizeScopes(scopes []string) ([]string, error) {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, scope := range scopes {
+		known := false
+		for _, s := range Scopes {
+			known = known || s == scope
+		}
+		if !known {
+			return nil, ErrInvalidScope
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			normalized = append(normalized, scope)
+		}
+	}
+	if len(normalized) == 0 {
+		return nil, ErrInvalidScope
+	}
+	return normalized, nil
+}
+
+// rateLimiter counts the requests of each key in fixed one-minute windows.
+// Counts are kept in memory, so each server enforces limits on its own.
+type rateLimiter struct {
+	mu      sync.Mutex
+	windows map[string]*rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// allow counts a request of a key and reports whether it is within limit
+func (l *rateLimiter) allow(keyID string, limit int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	window, ok := l.windows[keyID]
+	if !ok || now.Sub(window.start) >= time.Minute {
+		window = &rateWindow{start: now}
+		l.windows[keyID] = window
+	}
+	if window.count >= limit {
+		return false
+	}
+	window.count++
+	return true
+}
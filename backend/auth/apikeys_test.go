@@ -0,0 +1,191 @@
+// pickle/backend/auth/apikeys_test.go
+package auth
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/storage"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestNormalizeScopes(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		want   []string // nil for ErrInvalidScope
+	}{
+		{[]string{ScopeBookingsRead}, []string{ScopeBookingsRead}},
+		{[]string{ScopeBookingsWrite, ScopeBookingsRead, ScopeBookingsWrite}, []string{ScopeBookingsWrite, ScopeBookingsRead}},
+		{nil, nil},
+		{[]string{"everything"}, nil},
+		{[]string{ScopeBookingsRead, "everything"}, nil},
+	}
+	for _, tt := range tests {
+		got, err := normalizeScopes(tt.scopes)
+		if tt.want == nil {
+			if err != ErrInvalidScope {
+				t.Errorf("normalizeScopes(%q) = %q, %v, expected ErrInvalidScope", tt.scopes, got, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("normalizeScopes(%q) = %q, %v, expected %q", tt.scopes, got, err, tt.want)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := &rateLimiter{windows: make(map[string]*rateWindow)}
+	start := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !limiter.allow("key-1", 3, start.Add(time.Duration(i)*time.Second)) {
+			t.Fatalf("request %d refused within the limit", i+1)
+		}
+	}
+	if limiter.allow("key-1", 3, start.Add(59*time.Second)) {
+		t.Error("request beyond the limit allowed")
+	}
+	if !limiter.allow("key-2", 3, start) {
+		t.Error("another key shares the limit")
+	}
+	if !limiter.allow("key-1", 3, start.Add(time.Minute)) {
+		t.Error("request refused in the next minute")
+	}
+}
+
+// createUser creates a user with a fresh ID
+func createUser(t *testing.T, users storage.UserRepository) *storage.User {
+	t.Helper()
+	id := uuid.New().String()
+	user := &storage.User{ID: id, Email: id + "@example.com", Name: "Key owner", CreatedAt: time.Now()}
+	if err := users.CreateUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestKeyStore(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemory()
+	users := store.Users
+	keys := NewKeyStore(store.APIKeys, users)
+	UseAPIKeys(keys)
+	t.Cleanup(func() { UseAPIKeys(nil) })
+
+	user := createUser(t, users)
+
+	_, _, err := keys.Create(ctx, NewAPIKey{Name: "Made up", UserID: user.ID, Scopes: []string{"everything"}})
+	if err != ErrInvalidScope {
+		t.Fatalf("creating a key with an unknown scope: %v, expected ErrInvalidScope", err)
+	}
+	_, _, err = keys.Create(ctx, NewAPIKey{Name: "Flood", UserID: user.ID, Scopes: Scopes, RateLimit: MaxKeyRateLimit + 1})
+	if err != ErrInvalidRateLimit {
+		t.Fatalf("creating a key with too high a rate limit: %v, expected ErrInvalidRateLimit", err)
+	}
+
+	key, secret, err := keys.Create(ctx, NewAPIKey{
+		Name:      "League spreadsheet",
+		UserID:    user.ID,
+		Scopes:    []string{ScopeBookingsRead},
+		RateLimit: 2,
+		CreatedBy: user.ID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys act as their user, within their scopes
+	call := func(method string) error {
+		ctx := metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+secret))
+		info := &grpc.UnaryServerInfo{FullMethod: "/scheduler.SchedulerService/" + method}
+		_, err := AuthInterceptor(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			if got := GetUserID(ctx); got != user.ID {
+				t.Errorf("key acts as %q, expected %q", got, user.ID)
+			}
+			return nil, nil
+		})
+		return err
+	}
+	if err := call("GetBookings"); err != nil {
+		t.Fatalf("listing bookings with a read key: %v", err)
+	}
+	if got := status.Code(call("CreateBooking")); got != codes.PermissionDenied {
+		t.Errorf("booking with a read key got %v, expected PermissionDenied", got)
+	}
+
+	// Each key is limited to its rate, refused requests included
+	if got := status.Code(call("GetBookings")); got != codes.ResourceExhausted {
+		t.Errorf("third request in a minute got %v, expected ResourceExhausted", got)
+	}
+
+	listed, err := keys.ListForUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].ID != key.ID || listed[0].LastUsedAt == nil {
+		t.Errorf("listed %+v, expected the key with its last use", listed)
+	}
+
+	// Revoked keys stop working
+	if err := keys.Revoke(ctx, key.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Authenticate(ctx, secret); err != ErrInvalidAPIKey {
+		t.Errorf("authenticating a revoked key: %v, expected ErrInvalidAPIKey", err)
+	}
+	if err := keys.Revoke(ctx, key.ID); err != ErrAPIKeyNotFound {
+		t.Errorf("revoking a key twice: %v, expected ErrAPIKeyNotFound", err)
+	}
+}
+
+func TestFacilityKey(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemory()
+	keys := NewKeyStore(store.APIKeys, store.Users)
+	admin := createUser(t, store.Users)
+
+	court := &proto.Court{Id: uuid.New().String(), Name: "Riverside", Address: "1 River Rd, Springfield",
+		NumberOfCourts: 1, MaxPlayers: 4}
+	if err := store.Courts.CreateCourt(ctx, court); err != nil {
+		t.Fatal(err)
+	}
+
+	// Facility keys act as a service account, staff at the facility or its
+	// admin if they manage courts
+	tests := []struct {
+		scopes []string
+		role   string
+	}{
+		{[]string{ScopeBookingsRead}, RoleStaff},
+		{[]string{ScopeBookingsRead, ScopeCourtsManage}, RoleFacilityAdmin},
+	}
+	for _, tt := range tests {
+		key, secret, err := keys.Create(ctx, NewAPIKey{Name: "Front desk", CourtID: court.Id, Scopes: tt.scopes, CreatedBy: admin.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.CourtID != court.Id || key.UserID == "" {
+			t.Fatalf("facility key is %+v, expected a service account of the facility", key)
+		}
+
+		principal, err := keys.Authenticate(ctx, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if principal.UserID != key.UserID || !principal.HasRole(tt.role, court.Id) {
+			t.Errorf("key with %q acts as %s with %v, expected %s", tt.scopes, principal.UserID, principal.Roles, tt.role)
+		}
+
+		if listed, err := keys.ListForCourt(ctx, court.Id); err != nil || len(listed) == 0 || listed[0].ID != key.ID {
+			t.Errorf("facility keys are %+v (%v), expected the new key first", listed, err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// pickle/backend/auth/auth.go
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/carlostbanks/pickle/config"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// User is a user access tokens are issued for
+type User struct {
+	ID        string  `json:"id"`
+	Email     string  `json:"email"`
+	Name      string  `json:"name"`
+	Picture   string  `json:"picture"`
+	CreatedAt string  `json:"created_at"`
+	Roles     []Grant `json:"roles,omitempty"` // Granted by us, not the identity provider
+}
+
+// Claims represents the JWT claims
+type Claims struct {
+	UserID    string  `json:"user_id"`
+	Email     string  `json:"email"`
+	Roles     []Grant `json:"roles,omitempty"`
+	SessionID string  `json:"sid,omitempty"`
+	jwt.StandardClaims
+}
+
+// Principal returns the user the claims were issued for
+func (c *Claims) Principal() *Principal {
+	return &Principal{UserID: c.UserID, Email: c.Email, Roles: c.Roles}
+}
+
+var (
+	jwtKey []byte
+
+	// sessionStore is checked for revoked sessions once set with UseSessions
+	sessionStore *SessionStore
+
+	// keyStore authenticates API keys once set with UseAPIKeys
+	keyStore *KeyStore
+)
+
+// InitAuth sets the JWT signing key and the identity providers users log in
+// with
+func InitAuth(cfg config.AuthConfig) {
+	jwtKey = []byte(cfg.JWTSecret)
+
+	providers = make(map[string]Provider)
+	for _, providerConfig := range cfg.Providers {
+		if providerConfig.Issuer == "" || providerConfig.ClientID == "" {
+			log.Printf("Warning: OpenID Connect provider %q is missing its issuer or client ID", providerConfig.Name)
+			continue
+		}
+		providers[providerConfig.Name] = NewOIDCProvider(providerConfig)
+	}
+
+	if len(providers) == 0 && !cfg.MagicLink {
+		log.Println("Warning: no identity providers configured. Authentication will not work properly.")
+	}
+}
+
+// GenerateJWT generates a short-lived access token for the user's session
+func GenerateJWT(user *User, sessionID string) (string, error) {
+	now := time.Now()
+	claims := &Claims{
+		UserID:    user.ID,
+		Email:     user.Email,
+		Roles:     user.Roles,
+		SessionID: sessionID,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: now.Add(AccessTokenTTL).Unix(),
+			IssuedAt:  now.Unix(),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err := token.SignedString(jwtKey)
+	if err != nil {
+		return "", err
+	}
+
+	return tokenString, nil
+}
+
+// ValidateJWT validates a JWT token
+func ValidateJWT(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		// Check the signing method
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return jwtKey, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	return claims, nil
+}
+
+// UseSessions makes Authenticate reject access tokens of ended sessions
+func UseSessions(store *SessionStore) {
+	sessionStore = store
+}
+
+// UseAPIKeys makes Authenticate accept API keys from the store
+func UseAPIKeys(store *KeyStore) {
+	keyStore = store
+}
+
+// Authenticate returns the principal of a credential: an API key, or an
+// access token whose session has not ended. Tokens without a session are
+// rejected, since they could not be revoked.
+func Authenticate(ctx context.Context, credential string) (*Principal, error) {
+	if IsAPIKey(credential) {
+		if keyStore == nil {
+			return nil, ErrInvalidAPIKey
+		}
+		return keyStore.Authenticate(ctx, credential)
+	}
+
+	claims, err := ValidateJWT(credential)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.SessionID == "" {
+		return nil, ErrNoSession
+	}
+	if sessionStore != nil {
+		active, err := sessionStore.Active(ctx, claims.SessionID)
+		if err != nil {
+			return nil, err
+		}
+		if !active {
+			return nil, ErrSessionRevoked
+		}
+	}
+
+	return claims.Principal(), nil
+}
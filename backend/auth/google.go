@@ -1,146 +0,0 @@
-// pickle/backend/auth/google.go
-package auth
-
-import (
-	"context"
-	"encoding/json"
-	"errors"
-	"fmt"
-	"io/ioutil"
-	"log"
-	"net/http"
-	"os"
-	"time"
-
-	"github.com/golang-jwt/jwt/v4"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-)
-
-// User represents a user from Google
-type User struct {
-	ID        string `json:"id"`
-	Email     string `json:"email"`
-	Name      string `json:"name"`
-	Picture   string `json:"picture"`
-	CreatedAt string `json:"created_at"`
-}
-
-// Claims represents the JWT claims
-type Claims struct {
-	UserID string `json:"user_id"`
-	Email  string `json:"email"`
-	jwt.StandardClaims
-}
-
-var (
-	googleOauthConfig *oauth2.Config
-	jwtKey            []byte
-)
-
-// InitAuth initializes the authentication service
-func InitAuth() {
-	// Load Google OAuth config
-	googleOauthConfig = &oauth2.Config{
-		RedirectURL:  getEnv("GOOGLE_REDIRECT_URL", "http://localhost:8080/auth/google/callback"),
-		ClientID:     getEnv("GOOGLE_CLIENT_ID", ""),
-		ClientSecret: getEnv("GOOGLE_CLIENT_SECRET", ""),
-		Scopes:       []string{"https://www.googleapis.com/auth/userinfo.email", "https://www.googleapis.com/auth/userinfo.profile"},
-		Endpoint:     google.Endpoint,
-	}
-
-	// Load JWT key
-	jwtKey = []byte(getEnv("JWT_SECRET", "your-secret-key"))
-
-	if googleOauthConfig.ClientID == "" || googleOauthConfig.ClientSecret == "" {
-		log.Println("Warning: Google OAuth credentials not set. Authentication will not work properly.")
-	}
-}
-
-// Helper function to get environment variable or default value
-func getEnv(key, defaultValue string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		return defaultValue
-	}
-	return value
-}
-
-// GetGoogleLoginURL returns the Google OAuth login URL
-func GetGoogleLoginURL(state string) string {
-	return googleOauthConfig.AuthCodeURL(state)
-}
-
-// ExchangeCodeForToken exchanges the authorization code for a token
-func ExchangeCodeForToken(code string) (*oauth2.Token, error) {
-	return googleOauthConfig.Exchange(context.Background(), code)
-}
-
-// GetUserInfo gets the user info from Google
-func GetUserInfo(token *oauth2.Token) (*User, error) {
-	// Get user info
-	client := googleOauthConfig.Client(context.Background(), token)
-	response, err := client.Get("https://www.googleapis.com/oauth2/v2/userinfo")
-	if err != nil {
-		return nil, err
-	}
-	defer response.Body.Close()
-
-	if response.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to get user info: %s", response.Status)
-	}
-
-	data, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	var user User
-	if err := json.Unmarshal(data, &user); err != nil {
-		return nil, err
-	}
-
-	return &user, nil
-}
-
-// GenerateJWT generates a JWT token for the user
-func GenerateJWT(user *User) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims := &Claims{
-		UserID: user.ID,
-		Email:  user.Email,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-		},
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
-	if err != nil {
-		return "", err
-	}
-
-	return tokenString, nil
-}
-
-// ValidateJWT validates a JWT token
-func ValidateJWT(tokenString string) (*Claims, error) {
-	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		// Check the signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return jwtKey, nil
-	})
-
-	if err != nil {
-		return nil, err
-	}
-
-	if !token.Valid {
-		return nil, errors.New("invalid token")
-	}
-
-	return claims, nil
-}
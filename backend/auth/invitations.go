@@ -0,0 +1,64 @@
+// pickle/backend/auth/invitations.go
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// ErrInvalidInvitation is returned for RSVP tokens that were tampered with
+// or expired
+var ErrInvalidInvitation = errors.New("invalid or expired invitation")
+
+// invitationClaims are the claims of an RSVP token
+type invitationClaims struct {
+	BookingID string `json:"booking_id"`
+	Email     string `json:"email"`
+	jwt.StandardClaims
+}
+
+// SignInvitation creates the RSVP token of a player invited to a booking.
+// Whoever holds the token may answer for the player, without logging in,
+// until it expires.
+func SignInvitation(bookingID, email string, expiresAt time.Time) (string, error) {
+	claims := &invitationClaims{
+		BookingID: bookingID,
+		Email:     strings.ToLower(email),
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: expiresAt.Unix(),
+			IssuedAt:  time.Now().Unix(),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(invitationKey())
+}
+
+// OpenInvitation verifies an RSVP token made by SignInvitation and returns
+// the booking and email it was made for
+func OpenInvitation(token string) (bookingID, email string, err error) {
+	claims := &invitationClaims{}
+	_, err = jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return invitationKey(), nil
+	})
+	if err != nil || claims.BookingID == "" || claims.Email == "" {
+		return "", "", ErrInvalidInvitation
+	}
+
+	return claims.BookingID, claims.Email, nil
+}
+
+// invitationKey derives the key RSVP tokens are signed with from the JWT
+// signing key, so they can never pass for access tokens or sealed logins
+func invitationKey() []byte {
+	mac := hmac.New(sha256.New, jwtKey)
+	mac.Write([]byte("invitation"))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,100 @@
+// pickle/backend/auth/magiclink.go
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/carlostbanks/pickle/storage"
+)
+
+// MagicLinkProvider names users logging in with magic links in stored
+// identities
+const MagicLinkProvider = "email"
+
+// MagicLinkTTL is how long a magic link can be used
+const MagicLinkTTL = 15 * time.Minute
+
+var (
+	// ErrInvalidEmail is returned when a magic link is requested for an
+	// invalid email address
+	ErrInvalidEmail = errors.New("invalid email address")
+
+	// ErrInvalidMagicLink is returned for unknown, used and expired links
+	ErrInvalidMagicLink = errors.New("invalid or expired login link")
+)
+
+// Mailer sends the emails of the login flow
+type Mailer interface {
+	// SendMagicLink sends a login link to an email address
+	SendMagicLink(ctx context.Context, email, link string) error
+}
+
+// LogMailer is a Mailer for development that logs links instead of
+// sending them
+type LogMailer struct{}
+
+// SendMagicLink implements Mailer
+func (LogMailer) SendMagicLink(ctx context.Context, email, link string) error {
+	log.Printf("Login link for %s: %s", email, link)
+	return nil
+}
+
+// MagicLinks logs users in with single-use links sent to their email
+// address. Only hashes of the links' tokens are stored.
+type MagicLinks struct {
+	links       storage.MagicLinkRepository
+	mailer      Mailer
+	callbackURL string
+}
+
+// NewMagicLinks creates magic links kept in links and pointing to
+// callbackURL, which gets the token in its token parameter
+func NewMagicLinks(links storage.MagicLinkRepository, mailer Mailer, callbackURL string) *MagicLinks {
+	return &MagicLinks{links: links, mailer: mailer, callbackURL: callbackURL}
+}
+
+// Send emails a new login link to an address
+func (m *MagicLinks) Send(ctx context.Context, email string) error {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Name != "" {
+		return ErrInvalidEmail
+	}
+	email = strings.ToLower(address.Address)
+
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if err := m.links.CreateMagicLink(ctx, hashToken(token), email, now, now.Add(MagicLinkTTL)); err != nil {
+		return err
+	}
+
+	return m.mailer.SendMagicLink(ctx, email, m.callbackURL+"?token="+url.QueryEscape(token))
+}
+
+// Consume spends a link's token and returns the identity it proves: the
+// owner of the email address it was sent to
+func (m *MagicLinks) Consume(ctx context.Context, token string) (*Identity, error) {
+	email, err := m.links.ConsumeMagicLink(ctx, hashToken(token), time.Now())
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrInvalidMagicLink
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Provider:      MagicLinkProvider,
+		Subject:       email,
+		Email:         email,
+		EmailVerified: true,
+	}, nil
+}
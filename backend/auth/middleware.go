@@ -15,8 +15,43 @@ import (
 // contextKey is a custom type for context keys
 type contextKey string
 
-// UserIDKey is the context key for user ID
-const UserIDKey contextKey = "user_id"
+// principalKey is the context key for the Principal
+const principalKey contextKey = "principal"
+
+// Principal is the authenticated user a request is made for
+type Principal struct {
+	UserID string
+	Email  string
+	Roles  []Grant
+	KeyID  string   // API key the request was made with, if any
+	Scopes []string // Scopes of the API key
+}
+
+// Allows reports whether the principal's credential grants a scope. Access
+// tokens grant every scope; API keys only those they were created with.
+func (p *Principal) Allows(scope string) bool {
+	if p.KeyID == "" {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// WithPrincipal returns a copy of ctx carrying the principal
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey, p)
+}
+
+// PrincipalFromContext retrieves the principal from the context, if the
+// request was authenticated
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey).(*Principal)
+	return p, ok && p != nil
+}
 
 // AuthMiddleware is a middleware for HTTP endpoints that require authentication
 func AuthMiddleware(next http.Handler) http.Handler {
@@ -48,14 +83,18 @@ func AuthMiddleware(next http.Handler) http.Handler {
 		}
 
 		// Validate token
-		claims, err := ValidateJWT(tokenString)
+		principal, err := Authenticate(r.Context(), tokenString)
+		if err == ErrRateLimited {
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
 		if err != nil {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		// Create a new context with the user ID
-		ctx := context.WithValue(r.Context(), UserIDKey, claims.UserID)
+		// Create a new context with the authenticated user
+		ctx := WithPrincipal(r.Context(), principal)
 
 		// Call the next handler with the new context
 		next.ServeHTTP(w, r.WithContext(ctx))
@@ -64,11 +103,11 @@ func AuthMiddleware(next http.Handler) http.Handler {
 
 // GetUserID retrieves the user ID from the context
 func GetUserID(ctx context.Context) string {
-	userID, ok := ctx.Value(UserIDKey).(string)
+	p, ok := PrincipalFromContext(ctx)
 	if !ok {
 		return ""
 	}
-	return userID
+	return p.UserID
 }
 
 // AuthInterceptor is a gRPC interceptor for authentication
@@ -98,24 +137,79 @@ func AuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServe
 	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 
 	// Validate token
-	claims, err := ValidateJWT(tokenString)
+	principal, err := Authenticate(ctx, tokenString)
+	if err == ErrRateLimited {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
 	if err != nil {
 		return nil, status.Errorf(codes.Unauthenticated, "invalid token: %v", err)
 	}
 
-	// Create a new context with the user ID
-	newCtx := context.WithValue(ctx, UserIDKey, claims.UserID)
+	// Check the scope API keys need for the method
+	if principal.KeyID != "" {
+		scope, ok := methodScopes[info.FullMethod]
+		if !ok || !principal.Allows(scope) {
+			return nil, status.Errorf(codes.PermissionDenied, "API key lacks the scope for %s", info.FullMethod)
+		}
+	}
+
+	// Check the role the method needs
+	if role, ok := methodRoles[info.FullMethod]; ok && !principal.HasRoleAnywhere(role) {
+		return nil, status.Errorf(codes.PermissionDenied, "%s role required", role)
+	}
+
+	// Create a new context with the authenticated user
+	newCtx := WithPrincipal(ctx, principal)
 
 	// Call the handler with the new context
 	return handler(newCtx, req)
 }
 
+// methodRoles lists the methods that need more than a signed-in player. The
+// interceptor only checks that the role is held at some facility; services
+// check that it is held at the facility concerned.
+var methodRoles = map[string]string{
+	"/scheduler.SchedulerService/MarkNoShow":   RoleStaff,
+	"/scheduler.SchedulerService/CreateCourt":  RolePlatformAdmin,
+	"/scheduler.SchedulerService/UpdateCourt":  RoleFacilityAdmin,
+	"/scheduler.SchedulerService/ArchiveCourt": RoleFacilityAdmin,
+}
+
+// methodScopes lists the scope API keys need for each method. Keys cannot
+// call methods missing from it.
+var methodScopes = map[string]string{
+	"/scheduler.SchedulerService/GetQuote":            ScopeBookingsRead,
+	"/scheduler.SchedulerService/GetBookings":         ScopeBookingsRead,
+	"/scheduler.SchedulerService/GetBooking":          ScopeBookingsRead,
+	"/scheduler.SchedulerService/GetBookingPayment":   ScopeBookingsRead,
+	"/scheduler.SchedulerService/GetBookingSeries":    ScopeBookingsRead,
+	"/scheduler.SchedulerService/GetWaitlist":         ScopeBookingsRead,
+	"/scheduler.SchedulerService/CreateBooking":       ScopeBookingsWrite,
+	"/scheduler.SchedulerService/HoldBooking":         ScopeBookingsWrite,
+	"/scheduler.SchedulerService/ConfirmBooking":      ScopeBookingsWrite,
+	"/scheduler.SchedulerService/PayBooking":          ScopeBookingsWrite,
+	"/scheduler.SchedulerService/UpdateBooking":       ScopeBookingsWrite,
+	"/scheduler.SchedulerService/CancelBooking":       ScopeBookingsWrite,
+	"/scheduler.SchedulerService/MarkNoShow":          ScopeBookingsWrite,
+	"/scheduler.SchedulerService/CreateBookingSeries": ScopeBookingsWrite,
+	"/scheduler.SchedulerService/JoinWaitlist":        ScopeBookingsWrite,
+	"/scheduler.SchedulerService/LeaveWaitlist":       ScopeBookingsWrite,
+	"/scheduler.SchedulerService/ClaimWaitlistOffer":  ScopeBookingsWrite,
+	"/scheduler.SchedulerService/CreateCourt":         ScopeCourtsManage,
+	"/scheduler.SchedulerService/UpdateCourt":         ScopeCourtsManage,
+	"/scheduler.SchedulerService/ArchiveCourt":        ScopeCourtsManage,
+}
+
 // isPublicMethod checks if the method is public (doesn't require authentication)
 func isPublicMethod(method string) bool {
 	// List of public methods (doesn't require authentication)
 	publicMethods := []string{
 		"/scheduler.SchedulerService/GetCourts",
 		"/scheduler.SchedulerService/GetCourt",
+		"/scheduler.SchedulerService/GetAvailability",
+		"/scheduler.SchedulerService/GetInvitation",
+		"/scheduler.SchedulerService/AcceptInvitation",
+		"/scheduler.SchedulerService/DeclineInvitation",
 	}
 
 	for _, publicMethod := range publicMethods {
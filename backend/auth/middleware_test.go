@@ -0,0 +1,75 @@
+// pickle/backend/auth/middleware_test.go
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthInterceptor(t *testing.T) {
+	jwtKey = []byte("test-secret-at-least-32-bytes-long")
+
+	player, err := GenerateJWT(&User{ID: "player", Email: "player@example.com"}, "session-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	staff, err := GenerateJWT(&User{ID: "staff", Email: "staff@example.com",
+		Roles: []Grant{{Role: RoleStaff, CourtID: "court-1"}}}, "session-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessionless, err := GenerateJWT(&User{ID: "player", Email: "player@example.com"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		header string // Authorization header, if any
+		code   codes.Code
+		userID string // Principal the handler is called with
+	}{
+		{"public method anonymously", "GetCourts", "", codes.OK, ""},
+		{"anonymously", "GetBookings", "", codes.Unauthenticated, ""},
+		{"forged token", "GetBookings", "Bearer not-a-token", codes.Unauthenticated, ""},
+		{"without the Bearer scheme", "GetBookings", player, codes.Unauthenticated, ""},
+		{"token without a session", "GetBookings", "Bearer " + sessionless, codes.Unauthenticated, ""},
+		{"as a player", "GetBookings", "Bearer " + player, codes.OK, "player"},
+		{"staff method as a player", "MarkNoShow", "Bearer " + player, codes.PermissionDenied, ""},
+		{"staff method as staff", "MarkNoShow", "Bearer " + staff, codes.OK, "staff"},
+		{"admin method as staff", "UpdateCourt", "Bearer " + staff, codes.PermissionDenied, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.header != "" {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", tt.header))
+			}
+
+			called := false
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				called = true
+				if got := GetUserID(ctx); got != tt.userID {
+					t.Errorf("handler called as %q, expected %q", got, tt.userID)
+				}
+				return nil, nil
+			}
+			info := &grpc.UnaryServerInfo{FullMethod: "/scheduler.SchedulerService/" + tt.method}
+
+			_, err := AuthInterceptor(ctx, nil, info, handler)
+			if got := status.Code(err); got != tt.code {
+				t.Fatalf("got %v (%v), expected %v", got, err, tt.code)
+			}
+			if called != (tt.code == codes.OK) {
+				t.Errorf("handler called: %v, expected %v", called, tt.code == codes.OK)
+			}
+		})
+	}
+}
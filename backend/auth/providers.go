@@ -0,0 +1,258 @@
+// pickle/backend/auth/providers.go
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/carlostbanks/pickle/config"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/oauth2"
+)
+
+// LoginTTL is how long users have to log in at the provider
+const LoginTTL = 5 * time.Minute
+
+var (
+	// ErrInvalidIDToken is returned when the ID token of a login does not
+	// verify or was not issued for the login's nonce
+	ErrInvalidIDToken = errors.New("invalid ID token")
+
+	// ErrInvalidLoginState is returned for sealed logins that were tampered
+	// with, expired or started with another provider
+	ErrInvalidLoginState = errors.New("invalid login state")
+)
+
+// Identity is a user as known to an identity provider
+type Identity struct {
+	Provider      string
+	Subject       string // Stable ID of the user at the provider
+	Email         string
+	EmailVerified bool
+	Name          string
+	Picture       string
+}
+
+// LoginParams are the per-login secrets bound to an authorization request
+// and checked when its code is exchanged
+type LoginParams struct {
+	State        string
+	Nonce        string // Must come back in the ID token
+	CodeVerifier string // PKCE verifier; the provider gets its S256 challenge
+	LoginHint    string // Optional email to log in as
+}
+
+// NewLoginParams generates the secrets of a new login
+func NewLoginParams() (LoginParams, error) {
+	state, err := randomToken()
+	if err != nil {
+		return LoginParams{}, err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return LoginParams{}, err
+	}
+	return LoginParams{State: state, Nonce: nonce, CodeVerifier: oauth2.GenerateVerifier()}, nil
+}
+
+// loginClaims are the claims of a sealed login
+type loginClaims struct {
+	Provider     string `json:"provider"`
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+	jwt.StandardClaims
+}
+
+// SealLogin signs the params of a login with a provider, for the browser to
+// keep until the provider redirects back. The seal expires after LoginTTL.
+func SealLogin(provider string, params LoginParams) (string, error) {
+	claims := &loginClaims{
+		Provider:     provider,
+		State:        params.State,
+		Nonce:        params.Nonce,
+		CodeVerifier: params.CodeVerifier,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(LoginTTL).Unix(),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(loginKey())
+}
+
+// OpenLogin verifies a login sealed by SealLogin for a provider and returns
+// its params
+func OpenLogin(provider, sealed string) (LoginParams, error) {
+	claims := &loginClaims{}
+	_, err := jwt.ParseWithClaims(sealed, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return loginKey(), nil
+	})
+	if err != nil || claims.Provider != provider || claims.State == "" {
+		return LoginParams{}, ErrInvalidLoginState
+	}
+
+	return LoginParams{State: claims.State, Nonce: claims.Nonce, CodeVerifier: claims.CodeVerifier}, nil
+}
+
+// loginKey derives the key logins are sealed with from the JWT signing key,
+// so sealed logins can never pass for access tokens
+func loginKey() []byte {
+	mac := hmac.New(sha256.New, jwtKey)
+	mac.Write([]byte("login state"))
+	return mac.Sum(nil)
+}
+
+// Provider is an identity provider users log in with through a redirect
+type Provider interface {
+	// Name identifies the provider in login paths and stored identities
+	Name() string
+
+	// AuthCodeURL returns the provider's URL to send the user to
+	AuthCodeURL(ctx context.Context, params LoginParams) (string, error)
+
+	// Exchange redeems the code the provider redirected back with and
+	// returns the verified identity of the user
+	Exchange(ctx context.Context, code string, params LoginParams) (*Identity, error)
+}
+
+// providers are the identity providers configured by InitAuth, by name
+var providers map[string]Provider
+
+// LookupProvider returns the configured identity provider with a name
+func LookupProvider(name string) (Provider, bool) {
+	provider, ok := providers[name]
+	return provider, ok
+}
+
+// ProviderNames lists the configured identity providers
+func ProviderNames() []string {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// discoveryTimeout bounds requests to the issuer for its discovery document
+// and keys
+const discoveryTimeout = 10 * time.Second
+
+// OIDCProvider logs users in with a generic OpenID Connect provider. Its
+// endpoints are discovered from the issuer on first use, so the server
+// starts even while the issuer is unreachable.
+type OIDCProvider struct {
+	config config.OIDCProviderConfig
+
+	mu       sync.Mutex
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewOIDCProvider creates a provider for an OpenID Connect issuer
+func NewOIDCProvider(cfg config.OIDCProviderConfig) *OIDCProvider {
+	return &OIDCProvider{config: cfg}
+}
+
+// Name implements Provider
+func (p *OIDCProvider) Name() string {
+	return p.config.Name
+}
+
+// AuthCodeURL implements Provider
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, params LoginParams) (string, error) {
+	oauth, _, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	options := []oauth2.AuthCodeOption{
+		oidc.Nonce(params.Nonce),
+		oauth2.S256ChallengeOption(params.CodeVerifier),
+	}
+	if params.LoginHint != "" {
+		options = append(options, oauth2.SetAuthURLParam("login_hint", params.LoginHint))
+	}
+	return oauth.AuthCodeURL(params.State, options...), nil
+}
+
+// Exchange implements Provider
+func (p *OIDCProvider) Exchange(ctx context.Context, code string, params LoginParams) (*Identity, error) {
+	oauth, verifier, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := oauth.Exchange(ctx, code, oauth2.VerifierOption(params.CodeVerifier))
+	if err != nil {
+		return nil, fmt.Errorf("code exchange failed: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing from token response", ErrInvalidIDToken)
+	}
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	if idToken.Nonce != params.Nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+		Picture       string `json:"picture"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Provider:      p.config.Name,
+		Subject:       idToken.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Name:          claims.Name,
+		Picture:       claims.Picture,
+	}, nil
+}
+
+// discover fetches the issuer's discovery document once it succeeds
+func (p *OIDCProvider) discover() (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.oauth != nil {
+		return p.oauth, p.verifier, nil
+	}
+
+	// The context is kept to fetch the issuer's keys later on
+	ctx := oidc.ClientContext(context.Background(), &http.Client{Timeout: discoveryTimeout})
+	issuer, err := oidc.NewProvider(ctx, p.config.Issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("discovering %s: %w", p.config.Issuer, err)
+	}
+
+	p.oauth = &oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		RedirectURL:  p.config.RedirectURL,
+		Endpoint:     issuer.Endpoint(),
+		Scopes:       append([]string{oidc.ScopeOpenID}, p.config.Scopes...),
+	}
+	p.verifier = issuer.Verifier(&oidc.Config{ClientID: p.config.ClientID})
+	return p.oauth, p.verifier, nil
+}
@@ -0,0 +1,103 @@
+// pickle/backend/auth/roles.go
+package auth
+
+import (
+	"context"
+
+	"github.com/carlostbanks/pickle/storage"
+)
+
+// Roles, from least to most privileged. Every signed-in user is a player;
+// staff and facility admins hold their role at a facility, while platform
+// admins may act on every facility.
+const (
+	RolePlayer        = "player"
+	RoleStaff         = "staff"
+	RoleFacilityAdmin = "facility_admin"
+	RolePlatformAdmin = "platform_admin"
+)
+
+// roleRanks orders the roles; a role includes every role ranked below it
+var roleRanks = map[string]int{
+	RolePlayer:        0,
+	RoleStaff:         1,
+	RoleFacilityAdmin: 2,
+	RolePlatformAdmin: 3,
+}
+
+// Grant is a role held by a user at a facility. Platform admin grants have
+// no facility.
+type Grant struct {
+	Role    string `json:"role"`
+	CourtID string `json:"court_id,omitempty"`
+}
+
+// includes reports whether the grant gives role at the facility; an empty
+// courtID matches a grant at any facility
+func (g Grant) includes(role, courtID string) bool {
+	if roleRanks[g.Role] < roleRanks[role] {
+		return false
+	}
+	return g.Role == RolePlatformAdmin || courtID == "" || g.CourtID == courtID
+}
+
+// HasRole reports whether the principal holds role, or a role including it,
+// at the facility. Every principal is a player.
+func (p *Principal) HasRole(role, courtID string) bool {
+	if role == RolePlayer {
+		return true
+	}
+	for _, g := range p.Roles {
+		if g.includes(role, courtID) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRoleAnywhere reports whether the principal holds role, or a role
+// including it, at any facility
+func (p *Principal) HasRoleAnywhere(role string) bool {
+	return p.HasRole(role, "")
+}
+
+// IsPlatformAdmin reports whether the principal may act on every facility
+func (p *Principal) IsPlatformAdmin() bool {
+	return p.HasRole(RolePlatformAdmin, "")
+}
+
+// CourtsWithRole returns the facilities at which the principal holds role,
+// or a role including it. It is meaningless for platform admins, who hold
+// every role everywhere.
+func (p *Principal) CourtsWithRole(role string) []string {
+	var courtIDs []string
+	for _, g := range p.Roles {
+		if g.CourtID != "" && g.includes(role, g.CourtID) {
+			courtIDs = append(courtIDs, g.CourtID)
+		}
+	}
+	return courtIDs
+}
+
+// LoadGrants loads the roles held by a user. Every user is a player, so only
+// platform admin and facility grants are listed.
+func LoadGrants(ctx context.Context, users storage.UserRepository, userID string) ([]Grant, error) {
+	grants := []Grant{}
+
+	user, err := users.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.PlatformAdmin {
+		grants = append(grants, Grant{Role: RolePlatformAdmin})
+	}
+
+	roles, err := users.ListRoles(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range roles {
+		grants = append(grants, Grant{Role: role.Role, CourtID: role.CourtID})
+	}
+	return grants, nil
+}
@@ -0,0 +1,185 @@
+// pickle/backend/auth/sessions.go
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/carlostbanks/pickle/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	// AccessTokenTTL is how long access tokens are valid; clients get a new
+	// one with their refresh token
+	AccessTokenTTL = 15 * time.Minute
+
+	// SessionTTL is how long a session lasts after login, however often its
+	// refresh token is rotated
+	SessionTTL = 30 * 24 * time.Hour
+
+	// LoginCodeTTL is how long the frontend has to redeem the code it is
+	// sent back with after login
+	LoginCodeTTL = time.Minute
+)
+
+var (
+	// ErrInvalidRefreshToken is returned for unknown refresh tokens and those
+	// of expired or revoked sessions
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+	// ErrRefreshTokenReused is returned when a refresh token that was already
+	// rotated is presented again. Its session is revoked, since the token
+	// may have been stolen.
+	ErrRefreshTokenReused = errors.New("refresh token was already used")
+
+	// ErrInvalidLoginCode is returned for unknown, expired and already
+	// redeemed login codes
+	ErrInvalidLoginCode = errors.New("invalid or expired login code")
+
+	// ErrSessionRevoked is returned for access tokens of revoked or expired
+	// sessions
+	ErrSessionRevoked = errors.New("session has ended")
+
+	// ErrNoSession is returned for access tokens that name no session, which
+	// could not be revoked
+	ErrNoSession = errors.New("access token has no session")
+)
+
+// Session is a login of a user on a device. Its refresh tokens form a
+// family: each refresh rotates the current token for a new one.
+type Session struct {
+	ID        string
+	UserID    string
+	ExpiresAt time.Time
+}
+
+// SessionStore starts sessions and rotates their refresh tokens. Only
+// hashes of refresh tokens and login codes are stored.
+type SessionStore struct {
+	sessions storage.SessionRepository
+}
+
+// NewSessionStore creates a session store keeping sessions in the given
+// repository
+func NewSessionStore(sessions storage.SessionRepository) *SessionStore {
+	return &SessionStore{sessions: sessions}
+}
+
+// Start opens a session for a user who just logged in and returns it with
+// its first refresh token
+func (s *SessionStore) Start(ctx context.Context, userID, userAgent string) (Session, string, error) {
+	refreshToken, err := randomToken()
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	now := time.Now()
+	session := &storage.Session{ID: uuid.New().String(), UserID: userID, UserAgent: userAgent, CreatedAt: now, ExpiresAt: now.Add(SessionTTL)}
+	if err := s.sessions.CreateSession(ctx, session, hashToken(refreshToken)); err != nil {
+		return Session{}, "", err
+	}
+	return sessionOf(session), refreshToken, nil
+}
+
+// Refresh rotates a refresh token: the token is spent and a new one of the
+// same session is returned. Presenting a spent token again revokes the
+// session, so a stolen token can be used once at most.
+func (s *SessionStore) Refresh(ctx context.Context, refreshToken string) (Session, string, error) {
+	next, err := randomToken()
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	session, err := s.sessions.RotateRefreshToken(ctx, hashToken(refreshToken), hashToken(next), time.Now())
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return Session{}, "", ErrInvalidRefreshToken
+	case errors.Is(err, storage.ErrReused):
+		return Session{}, "", ErrRefreshTokenReused
+	case err != nil:
+		return Session{}, "", err
+	}
+	return sessionOf(session), next, nil
+}
+
+// IssueLoginCode creates a single-use code the frontend redeems for the
+// first access token of a session, so tokens never appear in URLs
+func (s *SessionStore) IssueLoginCode(ctx context.Context, sessionID string) (string, error) {
+	code, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	if err := s.sessions.CreateLoginCode(ctx, hashToken(code), sessionID, now, now.Add(LoginCodeTTL)); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// RedeemLoginCode spends a login code and returns its session. Redeeming a
+// code twice revokes the session, since the code may have leaked.
+func (s *SessionStore) RedeemLoginCode(ctx context.Context, code string) (Session, error) {
+	session, err := s.sessions.RedeemLoginCode(ctx, hashToken(code), time.Now())
+	if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrReused) {
+		return Session{}, ErrInvalidLoginCode
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	return sessionOf(session), nil
+}
+
+// SessionOf returns the session of a refresh token, spent or not
+func (s *SessionStore) SessionOf(ctx context.Context, refreshToken string) (Session, error) {
+	session, err := s.sessions.GetSessionByRefreshToken(ctx, hashToken(refreshToken))
+	if errors.Is(err, storage.ErrNotFound) {
+		return Session{}, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	return sessionOf(session), nil
+}
+
+// Revoke ends a session, invalidating its refresh tokens and the access
+// tokens issued for it
+func (s *SessionStore) Revoke(ctx context.Context, sessionID string) error {
+	return s.sessions.RevokeSession(ctx, sessionID, storage.RevokedLogout, time.Now())
+}
+
+// RevokeAll ends every session of a user
+func (s *SessionStore) RevokeAll(ctx context.Context, userID string) error {
+	return s.sessions.RevokeUserSessions(ctx, userID, storage.RevokedLogoutAll, time.Now())
+}
+
+// Active reports whether a session can still be used
+func (s *SessionStore) Active(ctx context.Context, sessionID string) (bool, error) {
+	return s.sessions.SessionLive(ctx, sessionID, time.Now())
+}
+
+// sessionOf returns the session a stored one describes
+func sessionOf(session *storage.Session) Session {
+	return Session{ID: session.ID, UserID: session.UserID, ExpiresAt: session.ExpiresAt}
+}
+
+// randomToken returns 32 random bytes, base64url-encoded
+func randomToken() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// hashToken returns the hex-encoded SHA-256 hash a token is stored as
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,91 @@
+// pickle/backend/auth/sessions_test.go
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/carlostbanks/pickle/storage"
+)
+
+// active reports whether a session can still be used, failing on errors
+func active(t *testing.T, sessions *SessionStore, sessionID string) bool {
+	t.Helper()
+	ok, err := sessions.Active(context.Background(), sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+func TestRefreshReuse(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemory()
+	sessions := NewSessionStore(store.Sessions)
+	user := createUser(t, store.Users)
+
+	session, first, err := sessions.Start(ctx, user.ID, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshed, second, err := sessions.Refresh(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.ID != session.ID || second == first {
+		t.Fatalf("refresh returned session %q with token %q, expected a new token of %q", refreshed.ID, second, session.ID)
+	}
+
+	// Presenting the spent token again ends the session, taking the token
+	// it was rotated for with it
+	if _, _, err := sessions.Refresh(ctx, first); err != ErrRefreshTokenReused {
+		t.Fatalf("reusing a refresh token: %v, expected ErrRefreshTokenReused", err)
+	}
+	if active(t, sessions, session.ID) {
+		t.Error("session still active after its refresh token was reused")
+	}
+	if _, _, err := sessions.Refresh(ctx, second); err != ErrInvalidRefreshToken {
+		t.Errorf("refreshing a revoked session: %v, expected ErrInvalidRefreshToken", err)
+	}
+
+	if _, _, err := sessions.Refresh(ctx, "made-up"); err != ErrInvalidRefreshToken {
+		t.Errorf("refreshing an unknown token: %v, expected ErrInvalidRefreshToken", err)
+	}
+}
+
+func TestRevokeAll(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemory()
+	sessions := NewSessionStore(store.Sessions)
+	user := createUser(t, store.Users)
+	other := createUser(t, store.Users)
+
+	var tokens []string
+	var ids []string
+	for _, userAgent := range []string{"phone", "laptop"} {
+		session, token, err := sessions.Start(ctx, user.ID, userAgent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, tokens = append(ids, session.ID), append(tokens, token)
+	}
+	kept, _, err := sessions.Start(ctx, other.ID, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sessions.RevokeAll(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range ids {
+		if active(t, sessions, id) {
+			t.Errorf("session %d still active after revoking all of them", i+1)
+		}
+		if _, _, err := sessions.Refresh(ctx, tokens[i]); err != ErrInvalidRefreshToken {
+			t.Errorf("refreshing revoked session %d: %v, expected ErrInvalidRefreshToken", i+1, err)
+		}
+	}
+	if !active(t, sessions, kept.ID) {
+		t.Error("revoking a user's sessions ended another user's")
+	}
+}
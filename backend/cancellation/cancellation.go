@@ -0,0 +1,109 @@
+// pickle/backend/cancellation/cancellation.go
+package cancellation
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/carlostbanks/pickle/schedule"
+)
+
+// Rules recorded on a booking when it is cancelled or marked as a no-show
+const (
+	RuleFree          = "FREE"           // Cancelled before the free cancellation deadline
+	RulePartialRefund = "PARTIAL_REFUND" // Cancelled in the partial refund window
+	RuleLate          = "LATE"           // Cancelled after every refund window
+	RuleNoShow        = "NO_SHOW"        // The players did not turn up
+)
+
+var (
+	// ErrNoCancel is returned for cancellations inside the no-cancel window
+	ErrNoCancel = errors.New("booking can no longer be cancelled")
+
+	// ErrStarted is returned for cancellations of bookings that already started
+	ErrStarted = errors.New("booking has already started")
+
+	// ErrNotStarted is returned for no-shows reported before the booking started
+	ErrNotStarted = errors.New("booking has not started yet")
+)
+
+// Policy is the cancellation policy of a facility. Windows are measured in
+// hours before the start of a booking and are expected to shrink in the
+// order free, partial refund, no-cancel. The zero value lets bookings be
+// cancelled for free until they start and charges nothing for no-shows.
+type Policy struct {
+	FreeUntilHours          int // Cancelling at least this long before the start is free
+	PartialRefundUntilHours int // Later cancellations up to this long before the start are refunded in part
+	PartialRefundPercent    int // Share of the price refunded in the partial refund window
+	NoCancelHours           int // Cancellation is refused this close to the start
+	NoShowFeePercent        int // Share of the price charged for no-shows
+}
+
+// Outcome is the rule applied to a booking and the fee it incurs
+type Outcome struct {
+	Rule     string
+	FeeCents int64
+}
+
+// StartsAt returns the start of a booking on a date, in the given location
+func StartsAt(date string, w schedule.Window, loc *time.Location) (time.Time, error) {
+	day, err := schedule.ParseDate(date)
+	if err != nil {
+		return time.Time{}, errors.New("invalid date format")
+	}
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, w.Start, 0, 0, loc), nil
+}
+
+// Cancel evaluates the cancellation at now of a booking starting at startsAt
+// and costing price
+func (p Policy) Cancel(startsAt, now time.Time, price int64) (Outcome, error) {
+	lead := startsAt.Sub(now)
+	switch {
+	case lead <= 0:
+		return Outcome{}, ErrStarted
+	case lead < hours(p.NoCancelHours):
+		return Outcome{}, fmt.Errorf("%w less than %d hours before the start", ErrNoCancel, p.NoCancelHours)
+	case lead >= hours(p.FreeUntilHours):
+		return Outcome{Rule: RuleFree}, nil
+	case p.PartialRefundUntilHours > 0 && lead >= hours(p.PartialRefundUntilHours):
+		return Outcome{Rule: RulePartialRefund, FeeCents: price - percent(price, p.PartialRefundPercent)}, nil
+	}
+	return Outcome{Rule: RuleLate, FeeCents: price}, nil
+}
+
+// NoShow evaluates a no-show reported at now for a booking starting at
+// startsAt and costing price
+func (p Policy) NoShow(startsAt, now time.Time, price int64) (Outcome, error) {
+	if now.Before(startsAt) {
+		return Outcome{}, ErrNotStarted
+	}
+	return Outcome{Rule: RuleNoShow, FeeCents: percent(price, p.NoShowFeePercent)}, nil
+}
+
+// Message describes the outcome of a cancellation to the user
+func (o Outcome) Message(currency string) string {
+	switch o.Rule {
+	case RulePartialRefund:
+		return fmt.Sprintf("Booking cancelled with a partial refund; a fee of %s applies", FormatAmount(o.FeeCents, currency))
+	case RuleLate:
+		return fmt.Sprintf("Booking cancelled late; a fee of %s applies", FormatAmount(o.FeeCents, currency))
+	case RuleNoShow:
+		return fmt.Sprintf("Booking marked as a no-show; a fee of %s applies", FormatAmount(o.FeeCents, currency))
+	}
+	return "Booking cancelled free of charge"
+}
+
+// FormatAmount formats an amount in the smallest currency unit, e.g. "12.50 USD"
+func FormatAmount(cents int64, currency string) string {
+	return fmt.Sprintf("%d.%02d %s", cents/100, cents%100, currency)
+}
+
+func hours(n int) time.Duration {
+	return time.Duration(n) * time.Hour
+}
+
+// percent returns pct percent of amount, rounded down
+func percent(amount int64, pct int) int64 {
+	return amount * int64(pct) / 100
+}
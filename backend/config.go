@@ -0,0 +1,43 @@
+// pickle/backend/config.go
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/carlostbanks/pickle/config"
+	"gopkg.in/yaml.v3"
+)
+
+// configUsage describes the config command
+const configUsage = `Usage: pickle [flags] config <command> [flags]
+
+Commands:
+  print [--redact]   Print the effective configuration as YAML, with its
+                     secrets replaced when --redact is given
+`
+
+// runConfig runs the config command with its arguments, exiting with a
+// non-zero status on failure. The configuration was loaded and validated
+// already.
+func runConfig(cfg *config.Config, args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprint(os.Stderr, configUsage)
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet("config print", flag.ExitOnError)
+	redact := flags.Bool("redact", false, "Replace secrets with "+config.Redacted)
+	flags.Parse(args[1:])
+
+	if *redact {
+		cfg = cfg.Redact()
+	}
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		log.Fatalf("Failed to print configuration: %v", err)
+	}
+	os.Stdout.Write(out)
+}
@@ -2,94 +2,420 @@
 package config
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 
+	"github.com/carlostbanks/pickle/payments"
 	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
 )
 
 // Config holds all configuration for the application
 type Config struct {
-	Server   ServerConfig
-	Database DatabaseConfig
-	Auth     AuthConfig
-	Maps     MapsConfig
+	Environment string         `yaml:"environment"` // EnvDevelopment or EnvProduction
+	Server      ServerConfig   `yaml:"server"`
+	Database    DatabaseConfig `yaml:"database"`
+	Auth        AuthConfig     `yaml:"auth"`
+	Maps        MapsConfig     `yaml:"maps"`
+	Payments    PaymentsConfig `yaml:"payments"`
+	Mail        MailConfig     `yaml:"mail"`
 }
 
 // ServerConfig holds server-related configuration
 type ServerConfig struct {
-	GRPCPort int
-	HTTPPort int
-	Host     string
+	GRPCPort int    `yaml:"grpc_port"`
+	HTTPPort int    `yaml:"http_port"`
+	Host     string `yaml:"host"`
 }
 
 // DatabaseConfig holds database-related configuration
 type DatabaseConfig struct {
-	Host     string
-	Port     int
-	User     string
-	Password string
-	Name     string
-	SSLMode  string
+	Driver   string `yaml:"driver"` // DriverPostgres or DriverSQLite
+	Path     string `yaml:"path"`   // File of the SQLite database
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Name     string `yaml:"name"`
+	SSLMode  string `yaml:"sslmode"`
 }
 
 // AuthConfig holds authentication-related configuration
 type AuthConfig struct {
-	GoogleClientID     string
-	GoogleClientSecret string
-	GoogleRedirectURL  string
-	JWTSecret          string
+	GoogleClientID     string               `yaml:"google_client_id"`
+	GoogleClientSecret string               `yaml:"google_client_secret"`
+	GoogleRedirectURL  string               `yaml:"google_redirect_url"` // Defaults to the callback under BaseURL
+	JWTSecret          string               `yaml:"jwt_secret"`
+	BaseURL            string               `yaml:"base_url"`     // Public URL of the backend, for callbacks and magic links
+	FrontendURL        string               `yaml:"frontend_url"` // Origin of the frontend, sent back to after login
+	Cookies            CookieConfig         `yaml:"cookies"`
+	Providers          []OIDCProviderConfig `yaml:"providers"`
+	MagicLink          bool                 `yaml:"magic_link"`  // Log in with links sent by email
+	FakeIssuer         bool                 `yaml:"fake_issuer"` // Serve a fake OpenID Connect issuer for development and tests
 }
 
+// CookieConfig holds the attributes of the cookies set at login
+type CookieConfig struct {
+	Domain   string `yaml:"domain"`   // Empty for the backend's host only
+	Secure   bool   `yaml:"secure"`   // Only send the cookies over HTTPS
+	SameSite string `yaml:"samesite"` // "lax", "strict" or "none"
+}
+
+// OIDCProviderConfig describes an OpenID Connect provider users log in with
+type OIDCProviderConfig struct {
+	Name         string   `yaml:"name"`   // Used in the login and callback paths
+	Issuer       string   `yaml:"issuer"` // Endpoints are discovered from the issuer
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	RedirectURL  string   `yaml:"redirect_url"` // Defaults to the callback under BaseURL
+	Scopes       []string `yaml:"scopes"`       // Requested besides openid
+
+	// TrustEmail links a first login to the user with the same verified
+	// email address. Only set it for issuers that own the addresses they
+	// vouch for, since anyone running an issuer can claim any address.
+	TrustEmail bool `yaml:"trust_email"`
+}
+
+// Environments. Production refuses to start without its secrets, see
+// Validate.
+const (
+	EnvDevelopment = "development"
+	EnvProduction  = "production"
+)
+
+// DevelopmentJWTSecret signs tokens when no JWT secret is configured, which
+// is only allowed outside production
+const DevelopmentJWTSecret = "your-secret-key"
+
+// Database drivers
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
+
+// GoogleIssuer is the OpenID Connect issuer of Google accounts
+const GoogleIssuer = "https://accounts.google.com"
+
+// The fake issuer is served at FakeIssuerPath, under BaseURL, for a single
+// client
+const (
+	FakeIssuerPath   = "/fake-oidc"
+	FakeClientID     = "pickle"
+	FakeClientSecret = "fake-secret"
+)
+
 // MapsConfig holds maps API configuration
 type MapsConfig struct {
-	APIKey string
+	APIKey string `yaml:"api_key"`
 }
 
-// Load loads the configuration from environment variables
-func Load() (*Config, error) {
-	// Load .env file if it exists
-	godotenv.Load()
+// PaymentsConfig holds payment provider configuration
+type PaymentsConfig struct {
+	Provider      string `yaml:"provider"` // One of payments.Providers; empty for the fake one
+	APIKey        string `yaml:"api_key"`  // Secret key of the provider's API
+	WebhookSecret string `yaml:"webhook_secret"`
+}
 
-	config := &Config{
+// MailConfig holds the configuration of outbound emails
+type MailConfig struct {
+	Sender     string     `yaml:"sender"`      // MailSMTP, MailFile or MailMemory
+	From       string     `yaml:"from"`        // Address emails are sent from
+	CaptureDir string     `yaml:"capture_dir"` // Directory MailFile writes emails to
+	SMTP       SMTPConfig `yaml:"smtp"`
+}
+
+// SMTPConfig holds the SMTP server emails are sent through. Connections are
+// upgraded with STARTTLS when the server offers it.
+type SMTPConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"` // Empty to send without authenticating
+	Password string `yaml:"password"`
+}
+
+// Mail senders. The file and memory senders capture emails instead of
+// sending them, for local development and tests.
+const (
+	MailSMTP   = "smtp"
+	MailFile   = "file"
+	MailMemory = "memory"
+)
+
+// defaults returns the configuration used for local development
+func defaults() *Config {
+	return &Config{
+		Environment: EnvDevelopment,
 		Server: ServerConfig{
-			GRPCPort: getEnvAsInt("GRPC_PORT", 50051),
-			HTTPPort: getEnvAsInt("HTTP_PORT", 8080),
-			Host:     getEnv("HOST", "localhost"),
+			GRPCPort: 50051,
+			HTTPPort: 8080,
+			Host:     "localhost",
 		},
 		Database: DatabaseConfig{
-			Host:     getEnv("DB_HOST", "localhost"),
-			Port:     getEnvAsInt("DB_PORT", 5432),
-			User:     getEnv("DB_USER", "postgres"),
-			Password: getEnv("DB_PASSWORD", "postgres"),
-			Name:     getEnv("DB_NAME", "pickle"),
-			SSLMode:  getEnv("DB_SSLMODE", "disable"),
+			Driver:   DriverPostgres,
+			Path:     "pickle.db",
+			Host:     "localhost",
+			Port:     5432,
+			User:     "postgres",
+			Password: "postgres",
+			Name:     "pickle",
+			SSLMode:  "disable",
 		},
 		Auth: AuthConfig{
-			GoogleClientID:     getEnv("GOOGLE_CLIENT_ID", ""),
-			GoogleClientSecret: getEnv("GOOGLE_CLIENT_SECRET", ""),
-			GoogleRedirectURL:  getEnv("GOOGLE_REDIRECT_URL", "http://localhost:8080/auth/google/callback"),
-			JWTSecret:          getEnv("JWT_SECRET", "your-super-secret-key-change-in-production"),
+			JWTSecret:   DevelopmentJWTSecret,
+			BaseURL:     "http://localhost:8080",
+			FrontendURL: "http://localhost:3000",
+			Cookies: CookieConfig{
+				SameSite: "lax",
+			},
+		},
+		Payments: PaymentsConfig{
+			Provider: payments.ProviderFake,
 		},
-		Maps: MapsConfig{
-			APIKey: getEnv("MAPS_API_KEY", ""),
+		Mail: MailConfig{
+			Sender:     MailFile,
+			From:       "Pickle <no-reply@localhost>",
+			CaptureDir: "mail",
+			SMTP: SMTPConfig{
+				Port: 587,
+			},
 		},
 	}
+}
+
+// setting binds a configuration value to its environment variable and,
+// unless it is a secret, to a command-line flag
+type setting struct {
+	env   string
+	flag  string // Empty for no flag; secrets would show in process lists
+	usage string
+	value interface{} // *string, *int or *bool
+}
 
-	return config, nil
+// settings lists the values of c that can be set by the environment and
+// flags
+func (c *Config) settings() []setting {
+	return []setting{
+		{"PICKLE_ENV", "env", "Environment, development or production", &c.Environment},
+		{"GRPC_PORT", "grpc-port", "Port of the gRPC server", &c.Server.GRPCPort},
+		{"HTTP_PORT", "http-port", "Port of the REST API", &c.Server.HTTPPort},
+		{"HOST", "host", "Host the gateway dials the gRPC server on", &c.Server.Host},
+		{"DB_DRIVER", "db-driver", "Database driver, postgres or sqlite", &c.Database.Driver},
+		{"DB_PATH", "db-path", "File of the SQLite database", &c.Database.Path},
+		{"DB_HOST", "db-host", "Postgres host", &c.Database.Host},
+		{"DB_PORT", "db-port", "Postgres port", &c.Database.Port},
+		{"DB_USER", "db-user", "Postgres user", &c.Database.User},
+		{"DB_PASSWORD", "", "", &c.Database.Password},
+		{"DB_NAME", "db-name", "Postgres database", &c.Database.Name},
+		{"DB_SSLMODE", "db-sslmode", "Postgres SSL mode", &c.Database.SSLMode},
+		{"GOOGLE_CLIENT_ID", "", "", &c.Auth.GoogleClientID},
+		{"GOOGLE_CLIENT_SECRET", "", "", &c.Auth.GoogleClientSecret},
+		{"GOOGLE_REDIRECT_URL", "", "", &c.Auth.GoogleRedirectURL},
+		{"JWT_SECRET", "", "", &c.Auth.JWTSecret},
+		{"AUTH_BASE_URL", "base-url", "Public URL of the backend", &c.Auth.BaseURL},
+		{"AUTH_FRONTEND_URL", "frontend-url", "Origin of the frontend", &c.Auth.FrontendURL},
+		{"AUTH_MAGIC_LINK", "magic-link", "Log in with links sent by email", &c.Auth.MagicLink},
+		{"AUTH_FAKE_ISSUER", "fake-issuer", "Serve a fake OpenID Connect issuer", &c.Auth.FakeIssuer},
+		{"AUTH_COOKIE_DOMAIN", "cookie-domain", "Domain of the login cookies", &c.Auth.Cookies.Domain},
+		{"AUTH_COOKIE_SECURE", "cookie-secure", "Only send the login cookies over HTTPS", &c.Auth.Cookies.Secure},
+		{"AUTH_COOKIE_SAMESITE", "cookie-samesite", "SameSite of the login cookies, lax, strict or none", &c.Auth.Cookies.SameSite},
+		{"MAPS_API_KEY", "", "", &c.Maps.APIKey},
+		{"PAYMENTS_PROVIDER", "payments-provider", "Payment provider", &c.Payments.Provider},
+		{"PAYMENTS_API_KEY", "", "", &c.Payments.APIKey},
+		{"PAYMENTS_WEBHOOK_SECRET", "", "", &c.Payments.WebhookSecret},
+		{"MAIL_SENDER", "mail-sender", "How emails are sent, smtp, file or memory", &c.Mail.Sender},
+		{"MAIL_FROM", "mail-from", "Address emails are sent from", &c.Mail.From},
+		{"MAIL_CAPTURE_DIR", "mail-capture-dir", "Directory the file mail sender writes emails to", &c.Mail.CaptureDir},
+		{"SMTP_HOST", "smtp-host", "SMTP server host", &c.Mail.SMTP.Host},
+		{"SMTP_PORT", "smtp-port", "SMTP server port", &c.Mail.SMTP.Port},
+		{"SMTP_USERNAME", "smtp-username", "SMTP user", &c.Mail.SMTP.Username},
+		{"SMTP_PASSWORD", "", "", &c.Mail.SMTP.Password},
+	}
+}
+
+// Load loads the configuration and returns the arguments left after the
+// flags. Later sources override earlier ones: the defaults, the YAML file
+// given by -config or PICKLE_CONFIG, the environment, including the .env
+// file if it exists, and the flags in args. Pass no args to skip the flags.
+// The configuration is validated, see Validate.
+func Load(args []string) (*Config, []string, error) {
+	// Load .env file if it exists
+	godotenv.Load()
+
+	config := defaults()
+	settings := config.settings()
+
+	// Flags are applied last, but are parsed first to find the file
+	flags := flag.NewFlagSet("pickle", flag.ContinueOnError)
+	file := flags.String("config", os.Getenv("PICKLE_CONFIG"), "YAML configuration file")
+	flagValues := make(map[string]string)
+	for _, s := range settings {
+		if s.flag == "" {
+			continue
+		}
+		name := s.flag
+		set := func(value string) error {
+			flagValues[name] = value
+			return nil
+		}
+		if _, ok := s.value.(*bool); ok {
+			flags.BoolFunc(name, s.usage, set)
+		} else {
+			flags.Func(name, s.usage, set)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *file != "" {
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read configuration file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return nil, nil, fmt.Errorf("invalid configuration file %s: %w", *file, err)
+		}
+	}
+
+	for _, s := range settings {
+		if value := os.Getenv(s.env); value != "" {
+			if err := setValue(s.value, value); err != nil {
+				return nil, nil, fmt.Errorf("invalid %s %q: %w", s.env, value, err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if value, ok := flagValues[s.flag]; ok {
+			if err := setValue(s.value, value); err != nil {
+				return nil, nil, fmt.Errorf("invalid -%s %q: %w", s.flag, value, err)
+			}
+		}
+	}
+
+	config.Environment = strings.ToLower(config.Environment)
+	config.Database.Driver = strings.ToLower(config.Database.Driver)
+	config.Auth.BaseURL = strings.TrimSuffix(config.Auth.BaseURL, "/")
+	config.Auth.FrontendURL = strings.TrimSuffix(config.Auth.FrontendURL, "/")
+	config.Auth.Cookies.SameSite = strings.ToLower(config.Auth.Cookies.SameSite)
+	if config.Auth.GoogleRedirectURL == "" {
+		config.Auth.GoogleRedirectURL = config.Auth.BaseURL + "/auth/google/callback"
+	}
+	config.Auth.Providers = loadProviders(config.Auth)
+	config.Mail.Sender = strings.ToLower(config.Mail.Sender)
+
+	if err := config.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return config, flags.Args(), nil
+}
+
+// setValue parses value into target, a *string, *int or *bool
+func setValue(target interface{}, value string) error {
+	switch target := target.(type) {
+	case *string:
+		*target = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("not a number")
+		}
+		*target = n
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("not a boolean")
+		}
+		*target = b
+	}
+	return nil
+}
+
+// loadProviders lists the OpenID Connect providers: those of the
+// configuration file, Google when it has credentials, those named in
+// AUTH_OIDC_PROVIDERS and the fake issuer when enabled. Provider NAME is
+// configured with AUTH_OIDC_NAME_ISSUER, AUTH_OIDC_NAME_CLIENT_ID,
+// AUTH_OIDC_NAME_CLIENT_SECRET and optionally AUTH_OIDC_NAME_SCOPES, a
+// comma-separated list, and AUTH_OIDC_NAME_TRUST_EMAIL. Google and the fake
+// issuer are trusted with email addresses. A later provider replaces an
+// earlier one of the same name.
+func loadProviders(auth AuthConfig) []OIDCProviderConfig {
+	var providers []OIDCProviderConfig
+	add := func(provider OIDCProviderConfig) {
+		if provider.RedirectURL == "" {
+			provider.RedirectURL = auth.BaseURL + "/auth/" + provider.Name + "/callback"
+		}
+		if provider.Scopes == nil {
+			provider.Scopes = []string{"email", "profile"}
+		}
+		for i := range providers {
+			if providers[i].Name == provider.Name {
+				providers[i] = provider
+				return
+			}
+		}
+		providers = append(providers, provider)
+	}
+
+	for _, provider := range auth.Providers {
+		add(provider)
+	}
+
+	if auth.GoogleClientID != "" {
+		add(OIDCProviderConfig{
+			Name:         "google",
+			Issuer:       GoogleIssuer,
+			ClientID:     auth.GoogleClientID,
+			ClientSecret: auth.GoogleClientSecret,
+			RedirectURL:  auth.GoogleRedirectURL,
+			TrustEmail:   true,
+		})
+	}
+
+	for _, name := range splitList(os.Getenv("AUTH_OIDC_PROVIDERS")) {
+		prefix := "AUTH_OIDC_" + strings.ToUpper(name) + "_"
+		trustEmail, _ := strconv.ParseBool(os.Getenv(prefix + "TRUST_EMAIL"))
+		add(OIDCProviderConfig{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			Scopes:       splitList(getEnv(prefix+"SCOPES", "email,profile")),
+			TrustEmail:   trustEmail,
+		})
+	}
+
+	if auth.FakeIssuer {
+		add(OIDCProviderConfig{
+			Name:         "fake",
+			Issuer:       auth.BaseURL + FakeIssuerPath,
+			ClientID:     FakeClientID,
+			ClientSecret: FakeClientSecret,
+			TrustEmail:   true,
+		})
+	}
+
+	return providers
 }
 
 // GetDatabaseConnectionString returns the database connection string
 func (c *Config) GetDatabaseConnectionString() string {
+	return c.Database.ConnectionString()
+}
+
+// ConnectionString returns the connection string of a Postgres database
+func (c DatabaseConfig) ConnectionString() string {
 	return fmt.Sprintf(
 		"host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
-		c.Database.Host,
-		c.Database.Port,
-		c.Database.User,
-		c.Database.Password,
-		c.Database.Name,
-		c.Database.SSLMode,
+		c.Host,
+		c.Port,
+		c.User,
+		c.Password,
+		c.Name,
+		c.SSLMode,
 	)
 }
 
@@ -112,15 +438,13 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
-// Helper function to get environment variable as int or default value
-func getEnvAsInt(key string, defaultValue int) int {
-	valueStr := getEnv(key, "")
-	if valueStr == "" {
-		return defaultValue
-	}
-	value, err := strconv.Atoi(valueStr)
-	if err != nil {
-		return defaultValue
+// splitList splits a comma-separated list, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
-	return value
+	return items
 }
@@ -0,0 +1,157 @@
+// pickle/backend/config/validate.go
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/carlostbanks/pickle/payments"
+)
+
+// Redacted replaces secrets
+const Redacted = "REDACTED"
+
+// Validate checks that the configuration is consistent and, in production,
+// that every secret is set rather than left to its development default.
+// All problems are reported together.
+func (c *Config) Validate() error {
+	var problems []error
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	switch c.Environment {
+	case EnvDevelopment, EnvProduction:
+	default:
+		problem("invalid PICKLE_ENV %q: must be %s or %s", c.Environment, EnvDevelopment, EnvProduction)
+	}
+
+	ports := []struct {
+		name string
+		port int
+	}{{"GRPC_PORT", c.Server.GRPCPort}, {"HTTP_PORT", c.Server.HTTPPort}}
+	for _, p := range ports {
+		if p.port < 1 || p.port > 65535 {
+			problem("invalid %s %d: must be between 1 and 65535", p.name, p.port)
+		}
+	}
+
+	switch c.Database.Driver {
+	case DriverPostgres:
+	case DriverSQLite:
+		if c.Database.Path == "" {
+			problem("DB_PATH is required with DB_DRIVER=%s", DriverSQLite)
+		}
+	default:
+		problem("invalid DB_DRIVER %q: must be %s or %s", c.Database.Driver, DriverPostgres, DriverSQLite)
+	}
+
+	switch c.Auth.Cookies.SameSite {
+	case "lax", "strict":
+	case "none":
+		if !c.Auth.Cookies.Secure {
+			problem("AUTH_COOKIE_SAMESITE=none requires AUTH_COOKIE_SECURE=true")
+		}
+	default:
+		problem("invalid AUTH_COOKIE_SAMESITE %q: must be lax, strict or none", c.Auth.Cookies.SameSite)
+	}
+
+	for _, provider := range c.Auth.Providers {
+		if provider.Issuer == "" || provider.ClientID == "" {
+			problem("OpenID Connect provider %q needs an issuer and a client ID", provider.Name)
+		}
+	}
+
+	switch c.Mail.Sender {
+	case MailSMTP:
+		if c.Mail.SMTP.Host == "" {
+			problem("SMTP_HOST is required with MAIL_SENDER=%s", MailSMTP)
+		}
+		if c.Mail.SMTP.Port < 1 || c.Mail.SMTP.Port > 65535 {
+			problem("invalid SMTP_PORT %d: must be between 1 and 65535", c.Mail.SMTP.Port)
+		}
+	case MailFile:
+		if c.Mail.CaptureDir == "" {
+			problem("MAIL_CAPTURE_DIR is required with MAIL_SENDER=%s", MailFile)
+		}
+	case MailMemory:
+	default:
+		problem("invalid MAIL_SENDER %q: must be %s, %s or %s", c.Mail.Sender, MailSMTP, MailFile, MailMemory)
+	}
+	switch c.Payments.Provider {
+	case "", payments.ProviderFake:
+	case payments.ProviderStripe:
+		if c.Payments.APIKey == "" {
+			problem("PAYMENTS_API_KEY is required with PAYMENTS_PROVIDER=%s", payments.ProviderStripe)
+		}
+	default:
+		problem("invalid PAYMENTS_PROVIDER %q: must be one of %s", c.Payments.Provider, strings.Join(payments.Providers, ", "))
+	}
+
+	if _, err := mail.ParseAddress(c.Mail.From); err != nil {
+		problem("invalid MAIL_FROM %q: %v", c.Mail.From, err)
+	}
+
+	if c.Production() {
+		if c.Auth.JWTSecret == "" || c.Auth.JWTSecret == DevelopmentJWTSecret {
+			problem("JWT_SECRET must be set in production")
+		} else if len(c.Auth.JWTSecret) < 32 {
+			problem("JWT_SECRET must be at least 32 bytes in production")
+		}
+		if c.Auth.FakeIssuer {
+			problem("AUTH_FAKE_ISSUER must be off in production")
+		}
+		for _, provider := range c.Auth.Providers {
+			if provider.ClientSecret == "" {
+				problem("OpenID Connect provider %q needs a client secret in production", provider.Name)
+			}
+		}
+		if c.Payments.Provider == "" || c.Payments.Provider == payments.ProviderFake {
+			problem("PAYMENTS_PROVIDER must be %s in production, not the fake provider", payments.ProviderStripe)
+		}
+		if c.Payments.WebhookSecret == "" {
+			problem("PAYMENTS_WEBHOOK_SECRET must be set in production")
+		}
+		if c.Mail.Sender != MailSMTP {
+			problem("MAIL_SENDER must be %s in production, or emails are never delivered", MailSMTP)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(problems...))
+	}
+	return nil
+}
+
+// Production reports whether the configuration is for production
+func (c *Config) Production() bool {
+	return c.Environment == EnvProduction
+}
+
+// Redact returns a copy of the configuration with its secrets replaced by
+// Redacted, safe to print or log. Unset secrets stay empty, to show they
+// are missing.
+func (c *Config) Redact() *Config {
+	redacted := *c
+	redact := func(secret *string) {
+		if *secret != "" {
+			*secret = Redacted
+		}
+	}
+
+	redact(&redacted.Database.Password)
+	redact(&redacted.Auth.GoogleClientSecret)
+	redact(&redacted.Auth.JWTSecret)
+	redact(&redacted.Maps.APIKey)
+	redact(&redacted.Payments.APIKey)
+	redact(&redacted.Payments.WebhookSecret)
+	redact(&redacted.Mail.SMTP.Password)
+
+	redacted.Auth.Providers = append([]OIDCProviderConfig(nil), c.Auth.Providers...)
+	for i := range redacted.Auth.Providers {
+		redact(&redacted.Auth.Providers[i].ClientSecret)
+	}
+	return &redacted
+}
@@ -0,0 +1,169 @@
+// pickle/backend/db/migrate_test.go
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// migrationFS returns a filesystem holding migration files with the given
+// names, each containing its own name
+func migrationFS(names ...string) fstest.MapFS {
+	fsys := make(fstest.MapFS)
+	for _, name := range names {
+		fsys["migrations/"+name] = &fstest.MapFile{Data: []byte(name)}
+	}
+	return fsys
+}
+
+func TestReadMigrations(t *testing.T) {
+	migrations, err := readMigrations(migrationFS(
+		"0010_later.up.sql", "0010_later.down.sql",
+		"0002_second.down.sql", "0002_second.up.sql",
+		"0009_ninth.up.sql", "0009_ninth.down.sql",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Versions are ordered by number, not by name
+	var got []string
+	for _, m := range migrations {
+		got = append(got, fmt.Sprintf("%d_%s", m.Version, m.Name))
+	}
+	if strings.Join(got, " ") != "2_second 9_ninth 10_later" {
+		t.Errorf("read %v, expected 2_second 9_ninth 10_later", got)
+	}
+	if m := migrations[0]; m.Up != "0002_second.up.sql" || m.Down != "0002_second.down.sql" {
+		t.Errorf("migration 2 is up %q and down %q", m.Up, m.Down)
+	}
+
+	invalid := map[string]fstest.MapFS{
+		"a badly named file":     migrationFS("0001_first.up.sql", "0001_first.down.sql", "first.sql"),
+		"a missing down file":    migrationFS("0001_first.up.sql"),
+		"a missing up file":      migrationFS("0001_first.down.sql"),
+		"two names of a version": migrationFS("0001_first.up.sql", "0001_other.down.sql"),
+	}
+	for name, fsys := range invalid {
+		if _, err := readMigrations(fsys); err == nil {
+			t.Errorf("read migrations with %s", name)
+		}
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// New migrations take the next version
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %d_%s should be version %d", m.Version, m.Name, i+1)
+		}
+	}
+}
+
+// TestMigrateUp applies the migrations, from two connections at once and
+// then again, to a new empty schema of the database at DATABASE_URL, which
+// must have the extensions the migrations create. The schema is dropped
+// afterwards.
+func TestMigrateUp(t *testing.T) {
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	schema := fmt.Sprintf("migrate_test_%d", time.Now().UnixNano())
+	if _, err := admin.ExecContext(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatal(err)
+	}
+	defer admin.ExecContext(ctx, "DROP SCHEMA "+schema+" CASCADE")
+
+	// The connection creates its tables in the schema, finding the
+	// extensions in public
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema+",public")
+	u.RawQuery = query.Encode()
+	conn, err := sql.Open("postgres", u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The advisory lock lets only one of two servers apply each migration
+	var wg sync.WaitGroup
+	applied := make([][]Migration, 2)
+	errs := make([]error, 2)
+	for i := range applied {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			applied[i], errs[i] = MigrateUp(ctx, conn, 0)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(applied[0]) + len(applied[1]); n != len(migrations) {
+		t.Errorf("applied %d migrations, expected each of the %d once", n, len(migrations))
+	}
+	if err := CheckMigrations(ctx, conn); err != nil {
+		t.Errorf("check after migrating: %v", err)
+	}
+
+	// Applying again is a no-op
+	again, err := MigrateUp(ctx, conn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != 0 {
+		t.Errorf("applied %d migrations again", len(again))
+	}
+	statuses, err := Status(ctx, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range statuses {
+		if s.AppliedAt == nil {
+			t.Errorf("migration %d_%s is not applied", s.Version, s.Name)
+		}
+	}
+
+	// A migration the build does not know fails the check
+	_, err = conn.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, 'future')",
+		len(migrations)+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckMigrations(ctx, conn); err == nil {
+		t.Error("a database with an unknown migration passed the check")
+	}
+}
@@ -0,0 +1,28 @@
+-- pickle/backend/db/migrations/0001_initial_schema.down.sql
+-- Drops every table, and all data with them
+
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS magic_links;
+DROP TABLE IF EXISTS user_identities;
+DROP TABLE IF EXISTS login_codes;
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS payments;
+DROP TABLE IF EXISTS waitlist_entries;
+DROP TABLE IF EXISTS bookings;
+DROP TABLE IF EXISTS booking_series;
+DROP TABLE IF EXISTS court_staff;
+DROP TABLE IF EXISTS court_cancellation_policies;
+DROP TABLE IF EXISTS court_members;
+DROP TABLE IF EXISTS court_peak_rates;
+DROP TABLE IF EXISTS court_rates;
+DROP TABLE IF EXISTS court_blackouts;
+DROP TABLE IF EXISTS court_hour_exceptions;
+DROP TABLE IF EXISTS court_opening_hours;
+DROP TABLE IF EXISTS court_units;
+DROP TABLE IF EXISTS courts;
+DROP TABLE IF EXISTS users;
+
+DROP EXTENSION IF EXISTS btree_gist;
+DROP EXTENSION IF EXISTS earthdistance;
+DROP EXTENSION IF EXISTS cube;
@@ -0,0 +1,326 @@
+-- pickle/backend/db/migrations/0001_initial_schema.up.sql
+-- The schema as it was created by createTables and db/setup.sql. Everything
+-- is created if missing, so databases set up before migrations adopt it as is.
+
+-- Create required extensions
+CREATE EXTENSION IF NOT EXISTS earthdistance CASCADE;
+CREATE EXTENSION IF NOT EXISTS cube CASCADE;
+CREATE EXTENSION IF NOT EXISTS btree_gist;
+
+-- Create users table
+CREATE TABLE IF NOT EXISTS users (
+    id VARCHAR(255) PRIMARY KEY,
+    email VARCHAR(255) NOT NULL UNIQUE,
+    name VARCHAR(255) NOT NULL,
+    picture TEXT,
+    platform_admin BOOLEAN NOT NULL DEFAULT false, -- May manage every facility
+    service_account BOOLEAN NOT NULL DEFAULT false, -- Acts for a facility through API keys
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create courts table
+CREATE TABLE IF NOT EXISTS courts (
+    id VARCHAR(255) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    address TEXT NOT NULL,
+    latitude FLOAT NOT NULL,
+    longitude FLOAT NOT NULL,
+    number_of_courts INT NOT NULL,
+    amenities TEXT[],
+    image_url TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    archived_at TIMESTAMP -- Archived facilities no longer take bookings
+);
+
+-- Create court units table (the individual courts inside a facility)
+CREATE TABLE IF NOT EXISTS court_units (
+    id VARCHAR(255) PRIMARY KEY,
+    court_id VARCHAR(255) NOT NULL REFERENCES courts(id),
+    name VARCHAR(255) NOT NULL,
+    position INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    archived_at TIMESTAMP, -- Set when the facility's number of courts is lowered
+    UNIQUE(court_id, position)
+);
+
+-- Create weekly opening hours table (weekday 0 = Sunday; a facility without
+-- rows is open during the default hours, otherwise missing days are closed)
+CREATE TABLE IF NOT EXISTS court_opening_hours (
+    court_id VARCHAR(255) NOT NULL REFERENCES courts(id),
+    weekday INT NOT NULL CHECK (weekday BETWEEN 0 AND 6),
+    open_time TIME NOT NULL,
+    close_time TIME NOT NULL CHECK (close_time > open_time),
+    PRIMARY KEY (court_id, weekday)
+);
+
+-- Create opening hours exceptions table (holidays, special hours)
+CREATE TABLE IF NOT EXISTS court_hour_exceptions (
+    court_id VARCHAR(255) NOT NULL REFERENCES courts(id),
+    date DATE NOT NULL,
+    closed BOOLEAN NOT NULL DEFAULT FALSE,
+    open_time TIME,
+    close_time TIME,
+    reason TEXT,
+    PRIMARY KEY (court_id, date),
+    CHECK (closed OR (open_time IS NOT NULL AND close_time > open_time))
+);
+
+-- Create blackouts table (resurfacing, private events)
+CREATE TABLE IF NOT EXISTS court_blackouts (
+    id VARCHAR(255) PRIMARY KEY,
+    court_id VARCHAR(255) NOT NULL REFERENCES courts(id),
+    court_unit_id VARCHAR(255) REFERENCES court_units(id),
+    starts_at TIMESTAMP NOT NULL,
+    ends_at TIMESTAMP NOT NULL CHECK (ends_at > starts_at),
+    reason TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create price list tables; rates are hourly, in the smallest currency unit
+CREATE TABLE IF NOT EXISTS court_rates (
+    court_id VARCHAR(255) PRIMARY KEY REFERENCES courts(id),
+    currency CHAR(3) NOT NULL DEFAULT 'USD',
+    guest_rate_cents BIGINT NOT NULL CHECK (guest_rate_cents >= 0),
+    member_rate_cents BIGINT NOT NULL CHECK (member_rate_cents >= 0),
+    min_duration_minutes INT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS court_peak_rates (
+    court_id VARCHAR(255) NOT NULL REFERENCES courts(id),
+    weekday INT NOT NULL CHECK (weekday BETWEEN 0 AND 6),
+    start_time TIME NOT NULL,
+    end_time TIME NOT NULL CHECK (end_time > start_time),
+    guest_rate_cents BIGINT NOT NULL CHECK (guest_rate_cents >= 0),
+    member_rate_cents BIGINT NOT NULL CHECK (member_rate_cents >= 0),
+    PRIMARY KEY (court_id, weekday, start_time)
+);
+
+-- Members of a facility are charged the member rates
+CREATE TABLE IF NOT EXISTS court_members (
+    court_id VARCHAR(255) NOT NULL REFERENCES courts(id),
+    user_id VARCHAR(255) NOT NULL REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (court_id, user_id)
+);
+
+-- Create cancellation policy table; windows are in hours before the start of
+-- a booking. A facility without a policy allows free cancellation until the
+-- booking starts.
+CREATE TABLE IF NOT EXISTS court_cancellation_policies (
+    court_id VARCHAR(255) PRIMARY KEY REFERENCES courts(id),
+    free_until_hours INT NOT NULL DEFAULT 0 CHECK (free_until_hours >= 0),
+    partial_refund_until_hours INT NOT NULL DEFAULT 0 CHECK (partial_refund_until_hours >= 0),
+    partial_refund_percent INT NOT NULL DEFAULT 0 CHECK (partial_refund_percent BETWEEN 0 AND 100),
+    no_cancel_hours INT NOT NULL DEFAULT 0 CHECK (no_cancel_hours >= 0),
+    no_show_fee_percent INT NOT NULL DEFAULT 100 CHECK (no_show_fee_percent BETWEEN 0 AND 100)
+);
+
+-- Staff of a facility see and manage all of its bookings and may mark them
+-- as no-shows; facility admins may also manage the facility itself
+CREATE TABLE IF NOT EXISTS court_staff (
+    court_id VARCHAR(255) NOT NULL REFERENCES courts(id),
+    user_id VARCHAR(255) NOT NULL REFERENCES users(id),
+    role VARCHAR(20) NOT NULL DEFAULT 'staff' CHECK (role IN ('staff', 'facility_admin')),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (court_id, user_id)
+);
+
+-- Create recurring booking series table
+CREATE TABLE IF NOT EXISTS booking_series (
+    id VARCHAR(255) PRIMARY KEY,
+    court_id VARCHAR(255) NOT NULL REFERENCES courts(id),
+    court_unit_id VARCHAR(255) REFERENCES court_units(id),
+    user_id VARCHAR(255) NOT NULL REFERENCES users(id),
+    rrule TEXT NOT NULL,
+    start_date DATE NOT NULL,
+    start_time TIME NOT NULL,
+    end_time TIME NOT NULL,
+    number_of_players INT NOT NULL,
+    player_emails TEXT[],
+    status VARCHAR(20) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create bookings table
+CREATE TABLE IF NOT EXISTS bookings (
+    id VARCHAR(255) PRIMARY KEY,
+    court_id VARCHAR(255) REFERENCES courts(id),
+    court_unit_id VARCHAR(255) REFERENCES court_units(id),
+    series_id VARCHAR(255) REFERENCES booking_series(id),
+    user_id VARCHAR(255) REFERENCES users(id),
+    date DATE NOT NULL,
+    start_time TIME NOT NULL,
+    end_time TIME NOT NULL,
+    number_of_players INT NOT NULL,
+    player_emails TEXT[],
+    price_cents BIGINT NOT NULL DEFAULT 0,
+    currency CHAR(3) NOT NULL DEFAULT 'USD',
+    status VARCHAR(20) NOT NULL,
+    hold_expires_at TIMESTAMP, -- PENDING bookings hold their slot until then
+    cancellation_rule VARCHAR(20) NOT NULL DEFAULT '', -- Set when cancelled or marked as a no-show
+    cancellation_fee_cents BIGINT NOT NULL DEFAULT 0,
+    cancelled_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    -- Active bookings may not overlap on the same unit
+    CONSTRAINT bookings_no_overlap EXCLUDE USING gist (
+        court_unit_id WITH =,
+        tsrange(date + start_time, date + end_time) WITH &&
+    ) WHERE (status != 'CANCELLED')
+);
+
+CREATE INDEX IF NOT EXISTS bookings_series_id_idx ON bookings (series_id);
+CREATE INDEX IF NOT EXISTS bookings_pending_hold_idx ON bookings (hold_expires_at) WHERE status = 'PENDING';
+
+-- Create waitlist table; an offer holds the freed slot as a PENDING booking
+CREATE TABLE IF NOT EXISTS waitlist_entries (
+    id VARCHAR(255) PRIMARY KEY,
+    court_id VARCHAR(255) NOT NULL REFERENCES courts(id),
+    court_unit_id VARCHAR(255) REFERENCES court_units(id),
+    user_id VARCHAR(255) NOT NULL REFERENCES users(id),
+    date DATE NOT NULL,
+    start_time TIME NOT NULL,
+    end_time TIME NOT NULL,
+    number_of_players INT NOT NULL,
+    player_emails TEXT[],
+    status VARCHAR(20) NOT NULL,
+    booking_id VARCHAR(255) REFERENCES bookings(id),
+    offer_expires_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS waitlist_entries_slot_idx ON waitlist_entries (court_id, date, status);
+
+-- Create payments table. A booking has at most one payment that still holds
+-- or may still collect money.
+CREATE TABLE IF NOT EXISTS payments (
+    id VARCHAR(255) PRIMARY KEY,
+    booking_id VARCHAR(255) NOT NULL REFERENCES bookings(id),
+    provider VARCHAR(50) NOT NULL,
+    provider_intent_id VARCHAR(255) NOT NULL,
+    amount_cents BIGINT NOT NULL,
+    refunded_cents BIGINT NOT NULL DEFAULT 0,
+    currency CHAR(3) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (provider, provider_intent_id)
+);
+
+CREATE INDEX IF NOT EXISTS payments_booking_id_idx ON payments (booking_id);
+CREATE UNIQUE INDEX IF NOT EXISTS payments_active_booking_idx ON payments (booking_id)
+    WHERE status IN ('REQUIRES_PAYMENT', 'AUTHORIZED', 'CAPTURED', 'PARTIALLY_REFUNDED');
+
+-- Create login sessions table
+CREATE TABLE IF NOT EXISTS sessions (
+    id VARCHAR(255) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL REFERENCES users(id),
+    user_agent TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP,
+    revoked_reason VARCHAR(20) -- LOGOUT, LOGOUT_ALL or REUSE
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
+
+-- Create refresh tokens table; only hashes are stored, and a token is spent
+-- once used_at is set
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    token_hash CHAR(64) PRIMARY KEY,
+    session_id VARCHAR(255) NOT NULL REFERENCES sessions(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_session_id_idx ON refresh_tokens (session_id);
+
+-- Create login codes table, for the codes the frontend redeems for the first
+-- access token of a session; only hashes are stored
+CREATE TABLE IF NOT EXISTS login_codes (
+    code_hash CHAR(64) PRIMARY KEY,
+    session_id VARCHAR(255) NOT NULL REFERENCES sessions(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+-- Create user identities table, linking the accounts users log in with at
+-- identity providers to our users
+CREATE TABLE IF NOT EXISTS user_identities (
+    provider VARCHAR(50) NOT NULL, -- e.g. google, or email for magic links
+    subject VARCHAR(255) NOT NULL,
+    user_id VARCHAR(255) NOT NULL REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (provider, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities (user_id);
+
+-- Create magic links table; only hashes are stored, and a link is spent once
+-- used_at is set
+CREATE TABLE IF NOT EXISTS magic_links (
+    token_hash CHAR(64) PRIMARY KEY,
+    email VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+-- Create API keys table; only hashes of secrets are stored
+CREATE TABLE IF NOT EXISTS api_keys (
+    id VARCHAR(16) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL REFERENCES users(id),
+    court_id VARCHAR(255) REFERENCES courts(id), -- Facility of service account keys
+    name VARCHAR(255) NOT NULL,
+    secret_hash CHAR(64) NOT NULL,
+    scopes TEXT[] NOT NULL,
+    rate_limit INT NOT NULL, -- Requests per minute
+    created_by VARCHAR(255) NOT NULL REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP,
+    expires_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_user_id_idx ON api_keys (user_id);
+CREATE INDEX IF NOT EXISTS api_keys_court_id_idx ON api_keys (court_id);
+
+-- Bring databases created by earlier versions of createTables up to date
+ALTER TABLE users ADD COLUMN IF NOT EXISTS platform_admin BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS service_account BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE courts ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+ALTER TABLE courts ADD COLUMN IF NOT EXISTS archived_at TIMESTAMP;
+ALTER TABLE court_units ADD COLUMN IF NOT EXISTS archived_at TIMESTAMP;
+ALTER TABLE court_staff ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'staff'
+    CHECK (role IN ('staff', 'facility_admin'));
+
+INSERT INTO court_units (id, court_id, name, position)
+SELECT c.id || '-' || n, c.id, 'Court ' || n, n
+FROM courts c, generate_series(1, c.number_of_courts) AS n
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE bookings ADD COLUMN IF NOT EXISTS court_unit_id VARCHAR(255) REFERENCES court_units(id);
+ALTER TABLE bookings ADD COLUMN IF NOT EXISTS series_id VARCHAR(255) REFERENCES booking_series(id);
+ALTER TABLE bookings ADD COLUMN IF NOT EXISTS hold_expires_at TIMESTAMP;
+ALTER TABLE bookings ADD COLUMN IF NOT EXISTS price_cents BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE bookings ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD';
+ALTER TABLE bookings ADD COLUMN IF NOT EXISTS cancellation_rule VARCHAR(20) NOT NULL DEFAULT '';
+ALTER TABLE bookings ADD COLUMN IF NOT EXISTS cancellation_fee_cents BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE bookings ADD COLUMN IF NOT EXISTS cancelled_at TIMESTAMP;
+UPDATE bookings SET court_unit_id = court_id || '-1' WHERE court_unit_id IS NULL;
+ALTER TABLE bookings DROP CONSTRAINT IF EXISTS bookings_court_id_date_start_time_key;
+ALTER TABLE bookings DROP CONSTRAINT IF EXISTS bookings_court_unit_id_date_start_time_key;
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'bookings_no_overlap') THEN
+        ALTER TABLE bookings ADD CONSTRAINT bookings_no_overlap EXCLUDE USING gist (
+            court_unit_id WITH =,
+            tsrange(date + start_time, date + end_time) WITH &&
+        ) WHERE (status != 'CANCELLED');
+    END IF;
+END $$;
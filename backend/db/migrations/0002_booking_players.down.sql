@@ -0,0 +1,15 @@
+-- pickle/backend/db/migrations/0002_booking_players.down.sql
+-- Puts the rosters back in bookings.player_emails; answers are lost
+
+ALTER TABLE bookings ADD COLUMN IF NOT EXISTS player_emails TEXT[];
+
+UPDATE bookings b
+SET player_emails = (
+    SELECT array_agg(p.email ORDER BY p.position)
+    FROM booking_players p
+    WHERE p.booking_id = b.id
+);
+
+DROP TABLE IF EXISTS booking_players;
+
+ALTER TABLE courts DROP COLUMN IF EXISTS max_players;
@@ -0,0 +1,34 @@
+-- pickle/backend/db/migrations/0002_booking_players.up.sql
+-- Moves the players invited to a booking from bookings.player_emails to a
+-- roster linking each of them to their user, when registered, with their
+-- answer. Facilities get the number of players a court holds.
+
+ALTER TABLE courts ADD COLUMN IF NOT EXISTS max_players INT NOT NULL DEFAULT 4 CHECK (max_players > 0);
+
+-- The players of a booking besides its organizer, in the order they were
+-- listed. Guests have no user_id.
+CREATE TABLE IF NOT EXISTS booking_players (
+    booking_id VARCHAR(255) NOT NULL REFERENCES bookings(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    user_id VARCHAR(255) REFERENCES users(id),
+    position INT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'INVITED' CHECK (status IN ('INVITED', 'ACCEPTED', 'DECLINED')),
+    responded_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (booking_id, email)
+);
+
+CREATE INDEX IF NOT EXISTS booking_players_user_id_idx ON booking_players (user_id);
+
+-- Existing lists keep their order; repeated emails are listed once
+INSERT INTO booking_players (booking_id, email, user_id, position)
+SELECT DISTINCT ON (p.booking_id, p.email) p.booking_id, p.email, u.id, p.position
+FROM (
+    SELECT b.id AS booking_id, lower(trim(e.email)) AS email, e.position
+    FROM bookings b, unnest(b.player_emails) WITH ORDINALITY AS e(email, position)
+    WHERE trim(e.email) != ''
+) p
+LEFT JOIN users u ON lower(u.email) = p.email
+ORDER BY p.booking_id, p.email, p.position;
+
+ALTER TABLE bookings DROP COLUMN IF EXISTS player_emails;
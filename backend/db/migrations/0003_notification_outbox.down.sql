@@ -0,0 +1,2 @@
+-- pickle/backend/db/migrations/0003_notification_outbox.down.sql
+DROP TABLE IF EXISTS notification_outbox;
@@ -0,0 +1,21 @@
+-- pickle/backend/db/migrations/0003_notification_outbox.up.sql
+-- Emails are queued in an outbox in the database and delivered in the
+-- background, so a mail server failure never fails the request that caused
+-- the email; failed deliveries are retried with backoff.
+
+CREATE TABLE IF NOT EXISTS notification_outbox (
+    id VARCHAR(255) PRIMARY KEY,
+    kind VARCHAR(50) NOT NULL,
+    recipient VARCHAR(255) NOT NULL,
+    subject TEXT NOT NULL,
+    body TEXT NOT NULL,
+    dedup_key VARCHAR(255) UNIQUE, -- Messages with a key are queued once, e.g. reminders
+    status VARCHAR(20) NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'SENT', 'FAILED')),
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    sent_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS notification_outbox_pending_idx ON notification_outbox (next_attempt_at) WHERE status = 'PENDING';
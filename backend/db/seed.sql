@@ -0,0 +1,67 @@
+-- pickle/backend/db/seed.sql
+-- Sample facilities and users for development. Apply the migrations first
+-- (go run . migrate up), then run this script on the database:
+--   psql -U postgres -d pickle -f db/seed.sql
+
+-- Insert sample court data
+INSERT INTO courts (id, name, address, latitude, longitude, number_of_courts, amenities, image_url, created_at)
+VALUES 
+    ('court-1', 'Downtown Padel Club', '123 Main St, Seattle, WA 98101', 47.6062, -122.3321, 4, 
+     ARRAY['Parking', 'Restrooms', 'Pro Shop', 'Lessons'], 'https://example.com/downtown.jpg', CURRENT_TIMESTAMP),
+    ('court-2', 'Eastside Padel Center', '456 Park Ave, Bellevue, WA 98004', 47.6101, -122.2015, 6, 
+     ARRAY['Parking', 'Restrooms', 'Pro Shop', 'Lessons', 'Cafe'], 'https://example.com/eastside.jpg', CURRENT_TIMESTAMP)
+ON CONFLICT (id) DO NOTHING;
+
+-- Create one unit per court for every facility
+INSERT INTO court_units (id, court_id, name, position)
+SELECT c.id || '-' || n, c.id, 'Court ' || n, n
+FROM courts c, generate_series(1, c.number_of_courts) AS n
+ON CONFLICT DO NOTHING;
+
+-- Open every facility from 07:00 to 22:00, and 08:00 to 20:00 on Sundays
+INSERT INTO court_opening_hours (court_id, weekday, open_time, close_time)
+SELECT c.id, d, CASE WHEN d = 0 THEN TIME '08:00' ELSE TIME '07:00' END,
+       CASE WHEN d = 0 THEN TIME '20:00' ELSE TIME '22:00' END
+FROM courts c, generate_series(0, 6) AS d
+ON CONFLICT DO NOTHING;
+
+-- Charge $40/hour ($30 for members), with peak rates of $56/hour ($42 for
+-- members) on weekday evenings and weekend mornings
+INSERT INTO court_rates (court_id, currency, guest_rate_cents, member_rate_cents, min_duration_minutes)
+SELECT c.id, 'USD', 4000, 3000, 60
+FROM courts c
+ON CONFLICT DO NOTHING;
+
+INSERT INTO court_peak_rates (court_id, weekday, start_time, end_time, guest_rate_cents, member_rate_cents)
+SELECT c.id, d, CASE WHEN d IN (0, 6) THEN TIME '08:00' ELSE TIME '17:00' END,
+       CASE WHEN d IN (0, 6) THEN TIME '12:00' ELSE TIME '21:00' END, 5600, 4200
+FROM courts c, generate_series(0, 6) AS d
+ON CONFLICT DO NOTHING;
+
+-- Insert sample user data
+INSERT INTO users (id, email, name, picture, created_at)
+VALUES 
+    ('user-1', 'alice@example.com', 'Alice Smith', 'https://example.com/alice.jpg', CURRENT_TIMESTAMP),
+    ('user-2', 'bob@example.com', 'Bob Johnson', 'https://example.com/bob.jpg', CURRENT_TIMESTAMP),
+    ('user-3', 'carol@example.com', 'Carol Davis', 'https://example.com/carol.jpg', CURRENT_TIMESTAMP)
+ON CONFLICT (id) DO NOTHING;
+
+-- Alice is a member of the Downtown Padel Club
+INSERT INTO court_members (court_id, user_id)
+VALUES ('court-1', 'user-1')
+ON CONFLICT DO NOTHING;
+
+-- The Downtown Padel Club cancels for free until 24 hours before the start,
+-- refunds half until 6 hours before, and refuses cancellations in the last
+-- 2 hours; no-shows pay in full
+INSERT INTO court_cancellation_policies (court_id, free_until_hours, partial_refund_until_hours,
+    partial_refund_percent, no_cancel_hours, no_show_fee_percent)
+VALUES ('court-1', 24, 6, 50, 2, 100)
+ON CONFLICT DO NOTHING;
+
+-- Bob works at the Downtown Padel Club, which Carol runs
+INSERT INTO court_staff (court_id, user_id, role)
+VALUES
+    ('court-1', 'user-2', 'staff'),
+    ('court-1', 'user-3', 'facility_admin')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,94 @@
+// pickle/backend/migrate.go
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/carlostbanks/pickle/config"
+	"github.com/carlostbanks/pickle/db"
+)
+
+// migrateUsage describes the migrate command
+const migrateUsage = `Usage: pickle migrate <command> [flags]
+
+Commands:
+  up [-to version]   Apply pending migrations, up to version if given
+  down [-steps n]    Roll back the last n applied migrations (default 1)
+  status             List migrations and when they were applied
+`
+
+// runMigrate runs the migrate command with its arguments, exiting with a
+// non-zero status on failure
+func runMigrate(cfg *config.Config, args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet("migrate "+args[0], flag.ExitOnError)
+	to := flags.Int("to", 0, "Version to migrate up to (default all)")
+	steps := flags.Int("steps", 1, "Number of migrations to roll back")
+	flags.Parse(args[1:])
+
+	if cfg.Database.Driver != config.DriverPostgres {
+		log.Fatalf("Migrations only apply to Postgres; %s databases get their schema when the server opens them", cfg.Database.Driver)
+	}
+
+	conn, err := db.Open(cfg.Database)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer conn.Close()
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		applied, err := db.MigrateUp(ctx, conn, *to)
+		for _, migration := range applied {
+			log.Printf("Applied migration %d_%s", migration.Version, migration.Name)
+		}
+		if err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		if len(applied) == 0 {
+			log.Println("No pending migrations")
+		}
+
+	case "down":
+		if *steps < 1 {
+			log.Fatalf("-steps must be at least 1")
+		}
+		rolledBack, err := db.MigrateDown(ctx, conn, *steps)
+		for _, migration := range rolledBack {
+			log.Printf("Rolled back migration %d_%s", migration.Version, migration.Name)
+		}
+		if err != nil {
+			log.Fatalf("Rollback failed: %v", err)
+		}
+		if len(rolledBack) == 0 {
+			log.Println("No applied migrations")
+		}
+
+	case "status":
+		statuses, err := db.Status(ctx, conn)
+		if err != nil {
+			log.Fatalf("Failed to get migration status: %v", err)
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%-30s %s\n", status.Version, status.Name, applied)
+		}
+
+	default:
+		fmt.Fprint(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,86 @@
+// pickle/backend/notifications/notifications.go
+package notifications
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// Kinds of emails, each rendered from the template of the same name
+const (
+	KindBookingConfirmed = "booking_confirmed" // To the organizer of a new booking
+	KindBookingChanged   = "booking_changed"   // To everyone playing when a booking is changed
+	KindBookingCancelled = "booking_cancelled" // To everyone playing when a booking is cancelled
+	KindBookingReminder  = "booking_reminder"  // To everyone playing, shortly before the start
+	KindInvitation       = "invitation"        // To an invited player, with their RSVP link
+	KindWaitlistOffer    = "waitlist_offer"    // To a waitlisted user offered a slot, until it expires
+)
+
+//go:embed templates/*.tmpl
+var templateFiles embed.FS
+
+// templates are the parsed templates, by kind
+var templates = parseTemplates(KindBookingConfirmed, KindBookingChanged, KindBookingCancelled, KindBookingReminder,
+	KindInvitation, KindWaitlistOffer)
+
+// parseTemplates parses the template of each kind, which defines its
+// "subject" and "body" with the shared "booking" template
+func parseTemplates(kinds ...string) map[string]*template.Template {
+	parsed := make(map[string]*template.Template, len(kinds))
+	for _, kind := range kinds {
+		parsed[kind] = template.Must(template.ParseFS(templateFiles, "templates/booking.tmpl", "templates/"+kind+".tmpl"))
+	}
+	return parsed
+}
+
+// Message is an email ready to be sent
+type Message struct {
+	Kind    string
+	To      string
+	Subject string
+	Body    string // Plain text
+	Key     string // Optional; the outbox queues one message per key
+}
+
+// Data is what the templates say about bookings. Bookings of a series are
+// told about together, so there may be several dates.
+type Data struct {
+	CourtName     string
+	CourtAddress  string
+	OrganizerName string
+	Dates         []string // ISO format dates
+	StartTime     string   // 24-hour format HH:MM
+	EndTime       string   // 24-hour format HH:MM
+	Link          string   // Where to see the booking, or answer an invitation
+	ExpiresAt     string   // When a waitlist offer lapses, "2006-01-02 15:04"
+}
+
+// Render renders the email of a kind to a recipient
+func Render(kind, to string, data Data) (*Message, error) {
+	t, ok := templates[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown kind of email %q", kind)
+	}
+	if len(data.Dates) == 0 {
+		return nil, fmt.Errorf("%s email without a date", kind)
+	}
+
+	var subject, body bytes.Buffer
+	if err := t.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := t.ExecuteTemplate(&body, "body", data); err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		Kind: kind,
+		To:   to,
+		// Subjects are headers, which must stay on one line
+		Subject: strings.Join(strings.Fields(subject.String()), " "),
+		Body:    strings.TrimLeft(body.String(), "\n"),
+	}, nil
+}
@@ -0,0 +1,59 @@
+// pickle/backend/notifications/notifications_test.go
+package notifications
+
+import (
+	"strings"
+	"testing"
+)
+
+// kinds are every kind of email
+var kinds = []string{
+	KindBookingConfirmed,
+	KindBookingChanged,
+	KindBookingCancelled,
+	KindBookingReminder,
+	KindInvitation,
+	KindWaitlistOffer,
+}
+
+// sampleData describes a booking of a series for the templates
+func sampleData() Data {
+	return Data{
+		CourtName:     "Riverside Court 1",
+		CourtAddress:  "1 River Road, Springfield",
+		OrganizerName: "Ana Organizer",
+		Dates:         []string{"2030-06-01", "2030-06-08"},
+		StartTime:     "18:00",
+		EndTime:       "19:30",
+		Link:          "http://localhost:3000/invitations/sample",
+		ExpiresAt:     "2030-05-31 18:15",
+	}
+}
+
+func TestRender(t *testing.T) {
+	data := sampleData()
+	for _, kind := range kinds {
+		t.Run(kind, func(t *testing.T) {
+			msg, err := Render(kind, "player@example.com", data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Subject == "" || strings.Contains(msg.Subject, "\n") {
+				t.Errorf("subject %q is not a single line", msg.Subject)
+			}
+			for _, want := range []string{data.CourtName, data.CourtAddress, data.Dates[1], data.StartTime, data.EndTime, data.Link} {
+				if !strings.Contains(msg.Body, want) {
+					t.Errorf("body does not mention %q:\n%s", want, msg.Body)
+				}
+			}
+		})
+	}
+
+	if _, err := Render("unknown", "player@example.com", data); err == nil {
+		t.Error("rendered an unknown kind")
+	}
+	data.Dates = nil
+	if _, err := Render(KindBookingConfirmed, "player@example.com", data); err == nil {
+		t.Error("rendered an email without a date")
+	}
+}
@@ -0,0 +1,144 @@
+// pickle/backend/notifications/outbox.go
+package notifications
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	// MaxAttempts is how many times a message is tried before it is given
+	// up as FAILED
+	MaxAttempts = 8
+
+	// deliveryBatch is how many messages a delivery claims at a time
+	deliveryBatch = 20
+
+	// deliveryLease is how long claimed messages are kept from other
+	// deliveries. It outlasts a batch of sends timing out, so only messages
+	// of a delivery that stopped are claimed again.
+	deliveryLease = 15 * time.Minute
+
+	// maxRetryDelay bounds the backoff between attempts
+	maxRetryDelay = 6 * time.Hour
+)
+
+// Queued is a message claimed from the outbox for an attempt to send it
+type Queued struct {
+	Message
+	ID      string
+	Attempt int // Counting from 1
+}
+
+// Queue keeps the messages of an outbox; see storage.OutboxRepository,
+// which also queues them, for the details
+type Queue interface {
+	// ClaimMessages claims up to limit messages due by at for a lease
+	ClaimMessages(ctx context.Context, at time.Time, lease time.Duration, limit int) ([]*Queued, error)
+
+	// MarkSent records that a message was sent
+	MarkSent(ctx context.Context, id string, at time.Time) error
+
+	// MarkFailed records a failed attempt, to be retried at retryAt or,
+	// if it is zero, given up
+	MarkFailed(ctx context.Context, id string, attempt int, lastError string, retryAt time.Time) error
+}
+
+// Outbox delivers the emails queued in the database in the background.
+// Queuing only needs the database, so requests never wait on, or fail
+// because of, the mail server, and emails about a change are queued in the
+// transaction making it.
+type Outbox struct {
+	queue  Queue
+	sender Sender
+	wake   chan struct{}
+}
+
+// NewOutbox creates an outbox delivering the messages of queue through
+// sender
+func NewOutbox(queue Queue, sender Sender) *Outbox {
+	return &Outbox{queue: queue, sender: sender, wake: make(chan struct{}, 1)}
+}
+
+// Wake delivers the messages queued right away rather than at the next tick
+func (o *Outbox) Wake() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Deliver sends the messages due, returning how many were sent. Failed
+// messages are retried with exponential backoff until MaxAttempts.
+// Messages are claimed before they are sent, so concurrent deliveries, e.g.
+// by several servers, skip each other's messages without holding locks on
+// them while the mail server answers.
+func (o *Outbox) Deliver(ctx context.Context) (int, error) {
+	sent := 0
+	for {
+		batch, err := o.queue.ClaimMessages(ctx, time.Now(), deliveryLease, deliveryBatch)
+		if err != nil {
+			return sent, err
+		}
+
+		for _, q := range batch {
+			ok, err := o.send(ctx, q)
+			if err != nil {
+				return sent, err
+			}
+			if ok {
+				sent++
+			}
+		}
+
+		if len(batch) < deliveryBatch {
+			return sent, nil
+		}
+	}
+}
+
+// send makes an attempt to send a claimed message and records its outcome,
+// reporting whether the message was sent
+func (o *Outbox) send(ctx context.Context, q *Queued) (bool, error) {
+	sendErr := o.sender.Send(ctx, &q.Message)
+	if sendErr == nil {
+		return true, o.queue.MarkSent(ctx, q.ID, time.Now())
+	}
+
+	log.Printf("Failed to send %s email %s (attempt %d): %v", q.Kind, q.ID, q.Attempt, sendErr)
+	var retryAt time.Time
+	if q.Attempt < MaxAttempts {
+		retryAt = time.Now().Add(retryDelay(q.Attempt))
+	}
+	return false, o.queue.MarkFailed(ctx, q.ID, q.Attempt, sendErr.Error(), retryAt)
+}
+
+// retryDelay is the wait before the next attempt after a failed one: a
+// minute, doubling with every attempt
+func retryDelay(attempts int) time.Duration {
+	delay := time.Minute << (attempts - 1)
+	if delay > maxRetryDelay || delay <= 0 {
+		return maxRetryDelay
+	}
+	return delay
+}
+
+// Run delivers messages as they are queued, and retries failed ones at the
+// given interval, until ctx is done
+func (o *Outbox) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.wake:
+		}
+		if _, err := o.Deliver(ctx); err != nil {
+			log.Printf("Error delivering emails: %v", err)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// pickle/backend/notifications/outbox_test.go
+package notifications
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{5, 16 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, maxRetryDelay},
+		{100, maxRetryDelay},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.attempts); got != tt.want {
+			t.Errorf("retryDelay(%d) = %v, expected %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// flakySender fails the first send to a recipient, then captures messages
+type flakySender struct {
+	mu    sync.Mutex
+	flaky string
+	sent  map[string]int
+}
+
+func (f *flakySender) Send(ctx context.Context, msg *Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if msg.To == f.flaky {
+		f.flaky = ""
+		return errors.New("mail server unavailable")
+	}
+	f.sent[msg.To]++
+	return nil
+}
+
+// memoryQueue keeps the messages of an outbox in memory, leasing them like
+// the stores do
+type memoryQueue struct {
+	mu       sync.Mutex
+	messages []*queuedMessage
+}
+
+type queuedMessage struct {
+	Queued
+	status    string
+	lastError string
+	retryAt   time.Time
+}
+
+func (q *memoryQueue) add(messages ...*Message) {
+	for _, msg := range messages {
+		q.messages = append(q.messages, &queuedMessage{
+			Queued: Queued{Message: *msg, ID: fmt.Sprintf("message-%d", len(q.messages))}, status: "PENDING"})
+	}
+}
+
+func (q *memoryQueue) ClaimMessages(ctx context.Context, at time.Time, lease time.Duration, limit int) ([]*Queued, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var claimed []*Queued
+	for _, m := range q.messages {
+		if m.status == "PENDING" && !m.retryAt.After(at) && len(claimed) < limit {
+			m.Attempt++
+			m.retryAt = at.Add(lease)
+			claim := m.Queued
+			claimed = append(claimed, &claim)
+		}
+	}
+	return claimed, nil
+}
+
+func (q *memoryQueue) MarkSent(ctx context.Context, id string, at time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.find(id).status = "SENT"
+	return nil
+}
+
+func (q *memoryQueue) MarkFailed(ctx context.Context, id string, attempt int, lastError string, retryAt time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	m := q.find(id)
+	m.lastError = lastError
+	m.retryAt = retryAt
+	if retryAt.IsZero() {
+		m.status = "FAILED"
+	}
+	return nil
+}
+
+func (q *memoryQueue) find(id string) *queuedMessage {
+	for _, m := range q.messages {
+		if m.ID == id {
+			return m
+		}
+	}
+	return nil
+}
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+	queue := &memoryQueue{}
+	sender := &flakySender{flaky: "second@example.com", sent: make(map[string]int)}
+	outbox := NewOutbox(queue, sender)
+
+	for _, to := range []string{"first@example.com", "second@example.com"} {
+		msg, err := Render(KindBookingReminder, to, sampleData())
+		if err != nil {
+			t.Fatal(err)
+		}
+		queue.add(msg)
+	}
+
+	// One send fails and is put off, the other goes out
+	if sent, err := outbox.Deliver(ctx); err != nil || sent != 1 {
+		t.Fatalf("first delivery sent %d, %v; expected one message", sent, err)
+	}
+	first, second := queue.messages[0], queue.messages[1]
+	if first.status != "SENT" || sender.sent[first.To] != 1 {
+		t.Errorf("first message is %s, sent %d times", first.status, sender.sent[first.To])
+	}
+	if second.status != "PENDING" || second.Attempt != 1 || second.lastError == "" || !second.retryAt.After(time.Now()) {
+		t.Fatalf("failed message is %s after %d attempts, retried at %v: %q",
+			second.status, second.Attempt, second.retryAt, second.lastError)
+	}
+
+	// Nothing is due until the retry
+	if sent, err := outbox.Deliver(ctx); err != nil || sent != 0 {
+		t.Fatalf("second delivery sent %d, %v; expected nothing", sent, err)
+	}
+	second.retryAt = time.Now()
+	if sent, err := outbox.Deliver(ctx); err != nil || sent != 1 {
+		t.Fatalf("retry sent %d, %v; expected the failed message", sent, err)
+	}
+	if second.status != "SENT" || sender.sent[second.To] != 1 {
+		t.Errorf("retried message is %s, sent %d times", second.status, sender.sent[second.To])
+	}
+
+	// The last attempt gives the message up
+	msg, err := Render(KindBookingReminder, "last@example.com", sampleData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.add(msg)
+	last := queue.messages[2]
+	last.Attempt = MaxAttempts - 1
+	sender.flaky = last.To
+	if _, err := outbox.Deliver(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if last.status != "FAILED" || last.Attempt != MaxAttempts {
+		t.Errorf("message is %s after %d attempts, expected it given up after %d", last.status, last.Attempt, MaxAttempts)
+	}
+}
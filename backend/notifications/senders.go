@@ -0,0 +1,229 @@
+// pickle/backend/notifications/senders.go
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/carlostbanks/pickle/config"
+)
+
+// smtpTimeout bounds a whole SMTP conversation unless the context has an
+// earlier deadline
+const smtpTimeout = 30 * time.Second
+
+// Sender sends emails
+type Sender interface {
+	// Send sends a message to its recipient
+	Send(ctx context.Context, msg *Message) error
+}
+
+// New returns the sender cfg selects
+func New(cfg config.MailConfig) (Sender, error) {
+	from, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address %q: %w", cfg.From, err)
+	}
+
+	switch cfg.Sender {
+	case config.MailSMTP:
+		return NewSMTPSender(cfg.SMTP, from), nil
+	case config.MailFile:
+		return NewFileSink(cfg.CaptureDir, from)
+	case config.MailMemory:
+		return NewMemorySink(), nil
+	}
+	return nil, fmt.Errorf("unsupported mail sender %q", cfg.Sender)
+}
+
+// SMTPSender sends emails through an SMTP server
+type SMTPSender struct {
+	config config.SMTPConfig
+	from   *mail.Address
+}
+
+// NewSMTPSender creates a sender for an SMTP server, sending from an address
+func NewSMTPSender(cfg config.SMTPConfig, from *mail.Address) *SMTPSender {
+	return &SMTPSender{config: cfg, from: from}
+}
+
+// Send implements Sender
+func (s *SMTPSender) Send(ctx context.Context, msg *Message) error {
+	data, err := format(s.from, msg)
+	if err != nil {
+		return err
+	}
+
+	dialer := net.Dialer{Timeout: smtpTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(s.config.Host, strconv.Itoa(s.config.Port)))
+	if err != nil {
+		return err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(smtpTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	client, err := smtp.NewClient(conn, s.config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: s.config.Host}); err != nil {
+			return err
+		}
+	}
+	if s.config.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.config.Username, s.config.Password, s.config.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(s.from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// FileSink captures emails as .eml files in a directory instead of sending
+// them, for local development
+type FileSink struct {
+	dir  string
+	from *mail.Address
+}
+
+// NewFileSink creates a sink writing to dir, which is created if missing
+func NewFileSink(dir string, from *mail.Address) (*FileSink, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileSink{dir: dir, from: from}, nil
+}
+
+// Send implements Sender
+func (f *FileSink) Send(ctx context.Context, msg *Message) error {
+	data, err := format(f.from, msg)
+	if err != nil {
+		return err
+	}
+	suffix, err := randomHex(4)
+	if err != nil {
+		return err
+	}
+	// Names sort in the order emails were sent
+	name := fmt.Sprintf("%s-%s-%s.eml", time.Now().Format("20060102T150405.000000"), msg.Kind, suffix)
+	return os.WriteFile(filepath.Join(f.dir, name), data, 0o644)
+}
+
+// MemorySink captures emails in memory instead of sending them, for tests
+type MemorySink struct {
+	mu       sync.Mutex
+	messages []*Message
+}
+
+// NewMemorySink creates an empty sink
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+// Send implements Sender
+func (m *MemorySink) Send(ctx context.Context, msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	copied := *msg
+	m.messages = append(m.messages, &copied)
+	return nil
+}
+
+// Messages returns the messages sent so far, oldest first
+func (m *MemorySink) Messages() []*Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Message(nil), m.messages...)
+}
+
+// format encodes a message as a plain text email from an address
+func format(from *mail.Address, msg *Message) ([]byte, error) {
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient %q: %w", msg.To, err)
+	}
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	headers := [][2]string{
+		{"From", from.String()},
+		{"To", to.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", msg.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", "<" + id + "@" + domain(from.Address) + ">"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	}
+	for _, header := range headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", header[0], header[1])
+	}
+	buf.WriteString("\r\n")
+
+	body := quotedprintable.NewWriter(&buf)
+	if _, err := body.Write(bytes.ReplaceAll([]byte(msg.Body), []byte("\n"), []byte("\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// domain returns the domain of an email address
+func domain(address string) string {
+	if at := strings.LastIndexByte(address, '@'); at >= 0 {
+		return address[at+1:]
+	}
+	return "localhost"
+}
+
+// randomHex returns n random bytes, hex encoded
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,69 @@
+// pickle/backend/notifications/senders_test.go
+package notifications
+
+import (
+	"context"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/carlostbanks/pickle/config"
+)
+
+func TestSinks(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	fileSink, err := New(config.MailConfig{Sender: config.MailFile, From: "Pickle <no-reply@example.com>", CaptureDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	memorySink := NewMemorySink()
+
+	for _, kind := range kinds {
+		msg, err := Render(kind, "Player <player@example.com>", sampleData())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fileSink.Send(ctx, msg); err != nil {
+			t.Fatalf("file sink: %v", err)
+		}
+		if err := memorySink.Send(ctx, msg); err != nil {
+			t.Fatalf("memory sink: %v", err)
+		}
+	}
+
+	if got := len(memorySink.Messages()); got != len(kinds) {
+		t.Errorf("memory sink captured %d messages, expected %d", got, len(kinds))
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(kinds) {
+		t.Fatalf("file sink wrote %d files, expected %d", len(files), len(kinds))
+	}
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := mail.ReadMessage(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s is not an email: %v", filepath.Base(name), err)
+		}
+		if to, err := msg.Header.AddressList("To"); err != nil || len(to) != 1 || to[0].Address != "player@example.com" {
+			t.Errorf("%s is addressed to %q", filepath.Base(name), msg.Header.Get("To"))
+		}
+		if msg.Header.Get("Subject") == "" || msg.Header.Get("Message-ID") == "" {
+			t.Errorf("%s lacks a subject or message ID", filepath.Base(name))
+		}
+	}
+
+	if _, err := New(config.MailConfig{Sender: "pigeon", From: "no-reply@example.com"}); err == nil {
+		t.Error("accepted an unknown sender")
+	}
+}
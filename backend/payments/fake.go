@@ -0,0 +1,199 @@
+// pickle/backend/payments/fake.go
+package payments
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Test payment methods understood by the fake provider
+const (
+	FakeCardOK       = "pm_card_ok"
+	FakeCardDeclined = "pm_card_declined"
+)
+
+// FakeSignatureHeader carries the hex HMAC-SHA256 of a fake webhook payload
+const FakeSignatureHeader = "Fake-Signature"
+
+// Fake is an in-process provider for development and tests. Intents and
+// events get sequential IDs, so a run is fully deterministic.
+type Fake struct {
+	mu      sync.Mutex
+	secret  []byte
+	intents map[string]*Intent
+	intentN int
+	eventN  int
+}
+
+// NewFake creates a fake provider signing webhooks with the given secret
+func NewFake(webhookSecret string) *Fake {
+	return &Fake{
+		secret:  []byte(webhookSecret),
+		intents: make(map[string]*Intent),
+	}
+}
+
+// Name implements Provider
+func (f *Fake) Name() string {
+	return ProviderFake
+}
+
+// CreateIntent implements Provider. FakeCardOK authorizes the intent and
+// FakeCardDeclined fails it; without a payment method it waits for Pay.
+func (f *Fake) CreateIntent(ctx context.Context, params IntentParams) (Intent, error) {
+	if params.Amount <= 0 {
+		return Intent{}, fmt.Errorf("invalid amount %d", params.Amount)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.intentN++
+	id := fmt.Sprintf("pi_fake_%06d", f.intentN)
+	intent := &Intent{
+		ID:           id,
+		Amount:       params.Amount,
+		Currency:     params.Currency,
+		Reference:    params.Reference,
+		Status:       StatusRequiresPayment,
+		ClientSecret: id + "_secret",
+	}
+	f.intents[id] = intent
+
+	if params.PaymentMethod != "" {
+		if err := f.pay(intent, params.PaymentMethod); err != nil {
+			return Intent{}, err
+		}
+	}
+
+	return *intent, nil
+}
+
+// Pay simulates the customer paying an intent with a test payment method,
+// and returns the webhook the provider would send about it
+func (f *Fake) Pay(intentID, paymentMethod string) ([]byte, http.Header, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	intent, ok := f.intents[intentID]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	if intent.Status != StatusRequiresPayment {
+		return nil, nil, ErrInvalidState
+	}
+	if err := f.pay(intent, paymentMethod); err != nil {
+		return nil, nil, err
+	}
+
+	eventType := EventAuthorized
+	if intent.Status == StatusFailed {
+		eventType = EventFailed
+	}
+	return f.event(eventType, *intent)
+}
+
+func (f *Fake) pay(intent *Intent, paymentMethod string) error {
+	switch paymentMethod {
+	case FakeCardOK:
+		intent.Status = StatusAuthorized
+	case FakeCardDeclined:
+		intent.Status = StatusFailed
+	default:
+		return fmt.Errorf("unknown payment method %q", paymentMethod)
+	}
+	return nil
+}
+
+// Capture implements Provider
+func (f *Fake) Capture(ctx context.Context, intentID string) (Intent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	intent, ok := f.intents[intentID]
+	if !ok {
+		return Intent{}, ErrNotFound
+	}
+	if intent.Status != StatusAuthorized {
+		return Intent{}, ErrInvalidState
+	}
+	intent.Status = StatusCaptured
+	return *intent, nil
+}
+
+// Refund implements Provider
+func (f *Fake) Refund(ctx context.Context, intentID string, amount int64) (Intent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	intent, ok := f.intents[intentID]
+	if !ok {
+		return Intent{}, ErrNotFound
+	}
+
+	switch intent.Status {
+	case StatusRequiresPayment, StatusAuthorized:
+		intent.Status = StatusCancelled
+	case StatusCaptured, StatusPartiallyRefunded:
+		if amount <= 0 || amount > intent.Amount-intent.Refunded {
+			return Intent{}, fmt.Errorf("invalid refund amount %d", amount)
+		}
+		intent.Refunded += amount
+		intent.Status = StatusPartiallyRefunded
+		if intent.Refunded == intent.Amount {
+			intent.Status = StatusRefunded
+		}
+	default:
+		return Intent{}, ErrInvalidState
+	}
+	return *intent, nil
+}
+
+// VerifyWebhook implements Provider
+func (f *Fake) VerifyWebhook(payload []byte, header http.Header) (Event, error) {
+	signature, err := hex.DecodeString(header.Get(FakeSignatureHeader))
+	if err != nil || !hmac.Equal(signature, f.sign(payload)) {
+		return Event{}, ErrInvalidSignature
+	}
+
+	var event Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return Event{}, fmt.Errorf("invalid webhook payload: %w", err)
+	}
+	return event, nil
+}
+
+// Sign returns the headers of a webhook request carrying the payload
+func (f *Fake) Sign(payload []byte) http.Header {
+	header := make(http.Header)
+	header.Set(FakeSignatureHeader, hex.EncodeToString(f.sign(payload)))
+	return header
+}
+
+func (f *Fake) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, f.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// event builds a signed webhook about an intent. The client secret is not
+// part of webhooks.
+func (f *Fake) event(eventType string, intent Intent) ([]byte, http.Header, error) {
+	f.eventN++
+	intent.ClientSecret = ""
+	payload, err := json.Marshal(Event{
+		ID:     fmt.Sprintf("evt_fake_%06d", f.eventN),
+		Type:   eventType,
+		Intent: intent,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return payload, f.Sign(payload), nil
+}
@@ -0,0 +1,142 @@
+// pickle/backend/payments/payments.go
+package payments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Names of the providers
+const (
+	ProviderFake   = "fake"   // In-process, for development and tests
+	ProviderStripe = "stripe" // Stripe payment intents
+)
+
+// Providers lists the names New accepts
+var Providers = []string{ProviderFake, ProviderStripe}
+
+// Intent statuses, stored as-is in the payments table
+const (
+	StatusRequiresPayment   = "REQUIRES_PAYMENT"   // Waiting for the customer to pay
+	StatusAuthorized        = "AUTHORIZED"         // Funds reserved, not yet captured
+	StatusCaptured          = "CAPTURED"           // Funds collected
+	StatusPartiallyRefunded = "PARTIALLY_REFUNDED" // Part of the captured amount returned
+	StatusRefunded          = "REFUNDED"           // The whole captured amount returned
+	StatusCancelled         = "CANCELLED"          // Released before capture
+	StatusFailed            = "FAILED"             // Declined by the provider
+)
+
+// Webhook event types for payments completed by the customer
+const (
+	EventAuthorized = "payment.authorized"
+	EventFailed     = "payment.failed"
+)
+
+var (
+	// ErrInvalidState is returned for operations the intent's status does not allow
+	ErrInvalidState = errors.New("payment is not in a valid state for this operation")
+
+	// ErrNotFound is returned for unknown intents
+	ErrNotFound = errors.New("payment intent not found")
+
+	// ErrInvalidSignature is returned for webhooks that fail verification
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+)
+
+// IntentParams describes a payment to collect
+type IntentParams struct {
+	Amount        int64 // In the smallest currency unit
+	Currency      string
+	Reference     string // Our identifier for the payment, e.g. the booking ID
+	PaymentMethod string // Optional; without it the customer pays with the client secret
+}
+
+// Intent is a payment tracked by a provider
+type Intent struct {
+	ID           string `json:"id"`
+	Amount       int64  `json:"amount"`
+	Refunded     int64  `json:"refunded"`
+	Currency     string `json:"currency"`
+	Reference    string `json:"reference"`
+	Status       string `json:"status"`
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+// Active reports whether the intent still holds or may still collect money
+func (i Intent) Active() bool {
+	switch i.Status {
+	case StatusRequiresPayment, StatusAuthorized, StatusCaptured, StatusPartiallyRefunded:
+		return true
+	}
+	return false
+}
+
+// Event is a verified webhook notification about an intent
+type Event struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Intent Intent `json:"intent"`
+}
+
+// Provider is a payment service provider
+type Provider interface {
+	// Name identifies the provider in the payments table
+	Name() string
+
+	// CreateIntent starts collecting a payment. Intents with a payment
+	// method are authorized (or fail) right away.
+	CreateIntent(ctx context.Context, params IntentParams) (Intent, error)
+
+	// Capture collects the funds of an authorized intent
+	Capture(ctx context.Context, intentID string) (Intent, error)
+
+	// Refund returns part or all of a captured intent, or releases an
+	// intent that was not captured yet, in which case amount is ignored
+	Refund(ctx context.Context, intentID string, amount int64) (Intent, error)
+
+	// VerifyWebhook authenticates a webhook request and decodes its event
+	VerifyWebhook(payload []byte, header http.Header) (Event, error)
+}
+
+// New returns the provider with the given name, one of Providers, calling
+// its API with apiKey. The fake provider is used when no name is given.
+func New(name, apiKey, webhookSecret string) (Provider, error) {
+	switch name {
+	case "", ProviderFake:
+		return NewFake(webhookSecret), nil
+	case ProviderStripe:
+		return NewStripe(apiKey, webhookSecret), nil
+	}
+	return nil, fmt.Errorf("unsupported payment provider %q", name)
+}
+
+// Settle settles a payment when its booking is cancelled, keeping only fee:
+// captured payments are refunded down to the fee, authorized ones are
+// captured first when there is a fee to keep, and anything else is released.
+// amount and refunded are the payment's amount and what was already
+// refunded. The returned intent reflects the payment's state even on error,
+// since a capture may have succeeded before the refund failed.
+func Settle(ctx context.Context, p Provider, intentID, status string, amount, refunded, fee int64) (Intent, error) {
+	current := Intent{ID: intentID, Amount: amount, Refunded: refunded, Status: status}
+
+	if fee > 0 && status == StatusAuthorized {
+		captured, err := p.Capture(ctx, intentID)
+		if err != nil {
+			return current, err
+		}
+		current = captured
+	}
+
+	refund := current.Amount - current.Refunded - fee
+	if (current.Status == StatusCaptured || current.Status == StatusPartiallyRefunded) && refund <= 0 {
+		return current, nil
+	}
+
+	settled, err := p.Refund(ctx, intentID, refund)
+	if err != nil {
+		return current, err
+	}
+	return settled, nil
+}
@@ -0,0 +1,306 @@
+// pickle/backend/payments/stripe.go
+package payments
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StripeSignatureHeader carries the timestamp and signatures of a Stripe
+// webhook
+const StripeSignatureHeader = "Stripe-Signature"
+
+// stripeTolerance bounds the age of the webhooks Stripe sends, so captured
+// requests cannot be replayed later
+const stripeTolerance = 5 * time.Minute
+
+// Stripe collects payments with Stripe payment intents. Intents are created
+// with manual capture, so a payment is only authorized until the booking is
+// confirmed.
+type Stripe struct {
+	apiKey  string
+	secret  []byte
+	baseURL string
+	client  *http.Client
+	now     func() time.Time
+}
+
+// NewStripe creates a provider calling the Stripe API with a secret API key
+// and verifying webhooks with the endpoint's signing secret
+func NewStripe(apiKey, webhookSecret string) *Stripe {
+	return &Stripe{
+		apiKey:  apiKey,
+		secret:  []byte(webhookSecret),
+		baseURL: "https://api.stripe.com",
+		client:  &http.Client{Timeout: 30 * time.Second},
+		now:     time.Now,
+	}
+}
+
+// stripeIntent is a payment intent as returned by the Stripe API. The latest
+// charge is expanded where refunds matter.
+type stripeIntent struct {
+	ID           string            `json:"id"`
+	Amount       int64             `json:"amount"`
+	Currency     string            `json:"currency"`
+	Status       string            `json:"status"`
+	ClientSecret string            `json:"client_secret"`
+	Metadata     map[string]string `json:"metadata"`
+	LatestCharge json.RawMessage   `json:"latest_charge"`
+}
+
+// stripeError is the error object of failed Stripe API calls
+type stripeError struct {
+	Type          string        `json:"type"`
+	Code          string        `json:"code"`
+	Message       string        `json:"message"`
+	PaymentIntent *stripeIntent `json:"payment_intent"`
+}
+
+func (e *stripeError) Error() string {
+	return fmt.Sprintf("stripe: %s (%s)", e.Message, e.Code)
+}
+
+// Name implements Provider
+func (s *Stripe) Name() string {
+	return ProviderStripe
+}
+
+// CreateIntent implements Provider. Intents with a payment method are
+// confirmed right away; a declined card fails the intent.
+func (s *Stripe) CreateIntent(ctx context.Context, params IntentParams) (Intent, error) {
+	if params.Amount <= 0 {
+		return Intent{}, fmt.Errorf("invalid amount %d", params.Amount)
+	}
+
+	form := url.Values{
+		"amount":              {strconv.FormatInt(params.Amount, 10)},
+		"currency":            {strings.ToLower(params.Currency)},
+		"capture_method":      {"manual"},
+		"metadata[reference]": {params.Reference},
+	}
+	if params.PaymentMethod != "" {
+		form.Set("payment_method", params.PaymentMethod)
+		form.Set("confirm", "true")
+	}
+
+	var intent stripeIntent
+	err := s.call(ctx, http.MethodPost, "/v1/payment_intents", form, &intent)
+	if stripeErr, ok := err.(*stripeError); ok && stripeErr.Type == "card_error" && stripeErr.PaymentIntent != nil {
+		failed := stripeErr.PaymentIntent.intent(0)
+		failed.Status = StatusFailed
+		return failed, nil
+	}
+	if err != nil {
+		return Intent{}, err
+	}
+	return intent.intent(0), nil
+}
+
+// Capture implements Provider
+func (s *Stripe) Capture(ctx context.Context, intentID string) (Intent, error) {
+	var intent stripeIntent
+	if err := s.call(ctx, http.MethodPost, "/v1/payment_intents/"+url.PathEscape(intentID)+"/capture", nil, &intent); err != nil {
+		return Intent{}, err
+	}
+	return intent.intent(0), nil
+}
+
+// Refund implements Provider. Intents not captured yet are cancelled;
+// captured ones are refunded through their charge.
+func (s *Stripe) Refund(ctx context.Context, intentID string, amount int64) (Intent, error) {
+	current, err := s.get(ctx, intentID)
+	if err != nil {
+		return Intent{}, err
+	}
+
+	switch current.Status {
+	case StatusRequiresPayment, StatusAuthorized:
+		var cancelled stripeIntent
+		err := s.call(ctx, http.MethodPost, "/v1/payment_intents/"+url.PathEscape(intentID)+"/cancel", nil, &cancelled)
+		if err != nil {
+			return Intent{}, err
+		}
+		return cancelled.intent(0), nil
+	case StatusCaptured, StatusPartiallyRefunded:
+		if amount <= 0 || amount > current.Amount-current.Refunded {
+			return Intent{}, fmt.Errorf("invalid refund amount %d", amount)
+		}
+		form := url.Values{
+			"payment_intent": {intentID},
+			"amount":         {strconv.FormatInt(amount, 10)},
+		}
+		if err := s.call(ctx, http.MethodPost, "/v1/refunds", form, nil); err != nil {
+			return Intent{}, err
+		}
+		return s.get(ctx, intentID)
+	}
+	return Intent{}, ErrInvalidState
+}
+
+// get returns an intent with what was refunded of it
+func (s *Stripe) get(ctx context.Context, intentID string) (Intent, error) {
+	var intent stripeIntent
+	path := "/v1/payment_intents/" + url.PathEscape(intentID) + "?expand[]=latest_charge"
+	if err := s.call(ctx, http.MethodGet, path, nil, &intent); err != nil {
+		return Intent{}, err
+	}
+
+	var charge struct {
+		AmountRefunded int64 `json:"amount_refunded"`
+	}
+	if len(intent.LatestCharge) > 0 && intent.LatestCharge[0] == '{' {
+		if err := json.Unmarshal(intent.LatestCharge, &charge); err != nil {
+			return Intent{}, fmt.Errorf("stripe: decoding charge: %w", err)
+		}
+	}
+	return intent.intent(charge.AmountRefunded), nil
+}
+
+// VerifyWebhook implements Provider. Only events about intents waiting for
+// the customer carry an intent: payment_intent.amount_capturable_updated
+// becomes EventAuthorized and payment_intent.payment_failed EventFailed.
+// Other events keep their Stripe type.
+func (s *Stripe) VerifyWebhook(payload []byte, header http.Header) (Event, error) {
+	if err := s.verify(payload, header.Get(StripeSignatureHeader)); err != nil {
+		return Event{}, err
+	}
+
+	var event struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			Object stripeIntent `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return Event{}, fmt.Errorf("invalid webhook payload: %w", err)
+	}
+
+	result := Event{ID: event.ID, Type: event.Type}
+	switch event.Type {
+	case "payment_intent.amount_capturable_updated":
+		result.Type = EventAuthorized
+		result.Intent = event.Data.Object.intent(0)
+	case "payment_intent.payment_failed":
+		result.Type = EventFailed
+		result.Intent = event.Data.Object.intent(0)
+		result.Intent.Status = StatusFailed
+	}
+	result.Intent.ClientSecret = ""
+	return result, nil
+}
+
+// verify checks a Stripe-Signature header, "t=<unix time>,v1=<hex HMAC>",
+// against the payload
+func (s *Stripe) verify(payload []byte, header string) error {
+	var timestamp string
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			if signature, err := hex.DecodeString(value); err == nil {
+				signatures = append(signatures, signature)
+			}
+		}
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || s.now().Sub(time.Unix(seconds, 0)).Abs() > stripeTolerance {
+		return ErrInvalidSignature
+	}
+
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	expected := mac.Sum(nil)
+	for _, signature := range signatures {
+		if hmac.Equal(signature, expected) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// call makes a request to the Stripe API and decodes the response into out,
+// unless it is nil. Unknown intents give ErrNotFound and operations their
+// status does not allow ErrInvalidState.
+func (s *Stripe) call(ctx context.Context, method, path string, form url.Values, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, s.baseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("stripe: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var body struct {
+			Error stripeError `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			return fmt.Errorf("stripe: %s", resp.Status)
+		}
+		switch body.Error.Code {
+		case "resource_missing":
+			return ErrNotFound
+		case "payment_intent_unexpected_state":
+			return ErrInvalidState
+		}
+		return &body.Error
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("stripe: decoding response: %w", err)
+	}
+	return nil
+}
+
+// intent converts a Stripe intent, of which refunded was refunded
+func (i *stripeIntent) intent(refunded int64) Intent {
+	intent := Intent{
+		ID:           i.ID,
+		Amount:       i.Amount,
+		Refunded:     refunded,
+		Currency:     strings.ToUpper(i.Currency),
+		Reference:    i.Metadata["reference"],
+		ClientSecret: i.ClientSecret,
+	}
+
+	switch i.Status {
+	case "requires_capture":
+		intent.Status = StatusAuthorized
+	case "succeeded":
+		intent.Status = StatusCaptured
+		if refunded == i.Amount {
+			intent.Status = StatusRefunded
+		} else if refunded > 0 {
+			intent.Status = StatusPartiallyRefunded
+		}
+	case "canceled":
+		intent.Status = StatusCancelled
+	default: // requires_payment_method, requires_confirmation, requires_action, processing
+		intent.Status = StatusRequiresPayment
+	}
+	return intent
+}
@@ -0,0 +1,195 @@
+// pickle/backend/payments/stripe_test.go
+package payments
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stripeAPI serves the payment intent and refund endpoints of the Stripe
+// API the provider uses, keeping the intents in memory
+type stripeAPI struct {
+	mu       sync.Mutex
+	intents  map[string]map[string]interface{}
+	refunded map[string]int64
+}
+
+func (a *stripeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r.ParseForm()
+
+	if r.Header.Get("Authorization") != "Bearer sk_test_key" {
+		a.fail(w, http.StatusUnauthorized, "invalid_request_error", "api_key_invalid", nil)
+		return
+	}
+
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/"), "/")
+	switch {
+	case r.Method == http.MethodPost && len(path) == 1 && path[0] == "payment_intents":
+		amount, _ := strconv.ParseInt(r.PostForm.Get("amount"), 10, 64)
+		id := fmt.Sprintf("pi_%d", len(a.intents)+1)
+		intent := map[string]interface{}{
+			"id": id, "amount": amount, "currency": r.PostForm.Get("currency"),
+			"status": "requires_payment_method", "client_secret": id + "_secret",
+			"metadata": map[string]string{"reference": r.PostForm.Get("metadata[reference]")},
+		}
+		a.intents[id] = intent
+		switch r.PostForm.Get("payment_method") {
+		case "pm_card_visa":
+			intent["status"] = "requires_capture"
+		case "pm_card_chargeDeclined":
+			a.fail(w, http.StatusPaymentRequired, "card_error", "card_declined", intent)
+			return
+		}
+		json.NewEncoder(w).Encode(intent)
+	case r.Method == http.MethodPost && len(path) == 1 && path[0] == "refunds":
+		intent, ok := a.intents[r.PostForm.Get("payment_intent")]
+		if !ok {
+			a.fail(w, http.StatusNotFound, "invalid_request_error", "resource_missing", nil)
+			return
+		}
+		amount, _ := strconv.ParseInt(r.PostForm.Get("amount"), 10, 64)
+		a.refunded[intent["id"].(string)] += amount
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": "re_1", "amount": amount})
+	case len(path) >= 2 && path[0] == "payment_intents":
+		intent, ok := a.intents[path[1]]
+		if !ok {
+			a.fail(w, http.StatusNotFound, "invalid_request_error", "resource_missing", nil)
+			return
+		}
+		if len(path) == 3 {
+			next := map[string]string{"capture": "succeeded", "cancel": "canceled"}[path[2]]
+			if path[2] == "capture" && intent["status"] != "requires_capture" {
+				a.fail(w, http.StatusBadRequest, "invalid_request_error", "payment_intent_unexpected_state", nil)
+				return
+			}
+			intent["status"] = next
+		}
+		out := map[string]interface{}{}
+		for key, value := range intent {
+			out[key] = value
+		}
+		if r.URL.Query().Get("expand[]") == "latest_charge" {
+			out["latest_charge"] = map[string]interface{}{"id": "ch_1", "amount_refunded": a.refunded[path[1]]}
+		}
+		json.NewEncoder(w).Encode(out)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *stripeAPI) fail(w http.ResponseWriter, status int, errorType, code string, intent map[string]interface{}) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{
+		"type": errorType, "code": code, "message": code, "payment_intent": intent}})
+}
+
+// newTestStripe returns a Stripe provider calling an in-memory Stripe API
+func newTestStripe(t *testing.T) *Stripe {
+	t.Helper()
+	api := httptest.NewServer(&stripeAPI{
+		intents:  make(map[string]map[string]interface{}),
+		refunded: make(map[string]int64),
+	})
+	t.Cleanup(api.Close)
+
+	s := NewStripe("sk_test_key", "whsec_test")
+	s.baseURL = api.URL
+	return s
+}
+
+func TestStripePayments(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStripe(t)
+
+	declined, err := s.CreateIntent(ctx, IntentParams{Amount: 2000, Currency: "USD", Reference: "booking-1",
+		PaymentMethod: "pm_card_chargeDeclined"})
+	if err != nil || declined.Status != StatusFailed {
+		t.Fatalf("declined card gave %+v, %v; expected a failed intent", declined, err)
+	}
+
+	intent, err := s.CreateIntent(ctx, IntentParams{Amount: 2000, Currency: "USD", Reference: "booking-2",
+		PaymentMethod: "pm_card_visa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if intent.Status != StatusAuthorized || intent.Currency != "USD" || intent.Reference != "booking-2" {
+		t.Fatalf("created %+v, expected an authorized USD intent for booking-2", intent)
+	}
+
+	if intent, err = s.Capture(ctx, intent.ID); err != nil || intent.Status != StatusCaptured {
+		t.Fatalf("capture gave %+v, %v", intent, err)
+	}
+	if _, err := s.Capture(ctx, intent.ID); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("capturing twice gave %v, expected ErrInvalidState", err)
+	}
+
+	intent, err = s.Refund(ctx, intent.ID, 500)
+	if err != nil || intent.Status != StatusPartiallyRefunded || intent.Refunded != 500 {
+		t.Fatalf("partial refund gave %+v, %v", intent, err)
+	}
+	intent, err = s.Refund(ctx, intent.ID, 1500)
+	if err != nil || intent.Status != StatusRefunded || intent.Refunded != 2000 {
+		t.Fatalf("full refund gave %+v, %v", intent, err)
+	}
+
+	// Intents not captured yet are cancelled
+	waiting, err := s.CreateIntent(ctx, IntentParams{Amount: 1000, Currency: "USD", Reference: "booking-3"})
+	if err != nil || waiting.Status != StatusRequiresPayment || waiting.ClientSecret == "" {
+		t.Fatalf("intent without a payment method gave %+v, %v", waiting, err)
+	}
+	if waiting, err = s.Refund(ctx, waiting.ID, 0); err != nil || waiting.Status != StatusCancelled {
+		t.Fatalf("releasing gave %+v, %v", waiting, err)
+	}
+
+	if _, err := s.Capture(ctx, "pi_unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown intent gave %v, expected ErrNotFound", err)
+	}
+}
+
+func TestStripeWebhook(t *testing.T) {
+	s := NewStripe("sk_test_key", "whsec_test")
+	now := time.Unix(1700000000, 0)
+	s.now = func() time.Time { return now }
+
+	payload := []byte(`{"id":"evt_1","type":"payment_intent.amount_capturable_updated","data":{"object":` +
+		`{"id":"pi_1","amount":2000,"currency":"usd","status":"requires_capture","client_secret":"pi_1_secret"}}}`)
+	sign := func(at time.Time, secret string) http.Header {
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(payload)
+		header := make(http.Header)
+		header.Set(StripeSignatureHeader, "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+		return header
+	}
+
+	event, err := s.VerifyWebhook(payload, sign(now, "whsec_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != EventAuthorized || event.Intent.ID != "pi_1" || event.Intent.Status != StatusAuthorized ||
+		event.Intent.ClientSecret != "" {
+		t.Errorf("verified %+v, expected pi_1 authorized without its client secret", event)
+	}
+
+	if _, err := s.VerifyWebhook(payload, sign(now, "whsec_other")); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("wrong secret gave %v, expected ErrInvalidSignature", err)
+	}
+	if _, err := s.VerifyWebhook(payload, sign(now.Add(-time.Hour), "whsec_test")); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("old webhook gave %v, expected ErrInvalidSignature", err)
+	}
+}
@@ -0,0 +1,115 @@
+// pickle/backend/pricing/pricing.go
+package pricing
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/carlostbanks/pickle/schedule"
+)
+
+// DefaultCurrency is used for facilities without a configured currency
+const DefaultCurrency = "USD"
+
+// ErrBelowMinimum is returned for bookings shorter than the facility's minimum duration
+var ErrBelowMinimum = errors.New("booking is shorter than the minimum duration")
+
+// Rate is an hourly price in the smallest currency unit (e.g. cents)
+type Rate struct {
+	Guest  int64
+	Member int64
+}
+
+// For returns the rate charged to members or guests
+func (r Rate) For(member bool) int64 {
+	if member {
+		return r.Member
+	}
+	return r.Guest
+}
+
+// PeakWindow overrides the base rate on a weekday during a time window
+type PeakWindow struct {
+	Weekday time.Weekday
+	Window  schedule.Window
+	Rate    Rate
+}
+
+// RateTable is the price list of a facility. The zero value prices every
+// booking at zero.
+type RateTable struct {
+	Currency           string
+	Base               Rate
+	Peaks              []PeakWindow
+	MinDurationMinutes int
+}
+
+// Line is a part of a booking charged at a single rate
+type Line struct {
+	Window schedule.Window
+	Peak   bool
+	Rate   int64
+	Amount int64
+}
+
+// Quote is the price of a booking
+type Quote struct {
+	Currency string
+	Member   bool
+	Total    int64
+	Lines    []Line
+}
+
+// Quote prices a booking on a date. Every minute is charged at the peak
+// rate of the first peak window containing it, or at the base rate.
+func (t RateTable) Quote(date string, w schedule.Window, member bool) (Quote, error) {
+	day, err := schedule.ParseDate(date)
+	if err != nil {
+		return Quote{}, errors.New("invalid date format")
+	}
+
+	if t.MinDurationMinutes > 0 && w.End-w.Start < t.MinDurationMinutes {
+		return Quote{}, fmt.Errorf("%w of %d minutes", ErrBelowMinimum, t.MinDurationMinutes)
+	}
+
+	quote := Quote{Currency: t.Currency, Member: member}
+	if quote.Currency == "" {
+		quote.Currency = DefaultCurrency
+	}
+
+	for minute := w.Start; minute < w.End; minute++ {
+		rate, peak := t.rateAt(day.Weekday(), minute, member)
+
+		last := len(quote.Lines) - 1
+		if last >= 0 && quote.Lines[last].Rate == rate && quote.Lines[last].Peak == peak {
+			quote.Lines[last].Window.End = minute + 1
+			continue
+		}
+		quote.Lines = append(quote.Lines, Line{
+			Window: schedule.Window{Start: minute, End: minute + 1},
+			Peak:   peak,
+			Rate:   rate,
+		})
+	}
+
+	for i := range quote.Lines {
+		line := &quote.Lines[i]
+		minutes := int64(line.Window.End - line.Window.Start)
+		line.Amount = (line.Rate*minutes + 30) / 60
+		quote.Total += line.Amount
+	}
+
+	return quote, nil
+}
+
+// rateAt returns the hourly rate charged for a minute on a weekday and
+// whether it is a peak rate
+func (t RateTable) rateAt(weekday time.Weekday, minute int, member bool) (int64, bool) {
+	for _, peak := range t.Peaks {
+		if peak.Weekday == weekday && peak.Window.Start <= minute && minute < peak.Window.End {
+			return peak.Rate.For(member), true
+		}
+	}
+	return t.Base.For(member), false
+}
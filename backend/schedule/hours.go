@@ -0,0 +1,152 @@
+// pickle/backend/schedule/hours.go
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrClosed is returned for bookings on a day the facility is closed
+	ErrClosed = errors.New("court is closed on this date")
+
+	// ErrOutsideHours is returned for bookings outside the opening hours
+	ErrOutsideHours = errors.New("booking is outside opening hours")
+
+	// ErrBlackout is returned for bookings overlapping a facility-wide blackout
+	ErrBlackout = errors.New("court is unavailable during this time")
+)
+
+// Exception overrides the weekly opening hours on a single date
+// (e.g. a holiday closure or special hours)
+type Exception struct {
+	Closed bool
+	Window Window
+	Reason string
+}
+
+// Blackout blocks a facility, or a single unit of it, for a period of time
+// (e.g. resurfacing or a private event). An empty UnitID blocks every unit.
+type Blackout struct {
+	UnitID string
+	Start  time.Time
+	End    time.Time
+	Reason string
+}
+
+// Hours is the calendar of a facility
+type Hours struct {
+	// Weekly holds the regular opening hours. A facility without any weekly
+	// hours uses DefaultOpeningHours every day; otherwise missing days are closed.
+	Weekly     map[time.Weekday]Window
+	Exceptions map[string]Exception // keyed by date
+	Blackouts  []Blackout
+}
+
+// ParseDate parses a booking date. Dates read back from the database may
+// carry a time component, which is ignored.
+func ParseDate(value string) (time.Time, error) {
+	if len(value) > len(DateLayout) {
+		value = value[:len(DateLayout)]
+	}
+	return time.Parse(DateLayout, value)
+}
+
+// OpenWindow returns the opening hours on a date and false if the facility is closed
+func (h Hours) OpenWindow(date string) (Window, bool) {
+	day, err := ParseDate(date)
+	if err != nil {
+		return Window{}, false
+	}
+
+	if exception, ok := h.Exceptions[day.Format(DateLayout)]; ok {
+		return exception.Window, !exception.Closed
+	}
+
+	if len(h.Weekly) == 0 {
+		return DefaultOpeningHours, true
+	}
+
+	open, ok := h.Weekly[day.Weekday()]
+	return open, ok
+}
+
+// Check verifies that a booking window on a date is within the opening
+// hours and does not overlap a facility-wide blackout. Blackouts of single
+// units are reported by Blocked instead, so another unit can be picked.
+func (h Hours) Check(date string, w Window) error {
+	open, ok := h.OpenWindow(date)
+	if !ok {
+		return ErrClosed
+	}
+
+	if !open.Contains(w) {
+		return fmt.Errorf("%w (%s-%s)", ErrOutsideHours, open.StartTime(), open.EndTime())
+	}
+
+	for _, b := range h.Blackouts {
+		if b.UnitID != "" {
+			continue
+		}
+		if blocked, ok := b.on(date); ok && blocked.Overlaps(w) {
+			if b.Reason != "" {
+				return fmt.Errorf("%w: %s", ErrBlackout, b.Reason)
+			}
+			return ErrBlackout
+		}
+	}
+
+	return nil
+}
+
+// Blocked returns the blackouts on a date as bookings of the affected units,
+// so they take part in the regular conflict check
+func (h Hours) Blocked(date string, unitIDs []string) []Booked {
+	var booked []Booked
+	for _, b := range h.Blackouts {
+		blocked, ok := b.on(date)
+		if !ok {
+			continue
+		}
+
+		if b.UnitID != "" {
+			booked = append(booked, Booked{UnitID: b.UnitID, Window: blocked})
+			continue
+		}
+		for _, unitID := range unitIDs {
+			booked = append(booked, Booked{UnitID: unitID, Window: blocked})
+		}
+	}
+	return booked
+}
+
+// on returns the part of the blackout falling on a date
+func (b Blackout) on(date string) (Window, bool) {
+	dayStart, err := ParseDate(date)
+	if err != nil {
+		return Window{}, false
+	}
+	dayEnd := dayStart.AddDate(0, 0, 1)
+
+	start, end := wallClock(b.Start), wallClock(b.End)
+	if start.Before(dayStart) {
+		start = dayStart
+	}
+	if end.After(dayEnd) {
+		end = dayEnd
+	}
+	if !start.Before(end) {
+		return Window{}, false
+	}
+
+	return Window{
+		Start: int(start.Sub(dayStart) / time.Minute),
+		End:   int(end.Sub(dayStart) / time.Minute),
+	}, true
+}
+
+// wallClock drops the location of a timestamp, keeping its local date and time
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
@@ -0,0 +1,207 @@
+// pickle/backend/schedule/recurrence.go
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxOccurrences caps how many bookings a single series may materialize
+const MaxOccurrences = 104
+
+// Scope selects which occurrences of a series an edit or cancellation applies to
+type Scope string
+
+const (
+	ScopeThis      Scope = "this"
+	ScopeFollowing Scope = "following"
+	ScopeAll       Scope = "all"
+)
+
+// ParseScope parses a scope, defaulting to ScopeThis
+func ParseScope(value string) (Scope, error) {
+	switch Scope(strings.ToLower(value)) {
+	case "", ScopeThis:
+		return ScopeThis, nil
+	case ScopeFollowing:
+		return ScopeFollowing, nil
+	case ScopeAll:
+		return ScopeAll, nil
+	}
+	return "", fmt.Errorf("invalid scope %q", value)
+}
+
+var weekdayCodes = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// Rule is the subset of an iCalendar RRULE supported for booking series:
+// FREQ=DAILY|WEEKLY|MONTHLY with INTERVAL, BYDAY (weekly only) and either
+// COUNT or UNTIL, e.g. "FREQ=WEEKLY;INTERVAL=2;BYDAY=TU,TH;COUNT=10".
+type Rule struct {
+	Freq     string
+	Interval int
+	ByDay    []time.Weekday
+	Count    int
+	Until    time.Time
+}
+
+// ParseRule parses an RRULE string. A leading "RRULE:" is accepted.
+func ParseRule(value string) (Rule, error) {
+	rule := Rule{Interval: 1}
+
+	value = strings.TrimPrefix(strings.TrimSpace(value), "RRULE:")
+	if value == "" {
+		return rule, errors.New("recurrence rule is required")
+	}
+
+	for _, part := range strings.Split(value, ";") {
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return rule, fmt.Errorf("invalid recurrence rule part %q", part)
+		}
+
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			rule.Freq = strings.ToUpper(val)
+			if rule.Freq != "DAILY" && rule.Freq != "WEEKLY" && rule.Freq != "MONTHLY" {
+				return rule, fmt.Errorf("unsupported frequency %q", val)
+			}
+		case "INTERVAL":
+			interval, err := strconv.Atoi(val)
+			if err != nil || interval < 1 {
+				return rule, fmt.Errorf("invalid interval %q", val)
+			}
+			rule.Interval = interval
+		case "COUNT":
+			count, err := strconv.Atoi(val)
+			if err != nil || count < 1 {
+				return rule, fmt.Errorf("invalid count %q", val)
+			}
+			rule.Count = count
+		case "UNTIL":
+			until, err := parseUntil(val)
+			if err != nil {
+				return rule, fmt.Errorf("invalid until %q", val)
+			}
+			rule.Until = until
+		case "BYDAY":
+			for _, code := range strings.Split(val, ",") {
+				weekday, ok := weekdayCodes[strings.ToUpper(code)]
+				if !ok {
+					return rule, fmt.Errorf("invalid weekday %q", code)
+				}
+				rule.ByDay = append(rule.ByDay, weekday)
+			}
+		default:
+			return rule, fmt.Errorf("unsupported recurrence rule part %q", key)
+		}
+	}
+
+	if rule.Freq == "" {
+		return rule, errors.New("recurrence rule must have a frequency")
+	}
+	if rule.Count == 0 && rule.Until.IsZero() {
+		return rule, errors.New("recurrence rule must end with COUNT or UNTIL")
+	}
+	if rule.Count > 0 && !rule.Until.IsZero() {
+		return rule, errors.New("recurrence rule cannot have both COUNT and UNTIL")
+	}
+	if len(rule.ByDay) > 0 && rule.Freq != "WEEKLY" {
+		return rule, errors.New("BYDAY is only supported for weekly rules")
+	}
+
+	return rule, nil
+}
+
+// parseUntil accepts an UNTIL date as YYYYMMDD, YYYYMMDDTHHMMSS[Z] or YYYY-MM-DD
+func parseUntil(value string) (time.Time, error) {
+	for _, layout := range []string{"20060102", "20060102T150405Z", "20060102T150405", DateLayout} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+		}
+	}
+	return time.Time{}, errors.New("invalid date")
+}
+
+// Dates returns the dates of the occurrences of the rule starting at the
+// given date (the first occurrence), capped at MaxOccurrences
+func (r Rule) Dates(start string) ([]string, error) {
+	first, err := ParseDate(start)
+	if err != nil {
+		return nil, errors.New("invalid date format")
+	}
+
+	var dates []string
+	add := func(day time.Time) bool {
+		if day.Before(first) {
+			return true
+		}
+		if !r.Until.IsZero() && day.After(r.Until) {
+			return false
+		}
+		if r.Count > 0 && len(dates) >= r.Count {
+			return false
+		}
+		if len(dates) >= MaxOccurrences {
+			return false
+		}
+		dates = append(dates, day.Format(DateLayout))
+		return true
+	}
+
+	switch r.Freq {
+	case "DAILY":
+		for day := first; add(day); day = day.AddDate(0, 0, r.Interval) {
+		}
+	case "WEEKLY":
+		byDay := r.ByDay
+		if len(byDay) == 0 {
+			byDay = []time.Weekday{first.Weekday()}
+		}
+		// Weeks start on Monday (the iCalendar default WKST)
+		weekStart := first.AddDate(0, 0, -((int(first.Weekday()) + 6) % 7))
+		for week := weekStart; ; week = week.AddDate(0, 0, 7*r.Interval) {
+			for offset := 0; offset < 7; offset++ {
+				day := week.AddDate(0, 0, offset)
+				if containsWeekday(byDay, day.Weekday()) && !add(day) {
+					return dates, nil
+				}
+			}
+		}
+	case "MONTHLY":
+		// Months without the start day (e.g. the 31st) are skipped
+		for month := 0; ; month += r.Interval {
+			day := time.Date(first.Year(), first.Month()+time.Month(month), first.Day(), 0, 0, 0, 0, time.UTC)
+			if day.Day() != first.Day() {
+				if !r.Until.IsZero() && day.After(r.Until) {
+					break
+				}
+				continue
+			}
+			if !add(day) {
+				break
+			}
+		}
+	}
+
+	return dates, nil
+}
+
+func containsWeekday(days []time.Weekday, day time.Weekday) bool {
+	for _, d := range days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+// pickle/backend/schedule/schedule.go
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DateLayout is the format used for booking dates
+const DateLayout = "2006-01-02"
+
+// DefaultSlotMinutes is the granularity at which availability is offered
+const DefaultSlotMinutes = 30
+
+// DefaultOpeningHours is used for facilities without configured opening hours
+var DefaultOpeningHours = Window{Start: 6 * 60, End: 22 * 60}
+
+// Window is a time range within a day, in minutes since midnight.
+// Start is inclusive and End is exclusive.
+type Window struct {
+	Start int
+	End   int
+}
+
+// ParseWindow parses a start and end time in 24-hour HH:MM (or HH:MM:SS) format
+func ParseWindow(startTime, endTime string) (Window, error) {
+	start, err := ParseClock(startTime)
+	if err != nil {
+		return Window{}, errors.New("invalid start time format")
+	}
+
+	end, err := ParseClock(endTime)
+	if err != nil {
+		return Window{}, errors.New("invalid end time format")
+	}
+
+	if end <= start {
+		return Window{}, errors.New("end time must be after start time")
+	}
+
+	return Window{Start: start, End: end}, nil
+}
+
+// ParseClock parses a 24-hour HH:MM (or HH:MM:SS) time into minutes since midnight
+func ParseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		t, err = time.Parse("15:04:05", value)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// FormatClock formats minutes since midnight as HH:MM
+func FormatClock(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// StartTime returns the window start as HH:MM
+func (w Window) StartTime() string {
+	return FormatClock(w.Start)
+}
+
+// EndTime returns the window end as HH:MM
+func (w Window) EndTime() string {
+	return FormatClock(w.End)
+}
+
+// Overlaps reports whether two windows share any time
+func (w Window) Overlaps(other Window) bool {
+	return w.Start < other.End && other.Start < w.End
+}
+
+// Contains reports whether other lies entirely within w
+func (w Window) Contains(other Window) bool {
+	return w.Start <= other.Start && other.End <= w.End
+}
+
+// Booked is an active booking occupying a court unit
+type Booked struct {
+	UnitID string
+	Window Window
+}
+
+// FreeUnits returns the units, in the given order, that have no booking
+// overlapping w. This is the single conflict rule shared by booking
+// creation and availability.
+func FreeUnits(unitIDs []string, booked []Booked, w Window) []string {
+	var free []string
+	for _, unitID := range unitIDs {
+		taken := false
+		for _, b := range booked {
+			if b.UnitID == unitID && b.Window.Overlaps(w) {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			free = append(free, unitID)
+		}
+	}
+	return free
+}
+
+// PickUnit chooses the unit a booking for w should be placed on.
+// If requested is set only that unit is considered; otherwise preferred is
+// tried before the remaining units. It returns "" if no unit is free.
+func PickUnit(unitIDs []string, booked []Booked, w Window, requested, preferred string) string {
+	free := FreeUnits(unitIDs, booked, w)
+	if requested != "" {
+		for _, unitID := range free {
+			if unitID == requested {
+				return unitID
+			}
+		}
+		return ""
+	}
+
+	for _, unitID := range free {
+		if unitID == preferred {
+			return unitID
+		}
+	}
+	if len(free) > 0 {
+		return free[0]
+	}
+	return ""
+}
+
+// Slot is a bookable time window together with the units free during it
+type Slot struct {
+	Window  Window
+	UnitIDs []string
+}
+
+// Slots returns every window of the given duration that starts on a step
+// boundary inside open and has at least one free unit
+func Slots(open Window, duration, step int, unitIDs []string, booked []Booked) []Slot {
+	var slots []Slot
+	if duration <= 0 || step <= 0 {
+		return slots
+	}
+
+	for start := open.Start; start+duration <= open.End; start += step {
+		w := Window{Start: start, End: start + duration}
+		free := FreeUnits(unitIDs, booked, w)
+		if len(free) > 0 {
+			slots = append(slots, Slot{Window: w, UnitIDs: free})
+		}
+	}
+	return slots
+}
+
+// MaxRangeDays limits how many days a single availability query may span
+const MaxRangeDays = 31
+
+// DateRange returns every date from from to to, inclusive
+func DateRange(from, to string) ([]string, error) {
+	fromDate, err := time.Parse(DateLayout, from)
+	if err != nil {
+		return nil, errors.New("invalid from date format")
+	}
+
+	toDate, err := time.Parse(DateLayout, to)
+	if err != nil {
+		return nil, errors.New("invalid to date format")
+	}
+
+	if toDate.Before(fromDate) {
+		return nil, errors.New("to date must not be before from date")
+	}
+
+	if toDate.Sub(fromDate) >= MaxRangeDays*24*time.Hour {
+		return nil, fmt.Errorf("date range must not exceed %d days", MaxRangeDays)
+	}
+
+	var dates []string
+	for d := fromDate; !d.After(toDate); d = d.AddDate(0, 0, 1) {
+		dates = append(dates, d.Format(DateLayout))
+	}
+	return dates, nil
+}
@@ -8,7 +8,10 @@ import (
 	"math/rand"
 	"time"
 
+	"github.com/carlostbanks/pickle/cancellation"
 	"github.com/carlostbanks/pickle/config"
+	"github.com/carlostbanks/pickle/pricing"
+	"github.com/carlostbanks/pickle/schedule"
 	"github.com/google/uuid"
 	"github.com/lib/pq"
 )
@@ -25,6 +28,45 @@ type Court struct {
 	ImageURL       string
 }
 
+// sampleRates is the price list of every sample court: $40/hour ($30 for
+// members), with peak rates on weekday evenings and weekend mornings
+var sampleRates = pricing.RateTable{
+	Currency:           "USD",
+	Base:               pricing.Rate{Guest: 4000, Member: 3000},
+	MinDurationMinutes: 60,
+	Peaks:              samplePeaks(),
+}
+
+// samplePolicy is the cancellation policy of every sample court: free until
+// 24 hours before the start, half refunded until 6 hours before, and no
+// cancellations in the last 2 hours
+var samplePolicy = cancellation.Policy{
+	FreeUntilHours:          24,
+	PartialRefundUntilHours: 6,
+	PartialRefundPercent:    50,
+	NoCancelHours:           2,
+	NoShowFeePercent:        100,
+}
+
+func samplePeaks() []pricing.PeakWindow {
+	var peaks []pricing.PeakWindow
+	for weekday := time.Monday; weekday <= time.Friday; weekday++ {
+		peaks = append(peaks, pricing.PeakWindow{
+			Weekday: weekday,
+			Window:  schedule.Window{Start: 17 * 60, End: 21 * 60},
+			Rate:    pricing.Rate{Guest: 5600, Member: 4200},
+		})
+	}
+	for _, weekday := range []time.Weekday{time.Saturday, time.Sunday} {
+		peaks = append(peaks, pricing.PeakWindow{
+			Weekday: weekday,
+			Window:  schedule.Window{Start: 8 * 60, End: 12 * 60},
+			Rate:    pricing.Rate{Guest: 5600, Member: 4200},
+		})
+	}
+	return peaks
+}
+
 // Sample court data
 var sampleCourts = []Court{
 	{
@@ -103,7 +145,7 @@ var sampleUsers = []struct {
 
 func main() {
 	// Load configuration
-	cfg, err := config.Load()
+	cfg, _, err := config.Load(nil)
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
@@ -128,8 +170,68 @@ func main() {
 		`, id, court.Name, court.Address, court.Latitude, court.Longitude, court.NumberOfCourts, pq.Array(court.Amenities), court.ImageURL, time.Now())
 		if err != nil {
 			log.Printf("Error inserting court %s: %v", court.Name, err)
-		} else {
-			log.Printf("Inserted court: %s", court.Name)
+			continue
+		}
+		log.Printf("Inserted court: %s", court.Name)
+
+		// Insert one unit per court
+		for n := 1; n <= court.NumberOfCourts; n++ {
+			_, err := db.Exec(`
+				INSERT INTO court_units (id, court_id, name, position)
+				VALUES ($1, $2, $3, $4)
+				ON CONFLICT DO NOTHING
+			`, fmt.Sprintf("%s-%d", id, n), id, fmt.Sprintf("Court %d", n), n)
+			if err != nil {
+				log.Printf("Error inserting unit %d of court %s: %v", n, court.Name, err)
+			}
+		}
+
+		// Open 07:00 to 22:00, and 08:00 to 20:00 on Sundays
+		for weekday := 0; weekday < 7; weekday++ {
+			openTime, closeTime := "07:00", "22:00"
+			if weekday == 0 {
+				openTime, closeTime = "08:00", "20:00"
+			}
+			_, err := db.Exec(`
+				INSERT INTO court_opening_hours (court_id, weekday, open_time, close_time)
+				VALUES ($1, $2, $3, $4)
+				ON CONFLICT DO NOTHING
+			`, id, weekday, openTime, closeTime)
+			if err != nil {
+				log.Printf("Error inserting opening hours of court %s: %v", court.Name, err)
+			}
+		}
+
+		// Insert the price list
+		_, err = db.Exec(`
+			INSERT INTO court_rates (court_id, currency, guest_rate_cents, member_rate_cents, min_duration_minutes)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT DO NOTHING
+		`, id, sampleRates.Currency, sampleRates.Base.Guest, sampleRates.Base.Member, sampleRates.MinDurationMinutes)
+		if err != nil {
+			log.Printf("Error inserting rates of court %s: %v", court.Name, err)
+		}
+		for _, peak := range sampleRates.Peaks {
+			_, err := db.Exec(`
+				INSERT INTO court_peak_rates (court_id, weekday, start_time, end_time, guest_rate_cents, member_rate_cents)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				ON CONFLICT DO NOTHING
+			`, id, int(peak.Weekday), peak.Window.StartTime(), peak.Window.EndTime(), peak.Rate.Guest, peak.Rate.Member)
+			if err != nil {
+				log.Printf("Error inserting peak rates of court %s: %v", court.Name, err)
+			}
+		}
+
+		// Insert the cancellation policy
+		_, err = db.Exec(`
+			INSERT INTO court_cancellation_policies (court_id, free_until_hours, partial_refund_until_hours,
+				partial_refund_percent, no_cancel_hours, no_show_fee_percent)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT DO NOTHING
+		`, id, samplePolicy.FreeUntilHours, samplePolicy.PartialRefundUntilHours, samplePolicy.PartialRefundPercent,
+			samplePolicy.NoCancelHours, samplePolicy.NoShowFeePercent)
+		if err != nil {
+			log.Printf("Error inserting cancellation policy of court %s: %v", court.Name, err)
 		}
 	}
 
@@ -148,28 +250,28 @@ func main() {
 	}
 
 	// Insert bookings
-	// Get court IDs
-	rows, err := db.Query("SELECT id FROM courts")
+	// Get court units
+	rows, err := db.Query("SELECT id, court_id FROM court_units")
 	if err != nil {
-		log.Fatalf("Failed to get court IDs: %v", err)
+		log.Fatalf("Failed to get court units: %v", err)
 	}
 	defer rows.Close()
 
-	var courtIDs []string
+	var units []struct{ ID, CourtID string }
 	for rows.Next() {
-		var id string
-		if err := rows.Scan(&id); err != nil {
-			log.Printf("Error scanning court ID: %v", err)
+		var unit struct{ ID, CourtID string }
+		if err := rows.Scan(&unit.ID, &unit.CourtID); err != nil {
+			log.Printf("Error scanning court unit: %v", err)
 			continue
 		}
-		courtIDs = append(courtIDs, id)
+		units = append(units, unit)
 	}
 
 	// Generate bookings for the next 7 days
 	for day := 0; day < 7; day++ {
 		date := time.Now().AddDate(0, 0, day).Format("2006-01-02")
 
-		for _, courtID := range courtIDs {
+		for _, unit := range units {
 			// Generate 1-3 bookings per court per day
 			numBookings := rand.Intn(3) + 1
 
@@ -180,34 +282,47 @@ func main() {
 				endTime := fmt.Sprintf("%02d:00", hour+1)
 
 				// Pick a random user
-				userID := sampleUsers[rand.Intn(len(sampleUsers))].ID
+				organizer := sampleUsers[rand.Intn(len(sampleUsers))]
+				userID := organizer.ID
 
 				// Generate random number of players (2 or 4)
 				numPlayers := (rand.Intn(2) + 1) * 2
 
-				// Generate random player emails
-				playerEmails := []string{sampleUsers[rand.Intn(len(sampleUsers))].Email}
+				// Invite other users to play with the organizer
+				var playerIDs, playerEmails []string
 				for len(playerEmails) < numPlayers-1 {
-					email := sampleUsers[rand.Intn(len(sampleUsers))].Email
-					if !contains(playerEmails, email) {
-						playerEmails = append(playerEmails, email)
+					player := sampleUsers[rand.Intn(len(sampleUsers))]
+					if player.ID != organizer.ID && !contains(playerEmails, player.Email) {
+						playerIDs = append(playerIDs, player.ID)
+						playerEmails = append(playerEmails, player.Email)
 					}
 				}
 
 				// Generate booking ID
 				bookingID := uuid.New().String()
 
+				// Price the booking at the guest rates
+				quote, err := sampleRates.Quote(date, schedule.Window{Start: hour * 60, End: (hour + 1) * 60}, false)
+				if err != nil {
+					log.Printf("Error pricing booking: %v", err)
+					continue
+				}
+
 				// Insert booking
-				_, err := db.Exec(`
-					INSERT INTO bookings (id, court_id, user_id, date, start_time, end_time, number_of_players, player_emails, status, created_at, updated_at)
-					VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
-					ON CONFLICT (court_id, date, start_time) DO NOTHING
-				`, bookingID, courtID, userID, date, startTime, endTime, numPlayers, pq.Array(playerEmails), "CONFIRMED", time.Now(), time.Now())
+				_, err = db.Exec(`
+					INSERT INTO bookings (id, court_id, court_unit_id, user_id, date, start_time, end_time, number_of_players, price_cents, currency, status, created_at, updated_at)
+					VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+					ON CONFLICT DO NOTHING
+				`, bookingID, unit.CourtID, unit.ID, userID, date, startTime, endTime, numPlayers, quote.Total, quote.Currency, "CONFIRMED", time.Now(), time.Now())
+
+				if err == nil {
+					err = insertPlayers(db, bookingID, playerIDs, playerEmails)
+				}
 
 				if err != nil {
 					log.Printf("Error inserting booking: %v", err)
 				} else {
-					log.Printf("Inserted booking for court %s on %s at %s", courtID, date, startTime)
+					log.Printf("Inserted booking for court unit %s on %s at %s", unit.ID, date, startTime)
 				}
 			}
 		}
@@ -216,6 +331,21 @@ func main() {
 	log.Println("Mock data generation complete")
 }
 
+// insertPlayers invites registered users to a booking, in order
+func insertPlayers(db *sql.DB, bookingID string, userIDs, emails []string) error {
+	for i := range emails {
+		_, err := db.Exec(`
+			INSERT INTO booking_players (booking_id, email, user_id, position)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT DO NOTHING
+		`, bookingID, emails[i], userIDs[i], i+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Helper function to check if a slice contains a value
 func contains(slice []string, value string) bool {
 	for _, item := range slice {
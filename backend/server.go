@@ -2,140 +2,192 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"strings"
 	"time"
 
-	"github.com/golang-jwt/jwt/v4"
-	"github.com/google/uuid"
-	"github.com/joho/godotenv"
+	"github.com/carlostbanks/pickle/api"
+	"github.com/carlostbanks/pickle/auth"
+	"github.com/carlostbanks/pickle/auth/fakeoidc"
+	"github.com/carlostbanks/pickle/config"
+	"github.com/carlostbanks/pickle/db"
+	"github.com/carlostbanks/pickle/notifications"
+	"github.com/carlostbanks/pickle/payments"
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/services"
+	"github.com/carlostbanks/pickle/storage"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/rs/cors"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	"gorm.io/driver/postgres"
-	"gorm.io/gorm"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
-// Court represents a padel court
-type Court struct {
-	ID             string    `json:"id" gorm:"primaryKey"`
-	Name           string    `json:"name"`
-	Address        string    `json:"address"`
-	Latitude       float64   `json:"latitude"`
-	Longitude      float64   `json:"longitude"`
-	NumberOfCourts int       `json:"number_of_courts"`
-	Amenities      []string  `json:"amenities" gorm:"-"` // Handled separately
-	AmenitiesArray string    `json:"-" gorm:"column:amenities"`
-	ImageURL       string    `json:"image_url" gorm:"column:image_url"`
-	CreatedAt      time.Time `json:"created_at"`
-}
-
-// TableName sets the table name for Court model
-func (Court) TableName() string {
-	return "courts"
-}
+var scheduler *services.SchedulerServer
 
-// Booking represents a court booking
-type Booking struct {
-	ID                string    `json:"id" gorm:"primaryKey"`
-	CourtID           string    `json:"court_id" gorm:"column:court_id"`
-	UserID            string    `json:"user_id" gorm:"column:user_id"`
-	Date              string    `json:"date"`
-	StartTime         string    `json:"start_time" gorm:"column:start_time"`
-	EndTime           string    `json:"end_time" gorm:"column:end_time"`
-	NumberOfPlayers   int       `json:"number_of_players" gorm:"column:number_of_players"`
-	PlayerEmails      []string  `json:"player_emails" gorm:"-"`
-	PlayerEmailsArray string    `json:"-" gorm:"column:player_emails"`
-	Status            string    `json:"status"`
-	CreatedAt         time.Time `json:"created_at"`
-	UpdatedAt         time.Time `json:"updated_at"`
-}
+var store *storage.Store
 
-// TableName sets the table name for Booking model
-func (Booking) TableName() string {
-	return "bookings"
-}
+var sessions *auth.SessionStore
 
-// User represents a user
-type User struct {
-	ID        string    `json:"id" gorm:"primaryKey"`
-	Email     string    `json:"email"`
-	Name      string    `json:"name"`
-	Picture   string    `json:"picture"`
-	CreatedAt time.Time `json:"created_at"`
-}
+var apiKeys *auth.KeyStore
 
-// TableName sets the table name for User model
-func (User) TableName() string {
-	return "users"
-}
+// magicLinks is nil unless magic link login is enabled
+var magicLinks *auth.MagicLinks
 
-var db *gorm.DB
+// reapInterval is how often expired holds and lapsed offers are released
+const reapInterval = time.Minute
 
-var (
-	googleOAuthConfig *oauth2.Config
-	oauthStateString  = "random-state" // In production, generate a random state string
-)
+// retryInterval is how often emails that failed to send are retried
+const retryInterval = time.Minute
 
-var jwtSecret = []byte("your-secret-key")
+// createdMethods are the RPCs answered with 201 Created over REST
+var createdMethods = map[string]bool{
+	"/scheduler.SchedulerService/CreateBooking":       true,
+	"/scheduler.SchedulerService/HoldBooking":         true,
+	"/scheduler.SchedulerService/PayBooking":          true,
+	"/scheduler.SchedulerService/CreateBookingSeries": true,
+	"/scheduler.SchedulerService/JoinWaitlist":        true,
+}
 
 func main() {
-	// Connect to database
-	// Load .env file if it exists
-	if err := godotenv.Load(); err != nil {
-		log.Println("No .env file found, using environment variables")
+	// Load configuration from the file, the environment and the flags; what
+	// is left of the arguments is the command
+	cfg, args, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
 	}
-	var err error
-	dsn := "host=localhost user=postgres password=postgres dbname=pickle port=5432 sslmode=disable"
-	db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	// pickle config shows the configuration instead of serving
+	if len(args) > 0 && args[0] == "config" {
+		runConfig(cfg, args[1:])
+		return
+	}
+
+	// pickle migrate manages the schema instead of serving
+	if len(args) > 0 && args[0] == "migrate" {
+		runMigrate(cfg, args[1:])
+		return
+	}
+	if len(args) > 0 {
+		log.Fatalf("Unknown command %q: expected migrate or config", args[0])
+	}
+
+	// Connect to the database. Postgres databases must be migrated first;
+	// SQLite files get their schema when opened.
+	var conn *sql.DB
+	store, conn, err = storage.Open(context.Background(), cfg.Database)
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
+	defer conn.Close()
+	log.Printf("Successfully connected to %s database", cfg.Database.Driver)
+	if cfg.Database.Driver == config.DriverPostgres {
+		if err := db.CheckMigrations(context.Background(), conn); err != nil {
+			log.Fatalf("Database schema is not up to date: %v. Run `go run . migrate up` first.", err)
+		}
+
+		// Set connection pool settings
+		conn.SetMaxIdleConns(10)
+		conn.SetMaxOpenConns(100)
+		conn.SetConnMaxLifetime(time.Hour)
+	}
 
-	// Get the underlying SQL DB
-	sqlDB, err := db.DB()
+	// Initialize the identity providers and the JWT signing key, and check
+	// access tokens against their sessions. API keys are accepted too.
+	auth.InitAuth(cfg.Auth)
+	sessions = auth.NewSessionStore(store.Sessions)
+	auth.UseSessions(sessions)
+	apiKeys = auth.NewKeyStore(store.APIKeys, store.Users)
+	auth.UseAPIKeys(apiKeys)
+	if cfg.Auth.MagicLink {
+		magicLinks = auth.NewMagicLinks(store.MagicLinks, auth.LogMailer{}, cfg.Auth.BaseURL+"/auth/email/callback")
+	}
+
+	// Initialize the payment provider
+	paymentProvider, err := payments.New(cfg.Payments.Provider, cfg.Payments.APIKey, cfg.Payments.WebhookSecret)
+	if err != nil {
+		log.Fatalf("Failed to initialize payments: %v", err)
+	}
+
+	// Emails are queued in the outbox and sent in the background
+	sender, err := notifications.New(cfg.Mail)
 	if err != nil {
-		log.Fatalf("Failed to get DB: %v", err)
+		log.Fatalf("Failed to initialize mail: %v", err)
 	}
+	outbox := notifications.NewOutbox(store.Outbox, sender)
 
-	// Set connection pool settings
-	sqlDB.SetMaxIdleConns(10)
-	sqlDB.SetMaxOpenConns(100)
-	sqlDB.SetConnMaxLifetime(time.Hour)
+	scheduler = services.NewSchedulerServer(store, paymentProvider, outbox, cfg.Auth.FrontendURL)
 
-	log.Println("Connected to database successfully")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	// Initialize OAuth config
-	googleOAuthConfig = &oauth2.Config{
-		RedirectURL:  "http://localhost:8080/auth/google/callback",
-		ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
-		ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
-		Scopes:       []string{"https://www.googleapis.com/auth/userinfo.email", "https://www.googleapis.com/auth/userinfo.profile"},
-		Endpoint:     google.Endpoint,
+	go outbox.Run(ctx, retryInterval)
+
+	// Release expired holds, pass lapsed waitlist offers on and queue
+	// reminders
+	go scheduler.RunReaper(ctx, reapInterval)
+
+	// Start the gRPC server
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Server.GRPCPort))
+	if err != nil {
+		log.Fatalf("Failed to listen on gRPC port: %v", err)
+	}
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(auth.AuthInterceptor))
+	proto.RegisterSchedulerServiceServer(grpcServer, scheduler)
+
+	go func() {
+		log.Printf("Starting gRPC server on port %d", cfg.Server.GRPCPort)
+		if err := grpcServer.Serve(listener); err != nil {
+			log.Fatalf("Failed to serve gRPC: %v", err)
+		}
+	}()
+
+	// Serve the REST API through grpc-gateway
+	gateway, err := newGateway(ctx, cfg.GetGRPCAddress())
+	if err != nil {
+		log.Fatalf("Failed to register gateway: %v", err)
 	}
 
 	// Set up HTTP routes with logging
-	setupRoutes()
+	mux := http.NewServeMux()
+	setupRoutes(mux, gateway, cfg.Auth)
+
+	// Serve the fake identity provider next to the API, so logins work
+	// without reaching a real one
+	if cfg.Auth.FakeIssuer {
+		issuer, err := fakeoidc.NewIssuer(cfg.Auth.BaseURL+config.FakeIssuerPath, config.FakeClientID, config.FakeClientSecret)
+		if err != nil {
+			log.Fatalf("Failed to create fake issuer: %v", err)
+		}
+		mux.Handle(config.FakeIssuerPath+"/", http.StripPrefix(config.FakeIssuerPath, issuer))
+		log.Printf("Serving fake OpenID Connect issuer at %s%s", cfg.Auth.BaseURL, config.FakeIssuerPath)
+	}
 
 	// Set up CORS wrapper
 	corsHandler := cors.New(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:3000"},
+		AllowedOrigins:   []string{cfg.Auth.FrontendURL},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Content-Type", "Authorization"},
 		AllowCredentials: true,
-	}).Handler(http.DefaultServeMux)
+	}).Handler(mux)
 
 	// Start HTTP server with CORS middleware
-	port := os.Getenv("HTTP_PORT")
-	if port == "" {
-		port = "8080"
-	}
-	log.Printf("Starting HTTP server on port %s", port)
-	if err := http.ListenAndServe(":"+port, corsHandler); err != nil {
+	log.Printf("Starting HTTP server on port %d", cfg.Server.HTTPPort)
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Server.HTTPPort), corsHandler); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
@@ -154,201 +206,61 @@ func logMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// setupRoutes sets up all HTTP routes with logging middleware
-func setupRoutes() {
-	// Your existing routes...
-	http.HandleFunc("/health", logMiddleware(healthHandler))
-	http.HandleFunc("/api/courts", logMiddleware(courtsHandler))
-	http.HandleFunc("/api/courts/", logMiddleware(courtDetailHandler))
-	http.HandleFunc("/api/bookings", logMiddleware(bookingsHandler))
-	http.HandleFunc("/api/bookings/", logMiddleware(bookingDetailHandler))
-
-	// Add Google OAuth routes
-	http.HandleFunc("/auth/google/login", logMiddleware(handleGoogleLogin))
-	http.HandleFunc("/auth/google/callback", logMiddleware(handleGoogleCallback))
-	http.HandleFunc("/auth/logout", logMiddleware(logoutHandler))
-
-	// Add user API endpoint
-	http.HandleFunc("/api/users/me", logMiddleware(getCurrentUser))
-}
-
-// Google OAuth login handler
-func handleGoogleLogin(w http.ResponseWriter, r *http.Request) {
-	url := googleOAuthConfig.AuthCodeURL(oauthStateString)
-	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
-}
-
-// Google OAuth callback handler
-func handleGoogleCallback(w http.ResponseWriter, r *http.Request) {
-	// Verify state
-	state := r.FormValue("state")
-	if state != oauthStateString {
-		http.Error(w, "Invalid state", http.StatusBadRequest)
-		return
-	}
-
-	// Exchange code for token
-	code := r.FormValue("code")
-	token, err := googleOAuthConfig.Exchange(r.Context(), code)
-	if err != nil {
-		log.Printf("Code exchange failed: %v", err)
-		http.Error(w, "Code exchange failed", http.StatusInternalServerError)
-		return
-	}
-
-	// Get user info
-	client := googleOAuthConfig.Client(r.Context(), token)
-	resp, err := client.Get("https://www.googleapis.com/oauth2/v2/userinfo")
-	if err != nil {
-		log.Printf("Failed to get user info: %v", err)
-		http.Error(w, "Failed to get user info", http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Parse user info
-	var userInfo struct {
-		ID      string `json:"id"`
-		Email   string `json:"email"`
-		Name    string `json:"name"`
-		Picture string `json:"picture"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
-		log.Printf("Failed to parse user info: %v", err)
-		http.Error(w, "Failed to parse user info", http.StatusInternalServerError)
-		return
-	}
-
-	// Create or update user in database
-	user := User{
-		ID:        userInfo.ID,
-		Email:     userInfo.Email,
-		Name:      userInfo.Name,
-		Picture:   userInfo.Picture,
-		CreatedAt: time.Now(),
-	}
+// setupRoutes sets up all HTTP routes with logging middleware. Everything
+// under /api that is not handled here is served by the gateway.
+func setupRoutes(mux *http.ServeMux, gateway http.Handler, authConfig config.AuthConfig) {
+	mux.HandleFunc("/health", logMiddleware(healthHandler))
+	mux.HandleFunc("/api/", logMiddleware(gateway.ServeHTTP))
 
-	// Check if user exists
-	var existingUser User
-	result := db.Where("id = ?", user.ID).First(&existingUser)
-	if result.Error != nil {
-		if result.Error == gorm.ErrRecordNotFound {
-			// Create new user
-			if err := db.Create(&user).Error; err != nil {
-				log.Printf("Failed to create user: %v", err)
-				http.Error(w, "Failed to create user", http.StatusInternalServerError)
-				return
-			}
-		} else {
-			log.Printf("Database error: %v", result.Error)
-			http.Error(w, "Database error", http.StatusInternalServerError)
-			return
-		}
-	} else {
-		// Update existing user
-		existingUser.Email = user.Email
-		existingUser.Name = user.Name
-		existingUser.Picture = user.Picture
-		if err := db.Save(&existingUser).Error; err != nil {
-			log.Printf("Failed to update user: %v", err)
-			http.Error(w, "Failed to update user", http.StatusInternalServerError)
-			return
-		}
+	// The provider signs the raw request, so webhooks bypass the gateway
+	mux.HandleFunc("/api/payments/webhook", logMiddleware(paymentWebhookHandler))
 
-		// Use the updated user
-		user = existingUser
-	}
+	// Login, sessions and the current user
+	api.NewAuthHandler(authConfig, store.Users, sessions, magicLinks).RegisterRoutes(mux, logMiddleware)
 
-	// Create JWT token
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims := &jwt.RegisteredClaims{
-		Subject:   user.ID,
-		ExpiresAt: jwt.NewNumericDate(expirationTime),
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
-	}
+	// API keys of users and facilities
+	api.NewKeysHandler(apiKeys).RegisterRoutes(mux, logMiddleware)
+}
 
-	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := jwtToken.SignedString(jwtSecret)
+// newGateway returns the REST API, served by grpc-gateway calling the gRPC
+// server at grpcAddress so requests go through the same interceptors
+func newGateway(ctx context.Context, grpcAddress string) (*runtime.ServeMux, error) {
+	gateway := runtime.NewServeMux(
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.JSONPb{
+			MarshalOptions:   protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true},
+			UnmarshalOptions: protojson.UnmarshalOptions{DiscardUnknown: true},
+		}),
+		runtime.WithMetadata(tokenCookieMetadata),
+		runtime.WithForwardResponseOption(setCreatedStatus),
+	)
+	err := proto.RegisterSchedulerServiceHandlerFromEndpoint(ctx, gateway, grpcAddress,
+		[]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())})
 	if err != nil {
-		log.Printf("Failed to generate JWT: %v", err)
-		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-
-	// Set JWT token in cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    tokenString,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   false,     // Set to true in production with HTTPS
-		MaxAge:   3600 * 24, // 24 hours
-	})
-
-	// Redirect back to frontend with token in URL
-	// This allows the frontend to capture the token
-	redirectURL := fmt.Sprintf("http://localhost:3000/auth-callback?token=%s", tokenString)
-	http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
+	return gateway, nil
 }
 
-// Get current user handler
-func getCurrentUser(w http.ResponseWriter, r *http.Request) {
-	// Get token from Authorization header
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		// Try to get from cookie as fallback
-		cookie, err := r.Cookie("token")
-		if err != nil {
-			http.Error(w, "Not authenticated", http.StatusUnauthorized)
-			return
-		}
-		authHeader = "Bearer " + cookie.Value
+// tokenCookieMetadata forwards the token cookie set at login as the
+// authorization metadata checked by auth.AuthInterceptor, for browser
+// requests without an Authorization header
+func tokenCookieMetadata(ctx context.Context, r *http.Request) metadata.MD {
+	if r.Header.Get("Authorization") != "" {
+		return nil
 	}
-
-	// Extract token from Bearer prefix
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-
-	// Parse and validate token
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
-		// Validate signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return jwtSecret, nil
-	})
-
+	cookie, err := r.Cookie("token")
 	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return
-	}
-
-	// Extract user ID from claims
-	claims, ok := token.Claims.(*jwt.RegisteredClaims)
-	if !ok || !token.Valid {
-		http.Error(w, "Invalid token claims", http.StatusUnauthorized)
-		return
-	}
-
-	userID := claims.Subject
-
-	// Get user from database
-	var user User
-	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			http.Error(w, "User not found", http.StatusNotFound)
-		} else {
-			log.Printf("Database error: %v", err)
-			http.Error(w, "Database error", http.StatusInternalServerError)
-		}
-		return
+		return nil
 	}
+	return metadata.Pairs("authorization", "Bearer "+cookie.Value)
+}
 
-	// Return user as JSON
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(user); err != nil {
-		log.Printf("Error encoding user: %v", err)
+// setCreatedStatus answers successful calls of createdMethods with 201 Created
+func setCreatedStatus(ctx context.Context, w http.ResponseWriter, _ protoreflect.ProtoMessage) error {
+	if method, ok := runtime.RPCMethod(ctx); ok && createdMethods[method] {
+		w.WriteHeader(http.StatusCreated)
 	}
+	return nil
 }
 
 // healthHandler is a simple health check endpoint
@@ -357,446 +269,35 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Server is healthy"))
 }
 
-// courtsHandler handles GET requests for courts
-func courtsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Get query parameters
-	city := r.URL.Query().Get("city")
-
-	// Initialize query with GORM
-	query := db
-
-	// Add filters if provided
-	if city != "" {
-		query = query.Where("address LIKE ?", "%"+city+"%")
-	}
-
-	// Fetch courts
-	var courts []Court
-	if err := query.Find(&courts).Error; err != nil {
-		log.Printf("Error querying courts: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-
-	// Process amenities for each court (convert PostgreSQL array to Go slice)
-	for i := range courts {
-		amenitiesStr := strings.Trim(courts[i].AmenitiesArray, "{}")
-		if amenitiesStr != "" {
-			courts[i].Amenities = strings.Split(amenitiesStr, ",")
-		} else {
-			courts[i].Amenities = []string{}
-		}
-	}
-
-	// Return JSON response
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(map[string]interface{}{
-		"courts": courts,
-	}); err != nil {
-		log.Printf("Error encoding response: %v", err)
-	}
-}
-
-// courtDetailHandler handles GET requests for a specific court
-func courtDetailHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Extract court ID from URL
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 3 {
-		http.Error(w, "Invalid court ID", http.StatusBadRequest)
-		return
-	}
-	courtID := parts[len(parts)-1]
-
-	// Query court with GORM
-	var court Court
-	if err := db.First(&court, "id = ?", courtID).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			http.Error(w, "Court not found", http.StatusNotFound)
-		} else {
-			log.Printf("Error querying court: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-		}
-		return
-	}
-
-	// Process amenities
-	amenitiesStr := strings.Trim(court.AmenitiesArray, "{}")
-	if amenitiesStr != "" {
-		court.Amenities = strings.Split(amenitiesStr, ",")
-	} else {
-		court.Amenities = []string{}
-	}
-
-	// Return JSON response
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(court); err != nil {
-		log.Printf("Error encoding response: %v", err)
-	}
-}
-
-// bookingsHandler handles GET, POST requests for bookings
-func bookingsHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		getBookingsHandler(w, r)
-	case http.MethodPost:
-		createBookingHandler(w, r)
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-	}
-}
-
-func bookingDetailHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		getBookingsHandler(w, r)
-	case http.MethodPut:
-		updateBookingHandler(w, r)
-	case http.MethodDelete:
-		cancelBookingHandler(w, r)
-	default:
+// paymentWebhookHandler handles POST requests from the payment provider
+// about payments completed or declined outside of our API
+func paymentWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-	}
-}
-
-// And implement the cancel booking handler
-func cancelBookingHandler(w http.ResponseWriter, r *http.Request) {
-	// Get user ID from JWT token
-	userID := getUserIDFromRequest(r)
-	if userID == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	// Extract booking ID from URL
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 3 {
-		http.Error(w, "Invalid booking ID", http.StatusBadRequest)
 		return
 	}
 
-	bookingID := parts[len(parts)-1]
-
-	// Check if booking exists and belongs to this user
-	var booking Booking
-	if err := db.Where("id = ?", bookingID).First(&booking).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			http.Error(w, "Booking not found", http.StatusNotFound)
-		} else {
-			log.Printf("Database error: %v", err)
-			http.Error(w, "Database error", http.StatusInternalServerError)
-		}
-		return
-	}
-
-	// Verify that the booking belongs to the authenticated user
-	if booking.UserID != userID {
-		http.Error(w, "Not authorized to cancel this booking", http.StatusForbidden)
-		return
-	}
-
-	// Update booking status to CANCELLED
-	if err := db.Model(&booking).Update("status", "CANCELLED").Error; err != nil {
-		log.Printf("Error updating booking: %v", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
-	}
-
-	// Return success response
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": "Booking cancelled successfully",
-	}); err != nil {
-		log.Printf("Error encoding response: %v", err)
-	}
-}
-
-// updateBookingHandler handles PUT requests to update a booking
-func updateBookingHandler(w http.ResponseWriter, r *http.Request) {
-	// Get user ID from JWT token
-	userID := getUserIDFromRequest(r)
-	if userID == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	// Extract booking ID from URL
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 3 {
-		http.Error(w, "Invalid booking ID", http.StatusBadRequest)
-		return
-	}
-
-	bookingID := parts[len(parts)-1]
-
-	// Parse request body
-	var input struct {
-		StartTime       string   `json:"startTime"`
-		EndTime         string   `json:"endTime"`
-		NumberOfPlayers int      `json:"numberOfPlayers"`
-		PlayerEmails    []string `json:"playerEmails"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+	payload, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	// Fetch the booking
-	var booking Booking
-	if err := db.Where("id = ?", bookingID).First(&booking).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			http.Error(w, "Booking not found", http.StatusNotFound)
-		} else {
-			log.Printf("Database error: %v", err)
-			http.Error(w, "Database error", http.StatusInternalServerError)
-		}
-		return
-	}
-
-	// Verify ownership
-	if booking.UserID != userID {
-		http.Error(w, "Not authorized to update this booking", http.StatusForbidden)
-		return
-	}
-
-	// Update booking fields
-	booking.StartTime = input.StartTime
-	booking.EndTime = input.EndTime
-	booking.NumberOfPlayers = input.NumberOfPlayers
-	booking.PlayerEmailsArray = "{" + strings.Join(input.PlayerEmails, ",") + "}"
-	booking.UpdatedAt = time.Now()
-
-	// Save changes
-	if err := db.Save(&booking).Error; err != nil {
-		log.Printf("Error updating booking: %v", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
-	}
-
-	// Set player emails for response
-	booking.PlayerEmails = input.PlayerEmails
-
-	// Return updated booking
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(booking); err != nil {
-		log.Printf("Error encoding response: %v", err)
-	}
-}
-
-// getBookingsHandler handles GET requests for bookings
-func getBookingsHandler(w http.ResponseWriter, r *http.Request) {
-	// Get the authenticated user ID
-	authenticatedUserID := getUserIDFromRequest(r)
-	if authenticatedUserID == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	// Get query parameters
-	courtID := r.URL.Query().Get("court_id")
-	date := r.URL.Query().Get("date")
-
-	// Initialize query with GORM
-	query := db
-
-	// Always filter by authenticated user unless they're an admin (add admin check later)
-	// For now, we'll enforce that users can only see their own bookings
-	query = query.Where("user_id = ?", authenticatedUserID)
-
-	// Add additional filters if provided
-	if courtID != "" {
-		query = query.Where("court_id = ?", courtID)
-	}
-	if date != "" {
-		query = query.Where("date = ?", date)
-	}
-
-	// Add ordering
-	query = query.Order("date").Order("start_time")
-
-	// Fetch bookings
-	var bookings []Booking
-	if err := query.Find(&bookings).Error; err != nil {
-		log.Printf("Error querying bookings: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-
-	// Process player emails for each booking
-	for i := range bookings {
-		emailsStr := strings.Trim(bookings[i].PlayerEmailsArray, "{}")
-		if emailsStr != "" {
-			bookings[i].PlayerEmails = strings.Split(emailsStr, ",")
-		} else {
-			bookings[i].PlayerEmails = []string{}
+	// Events about unknown intents are acknowledged, so the provider stops
+	// retrying them
+	if err := scheduler.HandlePaymentWebhook(r.Context(), payload, r.Header); err != nil {
+		if errors.Is(err, payments.ErrInvalidSignature) {
+			log.Printf("Rejected payment webhook: %v", err)
+			http.Error(w, "Invalid webhook", http.StatusBadRequest)
+			return
 		}
-	}
-
-	// Return JSON response
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(map[string]interface{}{
-		"bookings": bookings,
-	}); err != nil {
-		log.Printf("Error encoding response: %v", err)
-	}
-}
-
-// createBookingHandler handles POST requests to create a booking
-func createBookingHandler(w http.ResponseWriter, r *http.Request) {
-
-	// Get user ID from token
-	userID := getUserIDFromRequest(r)
-	if userID == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	// Parse request body
-	var input struct {
-		CourtID         string   `json:"courtId"` // Changed from court_id to match frontend
-		Date            string   `json:"date"`
-		StartTime       string   `json:"startTime"`       // Changed from start_time
-		EndTime         string   `json:"endTime"`         // Changed from end_time
-		NumberOfPlayers int      `json:"numberOfPlayers"` // Changed from number_of_players
-		PlayerEmails    []string `json:"playerEmails"`    // Changed from player_emails
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
-	}
-
-	// Validate inputs
-	if input.CourtID == "" || input.Date == "" || input.StartTime == "" || input.EndTime == "" {
-		http.Error(w, "Missing required fields", http.StatusBadRequest)
-		return
-	}
-
-	// Check if court exists
-	var courtCount int64
-	if err := db.Model(&Court{}).Where("id = ?", input.CourtID).Count(&courtCount).Error; err != nil {
-		log.Printf("Error checking court: %v", err)
+		log.Printf("Error handling payment webhook: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	if courtCount == 0 {
-		http.Error(w, "Court not found", http.StatusNotFound)
-		return
-	}
 
-	// Check for conflicting bookings
-	var conflictCount int64
-	if err := db.Model(&Booking{}).
-		Where("court_id = ? AND date = ? AND status != 'CANCELLED'", input.CourtID, input.Date).
-		Where("(start_time <= ? AND end_time > ?) OR (start_time < ? AND end_time >= ?) OR (start_time >= ? AND end_time <= ?)",
-			input.StartTime, input.StartTime, input.EndTime, input.EndTime, input.StartTime, input.EndTime).
-		Count(&conflictCount).Error; err != nil {
-		log.Printf("Error checking conflicts: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-	if conflictCount > 0 {
-		http.Error(w, "Time slot is already booked", http.StatusConflict)
-		return
-	}
-
-	// Create booking
-	booking := Booking{
-		ID:                uuid.New().String(),
-		CourtID:           input.CourtID,
-		UserID:            userID, // Use the authenticated user's ID
-		Date:              input.Date,
-		StartTime:         input.StartTime,
-		EndTime:           input.EndTime,
-		NumberOfPlayers:   input.NumberOfPlayers,
-		PlayerEmailsArray: "{" + strings.Join(input.PlayerEmails, ",") + "}",
-		Status:            "CONFIRMED",
-		CreatedAt:         time.Now(),
-		UpdatedAt:         time.Now(),
-	}
-
-	if err := db.Create(&booking).Error; err != nil {
-		log.Printf("Error creating booking: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-
-	// Set email field for response
-	booking.PlayerEmails = input.PlayerEmails
-
-	// Return success response
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	if err := json.NewEncoder(w).Encode(booking); err != nil {
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"received": true}); err != nil {
 		log.Printf("Error encoding response: %v", err)
 	}
 }
-
-// Add this helper function to extract user ID from JWT token
-func getUserIDFromRequest(r *http.Request) string {
-	// Get token from Authorization header
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		// Try to get from cookie as fallback
-		cookie, err := r.Cookie("token")
-		if err != nil {
-			return ""
-		}
-		authHeader = "Bearer " + cookie.Value
-	}
-
-	// Extract token from Bearer prefix
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-
-	// Parse and validate token
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
-		// Validate signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return jwtSecret, nil
-	})
-
-	if err != nil {
-		return ""
-	}
-
-	// Extract user ID from claims
-	claims, ok := token.Claims.(*jwt.RegisteredClaims)
-	if !ok || !token.Valid {
-		return ""
-	}
-
-	return claims.Subject
-}
-
-// logoutHandler handles POST requests to log out a user
-func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	// Clear the token cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    "",
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   false, // Set to true in production with HTTPS
-		MaxAge:   -1,    // Delete the cookie
-	})
-
-	// Return success response
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]bool{
-		"success": true,
-	})
-}
@@ -0,0 +1,175 @@
+// pickle/backend/server_test.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/carlostbanks/pickle/auth"
+	"github.com/carlostbanks/pickle/config"
+	"github.com/carlostbanks/pickle/payments"
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/schedule"
+	"github.com/carlostbanks/pickle/services"
+	"github.com/carlostbanks/pickle/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// discardNotifier never delivers the emails queued
+type discardNotifier struct{}
+
+func (discardNotifier) Wake() {}
+
+// newTestAPI serves the REST API in front of a gRPC server on an in-memory
+// store with a facility of two courts, court-1, open from 06:00 to 22:00.
+// It returns the store and the URL of the API.
+func newTestAPI(t *testing.T) (*storage.Store, string) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	store := storage.NewMemory()
+	court := &proto.Court{Id: "court-1", Name: "Riverside", Address: "1 River Rd, Springfield",
+		NumberOfCourts: 2, MaxPlayers: 4}
+	for position := 1; position <= 2; position++ {
+		court.Units = append(court.Units, &proto.CourtUnit{Id: fmt.Sprintf("court-1-%d", position),
+			CourtId: court.Id, Name: fmt.Sprintf("Court %d", position), Position: int32(position)})
+	}
+	for weekday := int32(0); weekday < 7; weekday++ {
+		court.OpeningHours = append(court.OpeningHours,
+			&proto.OpeningHours{Weekday: weekday, OpenTime: "06:00", CloseTime: "22:00"})
+	}
+	if err := store.Courts.CreateCourt(ctx, court); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(auth.AuthInterceptor))
+	proto.RegisterSchedulerServiceServer(grpcServer,
+		services.NewSchedulerServer(store, payments.NewFake("webhook-secret"), discardNotifier{}, "https://pickle.example.com"))
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	gateway, err := newGateway(ctx, listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(gateway)
+	t.Cleanup(srv.Close)
+	return store, srv.URL
+}
+
+func TestAvailabilityDuration(t *testing.T) {
+	_, baseURL := newTestAPI(t)
+	date := time.Now().AddDate(0, 0, 7).Format(schedule.DateLayout)
+
+	// firstSlot returns the first slot the API lists with the query
+	firstSlot := func(query string) *proto.AvailableSlot {
+		t.Helper()
+		resp, err := http.Get(baseURL + "/api/courts/court-1/availability?from=" + date + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("availability%s got %d", query, resp.StatusCode)
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		availability := &proto.GetAvailabilityResponse{}
+		if err := protojson.Unmarshal(body, availability); err != nil {
+			t.Fatal(err)
+		}
+		if len(availability.Slots) == 0 {
+			t.Fatalf("availability%s listed no slots", query)
+		}
+		return availability.Slots[0]
+	}
+
+	if slot := firstSlot(""); slot.StartTime != "06:00" || slot.EndTime != "07:00" {
+		t.Errorf("first slot is %s-%s, expected an hour from 06:00", slot.StartTime, slot.EndTime)
+	}
+	if slot := firstSlot("&duration=90"); slot.StartTime != "06:00" || slot.EndTime != "07:30" {
+		t.Errorf("first slot of 90 minutes is %s-%s, expected 06:00-07:30", slot.StartTime, slot.EndTime)
+	}
+}
+
+func TestBookingConflictStatus(t *testing.T) {
+	store, baseURL := newTestAPI(t)
+	auth.InitAuth(config.AuthConfig{JWTSecret: "test-secret"})
+	const parallel = 10
+
+	// Each request is made by another user, so none is rejected as a
+	// duplicate of the same user's booking
+	tokens := make([]string, parallel)
+	for i := range tokens {
+		user := &storage.User{ID: fmt.Sprintf("player-%d", i), Email: fmt.Sprintf("player-%d@example.com", i), CreatedAt: time.Now()}
+		if err := store.Users.CreateUser(context.Background(), user); err != nil {
+			t.Fatal(err)
+		}
+		token, err := auth.GenerateJWT(&auth.User{ID: user.ID, Email: user.Email}, "session-"+user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[i] = token
+	}
+
+	body := fmt.Sprintf(`{"court_id": "court-1", "court_unit_id": "court-1-1", "date": %q, "start_time": "10:00", "end_time": "11:00"}`,
+		time.Now().AddDate(0, 0, 7).Format(schedule.DateLayout))
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	codes := make([]int, parallel)
+	for i, token := range tokens {
+		wg.Add(1)
+		go func(i int, token string) {
+			defer wg.Done()
+			<-start
+			req, err := http.NewRequest(http.MethodPost, baseURL+"/api/bookings", strings.NewReader(body))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			codes[i] = resp.StatusCode
+		}(i, token)
+	}
+	close(start)
+	wg.Wait()
+
+	created := 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+		default:
+			t.Errorf("booking got %d, expected %d or %d", code, http.StatusCreated, http.StatusConflict)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d of %d parallel bookings were created, expected one; the others get %d",
+			created, parallel, http.StatusConflict)
+	}
+}
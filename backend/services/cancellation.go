@@ -0,0 +1,156 @@
+// pickle/backend/services/cancellation.go
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/carlostbanks/pickle/auth"
+	"github.com/carlostbanks/pickle/cancellation"
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/schedule"
+	"github.com/carlostbanks/pickle/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MarkNoShow marks a confirmed booking that started as a no-show, charging
+// the facility's no-show fee. Only staff of the facility may do so.
+func (s *SchedulerServer) MarkNoShow(ctx context.Context, req *proto.MarkNoShowRequest) (*proto.Booking, error) {
+	principal, ok := auth.PrincipalFromContext(ctx)
+	if !ok {
+		return nil, errUnauthenticated
+	}
+
+	booking, err := s.getBooking(ctx, req.BookingId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only staff of the facility may report no-shows
+	if !principal.HasRole(auth.RoleStaff, booking.CourtId) {
+		return nil, status.Error(codes.PermissionDenied, "not authorized to mark this booking as a no-show")
+	}
+
+	if booking.Status != proto.BookingStatus_CONFIRMED {
+		return nil, errNotConfirmed
+	}
+
+	policy, err := s.loadCancellationPolicy(ctx, booking.CourtId)
+	if err != nil {
+		return nil, err
+	}
+
+	window, err := schedule.ParseWindow(booking.StartTime, booking.EndTime)
+	if err != nil {
+		return nil, invalidArgument(err)
+	}
+	startsAt, err := cancellation.StartsAt(booking.Date, window, time.Local)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	outcome, err := cancellationPolicy(policy).NoShow(startsAt, now, booking.PriceCents)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	err = s.store.Bookings.MarkNoShow(ctx, req.BookingId, outcome.Rule, outcome.FeeCents, now)
+	if errors.Is(err, storage.ErrStale) {
+		return nil, errNotConfirmed
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the fee and refund the rest of any payment
+	s.settlePayments(ctx, map[string]int64{req.BookingId: outcome.FeeCents})
+
+	return s.getBooking(ctx, req.BookingId)
+}
+
+// errNotConfirmed is returned when marking a booking that is not confirmed
+// as a no-show
+var errNotConfirmed = status.Error(codes.FailedPrecondition, "booking is not confirmed")
+
+// applyCancellationPolicy evaluates the cancellation of the given bookings
+// of a facility, ordered by date. Holds were never confirmed and are
+// released for free, and occurrences of a series that already took place are
+// left out. It fails if any of the bookings can no longer be cancelled.
+func (s *SchedulerServer) applyCancellationPolicy(ctx context.Context, courtID string, bookings []*proto.Booking) ([]*proto.Cancellation, error) {
+	stored, err := s.loadCancellationPolicy(ctx, courtID)
+	if err != nil {
+		return nil, err
+	}
+	policy := cancellationPolicy(stored)
+
+	now := time.Now()
+	var cancellations []*proto.Cancellation
+	var refused []string
+	var refusal error
+	for _, booking := range bookings {
+		outcome := cancellation.Outcome{Rule: cancellation.RuleFree}
+		if booking.Status == proto.BookingStatus_CONFIRMED {
+			window, err := schedule.ParseWindow(booking.StartTime, booking.EndTime)
+			if err != nil {
+				return nil, err
+			}
+			startsAt, err := cancellation.StartsAt(booking.Date, window, time.Local)
+			if err != nil {
+				return nil, err
+			}
+
+			outcome, err = policy.Cancel(startsAt, now, booking.PriceCents)
+			if errors.Is(err, cancellation.ErrStarted) && len(bookings) > 1 {
+				continue
+			}
+			if err != nil {
+				refused = append(refused, booking.Date)
+				refusal = err
+				continue
+			}
+		}
+
+		cancellations = append(cancellations, &proto.Cancellation{
+			BookingId: booking.Id,
+			Date:      booking.Date,
+			Rule:      outcome.Rule,
+			FeeCents:  outcome.FeeCents,
+		})
+	}
+
+	if len(refused) == 1 && len(bookings) == 1 {
+		return nil, status.Error(codes.FailedPrecondition, refusal.Error())
+	}
+	if len(refused) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "%v on %s", cancellation.ErrNoCancel, strings.Join(refused, ", "))
+	}
+	if len(cancellations) == 0 {
+		return nil, status.Error(codes.FailedPrecondition, cancellation.ErrStarted.Error())
+	}
+	return cancellations, nil
+}
+
+// loadCancellationPolicy loads the cancellation policy of a facility, or nil
+// if it has none
+func (s *SchedulerServer) loadCancellationPolicy(ctx context.Context, courtID string) (*proto.CancellationPolicy, error) {
+	return s.store.Courts.GetCancellationPolicy(ctx, courtID)
+}
+
+// cancellationPolicy converts a cancellation policy for evaluation. Bookings
+// of a facility without a policy can be cancelled for free until they start.
+func cancellationPolicy(policy *proto.CancellationPolicy) cancellation.Policy {
+	if policy == nil {
+		return cancellation.Policy{}
+	}
+	return cancellation.Policy{
+		FreeUntilHours:          int(policy.FreeUntilHours),
+		PartialRefundUntilHours: int(policy.PartialRefundUntilHours),
+		PartialRefundPercent:    int(policy.PartialRefundPercent),
+		NoCancelHours:           int(policy.NoCancelHours),
+		NoShowFeePercent:        int(policy.NoShowFeePercent),
+	}
+}
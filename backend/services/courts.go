@@ -0,0 +1,230 @@
+// pickle/backend/services/courts.go
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/carlostbanks/pickle/auth"
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/schedule"
+	"github.com/carlostbanks/pickle/storage"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// MaxCourtUnits bounds the number of courts of a facility
+const MaxCourtUnits = 50
+
+// errUpcomingBookings is returned when courts with upcoming bookings would
+// stop taking bookings
+var errUpcomingBookings = status.Error(codes.FailedPrecondition, "courts have upcoming bookings; cancel them first")
+
+// CreateCourt creates a facility with one unit per court
+func (s *SchedulerServer) CreateCourt(ctx context.Context, req *proto.CreateCourtRequest) (*proto.Court, error) {
+	principal, ok := auth.PrincipalFromContext(ctx)
+	if !ok {
+		return nil, errUnauthenticated
+	}
+	if !principal.IsPlatformAdmin() {
+		return nil, status.Error(codes.PermissionDenied, "not authorized to create courts")
+	}
+
+	court := &proto.Court{
+		Id:             uuid.New().String(),
+		Name:           req.Name,
+		Address:        req.Address,
+		Latitude:       req.Latitude,
+		Longitude:      req.Longitude,
+		NumberOfCourts: req.NumberOfCourts,
+		MaxPlayers:     req.MaxPlayers,
+		Amenities:      req.Amenities,
+		ImageUrl:       req.ImageUrl,
+	}
+	if err := normalizeCourt(court); err != nil {
+		return nil, err
+	}
+
+	court.Units = courtUnits(court)
+
+	if err := s.store.Courts.CreateCourt(ctx, court); err != nil {
+		return nil, err
+	}
+
+	return s.GetCourt(ctx, &proto.GetCourtRequest{CourtId: court.Id})
+}
+
+// UpdateCourt changes the details of a facility that are set in the
+// request, keeping the others. Lowering the number of courts archives the
+// units above it.
+func (s *SchedulerServer) UpdateCourt(ctx context.Context, req *proto.UpdateCourtRequest) (*proto.Court, error) {
+	principal, ok := auth.PrincipalFromContext(ctx)
+	if !ok {
+		return nil, errUnauthenticated
+	}
+
+	court, err := s.checkCourtAdmin(ctx, principal, req.CourtId)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Name != nil {
+		court.Name = *req.Name
+	}
+	if req.Address != nil {
+		court.Address = *req.Address
+	}
+	if req.Latitude != nil {
+		court.Latitude = *req.Latitude
+	}
+	if req.Longitude != nil {
+		court.Longitude = *req.Longitude
+	}
+	if req.NumberOfCourts != nil {
+		court.NumberOfCourts = *req.NumberOfCourts
+	}
+	if req.MaxPlayers != nil {
+		court.MaxPlayers = *req.MaxPlayers
+	}
+	if req.Amenities != nil {
+		court.Amenities = nil
+		for _, value := range req.Amenities.Values {
+			amenity, ok := value.Kind.(*structpb.Value_StringValue)
+			if !ok {
+				return nil, status.Error(codes.InvalidArgument, "amenities must be strings")
+			}
+			court.Amenities = append(court.Amenities, amenity.StringValue)
+		}
+	}
+	if req.ImageUrl != nil {
+		court.ImageUrl = *req.ImageUrl
+	}
+	if err := normalizeCourt(court); err != nil {
+		return nil, err
+	}
+
+	// Archived facilities keep their details as they were
+	court.Units = courtUnits(court)
+	err = s.store.Courts.UpdateCourt(ctx, court, time.Now().Format(schedule.DateLayout))
+	if err != nil {
+		return nil, courtAdminError(err, "court is archived")
+	}
+
+	return s.GetCourt(ctx, &proto.GetCourtRequest{CourtId: court.Id})
+}
+
+// ArchiveCourt stops a facility from taking bookings. The facility is kept,
+// so past bookings still refer to it, and users still waiting for one of its
+// slots are taken off the waitlist.
+func (s *SchedulerServer) ArchiveCourt(ctx context.Context, req *proto.ArchiveCourtRequest) (*proto.Court, error) {
+	principal, ok := auth.PrincipalFromContext(ctx)
+	if !ok {
+		return nil, errUnauthenticated
+	}
+
+	if _, err := s.checkCourtAdmin(ctx, principal, req.CourtId); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	err := s.store.Courts.ArchiveCourt(ctx, req.CourtId, now.Format(schedule.DateLayout), now)
+	if err != nil {
+		return nil, courtAdminError(err, "court is already archived")
+	}
+
+	return s.GetCourt(ctx, &proto.GetCourtRequest{CourtId: req.CourtId})
+}
+
+// checkCourtAdmin verifies that a facility exists and that the principal is
+// one of its admins, and returns the facility
+func (s *SchedulerServer) checkCourtAdmin(ctx context.Context, principal *auth.Principal, courtID string) (*proto.Court, error) {
+	court, err := s.store.Courts.GetCourt(ctx, courtID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, status.Error(codes.NotFound, "court not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !principal.HasRole(auth.RoleFacilityAdmin, courtID) {
+		return nil, status.Error(codes.PermissionDenied, "not authorized to manage this court")
+	}
+
+	return court, nil
+}
+
+// normalizeCourt trims the details of a facility and validates them
+func normalizeCourt(court *proto.Court) error {
+	court.Name = strings.TrimSpace(court.Name)
+	court.Address = strings.TrimSpace(court.Address)
+	court.ImageUrl = strings.TrimSpace(court.ImageUrl)
+
+	var amenities []string
+	for _, amenity := range court.Amenities {
+		if amenity = strings.TrimSpace(amenity); amenity != "" {
+			amenities = append(amenities, amenity)
+		}
+	}
+	court.Amenities = amenities
+
+	if court.MaxPlayers == 0 {
+		court.MaxPlayers = DefaultMaxPlayers
+	}
+
+	switch {
+	case court.Name == "" || court.Address == "":
+		return status.Error(codes.InvalidArgument, "missing required fields")
+	case court.Latitude < -90 || court.Latitude > 90:
+		return status.Error(codes.InvalidArgument, "latitude must be between -90 and 90")
+	case court.Longitude < -180 || court.Longitude > 180:
+		return status.Error(codes.InvalidArgument, "longitude must be between -180 and 180")
+	case court.NumberOfCourts < 1 || court.NumberOfCourts > MaxCourtUnits:
+		return status.Errorf(codes.InvalidArgument, "number of courts must be between 1 and %d", MaxCourtUnits)
+	case court.MaxPlayers < 1 || court.MaxPlayers > MaxCourtPlayers:
+		return status.Errorf(codes.InvalidArgument, "max players must be between 1 and %d", MaxCourtPlayers)
+	}
+
+	if court.ImageUrl != "" {
+		u, err := url.Parse(court.ImageUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return status.Error(codes.InvalidArgument, "image URL must be an http or https URL")
+		}
+	}
+
+	return nil
+}
+
+// courtUnits returns the units of a facility, one per court, named after
+// their position
+func courtUnits(court *proto.Court) []*proto.CourtUnit {
+	units := make([]*proto.CourtUnit, 0, court.NumberOfCourts)
+	for position := 1; position <= int(court.NumberOfCourts); position++ {
+		units = append(units, &proto.CourtUnit{
+			Id:       fmt.Sprintf("%s-%d", court.Id, position),
+			CourtId:  court.Id,
+			Name:     fmt.Sprintf("Court %d", position),
+			Position: int32(position),
+		})
+	}
+	return units
+}
+
+// courtAdminError maps the errors of changing a facility, with the message
+// for archived ones
+func courtAdminError(err error, archived string) error {
+	switch {
+	case errors.Is(err, storage.ErrArchived):
+		return status.Error(codes.FailedPrecondition, archived)
+	case errors.Is(err, storage.ErrBooked):
+		return errUpcomingBookings
+	case errors.Is(err, storage.ErrNotFound):
+		return status.Error(codes.NotFound, "court not found")
+	}
+	return err
+}
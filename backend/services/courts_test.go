@@ -0,0 +1,148 @@
+// pickle/backend/services/courts_test.go
+package services
+
+import (
+	"testing"
+
+	"github.com/carlostbanks/pickle/auth"
+	"github.com/carlostbanks/pickle/proto"
+	"google.golang.org/grpc/codes"
+	gproto "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestCourtAdmin(t *testing.T) {
+	f := newFixture(t)
+	platformAdmin := f.as(&auth.Principal{UserID: "root", Email: "root@example.com",
+		Roles: []auth.Grant{{Role: auth.RolePlatformAdmin}}})
+
+	create := &proto.CreateCourtRequest{
+		Name:           "Lakeside Pickleball",
+		Address:        "1 Lake Rd, Springfield",
+		Latitude:       39.78,
+		Longitude:      -89.65,
+		NumberOfCourts: 3,
+		Amenities:      []string{"Lights", " Parking "},
+		ImageUrl:       "https://example.com/lakeside.jpg",
+	}
+
+	// Only platform admins create facilities
+	_, err := f.server.CreateCourt(f.as(f.player), create)
+	expectCode(t, err, codes.PermissionDenied)
+	_, err = f.server.CreateCourt(f.as(f.admin), create)
+	expectCode(t, err, codes.PermissionDenied)
+
+	invalid := gproto.Clone(create).(*proto.CreateCourtRequest)
+	invalid.Latitude = 120
+	_, err = f.server.CreateCourt(platformAdmin, invalid)
+	expectCode(t, err, codes.InvalidArgument)
+
+	court, err := f.server.CreateCourt(platformAdmin, create)
+	if err != nil {
+		t.Fatalf("creating: %v", err)
+	}
+	if len(court.Units) != 3 || len(court.Amenities) != 2 || court.Amenities[1] != "Parking" {
+		t.Fatalf("created facility has %d units and amenities %q", len(court.Units), court.Amenities)
+	}
+
+	// Admins of another facility may not edit it
+	update := &proto.UpdateCourtRequest{
+		CourtId:        court.Id,
+		Name:           gproto.String("Lakeside Pickleball Club"),
+		NumberOfCourts: gproto.Int32(2),
+	}
+	_, err = f.server.UpdateCourt(f.as(f.admin), update)
+	expectCode(t, err, codes.PermissionDenied)
+
+	// Fields left out of the request are kept
+	court, err = f.server.UpdateCourt(platformAdmin, update)
+	if err != nil {
+		t.Fatalf("editing: %v", err)
+	}
+	if court.Name != update.GetName() || len(court.Units) != 2 {
+		t.Fatalf("edited facility is %q with %d units", court.Name, len(court.Units))
+	}
+	if court.Address != create.Address || len(court.Amenities) != 2 || court.ImageUrl != create.ImageUrl {
+		t.Fatalf("edited facility is at %q with amenities %q and image %q, expected them unchanged",
+			court.Address, court.Amenities, court.ImageUrl)
+	}
+
+	court, err = f.server.UpdateCourt(platformAdmin, &proto.UpdateCourtRequest{CourtId: court.Id, ImageUrl: gproto.String("")})
+	if err != nil {
+		t.Fatalf("removing the image: %v", err)
+	}
+	if court.ImageUrl != "" || court.Name != update.GetName() {
+		t.Fatalf("facility is %q with image %q, expected no image", court.Name, court.ImageUrl)
+	}
+	_, err = f.server.UpdateCourt(platformAdmin, &proto.UpdateCourtRequest{CourtId: court.Id, Name: gproto.String(" ")})
+	expectCode(t, err, codes.InvalidArgument)
+
+	// An empty list of amenities removes them
+	court, err = f.server.UpdateCourt(platformAdmin, &proto.UpdateCourtRequest{CourtId: court.Id, Amenities: &structpb.ListValue{}})
+	if err != nil {
+		t.Fatalf("removing the amenities: %v", err)
+	}
+	if len(court.Amenities) != 0 || court.Address != create.Address {
+		t.Fatalf("facility at %q has amenities %q, expected none", court.Address, court.Amenities)
+	}
+	notStrings, _ := structpb.NewList([]interface{}{"Lights", 2})
+	_, err = f.server.UpdateCourt(platformAdmin, &proto.UpdateCourtRequest{CourtId: court.Id, Amenities: notStrings})
+	expectCode(t, err, codes.InvalidArgument)
+
+	_, err = f.server.ArchiveCourt(f.as(f.admin), &proto.ArchiveCourtRequest{CourtId: court.Id})
+	expectCode(t, err, codes.PermissionDenied)
+	court, err = f.server.ArchiveCourt(platformAdmin, &proto.ArchiveCourtRequest{CourtId: court.Id})
+	if err != nil {
+		t.Fatalf("archiving: %v", err)
+	}
+	if court.ArchivedAt == "" {
+		t.Fatal("archived facility has no archived_at")
+	}
+
+	// Archived facilities are kept but take no bookings
+	if _, err := f.server.GetCourt(f.as(f.player), &proto.GetCourtRequest{CourtId: court.Id}); err != nil {
+		t.Fatalf("getting the archived facility: %v", err)
+	}
+	courts, err := f.server.GetCourts(f.as(f.player), &proto.GetCourtsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, listed := range courts.Courts {
+		if listed.Id == court.Id {
+			t.Error("archived facility is still listed")
+		}
+	}
+	_, err = f.server.CreateBooking(f.as(f.player), &proto.CreateBookingRequest{
+		CourtId: court.Id, Date: nextWeek(), StartTime: "10:00", EndTime: "11:00", NumberOfPlayers: 2})
+	expectCode(t, err, codes.NotFound)
+	_, err = f.server.UpdateCourt(platformAdmin, update)
+	expectCode(t, err, codes.FailedPrecondition)
+	_, err = f.server.ArchiveCourt(platformAdmin, &proto.ArchiveCourtRequest{CourtId: court.Id})
+	expectCode(t, err, codes.FailedPrecondition)
+}
+
+func TestCourtWithUpcomingBookings(t *testing.T) {
+	f := newFixture(t)
+	req := f.bookingRequest("10:00", "11:00")
+	req.CourtUnitId = f.court.Units[1].Id
+	if _, err := f.server.CreateBooking(f.as(f.player), req); err != nil {
+		t.Fatalf("booking: %v", err)
+	}
+
+	// The booked court can neither be removed nor archived with its facility
+	_, err := f.server.UpdateCourt(f.as(f.admin), &proto.UpdateCourtRequest{
+		CourtId:        f.court.Id,
+		NumberOfCourts: gproto.Int32(1),
+	})
+	expectCode(t, err, codes.FailedPrecondition)
+	_, err = f.server.ArchiveCourt(f.as(f.admin), &proto.ArchiveCourtRequest{CourtId: f.court.Id})
+	expectCode(t, err, codes.FailedPrecondition)
+
+	court, err := f.server.GetCourt(f.as(f.admin), &proto.GetCourtRequest{CourtId: f.court.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(court.Units) != 2 || court.ArchivedAt != "" {
+		t.Errorf("facility has %d units and archived_at %q, expected it unchanged", len(court.Units), court.ArchivedAt)
+	}
+}
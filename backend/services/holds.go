@@ -0,0 +1,153 @@
+// pickle/backend/services/holds.go
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/carlostbanks/pickle/notifications"
+	"github.com/carlostbanks/pickle/payments"
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errHoldExpired is returned when a held booking is confirmed too late
+var errHoldExpired = status.Error(codes.FailedPrecondition, "hold has expired")
+
+// ConfirmBooking confirms a PENDING booking before its hold expires.
+// Confirming a waitlist offer claims it.
+func (s *SchedulerServer) ConfirmBooking(ctx context.Context, req *proto.ConfirmBookingRequest) (*proto.Booking, error) {
+	// Get user ID from context
+	userID := getUserIDFromContext(ctx)
+	if userID == "" {
+		return nil, errUnauthenticated
+	}
+
+	// Check if booking exists and the user may manage it
+	booking, err := s.getBooking(ctx, req.BookingId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !canManageBooking(ctx, booking.UserId, booking.CourtId) {
+		return nil, status.Error(codes.PermissionDenied, "not authorized to confirm this booking")
+	}
+
+	if booking.Status != proto.BookingStatus_PENDING {
+		return nil, status.Error(codes.FailedPrecondition, "booking is not pending")
+	}
+
+	return s.confirmHold(ctx, booking, errHoldExpired)
+}
+
+// confirmHold confirms a PENDING booking, collecting its payment first if it
+// is priced. lapsed is returned if the hold expired. The payment is captured
+// outside the transaction confirming the booking, so it is refunded if the
+// booking cannot be confirmed after all.
+func (s *SchedulerServer) confirmHold(ctx context.Context, booking *proto.Booking, lapsed error) (*proto.Booking, error) {
+	if holdExpired(booking, time.Now()) {
+		return nil, lapsed
+	}
+
+	// Priced bookings must be paid before they are confirmed
+	captured := false
+	if booking.PriceCents > 0 {
+		payment, err := s.activePayment(ctx, booking.Id)
+		if err != nil {
+			return nil, err
+		}
+		if payment == nil || payment.Status != payments.StatusAuthorized {
+			return nil, errPaymentRequired
+		}
+		if err := s.capturePayment(ctx, payment); err != nil {
+			return nil, err
+		}
+		captured = true
+	}
+
+	// Confirm the booking unless the hold expired in the meantime,
+	// announcing it and inviting the players now it is on
+	messages := append(s.emails(ctx, notifications.KindBookingConfirmed, booking),
+		s.invitations(ctx, booking, booking.Players)...)
+	err := s.store.Bookings.ConfirmBooking(ctx, booking.Id, time.Now(), messages...)
+	if err != nil {
+		if captured {
+			s.settlePayments(ctx, map[string]int64{booking.Id: 0})
+		}
+		if errors.Is(err, storage.ErrStale) {
+			return nil, lapsed
+		}
+		return nil, err
+	}
+
+	s.notifier.Wake()
+
+	return s.getBooking(ctx, booking.Id)
+}
+
+// holdExpired reports whether the hold of a booking expired by the given time
+func holdExpired(booking *proto.Booking, at time.Time) bool {
+	if booking.HoldExpiresAt == "" {
+		return false
+	}
+	expiresAt, err := time.ParseInLocation(timestampLayout, booking.HoldExpiresAt, time.Local)
+	return err == nil && !expiresAt.After(at)
+}
+
+// ExpireHolds cancels checkout holds past their expiry, releases their
+// payments and offers the freed slots to waitlisted users
+func (s *SchedulerServer) ExpireHolds(ctx context.Context) error {
+	expired, err := s.store.Bookings.ExpireHolds(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	// Expired holds keep no fee
+	released := make(map[string]int64)
+	freed := make(map[[2]string]bool)
+	for _, booking := range expired {
+		released[booking.Id] = 0
+		freed[[2]string{booking.CourtId, booking.Date}] = true
+	}
+
+	if len(released) > 0 {
+		s.settlePayments(ctx, released)
+	}
+
+	for slot := range freed {
+		if err := s.promoteWaitlist(ctx, slot[0], slot[1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RunReaper releases PENDING bookings that were not confirmed in time, lapsed
+// waitlist offers and expired checkout holds, and queues reminders of
+// upcoming bookings, at the given interval until ctx is done
+func (s *SchedulerServer) RunReaper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.ExpireWaitlistOffers(ctx); err != nil {
+				log.Printf("Error expiring waitlist offers: %v", err)
+			}
+			if err := s.ExpireHolds(ctx); err != nil {
+				log.Printf("Error expiring holds: %v", err)
+			}
+			if err := s.SendReminders(ctx); err != nil {
+				log.Printf("Error sending reminders: %v", err)
+			}
+		}
+	}
+}
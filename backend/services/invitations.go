@@ -0,0 +1,188 @@
+// pickle/backend/services/invitations.go
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/carlostbanks/pickle/auth"
+	"github.com/carlostbanks/pickle/notifications"
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errInvitationNotFound is returned for players removed from a booking
+// since they were invited
+var errInvitationNotFound = status.Error(codes.NotFound, "invitation not found")
+
+// GetInvitation returns the invitation an RSVP token was made for
+func (s *SchedulerServer) GetInvitation(ctx context.Context, req *proto.GetInvitationRequest) (*proto.Invitation, error) {
+	booking, player, err := s.openInvitation(ctx, req.Token)
+	if err != nil {
+		return nil, err
+	}
+	return s.invitation(ctx, booking, player)
+}
+
+// AcceptInvitation records that an invited player will play
+func (s *SchedulerServer) AcceptInvitation(ctx context.Context, req *proto.AcceptInvitationRequest) (*proto.Invitation, error) {
+	return s.answerInvitation(ctx, req.Token, proto.PlayerStatus_ACCEPTED)
+}
+
+// DeclineInvitation records that an invited player will not play
+func (s *SchedulerServer) DeclineInvitation(ctx context.Context, req *proto.DeclineInvitationRequest) (*proto.Invitation, error) {
+	return s.answerInvitation(ctx, req.Token, proto.PlayerStatus_DECLINED)
+}
+
+// answerInvitation records the answer of the player an RSVP token was made
+// for. Players may change their mind until the day of the booking is over.
+func (s *SchedulerServer) answerInvitation(ctx context.Context, token string, answer proto.PlayerStatus) (*proto.Invitation, error) {
+	booking, player, err := s.openInvitation(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if booking.Status == proto.BookingStatus_CANCELLED || booking.Status == proto.BookingStatus_NO_SHOW {
+		return nil, status.Error(codes.FailedPrecondition, "booking is no longer on")
+	}
+	if booking.Date < time.Now().Format("2006-01-02") {
+		return nil, status.Error(codes.FailedPrecondition, "booking is over")
+	}
+	if player.Status == answer {
+		return s.invitation(ctx, booking, player)
+	}
+
+	player.Status = answer
+	player.RespondedAt = time.Now().Format(timestampLayout)
+
+	// Players who registered since they were invited see the booking from
+	// now on
+	if player.UserId == "" {
+		user, err := s.store.Users.GetUserByEmail(ctx, player.Email)
+		if err == nil {
+			player.UserId = user.ID
+		} else if !errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+	}
+
+	err = s.store.Bookings.UpdatePlayer(ctx, booking.Id, player)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, errInvitationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.invitation(ctx, booking, player)
+}
+
+// openInvitation verifies an RSVP token and returns the booking and player
+// it was made for
+func (s *SchedulerServer) openInvitation(ctx context.Context, token string) (*proto.Booking, *proto.BookingPlayer, error) {
+	bookingID, email, err := auth.OpenInvitation(token)
+	if err != nil {
+		return nil, nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	booking, err := s.store.Bookings.GetBooking(ctx, bookingID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil, errInvitationNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, player := range booking.Players {
+		if player.Email == email {
+			return booking, player, nil
+		}
+	}
+	return nil, nil, errInvitationNotFound
+}
+
+// invitation describes a booking to one of its players, leaving the other
+// players out
+func (s *SchedulerServer) invitation(ctx context.Context, booking *proto.Booking, player *proto.BookingPlayer) (*proto.Invitation, error) {
+	invitation := &proto.Invitation{
+		BookingId:     booking.Id,
+		CourtId:       booking.CourtId,
+		Date:          booking.Date,
+		StartTime:     booking.StartTime,
+		EndTime:       booking.EndTime,
+		Email:         player.Email,
+		Status:        player.Status,
+		RespondedAt:   player.RespondedAt,
+		BookingStatus: booking.Status,
+	}
+
+	data, _, err := s.notificationData(ctx, booking)
+	if err != nil {
+		return nil, err
+	}
+	invitation.CourtName = data.CourtName
+	invitation.OrganizerName = data.OrganizerName
+
+	return invitation, nil
+}
+
+// invitations renders the invitations of the players of a booking who have
+// not answered yet, with a link to accept or decline at, for the store to
+// queue with the booking. Failures are only logged: the booking stands
+// either way.
+func (s *SchedulerServer) invitations(ctx context.Context, booking *proto.Booking, players []*proto.BookingPlayer) []*notifications.Message {
+	var messages []*notifications.Message
+	for _, player := range players {
+		if player.Status != proto.PlayerStatus_INVITED || player.RespondedAt != "" {
+			continue
+		}
+		msg, err := s.invitationMessage(ctx, booking, player)
+		if err != nil {
+			log.Printf("Failed to invite %s to booking %s: %v", player.Email, booking.Id, err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+// invitationMessage renders the invitation of a player of a booking
+func (s *SchedulerServer) invitationMessage(ctx context.Context, booking *proto.Booking, player *proto.BookingPlayer) (*notifications.Message, error) {
+	// Tokens outlive the day of the booking by a day, whatever the time zone
+	date, err := time.Parse("2006-01-02", booking.Date)
+	if err != nil {
+		return nil, err
+	}
+	token, err := auth.SignInvitation(booking.Id, player.Email, date.AddDate(0, 0, 2))
+	if err != nil {
+		return nil, err
+	}
+
+	data, _, err := s.notificationData(ctx, booking)
+	if err != nil {
+		return nil, err
+	}
+	data.Link = s.frontendURL + "/invitations/" + url.PathEscape(token)
+	return notifications.Render(notifications.KindInvitation, player.Email, data)
+}
+
+// addedPlayers returns the players of roster missing from previous
+func addedPlayers(roster, previous []*proto.BookingPlayer) []*proto.BookingPlayer {
+	listed := make(map[string]bool, len(previous))
+	for _, player := range previous {
+		listed[player.Email] = true
+	}
+
+	var added []*proto.BookingPlayer
+	for _, player := range roster {
+		if !listed[player.Email] {
+			added = append(added, player)
+		}
+	}
+	return added
+}
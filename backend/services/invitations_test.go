@@ -0,0 +1,113 @@
+// pickle/backend/services/invitations_test.go
+package services
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/carlostbanks/pickle/auth"
+	"github.com/carlostbanks/pickle/config"
+	"github.com/carlostbanks/pickle/notifications"
+	"github.com/carlostbanks/pickle/proto"
+	"google.golang.org/grpc/codes"
+)
+
+// invitationLink matches the RSVP token in the link of invitation emails
+var invitationLink = regexp.MustCompile(`/invitations/(\S+)`)
+
+// invitationToken returns the RSVP token last emailed to a player
+func (f *fixture) invitationToken(t *testing.T, email string) string {
+	t.Helper()
+	token := ""
+	for _, msg := range f.sent(t) {
+		if msg.Kind != notifications.KindInvitation || msg.To != email {
+			continue
+		}
+		match := invitationLink.FindStringSubmatch(msg.Body)
+		if match == nil {
+			t.Fatalf("invitation to %s has no link: %q", email, msg.Body)
+		}
+		token, _ = url.PathUnescape(match[1])
+	}
+	if token == "" {
+		t.Fatalf("%s was not invited", email)
+	}
+	return token
+}
+
+func TestInvitations(t *testing.T) {
+	// RSVP tokens are signed with a key derived from the JWT secret
+	auth.InitAuth(config.AuthConfig{JWTSecret: "test-secret-at-least-32-bytes-long"})
+
+	f := newFixture(t)
+	anonymous := context.Background()
+	guest := "guest@example.com"
+
+	req := f.bookingRequest("17:00", "18:00")
+	req.PlayerEmails = []string{f.other.Email, guest}
+	booking, err := f.server.CreateBooking(f.as(f.player), req)
+	if err != nil {
+		t.Fatalf("booking: %v", err)
+	}
+	otherToken := f.invitationToken(t, f.other.Email)
+	guestToken := f.invitationToken(t, guest)
+
+	// Players answer through their link without logging in
+	invitation, err := f.server.GetInvitation(anonymous, &proto.GetInvitationRequest{Token: otherToken})
+	if err != nil {
+		t.Fatalf("getting the invitation: %v", err)
+	}
+	if invitation.BookingId != booking.Id || invitation.Status != proto.PlayerStatus_INVITED {
+		t.Fatalf("invitation is to %s as %v, expected %s as INVITED", invitation.BookingId, invitation.Status, booking.Id)
+	}
+
+	_, err = f.server.GetInvitation(anonymous, &proto.GetInvitationRequest{Token: otherToken + "x"})
+	expectCode(t, err, codes.PermissionDenied)
+	stranger, err := auth.SignInvitation(booking.Id, "stranger@example.com", time.Now().AddDate(0, 0, 30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.server.AcceptInvitation(anonymous, &proto.AcceptInvitationRequest{Token: stranger})
+	expectCode(t, err, codes.NotFound)
+
+	invitation, err = f.server.AcceptInvitation(anonymous, &proto.AcceptInvitationRequest{Token: otherToken})
+	if err != nil || invitation.Status != proto.PlayerStatus_ACCEPTED {
+		t.Fatalf("accepting: %v, %v", invitation.GetStatus(), err)
+	}
+	invitation, err = f.server.DeclineInvitation(anonymous, &proto.DeclineInvitationRequest{Token: guestToken})
+	if err != nil || invitation.Status != proto.PlayerStatus_DECLINED {
+		t.Fatalf("declining: %v, %v", invitation.GetStatus(), err)
+	}
+
+	// The organizer sees the answers
+	booking, err = f.server.GetBooking(f.as(f.player), &proto.GetBookingRequest{BookingId: booking.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	answers := map[string]proto.PlayerStatus{}
+	for _, player := range booking.Players {
+		answers[player.Email] = player.Status
+	}
+	if answers[f.other.Email] != proto.PlayerStatus_ACCEPTED || answers[guest] != proto.PlayerStatus_DECLINED {
+		t.Errorf("the organizer sees the answers %v", answers)
+	}
+
+	// The invited user sees the booking as theirs
+	listed, err := f.server.GetBookings(f.as(f.other), &proto.GetBookingsRequest{UserId: f.other.UserID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Bookings) != 1 || listed.Bookings[0].Id != booking.Id {
+		t.Errorf("the invited user sees %v, expected the booking", listed.Bookings)
+	}
+
+	// Cancelled bookings take no more answers
+	if _, err := f.server.CancelBooking(f.as(f.player), &proto.CancelBookingRequest{BookingId: booking.Id}); err != nil {
+		t.Fatalf("cancelling: %v", err)
+	}
+	_, err = f.server.AcceptInvitation(anonymous, &proto.AcceptInvitationRequest{Token: guestToken})
+	expectCode(t, err, codes.FailedPrecondition)
+}
@@ -0,0 +1,151 @@
+// pickle/backend/services/notify.go
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/carlostbanks/pickle/cancellation"
+	"github.com/carlostbanks/pickle/notifications"
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/schedule"
+	"github.com/carlostbanks/pickle/storage"
+)
+
+// ReminderLead is how long before its start players are reminded of a
+// booking
+const ReminderLead = 24 * time.Hour
+
+// Notifier delivers the emails queued in the outbox of the store, see
+// notifications.Outbox
+type Notifier interface {
+	// Wake delivers the emails queued right away rather than at the next
+	// retry
+	Wake()
+}
+
+// emails renders a kind of email for the people it concerns about
+// bookings of one organizer at the same court and times, such as the
+// occurrences of a series changed together, for the store to queue with the
+// change. Failures are only logged: the change is made either way.
+func (s *SchedulerServer) emails(ctx context.Context, kind string, bookings ...*proto.Booking) []*notifications.Message {
+	if len(bookings) == 0 {
+		return nil
+	}
+	messages, err := s.bookingMessages(ctx, kind, bookings)
+	if err != nil {
+		log.Printf("Failed to render %s emails for booking %s: %v", kind, bookings[0].Id, err)
+		return nil
+	}
+	return messages
+}
+
+// bookingMessages renders a kind of email about bookings for everyone it
+// concerns: the organizer, and the players who did not decline for changes
+// and cancellations, or who accepted for reminders. Players hear about new
+// bookings through their invitations.
+func (s *SchedulerServer) bookingMessages(ctx context.Context, kind string, bookings []*proto.Booking) ([]*notifications.Message, error) {
+	data, organizer, err := s.notificationData(ctx, bookings[0])
+	if err != nil {
+		return nil, err
+	}
+	data.Dates = nil
+	for _, booking := range bookings {
+		data.Dates = append(data.Dates, booking.Date)
+	}
+
+	recipients := []string{organizer.Email}
+	listed := map[string]bool{organizer.Email: true}
+	for _, booking := range bookings {
+		for _, player := range booking.Players {
+			switch {
+			case listed[player.Email]:
+			case kind == notifications.KindBookingChanged && player.Status != proto.PlayerStatus_DECLINED,
+				kind == notifications.KindBookingCancelled && player.Status != proto.PlayerStatus_DECLINED,
+				kind == notifications.KindBookingReminder && player.Status == proto.PlayerStatus_ACCEPTED:
+				recipients = append(recipients, player.Email)
+				listed[player.Email] = true
+			}
+		}
+	}
+
+	var messages []*notifications.Message
+	for _, to := range recipients {
+		msg, err := notifications.Render(kind, to, data)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// notificationData describes a booking for the email templates, linking to
+// the bookings page, and returns its organizer
+func (s *SchedulerServer) notificationData(ctx context.Context, booking *proto.Booking) (notifications.Data, *storage.User, error) {
+	court, err := s.store.Courts.GetCourt(ctx, booking.CourtId)
+	if err != nil {
+		return notifications.Data{}, nil, err
+	}
+	organizer, err := s.store.Users.GetUser(ctx, booking.UserId)
+	if err != nil {
+		return notifications.Data{}, nil, err
+	}
+
+	data := notifications.Data{
+		CourtName:     court.Name,
+		CourtAddress:  court.Address,
+		OrganizerName: organizer.Name,
+		Dates:         []string{booking.Date},
+		StartTime:     booking.StartTime,
+		EndTime:       booking.EndTime,
+		Link:          s.frontendURL + "/bookings",
+	}
+	if data.OrganizerName == "" {
+		data.OrganizerName = organizer.Email
+	}
+	return data, organizer, nil
+}
+
+// SendReminders queues reminders of the confirmed bookings starting within
+// ReminderLead. Each recipient is reminded of a booking once.
+func (s *SchedulerServer) SendReminders(ctx context.Context) error {
+	now := time.Now()
+	for _, date := range []string{now.Format("2006-01-02"), now.Add(ReminderLead).Format("2006-01-02")} {
+		bookings, err := s.store.Bookings.ListBookings(ctx, storage.BookingFilter{Date: date})
+		if err != nil {
+			return err
+		}
+
+		for _, booking := range bookings {
+			if booking.Status != proto.BookingStatus_CONFIRMED {
+				continue
+			}
+			window, err := schedule.ParseWindow(booking.StartTime, booking.EndTime)
+			if err != nil {
+				return err
+			}
+			startsAt, err := cancellation.StartsAt(booking.Date, window, time.Local)
+			if err != nil {
+				return err
+			}
+			if !startsAt.After(now) || startsAt.Sub(now) > ReminderLead {
+				continue
+			}
+
+			messages, err := s.bookingMessages(ctx, notifications.KindBookingReminder, []*proto.Booking{booking})
+			if err != nil {
+				return err
+			}
+			for _, msg := range messages {
+				msg.Key = "reminder:" + booking.Id + ":" + msg.To
+			}
+			if err := s.store.Outbox.Enqueue(ctx, messages...); err != nil {
+				return err
+			}
+			s.notifier.Wake()
+		}
+	}
+	return nil
+}
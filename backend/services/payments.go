@@ -0,0 +1,236 @@
+// pickle/backend/services/payments.go
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/carlostbanks/pickle/payments"
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/storage"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// paymentStatusValues maps the database representation of payment statuses
+var paymentStatusValues = map[string]proto.PaymentStatus{
+	payments.StatusRequiresPayment:   proto.PaymentStatus_REQUIRES_PAYMENT,
+	payments.StatusAuthorized:        proto.PaymentStatus_AUTHORIZED,
+	payments.StatusCaptured:          proto.PaymentStatus_CAPTURED,
+	payments.StatusPartiallyRefunded: proto.PaymentStatus_PARTIALLY_REFUNDED,
+	payments.StatusRefunded:          proto.PaymentStatus_REFUNDED,
+	payments.StatusCancelled:         proto.PaymentStatus_PAYMENT_CANCELLED,
+	payments.StatusFailed:            proto.PaymentStatus_FAILED,
+}
+
+var (
+	// errPaymentRequired is returned when a priced hold is confirmed before it is paid
+	errPaymentRequired = status.Error(codes.FailedPrecondition, "booking must be paid before it is confirmed")
+
+	// errPaymentDeclined is returned when the provider declines a payment
+	errPaymentDeclined = status.Error(codes.FailedPrecondition, "payment was declined")
+)
+
+// PayBooking starts collecting the payment for a booking
+func (s *SchedulerServer) PayBooking(ctx context.Context, req *proto.PayBookingRequest) (*proto.Payment, error) {
+	// Get user ID from context
+	userID := getUserIDFromContext(ctx)
+	if userID == "" {
+		return nil, errUnauthenticated
+	}
+
+	// Check if booking exists and belongs to user
+	booking, err := s.getBooking(ctx, req.BookingId)
+	if err != nil {
+		return nil, err
+	}
+
+	if booking.UserId != userID {
+		return nil, status.Error(codes.PermissionDenied, "not authorized to pay for this booking")
+	}
+	if booking.Status == proto.BookingStatus_CANCELLED {
+		return nil, status.Error(codes.FailedPrecondition, "booking is cancelled")
+	}
+	if booking.PriceCents == 0 {
+		return nil, status.Error(codes.FailedPrecondition, "booking is free")
+	}
+	priceCents, currency := booking.PriceCents, booking.Currency
+
+	// Start collecting the payment
+	intent, err := s.paymentProvider.CreateIntent(ctx, payments.IntentParams{
+		Amount:        priceCents,
+		Currency:      currency,
+		Reference:     req.BookingId,
+		PaymentMethod: req.PaymentMethod,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	payment := &proto.Payment{
+		Id:               uuid.New().String(),
+		BookingId:        req.BookingId,
+		Provider:         s.paymentProvider.Name(),
+		ProviderIntentId: intent.ID,
+		AmountCents:      intent.Amount,
+		Currency:         currency,
+		Status:           paymentStatusValues[intent.Status],
+		CreatedAt:        now.Format(time.RFC3339),
+		UpdatedAt:        now.Format(time.RFC3339),
+	}
+
+	// A booking has a single active payment
+	err = s.store.Payments.InsertPayment(ctx, &storage.Payment{
+		ID:          payment.Id,
+		BookingID:   payment.BookingId,
+		Provider:    payment.Provider,
+		IntentID:    payment.ProviderIntentId,
+		AmountCents: payment.AmountCents,
+		Currency:    payment.Currency,
+		Status:      intent.Status,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	})
+	if err != nil {
+		if intent.Active() {
+			if _, refundErr := s.paymentProvider.Refund(ctx, intent.ID, 0); refundErr != nil {
+				log.Printf("Error releasing payment intent %s: %v", intent.ID, refundErr)
+			}
+		}
+		if errors.Is(err, storage.ErrConflict) {
+			return nil, status.Error(codes.AlreadyExists, "booking already has a payment")
+		}
+		return nil, err
+	}
+
+	if intent.Status == payments.StatusFailed {
+		return nil, errPaymentDeclined
+	}
+
+	payment.ClientSecret = intent.ClientSecret
+	return payment, nil
+}
+
+// GetBookingPayment returns the latest payment of a booking
+func (s *SchedulerServer) GetBookingPayment(ctx context.Context, req *proto.GetBookingPaymentRequest) (*proto.Payment, error) {
+	// Get user ID from context
+	userID := getUserIDFromContext(ctx)
+	if userID == "" {
+		return nil, errUnauthenticated
+	}
+
+	payment, err := s.store.Payments.LatestPayment(ctx, req.BookingId)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, status.Error(codes.NotFound, "payment not found")
+		}
+		return nil, err
+	}
+
+	booking, err := s.getBooking(ctx, req.BookingId)
+	if err != nil {
+		return nil, err
+	}
+	if booking.UserId != userID {
+		return nil, status.Error(codes.PermissionDenied, "not authorized to view this booking")
+	}
+
+	return &proto.Payment{
+		Id:               payment.ID,
+		BookingId:        payment.BookingID,
+		Provider:         payment.Provider,
+		ProviderIntentId: payment.IntentID,
+		AmountCents:      payment.AmountCents,
+		RefundedCents:    payment.RefundedCents,
+		Currency:         payment.Currency,
+		Status:           paymentStatusValues[payment.Status],
+		CreatedAt:        payment.CreatedAt.Format(time.RFC3339),
+		UpdatedAt:        payment.UpdatedAt.Format(time.RFC3339),
+	}, nil
+}
+
+// HandlePaymentWebhook records the outcome of payments completed by the
+// customer with the provider. It is served over plain HTTP, since the
+// provider signs the raw request.
+func (s *SchedulerServer) HandlePaymentWebhook(ctx context.Context, payload []byte, header http.Header) error {
+	event, err := s.paymentProvider.VerifyWebhook(payload, header)
+	if err != nil {
+		return err
+	}
+	if event.Type != payments.EventAuthorized && event.Type != payments.EventFailed {
+		log.Printf("Ignoring %s event %s", event.Type, event.ID)
+		return nil
+	}
+
+	// Only payments still waiting for the customer are updated, so late or
+	// replayed events cannot undo a capture or refund
+	err = s.store.Payments.UpdateIntentStatus(ctx, s.paymentProvider.Name(), event.Intent.ID,
+		payments.StatusRequiresPayment, event.Intent.Status, time.Now())
+	if errors.Is(err, storage.ErrStale) {
+		log.Printf("Ignoring %s event %s for intent %s", event.Type, event.ID, event.Intent.ID)
+		return nil
+	}
+	return err
+}
+
+// activePayment returns the payment of a booking that still holds or may
+// still collect money, or nil if there is none
+func (s *SchedulerServer) activePayment(ctx context.Context, bookingID string) (*storage.Payment, error) {
+	active, err := s.store.Payments.ActivePayments(ctx, []string{bookingID})
+	if err != nil || len(active) == 0 {
+		return nil, err
+	}
+	return active[0], nil
+}
+
+// capturePayment collects an authorized payment
+func (s *SchedulerServer) capturePayment(ctx context.Context, payment *storage.Payment) error {
+	intent, err := s.paymentProvider.Capture(ctx, payment.IntentID)
+	if err != nil {
+		return status.Errorf(codes.FailedPrecondition, "payment could not be captured: %v", err)
+	}
+
+	payment.Status = intent.Status
+	payment.UpdatedAt = time.Now()
+	return s.store.Payments.UpdatePayment(ctx, payment)
+}
+
+// settlePayments settles the payments of cancelled bookings and no-shows,
+// keeping the fee recorded for each booking (see payments.Settle). Failures
+// are logged and leave the payment as it was, so it can be settled by hand.
+// It returns the amount refunded.
+func (s *SchedulerServer) settlePayments(ctx context.Context, fees map[string]int64) int64 {
+	bookingIDs := make([]string, 0, len(fees))
+	for bookingID := range fees {
+		bookingIDs = append(bookingIDs, bookingID)
+	}
+
+	active, err := s.store.Payments.ActivePayments(ctx, bookingIDs)
+	if err != nil {
+		log.Printf("Error querying payments to settle: %v", err)
+		return 0
+	}
+
+	var refunded int64
+	for _, p := range active {
+		alreadyRefunded := p.RefundedCents
+		intent, err := payments.Settle(ctx, s.paymentProvider, p.IntentID, p.Status, p.AmountCents, alreadyRefunded, fees[p.BookingID])
+		if err != nil {
+			log.Printf("Error settling payment %s: %v", p.ID, err)
+		}
+		refunded += intent.Refunded - alreadyRefunded
+
+		p.Status = intent.Status
+		p.RefundedCents = intent.Refunded
+		p.UpdatedAt = time.Now()
+		if err := s.store.Payments.UpdatePayment(ctx, p); err != nil {
+			log.Printf("Error updating payment %s: %v", p.ID, err)
+		}
+	}
+	return refunded
+}
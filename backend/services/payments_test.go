@@ -0,0 +1,204 @@
+// pickle/backend/services/payments_test.go
+package services
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/carlostbanks/pickle/payments"
+	"github.com/carlostbanks/pickle/proto"
+	"google.golang.org/grpc/codes"
+)
+
+// price charges $20 an hour at the fixture's facility
+func (f *fixture) price(t *testing.T) {
+	t.Helper()
+	err := f.store.Courts.SetRates(context.Background(), f.court.Id, &proto.CourtRates{
+		Currency:        "USD",
+		GuestRateCents:  2000,
+		MemberRateCents: 2000,
+	})
+	if err != nil {
+		t.Fatalf("setting rates: %v", err)
+	}
+}
+
+// hold holds the requested slot for the player, checking it is priced
+func (f *fixture) hold(t *testing.T, req *proto.CreateBookingRequest) *proto.Booking {
+	t.Helper()
+	booking, err := f.server.HoldBooking(f.as(f.player), &proto.HoldBookingRequest{Booking: req})
+	if err != nil {
+		t.Fatalf("holding %s-%s: %v", req.StartTime, req.EndTime, err)
+	}
+	if booking.PriceCents <= 0 {
+		t.Fatalf("held booking has no price")
+	}
+	return booking
+}
+
+// expectPayment fails the test unless the latest payment of a booking has
+// the status
+func (f *fixture) expectPayment(t *testing.T, bookingID string, want proto.PaymentStatus) {
+	t.Helper()
+	payment, err := f.server.GetBookingPayment(f.as(f.player), &proto.GetBookingPaymentRequest{BookingId: bookingID})
+	if err != nil {
+		t.Fatalf("getting payment: %v", err)
+	}
+	if payment.Status != want {
+		t.Fatalf("payment is %v, expected %v", payment.Status, want)
+	}
+}
+
+func TestCheckout(t *testing.T) {
+	f := newFixture(t)
+	f.price(t)
+	ctx := f.as(f.player)
+	booking := f.hold(t, f.bookingRequest("13:00", "14:00"))
+
+	_, err := f.server.ConfirmBooking(ctx, &proto.ConfirmBookingRequest{BookingId: booking.Id})
+	expectCode(t, err, codes.FailedPrecondition)
+
+	payment, err := f.server.PayBooking(ctx, &proto.PayBookingRequest{BookingId: booking.Id, PaymentMethod: payments.FakeCardOK})
+	if err != nil {
+		t.Fatalf("paying: %v", err)
+	}
+	if payment.Status != proto.PaymentStatus_AUTHORIZED || payment.AmountCents != booking.PriceCents {
+		t.Fatalf("payment is %v for %d, expected AUTHORIZED for %d", payment.Status, payment.AmountCents, booking.PriceCents)
+	}
+	_, err = f.server.PayBooking(ctx, &proto.PayBookingRequest{BookingId: booking.Id, PaymentMethod: payments.FakeCardOK})
+	expectCode(t, err, codes.AlreadyExists)
+
+	confirmed, err := f.server.ConfirmBooking(ctx, &proto.ConfirmBookingRequest{BookingId: booking.Id})
+	if err != nil {
+		t.Fatalf("confirming: %v", err)
+	}
+	if confirmed.Status != proto.BookingStatus_CONFIRMED {
+		t.Fatalf("booking is %v, expected CONFIRMED", confirmed.Status)
+	}
+	f.expectPayment(t, booking.Id, proto.PaymentStatus_CAPTURED)
+
+	// Without a cancellation policy, cancelling refunds everything
+	cancelled, err := f.server.CancelBooking(ctx, &proto.CancelBookingRequest{BookingId: booking.Id})
+	if err != nil {
+		t.Fatalf("cancelling: %v", err)
+	}
+	if cancelled.RefundedCents != booking.PriceCents {
+		t.Errorf("cancelling refunded %d, expected %d", cancelled.RefundedCents, booking.PriceCents)
+	}
+	f.expectPayment(t, booking.Id, proto.PaymentStatus_REFUNDED)
+}
+
+func TestDeclinedPayment(t *testing.T) {
+	f := newFixture(t)
+	f.price(t)
+	ctx := f.as(f.player)
+	booking := f.hold(t, f.bookingRequest("15:00", "16:00"))
+
+	_, err := f.server.PayBooking(ctx, &proto.PayBookingRequest{BookingId: booking.Id, PaymentMethod: payments.FakeCardDeclined})
+	expectCode(t, err, codes.FailedPrecondition)
+	f.expectPayment(t, booking.Id, proto.PaymentStatus_FAILED)
+
+	_, err = f.server.ConfirmBooking(ctx, &proto.ConfirmBookingRequest{BookingId: booking.Id})
+	expectCode(t, err, codes.FailedPrecondition)
+
+	// A failed payment does not stop paying again
+	if _, err := f.server.PayBooking(ctx, &proto.PayBookingRequest{BookingId: booking.Id, PaymentMethod: payments.FakeCardOK}); err != nil {
+		t.Fatalf("paying again: %v", err)
+	}
+	if _, err := f.server.ConfirmBooking(ctx, &proto.ConfirmBookingRequest{BookingId: booking.Id}); err != nil {
+		t.Fatalf("confirming: %v", err)
+	}
+}
+
+func TestPaymentWebhook(t *testing.T) {
+	f := newFixture(t)
+	f.price(t)
+	booking := f.hold(t, f.bookingRequest("13:00", "14:00"))
+
+	// Without a payment method, the customer pays with the provider
+	payment, err := f.server.PayBooking(f.as(f.player), &proto.PayBookingRequest{BookingId: booking.Id})
+	if err != nil {
+		t.Fatalf("paying: %v", err)
+	}
+	if payment.Status != proto.PaymentStatus_REQUIRES_PAYMENT || payment.ClientSecret == "" {
+		t.Fatalf("payment is %v, expected REQUIRES_PAYMENT with a client secret", payment.Status)
+	}
+	payload, header, err := f.provider.Pay(payment.ProviderIntentId, payments.FakeCardOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Webhooks must be signed with the webhook secret
+	forged := http.Header{payments.FakeSignatureHeader: []string{"00"}}
+	if err := f.server.HandlePaymentWebhook(context.Background(), payload, forged); err == nil {
+		t.Fatal("a forged webhook was accepted")
+	}
+	f.expectPayment(t, booking.Id, proto.PaymentStatus_REQUIRES_PAYMENT)
+
+	if err := f.server.HandlePaymentWebhook(context.Background(), payload, header); err != nil {
+		t.Fatalf("handling the webhook: %v", err)
+	}
+	f.expectPayment(t, booking.Id, proto.PaymentStatus_AUTHORIZED)
+
+	// Replayed events cannot undo the capture
+	if _, err := f.server.ConfirmBooking(f.as(f.player), &proto.ConfirmBookingRequest{BookingId: booking.Id}); err != nil {
+		t.Fatalf("confirming: %v", err)
+	}
+	if err := f.server.HandlePaymentWebhook(context.Background(), payload, header); err != nil {
+		t.Fatalf("handling the replayed webhook: %v", err)
+	}
+	f.expectPayment(t, booking.Id, proto.PaymentStatus_CAPTURED)
+}
+
+func TestClaimPricedOffer(t *testing.T) {
+	f := newFixture(t)
+	f.price(t)
+
+	// Book both courts, so the other player has to wait
+	first := f.book(t, f.player, "10:00", "11:00")
+	second := f.bookingRequest("10:00", "11:00")
+	second.CourtUnitId = f.court.Units[1].Id
+	if _, err := f.server.CreateBooking(f.as(f.player), second); err != nil {
+		t.Fatalf("booking the second court: %v", err)
+	}
+	entry, err := f.server.JoinWaitlist(f.as(f.other), &proto.JoinWaitlistRequest{
+		CourtId: f.court.Id, Date: first.Date, StartTime: "10:00", EndTime: "11:00"})
+	if err != nil {
+		t.Fatalf("joining the waitlist: %v", err)
+	}
+
+	if _, err := f.server.CancelBooking(f.as(f.player), &proto.CancelBookingRequest{BookingId: first.Id}); err != nil {
+		t.Fatalf("cancelling: %v", err)
+	}
+	entry, err = f.store.Waitlist.GetEntry(context.Background(), entry.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Status != proto.WaitlistStatus_OFFERED {
+		t.Fatalf("entry is %v, expected OFFERED", entry.Status)
+	}
+
+	// The offered slot is paid for like any other hold
+	ctx := f.as(f.other)
+	_, err = f.server.ClaimWaitlistOffer(ctx, &proto.ClaimWaitlistOfferRequest{EntryId: entry.Id})
+	expectCode(t, err, codes.FailedPrecondition)
+
+	if _, err := f.server.PayBooking(ctx, &proto.PayBookingRequest{BookingId: entry.BookingId, PaymentMethod: payments.FakeCardOK}); err != nil {
+		t.Fatalf("paying: %v", err)
+	}
+	booking, err := f.server.ClaimWaitlistOffer(ctx, &proto.ClaimWaitlistOfferRequest{EntryId: entry.Id})
+	if err != nil {
+		t.Fatalf("claiming: %v", err)
+	}
+	if booking.Status != proto.BookingStatus_CONFIRMED {
+		t.Fatalf("booking is %v, expected CONFIRMED", booking.Status)
+	}
+	payment, err := f.server.GetBookingPayment(ctx, &proto.GetBookingPaymentRequest{BookingId: booking.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.Status != proto.PaymentStatus_CAPTURED {
+		t.Errorf("payment is %v, expected CAPTURED", payment.Status)
+	}
+}
@@ -0,0 +1,118 @@
+// pickle/backend/services/players.go
+package services
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"strings"
+
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultMaxPlayers is how many players a court holds unless its facility
+// says otherwise, enough for doubles
+const DefaultMaxPlayers = 4
+
+// MaxCourtPlayers bounds how many players a facility may let on a court
+const MaxCourtPlayers = 20
+
+// newRoster builds the players of a booking of organizerID from the emails
+// the organizer listed. Emails are matched to registered users, the others
+// are guests; blank emails and the organizer's own are dropped, since the
+// organizer always plays. Every player starts INVITED.
+func (s *SchedulerServer) newRoster(ctx context.Context, organizerID string, emails []string) ([]*proto.BookingPlayer, error) {
+	organizerEmail := ""
+	if organizer, err := s.store.Users.GetUser(ctx, organizerID); err == nil {
+		organizerEmail = strings.ToLower(organizer.Email)
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+
+	var players []*proto.BookingPlayer
+	listed := make(map[string]bool)
+	for _, email := range emails {
+		// Forms may leave some emails blank
+		if strings.TrimSpace(email) == "" {
+			continue
+		}
+		address, err := mail.ParseAddress(strings.TrimSpace(email))
+		if err != nil || address.Name != "" {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid player email %q", email)
+		}
+		email = strings.ToLower(address.Address)
+		if email == organizerEmail {
+			continue
+		}
+		if listed[email] {
+			return nil, status.Errorf(codes.InvalidArgument, "player %s is listed twice", email)
+		}
+		listed[email] = true
+
+		player := &proto.BookingPlayer{Email: email, Status: proto.PlayerStatus_INVITED}
+		user, err := s.store.Users.GetUserByEmail(ctx, email)
+		if err == nil {
+			player.UserId = user.ID
+		} else if !errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+		players = append(players, player)
+	}
+
+	return players, nil
+}
+
+// checkRoster returns the number of players of a booking, organizer
+// included, checking that they fit on a court holding maxPlayers. A
+// numberOfPlayers of 0 counts the organizer and the listed players;
+// otherwise it may leave room for players who were not listed.
+func checkRoster(numberOfPlayers int32, players []*proto.BookingPlayer, maxPlayers int32) (int32, error) {
+	if maxPlayers < 1 {
+		maxPlayers = DefaultMaxPlayers
+	}
+	listed := int32(len(players)) + 1
+
+	switch {
+	case numberOfPlayers == 0:
+		numberOfPlayers = listed
+	case numberOfPlayers < listed:
+		return 0, status.Errorf(codes.InvalidArgument, "number of players must count the organizer and the %d listed players", len(players))
+	}
+	if numberOfPlayers > maxPlayers {
+		return 0, status.Errorf(codes.InvalidArgument, "%d players do not fit on a court, which holds %d", numberOfPlayers, maxPlayers)
+	}
+
+	return numberOfPlayers, nil
+}
+
+// keepAnswers returns the players of a roster, with the answers of those
+// already on the current roster
+func keepAnswers(players, current []*proto.BookingPlayer) []*proto.BookingPlayer {
+	answers := make(map[string]*proto.BookingPlayer)
+	for _, player := range current {
+		answers[player.Email] = player
+	}
+
+	kept := make([]*proto.BookingPlayer, 0, len(players))
+	for _, player := range players {
+		player = &proto.BookingPlayer{Email: player.Email, UserId: player.UserId, Status: player.Status}
+		if answer, ok := answers[player.Email]; ok {
+			player.Status = answer.Status
+			player.RespondedAt = answer.RespondedAt
+		}
+		kept = append(kept, player)
+	}
+	return kept
+}
+
+// rosterEmails lists the emails of players, as Booking.PlayerEmails does
+func rosterEmails(players []*proto.BookingPlayer) []string {
+	var emails []string
+	for _, player := range players {
+		emails = append(emails, player.Email)
+	}
+	return emails
+}
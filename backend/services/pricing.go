@@ -0,0 +1,108 @@
+// pickle/backend/services/pricing.go
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/carlostbanks/pickle/pricing"
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/schedule"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GetQuote prices a prospective booking. Members of the facility are
+// quoted member rates.
+func (s *SchedulerServer) GetQuote(ctx context.Context, req *proto.GetQuoteRequest) (*proto.Quote, error) {
+	if req.CourtId == "" || req.Date == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing required fields")
+	}
+	window, err := schedule.ParseWindow(req.StartTime, req.EndTime)
+	if err != nil {
+		return nil, invalidArgument(err)
+	}
+
+	// Check that the court exists
+	if _, err := s.checkCourt(ctx, req.CourtId); err != nil {
+		return nil, err
+	}
+
+	rates, member, err := s.loadPricing(ctx, req.CourtId, getUserIDFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	quote, err := rates.Quote(req.Date, window, member)
+	if err != nil {
+		return nil, invalidArgument(err)
+	}
+
+	resp := &proto.Quote{
+		CourtId:    req.CourtId,
+		Date:       req.Date,
+		StartTime:  window.StartTime(),
+		EndTime:    window.EndTime(),
+		Currency:   quote.Currency,
+		Member:     quote.Member,
+		TotalCents: quote.Total,
+	}
+	for _, line := range quote.Lines {
+		resp.Lines = append(resp.Lines, &proto.QuoteLine{
+			StartTime:   line.Window.StartTime(),
+			EndTime:     line.Window.EndTime(),
+			Peak:        line.Peak,
+			RateCents:   line.Rate,
+			AmountCents: line.Amount,
+		})
+	}
+
+	return resp, nil
+}
+
+// loadRates loads the price list of a facility, or nil if it has none
+func (s *SchedulerServer) loadRates(ctx context.Context, courtID string) (*proto.CourtRates, error) {
+	return s.store.Courts.GetRates(ctx, courtID)
+}
+
+// ratesTable converts a price list for the pricing engine. A facility
+// without a price list is free.
+func ratesTable(rates *proto.CourtRates) pricing.RateTable {
+	if rates == nil {
+		return pricing.RateTable{}
+	}
+
+	table := pricing.RateTable{
+		Currency:           rates.Currency,
+		Base:               pricing.Rate{Guest: rates.GuestRateCents, Member: rates.MemberRateCents},
+		MinDurationMinutes: int(rates.MinDurationMinutes),
+	}
+	for _, peak := range rates.PeakRates {
+		if window, err := schedule.ParseWindow(peak.StartTime, peak.EndTime); err == nil {
+			table.Peaks = append(table.Peaks, pricing.PeakWindow{
+				Weekday: time.Weekday(peak.Weekday),
+				Window:  window,
+				Rate:    pricing.Rate{Guest: peak.GuestRateCents, Member: peak.MemberRateCents},
+			})
+		}
+	}
+	return table
+}
+
+// loadPricing returns the rate table of a facility and whether the user is
+// one of its members. An empty userID is priced as a guest.
+func (s *SchedulerServer) loadPricing(ctx context.Context, courtID, userID string) (pricing.RateTable, bool, error) {
+	rates, err := s.loadRates(ctx, courtID)
+	if err != nil {
+		return pricing.RateTable{}, false, err
+	}
+
+	member := false
+	if userID != "" {
+		if member, err = s.store.Courts.IsMember(ctx, courtID, userID); err != nil {
+			return pricing.RateTable{}, false, err
+		}
+	}
+
+	return ratesTable(rates), member, nil
+}
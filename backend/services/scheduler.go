@@ -3,537 +3,1034 @@ package services
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"fmt"
+	"log"
+	"strings"
 	"time"
 
+	"github.com/carlostbanks/pickle/auth"
+	"github.com/carlostbanks/pickle/cancellation"
+	"github.com/carlostbanks/pickle/notifications"
+	"github.com/carlostbanks/pickle/payments"
+	"github.com/carlostbanks/pickle/pricing"
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/schedule"
+	"github.com/carlostbanks/pickle/storage"
 	"github.com/google/uuid"
-	// These will be available after proto generation
-	// "github.com/carlostbanks/pickle/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	gproto "google.golang.org/protobuf/proto"
 )
 
-// Temporary type definitions until proto generation is done
-// These will be replaced by the generated protobuf types
-
-// BookingStatus represents the status of a booking
-type BookingStatus int32
-
 const (
-	BookingStatus_PENDING   BookingStatus = 0
-	BookingStatus_CONFIRMED BookingStatus = 1
-	BookingStatus_CANCELLED BookingStatus = 2
+	// DefaultHoldDuration is how long a slot is held during checkout unless
+	// the client asks for less; holds are capped at MaxHoldDuration
+	DefaultHoldDuration = 10 * time.Minute
+	MaxHoldDuration     = 30 * time.Minute
 )
 
-// Court represents a padel court
-type Court struct {
-	Id             string
-	Name           string
-	Address        string
-	Latitude       float64
-	Longitude      float64
-	NumberOfCourts int32
-	Amenities      []string
-	ImageUrl       string
+// SchedulerServer implements the SchedulerService gRPC service
+type SchedulerServer struct {
+	proto.UnimplementedSchedulerServiceServer
+	store           *storage.Store
+	paymentProvider payments.Provider
+	notifier        Notifier
+	frontendURL     string
 }
 
-// GetCourtsRequest represents a request to get courts
-type GetCourtsRequest struct {
-	City      string
-	Latitude  float64
-	Longitude float64
-	RadiusKm  int32
+// NewSchedulerServer creates a new scheduler server keeping its records in
+// store. Emails are queued with notifier and link to pages under frontendURL.
+func NewSchedulerServer(store *storage.Store, paymentProvider payments.Provider, notifier Notifier, frontendURL string) *SchedulerServer {
+	return &SchedulerServer{store: store, paymentProvider: paymentProvider, notifier: notifier, frontendURL: frontendURL}
 }
 
-// GetCourtsResponse represents a response with courts
-type GetCourtsResponse struct {
-	Courts []*Court
-}
+// GetCourts returns courts based on search criteria
+func (s *SchedulerServer) GetCourts(ctx context.Context, req *proto.GetCourtsRequest) (*proto.GetCourtsResponse, error) {
+	// Query courts by city (matched against the address) and location
+	courts, err := s.store.Courts.ListCourts(ctx, storage.CourtFilter{
+		City:      req.City,
+		Latitude:  req.Latitude,
+		Longitude: req.Longitude,
+		RadiusKm:  float64(req.RadiusKm),
+	})
+	if err != nil {
+		return nil, err
+	}
 
-// GetCourtRequest represents a request to get a court
-type GetCourtRequest struct {
-	CourtId string
+	return &proto.GetCourtsResponse{Courts: courts}, nil
 }
 
-// Booking represents a court booking
-type Booking struct {
-	Id              string
-	CourtId         string
-	UserId          string
-	Date            string
-	StartTime       string
-	EndTime         string
-	NumberOfPlayers int32
-	PlayerEmails    []string
-	Status          BookingStatus
-	CreatedAt       string
-	UpdatedAt       string
-}
+// GetCourt returns a specific court by ID
+func (s *SchedulerServer) GetCourt(ctx context.Context, req *proto.GetCourtRequest) (*proto.Court, error) {
+	court, err := s.store.Courts.GetCourt(ctx, req.CourtId)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, status.Error(codes.NotFound, "court not found")
+		}
+		return nil, err
+	}
 
-// CreateBookingRequest represents a request to create a booking
-type CreateBookingRequest struct {
-	CourtId         string
-	Date            string
-	StartTime       string
-	EndTime         string
-	NumberOfPlayers int32
-	PlayerEmails    []string
-}
+	// Load opening hours and upcoming exceptions and blackouts
+	if err := s.store.Courts.LoadCalendar(ctx, court, time.Now().Format(schedule.DateLayout), ""); err != nil {
+		return nil, err
+	}
 
-// GetBookingsRequest represents a request to get bookings
-type GetBookingsRequest struct {
-	UserId  string
-	CourtId string
-	Date    string
-}
+	// Load the price list
+	rates, err := s.loadRates(ctx, court.Id)
+	if err != nil {
+		return nil, err
+	}
+	court.Rates = rates
 
-// GetBookingsResponse represents a response with bookings
-type GetBookingsResponse struct {
-	Bookings []*Booking
-}
+	// Load the cancellation policy
+	policy, err := s.loadCancellationPolicy(ctx, court.Id)
+	if err != nil {
+		return nil, err
+	}
+	court.CancellationPolicy = policy
 
-// UpdateBookingRequest represents a request to update a booking
-type UpdateBookingRequest struct {
-	BookingId       string
-	StartTime       string
-	EndTime         string
-	NumberOfPlayers int32
-	PlayerEmails    []string
-}
+	// Load the individual bookable courts of the facility
+	units, err := s.store.Courts.ListUnits(ctx, court.Id)
+	if err != nil {
+		return nil, err
+	}
+	court.Units = units
 
-// CancelBookingRequest represents a request to cancel a booking
-type CancelBookingRequest struct {
-	BookingId string
+	return court, nil
 }
 
-// CancelBookingResponse represents a response to a booking cancellation
-type CancelBookingResponse struct {
-	Success bool
-	Message string
-}
+// GetAvailability returns the bookable slots of a court over a date range
+func (s *SchedulerServer) GetAvailability(ctx context.Context, req *proto.GetAvailabilityRequest) (*proto.GetAvailabilityResponse, error) {
+	from := req.From
+	if from == "" {
+		from = time.Now().Format(schedule.DateLayout)
+	}
+	to := req.To
+	if to == "" {
+		to = from
+	}
+	duration := int(req.Duration)
+	if duration == 0 {
+		duration = 60
+	}
+	if duration < 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid duration")
+	}
 
-// SchedulerServer implements the SchedulerService gRPC service
-type SchedulerServer struct {
-	// This field will be added after proto generation
-	// proto.UnimplementedSchedulerServiceServer
-	db *sql.DB
-}
+	dates, err := schedule.DateRange(from, to)
+	if err != nil {
+		return nil, invalidArgument(err)
+	}
 
-// NewSchedulerServer creates a new scheduler server
-func NewSchedulerServer(db *sql.DB) *SchedulerServer {
-	return &SchedulerServer{db: db}
-}
+	// Check if court exists
+	if _, err := s.checkCourt(ctx, req.CourtId); err != nil {
+		return nil, err
+	}
 
-// GetCourts returns courts based on search criteria
-func (s *SchedulerServer) GetCourts(ctx context.Context, req *GetCourtsRequest) (*GetCourtsResponse, error) {
-	// This is a placeholder implementation
-	// In a real implementation, you'd query a database or external API
-
-	// Query courts from database based on location
-	rows, err := s.db.Query(`
-		SELECT id, name, address, latitude, longitude, number_of_courts, amenities, image_url
-		FROM courts
-		WHERE 
-			($1 = '' OR city = $1)
-			AND ($2 = 0 OR 
-				(
-					earth_distance(
-						ll_to_earth($2, $3),
-						ll_to_earth(latitude, longitude)
-					) <= $4 * 1000
-				)
-			)
-	`, req.City, req.Latitude, req.Longitude, req.RadiusKm)
-
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var courts []*Court
-	for rows.Next() {
-		var court Court
-		var amenitiesArray []string
-
-		err := rows.Scan(
-			&court.Id,
-			&court.Name,
-			&court.Address,
-			&court.Latitude,
-			&court.Longitude,
-			&court.NumberOfCourts,
-			&amenitiesArray,
-			&court.ImageUrl,
-		)
+	court := &proto.Court{Id: req.CourtId}
+	if err := s.store.Courts.LoadCalendar(ctx, court, from, to); err != nil {
+		return nil, err
+	}
+	hours := courtHours(court)
 
-		if err != nil {
-			return nil, err
-		}
+	unitIDs, err := s.loadUnitIDs(ctx, req.CourtId)
+	if err != nil {
+		return nil, err
+	}
+
+	booked, err := s.store.Bookings.Booked(ctx, req.CourtId, from, to, "")
+	if err != nil {
+		return nil, err
+	}
 
-		court.Amenities = amenitiesArray
-		courts = append(courts, &court)
+	// Compute free slots day by day
+	var slots []*proto.AvailableSlot
+	for _, date := range dates {
+		open, ok := hours.OpenWindow(date)
+		if !ok {
+			continue
+		}
+		for _, slot := range schedule.Slots(open, duration, schedule.DefaultSlotMinutes, unitIDs, append(booked[date], hours.Blocked(date, unitIDs)...)) {
+			slots = append(slots, &proto.AvailableSlot{
+				Date:         date,
+				StartTime:    slot.Window.StartTime(),
+				EndTime:      slot.Window.EndTime(),
+				CourtUnitIds: slot.UnitIDs,
+			})
+		}
 	}
 
-	return &GetCourtsResponse{Courts: courts}, nil
+	return &proto.GetAvailabilityResponse{Slots: slots}, nil
 }
 
-// GetCourt returns a specific court by ID
-func (s *SchedulerServer) GetCourt(ctx context.Context, req *GetCourtRequest) (*Court, error) {
-	var court Court
-	var amenitiesArray []string
+// CreateBooking creates a new booking
+func (s *SchedulerServer) CreateBooking(ctx context.Context, req *proto.CreateBookingRequest) (*proto.Booking, error) {
+	return s.createBooking(ctx, req, 0)
+}
 
-	err := s.db.QueryRow(`
-		SELECT id, name, address, latitude, longitude, number_of_courts, amenities, image_url
-		FROM courts
-		WHERE id = $1
-	`, req.CourtId).Scan(
-		&court.Id,
-		&court.Name,
-		&court.Address,
-		&court.Latitude,
-		&court.Longitude,
-		&court.NumberOfCourts,
-		&amenitiesArray,
-		&court.ImageUrl,
-	)
+// HoldBooking holds a slot during checkout. The booking stays PENDING until
+// it is confirmed with ConfirmBooking or the hold expires.
+func (s *SchedulerServer) HoldBooking(ctx context.Context, req *proto.HoldBookingRequest) (*proto.Booking, error) {
+	if req.Booking == nil {
+		return nil, status.Error(codes.InvalidArgument, "booking is required")
+	}
 
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, errors.New("court not found")
-		}
-		return nil, err
+	holdFor := DefaultHoldDuration
+	if req.HoldMinutes > 0 {
+		holdFor = time.Duration(req.HoldMinutes) * time.Minute
+	}
+	if holdFor > MaxHoldDuration {
+		holdFor = MaxHoldDuration
 	}
 
-	court.Amenities = amenitiesArray
-	return &court, nil
+	return s.createBooking(ctx, req.Booking, holdFor)
 }
 
-// CreateBooking creates a new booking
-func (s *SchedulerServer) CreateBooking(ctx context.Context, req *CreateBookingRequest) (*Booking, error) {
+// createBooking creates a CONFIRMED booking, or a PENDING hold expiring
+// after holdFor if it is set
+func (s *SchedulerServer) createBooking(ctx context.Context, req *proto.CreateBookingRequest, holdFor time.Duration) (*proto.Booking, error) {
 	// Generate a new UUID for the booking
 	bookingID := uuid.New().String()
 
 	// Get user ID from context
 	userID := getUserIDFromContext(ctx)
 	if userID == "" {
-		return nil, errors.New("user not authenticated")
+		return nil, errUnauthenticated
 	}
 
 	// Validate booking times
-	startTime, err := time.Parse("15:04", req.StartTime)
+	window, err := schedule.ParseWindow(req.StartTime, req.EndTime)
 	if err != nil {
-		return nil, errors.New("invalid start time format")
+		return nil, invalidArgument(err)
 	}
 
-	endTime, err := time.Parse("15:04", req.EndTime)
+	// Check if court exists
+	court, err := s.checkCourt(ctx, req.CourtId)
 	if err != nil {
-		return nil, errors.New("invalid end time format")
+		return nil, err
 	}
 
-	if endTime.Before(startTime) {
-		return nil, errors.New("end time must be after start time")
+	// Invite the players, who must fit on a court with the organizer
+	players, err := s.newRoster(ctx, userID, req.PlayerEmails)
+	if err != nil {
+		return nil, err
 	}
-
-	// Check if court exists
-	var courtExists bool
-	err = s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM courts WHERE id = $1)", req.CourtId).Scan(&courtExists)
+	numberOfPlayers, err := checkRoster(req.NumberOfPlayers, players, court.MaxPlayers)
 	if err != nil {
 		return nil, err
 	}
 
-	if !courtExists {
-		return nil, errors.New("court not found")
+	// Check opening hours, closures and blackouts
+	if err := s.store.Courts.LoadCalendar(ctx, court, req.Date, req.Date); err != nil {
+		return nil, err
+	}
+	hours := courtHours(court)
+	if err := hours.Check(req.Date, window); err != nil {
+		return nil, hoursError(err)
 	}
 
-	// Check for conflicting bookings
-	var conflictExists bool
-	err = s.db.QueryRow(`
-		SELECT EXISTS(
-			SELECT 1 FROM bookings 
-			WHERE court_id = $1 
-			AND date = $2 
-			AND status != 'CANCELLED'
-			AND (
-				(start_time <= $3 AND end_time > $3) OR
-				(start_time < $4 AND end_time >= $4) OR
-				(start_time >= $3 AND end_time <= $4)
-			)
-		)
-	`, req.CourtId, req.Date, req.StartTime, req.EndTime).Scan(&conflictExists)
+	if req.CourtUnitId != "" {
+		if err := s.checkCourtUnit(ctx, req.CourtId, req.CourtUnitId); err != nil {
+			return nil, err
+		}
+	}
 
+	// Price the booking
+	rates, member, err := s.loadPricing(ctx, req.CourtId, userID)
 	if err != nil {
 		return nil, err
 	}
-
-	if conflictExists {
-		return nil, errors.New("booking time conflicts with existing booking")
+	quote, err := rates.Quote(req.Date, window, member)
+	if err != nil {
+		return nil, invalidArgument(err)
 	}
 
 	// Create booking in database
 	now := time.Now().Format(time.RFC3339)
 
-	_, err = s.db.Exec(`
-		INSERT INTO bookings (
-			id, court_id, user_id, date, start_time, end_time, 
-			number_of_players, player_emails, status, created_at, updated_at
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
-	`, bookingID, req.CourtId, userID, req.Date, req.StartTime, req.EndTime,
-		req.NumberOfPlayers, req.PlayerEmails, "CONFIRMED", now, now)
-
-	if err != nil {
-		return nil, err
-	}
-
-	// Return the created booking
-	booking := &Booking{
+	booking := &proto.Booking{
 		Id:              bookingID,
 		CourtId:         req.CourtId,
 		UserId:          userID,
+		PriceCents:      quote.Total,
+		Currency:        quote.Currency,
 		Date:            req.Date,
 		StartTime:       req.StartTime,
 		EndTime:         req.EndTime,
-		NumberOfPlayers: req.NumberOfPlayers,
-		PlayerEmails:    req.PlayerEmails,
-		Status:          BookingStatus_CONFIRMED,
+		NumberOfPlayers: numberOfPlayers,
+		PlayerEmails:    rosterEmails(players),
+		Players:         players,
+		Status:          proto.BookingStatus_CONFIRMED,
 		CreatedAt:       now,
 		UpdatedAt:       now,
 	}
+	if holdFor > 0 {
+		booking.Status = proto.BookingStatus_PENDING
+		booking.HoldExpiresAt = time.Now().Add(holdFor).Format(timestampLayout)
+	}
 
-	return booking, nil
-}
-
-// GetBookings retrieves bookings based on filter criteria
-func (s *SchedulerServer) GetBookings(ctx context.Context, req *GetBookingsRequest) (*GetBookingsResponse, error) {
-	// Build query based on filters
-	query := `
-		SELECT id, court_id, user_id, date, start_time, end_time, 
-			   number_of_players, player_emails, status, created_at, updated_at
-		FROM bookings
-		WHERE 1=1
-	`
-	var args []interface{}
-	var argCount int = 1
+	// Holds are announced, and invite the players, once they are confirmed
+	var messages []*notifications.Message
+	if booking.Status == proto.BookingStatus_CONFIRMED {
+		messages = append(s.emails(ctx, notifications.KindBookingConfirmed, booking),
+			s.invitations(ctx, booking, booking.Players)...)
+	}
 
-	if req.UserId != "" {
-		query += fmt.Sprintf(" AND user_id = $%d", argCount)
-		args = append(args, req.UserId)
-		argCount++
+	if err := s.insertBooking(ctx, booking, req.CourtUnitId, window, hours, messages...); err != nil {
+		return nil, err
 	}
+	s.notifier.Wake()
 
-	if req.CourtId != "" {
-		query += fmt.Sprintf(" AND court_id = $%d", argCount)
-		args = append(args, req.CourtId)
-		argCount++
+	return booking, nil
+}
+
+// GetBookings retrieves bookings based on filter criteria. Players only see
+// their own bookings, staff also see every booking at their facilities.
+func (s *SchedulerServer) GetBookings(ctx context.Context, req *proto.GetBookingsRequest) (*proto.GetBookingsResponse, error) {
+	principal, ok := auth.PrincipalFromContext(ctx)
+	if !ok {
+		return nil, errUnauthenticated
 	}
 
-	if req.Date != "" {
-		query += fmt.Sprintf(" AND date = $%d", argCount)
-		args = append(args, req.Date)
-		argCount++
+	var visible *storage.Visibility
+	switch {
+	case principal.IsPlatformAdmin():
+	case req.CourtId != "" && principal.HasRole(auth.RoleStaff, req.CourtId):
+	default:
+		visible = &storage.Visibility{UserID: principal.UserID, CourtIDs: principal.CourtsWithRole(auth.RoleStaff)}
+		if req.UserId != "" && req.UserId != principal.UserID && len(visible.CourtIDs) == 0 {
+			return nil, status.Error(codes.PermissionDenied, "not authorized to view this user's bookings")
+		}
 	}
 
-	query += " ORDER BY date, start_time"
+	return s.listBookings(ctx, req, visible)
+}
 
-	// Execute query
-	rows, err := s.db.Query(query, args...)
+// listBookings retrieves bookings based on filter criteria, restricted to
+// visible ones unless visible is nil
+func (s *SchedulerServer) listBookings(ctx context.Context, req *proto.GetBookingsRequest, visible *storage.Visibility) (*proto.GetBookingsResponse, error) {
+	bookings, err := s.store.Bookings.ListBookings(ctx, storage.BookingFilter{
+		UserID:   req.UserId,
+		CourtID:  req.CourtId,
+		Date:     req.Date,
+		SeriesID: req.SeriesId,
+		Visible:  visible,
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	// Process results
-	var bookings []*Booking
-	for rows.Next() {
-		var booking Booking
-		var statusStr string
-		var playerEmailsArray []string
+	return &proto.GetBookingsResponse{Bookings: bookings}, nil
+}
 
-		err := rows.Scan(
-			&booking.Id,
-			&booking.CourtId,
-			&booking.UserId,
-			&booking.Date,
-			&booking.StartTime,
-			&booking.EndTime,
-			&booking.NumberOfPlayers,
-			&playerEmailsArray,
-			&statusStr,
-			&booking.CreatedAt,
-			&booking.UpdatedAt,
-		)
+// GetBooking returns a booking to its organizer and players, and to staff of
+// its facility
+func (s *SchedulerServer) GetBooking(ctx context.Context, req *proto.GetBookingRequest) (*proto.Booking, error) {
+	principal, ok := auth.PrincipalFromContext(ctx)
+	if !ok {
+		return nil, errUnauthenticated
+	}
 
-		if err != nil {
-			return nil, err
-		}
+	booking, err := s.getBooking(ctx, req.BookingId)
+	if err != nil {
+		return nil, err
+	}
 
-		// Map status string to enum
-		switch statusStr {
-		case "PENDING":
-			booking.Status = BookingStatus_PENDING
-		case "CONFIRMED":
-			booking.Status = BookingStatus_CONFIRMED
-		case "CANCELLED":
-			booking.Status = BookingStatus_CANCELLED
-		}
+	if !canManageBooking(ctx, booking.UserId, booking.CourtId) && !isPlayer(booking, principal.UserID) {
+		return nil, status.Error(codes.PermissionDenied, "not authorized to view this booking")
+	}
+	return booking, nil
+}
 
-		booking.PlayerEmails = playerEmailsArray
-		bookings = append(bookings, &booking)
+// isPlayer reports whether a user is one of the players of a booking
+func isPlayer(booking *proto.Booking, userID string) bool {
+	for _, player := range booking.Players {
+		if player.UserId != "" && player.UserId == userID {
+			return true
+		}
 	}
+	return false
+}
 
-	return &GetBookingsResponse{Bookings: bookings}, nil
+// getBooking returns a booking, or a NotFound status for unknown ones
+func (s *SchedulerServer) getBooking(ctx context.Context, bookingID string) (*proto.Booking, error) {
+	booking, err := s.store.Bookings.GetBooking(ctx, bookingID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, status.Error(codes.NotFound, "booking not found")
+	}
+	return booking, err
 }
 
 // UpdateBooking updates an existing booking
-func (s *SchedulerServer) UpdateBooking(ctx context.Context, req *UpdateBookingRequest) (*Booking, error) {
+func (s *SchedulerServer) UpdateBooking(ctx context.Context, req *proto.UpdateBookingRequest) (*proto.Booking, error) {
 	// Get user ID from context
 	userID := getUserIDFromContext(ctx)
 	if userID == "" {
-		return nil, errors.New("user not authenticated")
+		return nil, errUnauthenticated
 	}
 
-	// Check if booking exists and belongs to user
-	var booking Booking
-	var statusStr string
-	var playerEmailsArray []string
-	var courtID string
-	var dateStr string
+	// Check if booking exists and the user may manage it
+	booking, err := s.getBooking(ctx, req.BookingId)
+	if err != nil {
+		return nil, err
+	}
 
-	err := s.db.QueryRow(`
-		SELECT id, court_id, user_id, date, start_time, end_time, 
-			   number_of_players, player_emails, status, created_at, updated_at
-		FROM bookings
-		WHERE id = $1
-	`, req.BookingId).Scan(
-		&booking.Id,
-		&courtID,
-		&booking.UserId,
-		&dateStr,
-		&booking.StartTime,
-		&booking.EndTime,
-		&booking.NumberOfPlayers,
-		&playerEmailsArray,
-		&statusStr,
-		&booking.CreatedAt,
-		&booking.UpdatedAt,
-	)
+	if !canManageBooking(ctx, booking.UserId, booking.CourtId) {
+		return nil, status.Error(codes.PermissionDenied, "not authorized to update this booking")
+	}
+
+	switch booking.Status {
+	case proto.BookingStatus_CANCELLED:
+		return nil, status.Error(codes.FailedPrecondition, "booking is cancelled")
+	case proto.BookingStatus_NO_SHOW:
+		return nil, status.Error(codes.FailedPrecondition, "booking was marked as a no-show")
+	}
 
+	window, err := schedule.ParseWindow(req.StartTime, req.EndTime)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, errors.New("booking not found")
+		return nil, invalidArgument(err)
+	}
+
+	if req.CourtUnitId != "" {
+		if err := s.checkCourtUnit(ctx, booking.CourtId, req.CourtUnitId); err != nil {
+			return nil, err
 		}
+	}
+
+	// Collect the occurrences the update applies to
+	targets, err := s.seriesTargets(ctx, booking, req.Scope)
+	if err != nil {
 		return nil, err
 	}
 
-	if booking.UserId != userID {
-		return nil, errors.New("not authorized to update this booking")
+	// The players must fit on a court with the organizer
+	court, err := s.store.Courts.GetCourt(ctx, booking.CourtId)
+	if err != nil {
+		return nil, err
+	}
+	players, err := s.newRoster(ctx, booking.UserId, req.PlayerEmails)
+	if err != nil {
+		return nil, err
+	}
+	numberOfPlayers, err := checkRoster(req.NumberOfPlayers, players, court.MaxPlayers)
+	if err != nil {
+		return nil, err
 	}
 
-	// Check for conflicting bookings (excluding this booking)
-	var conflictExists bool
-	err = s.db.QueryRow(`
-		SELECT EXISTS(
-			SELECT 1 FROM bookings 
-			WHERE court_id = $1 
-			AND date = $2 
-			AND id != $3
-			AND status != 'CANCELLED'
-			AND (
-				(start_time <= $4 AND end_time > $4) OR
-				(start_time < $5 AND end_time >= $5) OR
-				(start_time >= $4 AND end_time <= $5)
-			)
-		)
-	`, courtID, dateStr, req.BookingId, req.StartTime, req.EndTime).Scan(&conflictExists)
+	// Check opening hours, closures and blackouts
+	if err := s.store.Courts.LoadCalendar(ctx, court, targets[0].date, targets[len(targets)-1].date); err != nil {
+		return nil, err
+	}
+	hours := courtHours(court)
 
+	// Reprice the booking for the new times
+	rates, member, err := s.loadPricing(ctx, booking.CourtId, booking.UserId)
 	if err != nil {
 		return nil, err
 	}
+	if _, err := rates.Quote(booking.Date, window, member); err != nil {
+		return nil, invalidArgument(err)
+	}
+
+	// Keep each occurrence on its current unit if it is still free, otherwise
+	// move it to another one
+	var conflicts []string
+	for _, target := range targets {
+		if err := hours.Check(target.date, window); err != nil {
+			if len(targets) == 1 {
+				return nil, hoursError(err)
+			}
+			conflicts = append(conflicts, target.date)
+			continue
+		}
 
-	if conflictExists {
-		return nil, errors.New("booking time conflicts with existing booking")
+		unitID, err := s.findFreeUnit(ctx, booking.CourtId, req.CourtUnitId, target.courtUnitID, target.id, target.date, window, hours)
+		if err != nil {
+			return nil, err
+		}
+		if unitID == "" {
+			conflicts = append(conflicts, target.date)
+			continue
+		}
+		quote, err := rates.Quote(target.date, window, member)
+		if err != nil {
+			conflicts = append(conflicts, target.date)
+			continue
+		}
+		target.courtUnitID = unitID
+		target.quote = quote
+	}
+	if len(conflicts) > 0 {
+		if len(targets) == 1 {
+			return nil, errBookingConflict
+		}
+		return nil, fmt.Errorf("%w on %s", errBookingConflict, strings.Join(conflicts, ", "))
 	}
 
-	// Update booking
+	// Update bookings
 	now := time.Now().Format(time.RFC3339)
 
-	_, err = s.db.Exec(`
-		UPDATE bookings
-		SET start_time = $1, end_time = $2, number_of_players = $3, 
-			player_emails = $4, updated_at = $5
-		WHERE id = $6
-	`, req.StartTime, req.EndTime, req.NumberOfPlayers, req.PlayerEmails, now, req.BookingId)
+	changes := make([]*proto.Booking, len(targets))
+	for i, target := range targets {
+		changes[i] = &proto.Booking{
+			Id:              target.id,
+			CourtUnitId:     target.courtUnitID,
+			StartTime:       req.StartTime,
+			EndTime:         req.EndTime,
+			NumberOfPlayers: numberOfPlayers,
+			PriceCents:      target.quote.Total,
+			Currency:        target.quote.Currency,
+			UpdatedAt:       now,
+		}
 
+		if target.id == req.BookingId {
+			booking.CourtUnitId = target.courtUnitID
+			booking.PriceCents = target.quote.Total
+			booking.Currency = target.quote.Currency
+		}
+	}
+
+	// The players of each occurrence are replaced; those it had already
+	// keep their answers, new ones are invited. Everyone playing is told
+	// about the change with it.
+	rosters := make([][]*proto.BookingPlayer, len(targets))
+	updated := make([]*proto.Booking, len(targets))
+	for i, target := range targets {
+		rosters[i] = keepAnswers(players, target.booking.Players)
+		updated[i] = gproto.Clone(target.booking).(*proto.Booking)
+		updated[i].StartTime = req.StartTime
+		updated[i].EndTime = req.EndTime
+		updated[i].Players = rosters[i]
+	}
+
+	err = s.store.Bookings.UpdateBookings(ctx, changes, s.emails(ctx, notifications.KindBookingChanged, updated...)...)
+	if errors.Is(err, storage.ErrOverlap) {
+		return nil, errBookingConflict
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	for i, target := range targets {
+		// Holds invite the players once they are confirmed
+		var invitations []*notifications.Message
+		if target.booking.Status == proto.BookingStatus_CONFIRMED {
+			invitations = s.invitations(ctx, updated[i], addedPlayers(rosters[i], target.booking.Players))
+		}
+		if err := s.store.Bookings.SetPlayers(ctx, target.id, rosters[i], invitations...); err != nil {
+			return nil, err
+		}
+		if target.id == req.BookingId {
+			booking.Players = rosters[i]
+		}
+	}
+	s.notifier.Wake()
+
 	// Return updated booking
 	booking.StartTime = req.StartTime
 	booking.EndTime = req.EndTime
-	booking.NumberOfPlayers = req.NumberOfPlayers
-	booking.PlayerEmails = req.PlayerEmails
+	booking.NumberOfPlayers = numberOfPlayers
+	booking.PlayerEmails = rosterEmails(booking.Players)
 	booking.UpdatedAt = now
 
-	// Map status string to enum
-	switch statusStr {
-	case "PENDING":
-		booking.Status = BookingStatus_PENDING
-	case "CONFIRMED":
-		booking.Status = BookingStatus_CONFIRMED
-	case "CANCELLED":
-		booking.Status = BookingStatus_CANCELLED
+	return booking, nil
+}
+
+// CancelBooking cancels an existing booking
+func (s *SchedulerServer) CancelBooking(ctx context.Context, req *proto.CancelBookingRequest) (*proto.CancelBookingResponse, error) {
+	// Get user ID from context
+	userID := getUserIDFromContext(ctx)
+	if userID == "" {
+		return nil, errUnauthenticated
+	}
+
+	// Check if booking exists and the user may manage it
+	booking, err := s.getBooking(ctx, req.BookingId)
+	if err != nil {
+		return nil, err
 	}
 
-	return &booking, nil
+	if !canManageBooking(ctx, booking.UserId, booking.CourtId) {
+		return nil, status.Error(codes.PermissionDenied, "not authorized to cancel this booking")
+	}
+
+	switch booking.Status {
+	case proto.BookingStatus_CANCELLED:
+		return nil, status.Error(codes.FailedPrecondition, "booking is already cancelled")
+	case proto.BookingStatus_NO_SHOW:
+		return nil, status.Error(codes.FailedPrecondition, "booking was marked as a no-show")
+	}
+
+	// Collect the occurrences the cancellation applies to
+	targets, err := s.seriesTargets(ctx, booking, req.Scope)
+	if err != nil {
+		return nil, err
+	}
+	bookings := make([]*proto.Booking, len(targets))
+	for i, target := range targets {
+		bookings[i] = target.booking
+	}
+
+	// Apply the facility's cancellation policy
+	cancellations, err := s.applyCancellationPolicy(ctx, booking.CourtId, bookings)
+	if err != nil {
+		return nil, err
+	}
+
+	// Update booking status to cancelled, telling everyone playing;
+	// cancelling an offered booking declines the offer
+	now := time.Now()
+	messages := s.emails(ctx, notifications.KindBookingCancelled, bookings...)
+	if err := s.store.Bookings.CancelBookings(ctx, cancellations, now, messages...); err != nil {
+		return nil, err
+	}
+	s.notifier.Wake()
+
+	cancelledIDs := make([]string, len(cancellations))
+	fees := make(map[string]int64, len(cancellations))
+	var totalFee int64
+	for i, c := range cancellations {
+		cancelledIDs[i] = c.BookingId
+		fees[c.BookingId] = c.FeeCents
+		totalFee += c.FeeCents
+	}
+
+	if req.Scope == proto.SeriesScope_ALL_OCCURRENCES && booking.SeriesId != "" {
+		if err := s.store.Series.CancelSeries(ctx, booking.SeriesId, now); err != nil {
+			return nil, err
+		}
+	}
+
+	// Keep the fees and refund the rest of what was paid
+	refunded := s.settlePayments(ctx, fees)
+
+	// Offer the freed slots to waitlisted users
+	for _, c := range cancellations {
+		if err := s.promoteWaitlist(ctx, booking.CourtId, c.Date); err != nil {
+			log.Printf("Error promoting waitlist: %v", err)
+		}
+	}
+
+	currency := booking.Currency
+	message := cancellation.Outcome{Rule: cancellations[0].Rule, FeeCents: cancellations[0].FeeCents}.Message(currency)
+	if len(cancellations) > 1 {
+		message = fmt.Sprintf("%d bookings cancelled successfully", len(cancellations))
+		if totalFee > 0 {
+			message += fmt.Sprintf("; fees of %s apply", cancellation.FormatAmount(totalFee, currency))
+		}
+	}
+
+	return &proto.CancelBookingResponse{
+		Success:              true,
+		Message:              message,
+		CancelledBookingIds:  cancelledIDs,
+		Cancellations:        cancellations,
+		CancellationFeeCents: totalFee,
+		RefundedCents:        refunded,
+	}, nil
 }
 
-// CancelBooking cancels an existing booking
-func (s *SchedulerServer) CancelBooking(ctx context.Context, req *CancelBookingRequest) (*CancelBookingResponse, error) {
+// CreateBookingSeries creates a recurring booking and books every free occurrence
+func (s *SchedulerServer) CreateBookingSeries(ctx context.Context, req *proto.CreateBookingSeriesRequest) (*proto.CreateBookingSeriesResponse, error) {
 	// Get user ID from context
 	userID := getUserIDFromContext(ctx)
 	if userID == "" {
-		return nil, errors.New("user not authenticated")
+		return nil, errUnauthenticated
+	}
+
+	// Validate booking times and the recurrence rule
+	window, err := schedule.ParseWindow(req.StartTime, req.EndTime)
+	if err != nil {
+		return nil, invalidArgument(err)
+	}
+
+	rule, err := schedule.ParseRule(req.Rrule)
+	if err != nil {
+		return nil, invalidArgument(err)
+	}
+
+	dates, err := rule.Dates(req.Date)
+	if err != nil {
+		return nil, invalidArgument(err)
 	}
 
-	// Check if booking exists and belongs to user
-	var bookingUserID string
-	err := s.db.QueryRow("SELECT user_id FROM bookings WHERE id = $1", req.BookingId).Scan(&bookingUserID)
+	if len(dates) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "recurrence rule has no occurrences")
+	}
 
+	// Check if court exists
+	court, err := s.checkCourt(ctx, req.CourtId)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, errors.New("booking not found")
+		return nil, err
+	}
+
+	if req.CourtUnitId != "" {
+		if err := s.checkCourtUnit(ctx, req.CourtId, req.CourtUnitId); err != nil {
+			return nil, err
 		}
+	}
+
+	// Every occurrence has the same players
+	players, err := s.newRoster(ctx, userID, req.PlayerEmails)
+	if err != nil {
+		return nil, err
+	}
+	numberOfPlayers, err := checkRoster(req.NumberOfPlayers, players, court.MaxPlayers)
+	if err != nil {
 		return nil, err
 	}
 
-	if bookingUserID != userID {
-		return nil, errors.New("not authorized to cancel this booking")
+	if err := s.store.Courts.LoadCalendar(ctx, court, dates[0], dates[len(dates)-1]); err != nil {
+		return nil, err
 	}
+	hours := courtHours(court)
 
-	// Update booking status to cancelled
+	// Load the price list; occurrences are priced individually since peak
+	// rates depend on the weekday
+	rates, member, err := s.loadPricing(ctx, req.CourtId, userID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := rates.Quote(req.Date, window, member); err != nil {
+		return nil, invalidArgument(err)
+	}
+
+	// Create the series
 	now := time.Now().Format(time.RFC3339)
 
-	_, err = s.db.Exec(`
-		UPDATE bookings
-		SET status = 'CANCELLED', updated_at = $1
-		WHERE id = $2
-	`, now, req.BookingId)
+	series := &proto.BookingSeries{
+		Id:              uuid.New().String(),
+		CourtId:         req.CourtId,
+		CourtUnitId:     req.CourtUnitId,
+		UserId:          userID,
+		Rrule:           req.Rrule,
+		StartDate:       req.Date,
+		StartTime:       req.StartTime,
+		EndTime:         req.EndTime,
+		NumberOfPlayers: numberOfPlayers,
+		PlayerEmails:    rosterEmails(players),
+		Status:          "ACTIVE",
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+
+	if err := s.store.Series.InsertSeries(ctx, series); err != nil {
+		return nil, err
+	}
+
+	// Materialize the occurrences
+	resp := &proto.CreateBookingSeriesResponse{Series: series}
+	for _, date := range dates {
+		if err := hours.Check(date, window); err != nil {
+			resp.Conflicts = append(resp.Conflicts, &proto.SeriesConflict{Date: date, Reason: err.Error()})
+			continue
+		}
+		quote, err := rates.Quote(date, window, member)
+		if err != nil {
+			resp.Conflicts = append(resp.Conflicts, &proto.SeriesConflict{Date: date, Reason: err.Error()})
+			continue
+		}
 
+		booking := &proto.Booking{
+			Id:              uuid.New().String(),
+			CourtId:         req.CourtId,
+			SeriesId:        series.Id,
+			UserId:          userID,
+			PriceCents:      quote.Total,
+			Currency:        quote.Currency,
+			Date:            date,
+			StartTime:       req.StartTime,
+			EndTime:         req.EndTime,
+			NumberOfPlayers: numberOfPlayers,
+			PlayerEmails:    rosterEmails(players),
+			Players:         players,
+			Status:          proto.BookingStatus_CONFIRMED,
+			CreatedAt:       now,
+			UpdatedAt:       now,
+		}
+
+		err = s.insertBooking(ctx, booking, req.CourtUnitId, window, hours, s.invitations(ctx, booking, booking.Players)...)
+		if errors.Is(err, errBookingConflict) {
+			resp.Conflicts = append(resp.Conflicts, &proto.SeriesConflict{Date: date, Reason: err.Error()})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		resp.Bookings = append(resp.Bookings, booking)
+	}
+
+	// A series without a single free occurrence is not kept
+	if len(resp.Bookings) == 0 {
+		if err := s.store.Series.DeleteSeries(ctx, series.Id); err != nil {
+			return nil, err
+		}
+		return nil, status.Error(codes.FailedPrecondition, "no occurrence of the series is available")
+	}
+
+	// The organizer hears about every occurrence booked at once, which is
+	// only known once they are all inserted. The series is not booked in a
+	// single transaction, so the email is queued after it.
+	if err := s.store.Outbox.Enqueue(ctx, s.emails(ctx, notifications.KindBookingConfirmed, resp.Bookings...)...); err != nil {
+		log.Printf("Failed to queue the emails of series %s: %v", series.Id, err)
+	}
+	s.notifier.Wake()
+
+	return resp, nil
+}
+
+// GetBookingSeries retrieves a booking series and its occurrences
+func (s *SchedulerServer) GetBookingSeries(ctx context.Context, req *proto.GetBookingSeriesRequest) (*proto.GetBookingSeriesResponse, error) {
+	// Get user ID from context
+	userID := getUserIDFromContext(ctx)
+	if userID == "" {
+		return nil, errUnauthenticated
+	}
+
+	series, err := s.store.Series.GetSeries(ctx, req.SeriesId)
 	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, status.Error(codes.NotFound, "booking series not found")
+		}
 		return nil, err
 	}
 
-	return &CancelBookingResponse{
-		Success: true,
-		Message: "Booking cancelled successfully",
+	if !canManageBooking(ctx, series.UserId, series.CourtId) {
+		return nil, status.Error(codes.PermissionDenied, "not authorized to view this booking series")
+	}
+
+	bookings, err := s.listBookings(ctx, &proto.GetBookingsRequest{SeriesId: series.Id}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.GetBookingSeriesResponse{
+		Series:   series,
+		Bookings: bookings.Bookings,
 	}, nil
 }
 
-// Helper function to get user ID from context
-// In a real implementation, this would retrieve the user ID from the JWT token
+// seriesOccurrence is a booking a series-wide change applies to
+type seriesOccurrence struct {
+	id          string
+	date        string
+	courtUnitID string
+	quote       pricing.Quote
+	booking     *proto.Booking // As stored before the change
+}
+
+// seriesTargets returns the bookings a change of booking with the given
+// scope applies to, ordered by date. Cancelled occurrences and no-shows are
+// skipped; a booking outside a series is always its only target.
+func (s *SchedulerServer) seriesTargets(ctx context.Context, booking *proto.Booking, scope proto.SeriesScope) ([]*seriesOccurrence, error) {
+	single := []*seriesOccurrence{{id: booking.Id, date: booking.Date, courtUnitID: booking.CourtUnitId, booking: booking}}
+	if booking.SeriesId == "" || scope == proto.SeriesScope_THIS_OCCURRENCE {
+		return single, nil
+	}
+
+	occurrences, err := s.store.Bookings.ListBookings(ctx, storage.BookingFilter{SeriesID: booking.SeriesId})
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []*seriesOccurrence
+	for _, occurrence := range occurrences {
+		if occurrence.Status == proto.BookingStatus_CANCELLED || occurrence.Status == proto.BookingStatus_NO_SHOW {
+			continue
+		}
+		if scope == proto.SeriesScope_THIS_AND_FOLLOWING && occurrence.Date < booking.Date {
+			continue
+		}
+		targets = append(targets, &seriesOccurrence{
+			id:          occurrence.Id,
+			date:        occurrence.Date,
+			courtUnitID: occurrence.CourtUnitId,
+			booking:     occurrence,
+		})
+	}
+
+	if len(targets) == 0 {
+		return single, nil
+	}
+	return targets, nil
+}
+
+// checkCourt verifies that a facility exists and is not archived, and
+// returns its details
+func (s *SchedulerServer) checkCourt(ctx context.Context, courtID string) (*proto.Court, error) {
+	court, err := s.store.Courts.GetCourt(ctx, courtID)
+	if errors.Is(err, storage.ErrNotFound) || (err == nil && court.ArchivedAt != "") {
+		return nil, status.Error(codes.NotFound, "court not found")
+	}
+	return court, err
+}
+
+// checkCourtUnit verifies that a court unit belongs to the given facility
+func (s *SchedulerServer) checkCourtUnit(ctx context.Context, courtID, unitID string) error {
+	unitIDs, err := s.loadUnitIDs(ctx, courtID)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range unitIDs {
+		if id == unitID {
+			return nil
+		}
+	}
+
+	return status.Error(codes.NotFound, "court unit not found")
+}
+
+// errUnauthenticated is returned by RPCs that need a user when there is none
+var errUnauthenticated = status.Error(codes.Unauthenticated, "user not authenticated")
+
+// errBookingConflict is returned when no unit is free for the requested time
+var errBookingConflict = status.Error(codes.AlreadyExists, "booking time conflicts with existing booking")
+
+// invalidArgument reports a malformed request, such as an unparsable date or
+// time, as an InvalidArgument status
+func invalidArgument(err error) error {
+	return status.Error(codes.InvalidArgument, err.Error())
+}
+
+// hoursError reports a booking outside the opening hours of a facility, or
+// during a blackout, as a status error
+func hoursError(err error) error {
+	if errors.Is(err, schedule.ErrBlackout) {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Error(codes.InvalidArgument, err.Error())
+}
+
+// maxBookingAttempts bounds how often a booking is moved to another unit
+// after losing a race for the one it was assigned
+const maxBookingAttempts = 3
+
+// insertBooking assigns a free unit to the booking and inserts it, queuing
+// the messages with it. The store
+// rejects the insert with storage.ErrOverlap if a concurrent request took the
+// same unit first; the booking is then moved to another free unit, unless the
+// caller asked for a specific one.
+func (s *SchedulerServer) insertBooking(ctx context.Context, booking *proto.Booking, requestedUnitID string, window schedule.Window, hours schedule.Hours, messages ...*notifications.Message) error {
+	for attempt := 1; ; attempt++ {
+		unitID, err := s.findFreeUnit(ctx, booking.CourtId, requestedUnitID, "", "", booking.Date, window, hours)
+		if err != nil {
+			return err
+		}
+		if unitID == "" {
+			return errBookingConflict
+		}
+
+		booking.CourtUnitId = unitID
+		err = s.store.Bookings.InsertBooking(ctx, booking, messages...)
+		if errors.Is(err, storage.ErrOverlap) {
+			if requestedUnitID != "" || attempt == maxBookingAttempts {
+				return errBookingConflict
+			}
+			continue
+		}
+		return err
+	}
+}
+
+// findFreeUnit returns the unit of a facility a booking for the given window
+// should be placed on, or "" if every candidate is taken. unitID restricts
+// the search to a single unit, preferredUnitID is tried before the others
+// and excludeBookingID is ignored when checking conflicts. Units blacked out
+// in hours count as booked.
+func (s *SchedulerServer) findFreeUnit(ctx context.Context, courtID, unitID, preferredUnitID, excludeBookingID, date string, window schedule.Window, hours schedule.Hours) (string, error) {
+	unitIDs, err := s.loadUnitIDs(ctx, courtID)
+	if err != nil {
+		return "", err
+	}
+
+	bookedByDate, err := s.store.Bookings.Booked(ctx, courtID, date, date, excludeBookingID)
+	if err != nil {
+		return "", err
+	}
+
+	booked := hours.Blocked(date, unitIDs)
+	for _, b := range bookedByDate {
+		booked = append(booked, b...)
+	}
+
+	return schedule.PickUnit(unitIDs, booked, window, unitID, preferredUnitID), nil
+}
+
+// timestampLayout is the format of blackout start and end times (facility local time)
+const timestampLayout = "2006-01-02T15:04:05"
+
+// courtHours converts the calendar loaded by LoadCalendar for the conflict check
+func courtHours(court *proto.Court) schedule.Hours {
+	hours := schedule.Hours{
+		Weekly:     make(map[time.Weekday]schedule.Window),
+		Exceptions: make(map[string]schedule.Exception),
+	}
+
+	for _, oh := range court.OpeningHours {
+		if window, err := schedule.ParseWindow(oh.OpenTime, oh.CloseTime); err == nil {
+			hours.Weekly[time.Weekday(oh.Weekday)] = window
+		}
+	}
+
+	for _, ex := range court.HourExceptions {
+		exception := schedule.Exception{Closed: ex.Closed, Reason: ex.Reason}
+		if !ex.Closed {
+			window, err := schedule.ParseWindow(ex.OpenTime, ex.CloseTime)
+			if err != nil {
+				exception.Closed = true
+			}
+			exception.Window = window
+		}
+		hours.Exceptions[ex.Date] = exception
+	}
+
+	for _, b := range court.Blackouts {
+		startsAt, err := time.Parse(timestampLayout, b.StartsAt)
+		if err != nil {
+			continue
+		}
+		endsAt, err := time.Parse(timestampLayout, b.EndsAt)
+		if err != nil {
+			continue
+		}
+		hours.Blackouts = append(hours.Blackouts, schedule.Blackout{
+			UnitID: b.CourtUnitId,
+			Start:  startsAt,
+			End:    endsAt,
+			Reason: b.Reason,
+		})
+	}
+
+	return hours
+}
+
+// loadUnitIDs returns the unit IDs of a facility in display order
+func (s *SchedulerServer) loadUnitIDs(ctx context.Context, courtID string) ([]string, error) {
+	units, err := s.store.Courts.ListUnits(ctx, courtID)
+	if err != nil {
+		return nil, err
+	}
+
+	var unitIDs []string
+	for _, unit := range units {
+		unitIDs = append(unitIDs, unit.Id)
+	}
+
+	return unitIDs, nil
+}
+
+// getUserIDFromContext returns the ID of the user placed in the context by
+// auth.AuthInterceptor, or "" for anonymous calls
 func getUserIDFromContext(ctx context.Context) string {
-	// This is a placeholder
-	// In a real implementation, you'd extract the user ID from the context
-	// which would be set by the auth middleware
-	return "sample-user-id"
+	return auth.GetUserID(ctx)
+}
+
+// canManageBooking reports whether the user in ctx may manage a booking of
+// ownerID at a facility: its owner, staff of the facility and platform admins
+func canManageBooking(ctx context.Context, ownerID, courtID string) bool {
+	p, ok := auth.PrincipalFromContext(ctx)
+	return ok && (p.UserID == ownerID || p.HasRole(auth.RoleStaff, courtID))
 }
@@ -0,0 +1,332 @@
+// pickle/backend/services/scheduler_test.go
+package services
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/carlostbanks/pickle/auth"
+	"github.com/carlostbanks/pickle/notifications"
+	"github.com/carlostbanks/pickle/payments"
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/schedule"
+	"github.com/carlostbanks/pickle/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fixture is a scheduler on an in-memory store with a facility of two courts,
+// open every day from 06:00 to 22:00, and the people using it
+type fixture struct {
+	server   *SchedulerServer
+	store    *storage.Store
+	provider *payments.Fake
+	outbox   *notifications.Outbox
+	mail     *recordingSender
+	court    *proto.Court
+
+	player, other, staff, admin *auth.Principal
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	ctx := context.Background()
+
+	f := &fixture{
+		store:    storage.NewMemory(),
+		provider: payments.NewFake("webhook-secret"),
+		mail:     &recordingSender{},
+		court: &proto.Court{
+			Id:             "court-1",
+			Name:           "Riverside",
+			Address:        "1 River Rd, Springfield",
+			Latitude:       40.0,
+			Longitude:      -75.0,
+			NumberOfCourts: 2,
+			MaxPlayers:     4,
+		},
+		player: &auth.Principal{UserID: "player", Email: "player@example.com"},
+		other:  &auth.Principal{UserID: "other", Email: "other@example.com"},
+		staff: &auth.Principal{UserID: "staff", Email: "staff@example.com",
+			Roles: []auth.Grant{{Role: auth.RoleStaff, CourtID: "court-1"}}},
+		admin: &auth.Principal{UserID: "admin", Email: "admin@example.com",
+			Roles: []auth.Grant{{Role: auth.RoleFacilityAdmin, CourtID: "court-1"}}},
+	}
+	f.outbox = notifications.NewOutbox(f.store.Outbox, f.mail)
+	f.server = NewSchedulerServer(f.store, f.provider, f.outbox, "https://pickle.example.com")
+
+	for _, p := range []*auth.Principal{f.player, f.other, f.staff, f.admin} {
+		user := &storage.User{ID: p.UserID, Email: p.Email, Name: p.UserID, CreatedAt: time.Now()}
+		if err := f.store.Users.CreateUser(ctx, user); err != nil {
+			t.Fatalf("creating user %s: %v", p.UserID, err)
+		}
+	}
+
+	f.court.Units = courtUnits(f.court)
+	for weekday := int32(0); weekday < 7; weekday++ {
+		f.court.OpeningHours = append(f.court.OpeningHours,
+			&proto.OpeningHours{Weekday: weekday, OpenTime: "06:00", CloseTime: "22:00"})
+	}
+	if err := f.store.Courts.CreateCourt(ctx, f.court); err != nil {
+		t.Fatalf("creating court: %v", err)
+	}
+
+	return f
+}
+
+// as returns a context authenticated as p
+func (f *fixture) as(p *auth.Principal) context.Context {
+	return auth.WithPrincipal(context.Background(), p)
+}
+
+// book books a slot next week on the first court for p
+func (f *fixture) book(t *testing.T, p *auth.Principal, start, end string) *proto.Booking {
+	t.Helper()
+	booking, err := f.server.CreateBooking(f.as(p), f.bookingRequest(start, end))
+	if err != nil {
+		t.Fatalf("booking %s-%s: %v", start, end, err)
+	}
+	return booking
+}
+
+// bookingRequest asks for a slot next week on the first court
+func (f *fixture) bookingRequest(start, end string) *proto.CreateBookingRequest {
+	return &proto.CreateBookingRequest{
+		CourtId:     f.court.Id,
+		CourtUnitId: f.court.Units[0].Id,
+		Date:        nextWeek(),
+		StartTime:   start,
+		EndTime:     end,
+	}
+}
+
+// nextWeek is the date a week from today
+func nextWeek() string {
+	return time.Now().AddDate(0, 0, 7).Format(schedule.DateLayout)
+}
+
+// recordingSender keeps the messages sent through it
+type recordingSender struct {
+	mu       sync.Mutex
+	messages []*notifications.Message
+}
+
+func (s *recordingSender) Send(ctx context.Context, msg *notifications.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, msg)
+	return nil
+}
+
+// sent delivers the emails queued and returns every email sent so far
+func (f *fixture) sent(t *testing.T) []*notifications.Message {
+	t.Helper()
+	if _, err := f.outbox.Deliver(context.Background()); err != nil {
+		t.Fatalf("delivering emails: %v", err)
+	}
+	f.mail.mu.Lock()
+	defer f.mail.mu.Unlock()
+	return append([]*notifications.Message(nil), f.mail.messages...)
+}
+
+// expectCode fails the test unless err carries the gRPC code
+func expectCode(t *testing.T, err error, code codes.Code) {
+	t.Helper()
+	if got := status.Code(err); got != code {
+		t.Fatalf("got %v (%v), expected %v", got, err, code)
+	}
+}
+
+func TestConcurrentBookings(t *testing.T) {
+	f := newFixture(t)
+	const parallel = 20
+
+	// Release all requests at the same time
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make(chan error, parallel)
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := f.server.CreateBooking(f.as(f.player), f.bookingRequest("10:00", "11:00"))
+			errs <- err
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	booked := 0
+	for err := range errs {
+		switch status.Code(err) {
+		case codes.OK:
+			booked++
+		case codes.AlreadyExists:
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if booked != 1 {
+		t.Errorf("%d of %d parallel bookings succeeded, expected exactly one", booked, parallel)
+	}
+
+	bookings, err := f.store.Bookings.ListBookings(context.Background(), storage.BookingFilter{CourtID: f.court.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bookings) != 1 {
+		t.Errorf("store has %d bookings, expected 1", len(bookings))
+	}
+
+	// Emails are queued with the bookings made only
+	if sent := f.sent(t); len(sent) != 1 || sent[0].Kind != notifications.KindBookingConfirmed {
+		t.Errorf("sent %v, expected the confirmation of the booking made", sent)
+	}
+}
+
+func TestBookingEmails(t *testing.T) {
+	f := newFixture(t)
+	guest := "guest@example.com"
+
+	// kinds returns the kinds of the emails sent since the last call, by
+	// recipient
+	seen := 0
+	kinds := func() map[string][]string {
+		t.Helper()
+		sent := f.sent(t)
+		got := make(map[string][]string)
+		for _, msg := range sent[seen:] {
+			got[msg.To] = append(got[msg.To], msg.Kind)
+		}
+		seen = len(sent)
+		return got
+	}
+	expectKinds := func(step string, want map[string][]string) {
+		t.Helper()
+		if got := kinds(); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s sent %v, expected %v", step, got, want)
+		}
+	}
+
+	req := f.bookingRequest("10:00", "11:00")
+	req.PlayerEmails = []string{guest}
+	booking, err := f.server.CreateBooking(f.as(f.player), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKinds("booking", map[string][]string{
+		f.player.Email: {notifications.KindBookingConfirmed},
+		guest:          {notifications.KindInvitation},
+	})
+
+	// A conflicting booking is not announced
+	_, err = f.server.CreateBooking(f.as(f.other), f.bookingRequest("10:30", "11:30"))
+	expectCode(t, err, codes.AlreadyExists)
+	expectKinds("a conflicting booking", map[string][]string{})
+
+	// New players are invited, everyone is told about the change
+	_, err = f.server.UpdateBooking(f.as(f.player), &proto.UpdateBookingRequest{BookingId: booking.Id,
+		StartTime: "12:00", EndTime: "13:00", PlayerEmails: []string{guest, f.other.Email}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKinds("updating", map[string][]string{
+		f.player.Email: {notifications.KindBookingChanged},
+		guest:          {notifications.KindBookingChanged},
+		f.other.Email:  {notifications.KindBookingChanged, notifications.KindInvitation},
+	})
+
+	if _, err := f.server.CancelBooking(f.as(f.player), &proto.CancelBookingRequest{BookingId: booking.Id}); err != nil {
+		t.Fatal(err)
+	}
+	expectKinds("cancelling", map[string][]string{
+		f.player.Email: {notifications.KindBookingCancelled},
+		guest:          {notifications.KindBookingCancelled},
+		f.other.Email:  {notifications.KindBookingCancelled},
+	})
+}
+
+func TestBookingAccess(t *testing.T) {
+	f := newFixture(t)
+	anonymous := context.Background()
+	date := nextWeek()
+
+	_, err := f.server.CreateBooking(anonymous, f.bookingRequest("17:00", "18:00"))
+	expectCode(t, err, codes.Unauthenticated)
+	_, err = f.server.GetBookings(anonymous, &proto.GetBookingsRequest{})
+	expectCode(t, err, codes.Unauthenticated)
+
+	// Bookings belong to the user making them
+	booking := f.book(t, f.player, "17:00", "18:00")
+	if booking.UserId != f.player.UserID {
+		t.Fatalf("booking belongs to %q, expected %q", booking.UserId, f.player.UserID)
+	}
+
+	// Other players may not touch it
+	_, err = f.server.UpdateBooking(f.as(f.other), &proto.UpdateBookingRequest{
+		BookingId: booking.Id, StartTime: "17:00", EndTime: "18:00", NumberOfPlayers: 4})
+	expectCode(t, err, codes.PermissionDenied)
+	_, err = f.server.CancelBooking(f.as(f.other), &proto.CancelBookingRequest{BookingId: booking.Id})
+	expectCode(t, err, codes.PermissionDenied)
+	_, err = f.server.CancelBooking(anonymous, &proto.CancelBookingRequest{BookingId: booking.Id})
+	expectCode(t, err, codes.Unauthenticated)
+	_, err = f.server.MarkNoShow(f.as(f.other), &proto.MarkNoShowRequest{BookingId: booking.Id})
+	expectCode(t, err, codes.PermissionDenied)
+
+	// Players only see their own bookings
+	_, err = f.server.GetBookings(f.as(f.other), &proto.GetBookingsRequest{UserId: f.player.UserID})
+	expectCode(t, err, codes.PermissionDenied)
+	listed, err := f.server.GetBookings(f.as(f.other), &proto.GetBookingsRequest{CourtId: f.court.Id, Date: date})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Bookings) != 0 {
+		t.Errorf("a player saw %d bookings of another user", len(listed.Bookings))
+	}
+	_, err = f.server.GetBooking(f.as(f.other), &proto.GetBookingRequest{BookingId: booking.Id})
+	expectCode(t, err, codes.PermissionDenied)
+
+	// Staff see and manage every booking at their facility
+	listed, err = f.server.GetBookings(f.as(f.staff), &proto.GetBookingsRequest{CourtId: f.court.Id, Date: date})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Bookings) != 1 || listed.Bookings[0].Id != booking.Id {
+		t.Errorf("staff saw %v, expected the booking at their facility", listed.Bookings)
+	}
+	if _, err := f.server.CancelBooking(f.as(f.staff), &proto.CancelBookingRequest{BookingId: booking.Id}); err != nil {
+		t.Errorf("cancelling as staff: %v", err)
+	}
+}
+
+func TestBookingSeries(t *testing.T) {
+	f := newFixture(t)
+	taken := f.book(t, f.other, "10:00", "11:00")
+
+	req := &proto.CreateBookingSeriesRequest{
+		CourtId:     f.court.Id,
+		CourtUnitId: taken.CourtUnitId,
+		Date:        time.Now().Format(schedule.DateLayout),
+		StartTime:   "10:00",
+		EndTime:     "11:00",
+		Rrule:       "FREQ=WEEKLY;COUNT=3",
+	}
+	_, err := f.server.CreateBookingSeries(f.as(f.player), &proto.CreateBookingSeriesRequest{
+		CourtId: req.CourtId, Date: "next monday", StartTime: req.StartTime, EndTime: req.EndTime, Rrule: req.Rrule})
+	expectCode(t, err, codes.InvalidArgument)
+
+	// The occurrence on the taken court is reported, the others are booked
+	resp, err := f.server.CreateBookingSeries(f.as(f.player), req)
+	if err != nil {
+		t.Fatalf("creating the series: %v", err)
+	}
+	if len(resp.Bookings) != 2 || len(resp.Conflicts) != 1 || resp.Conflicts[0].Date != taken.Date {
+		t.Fatalf("series booked %d occurrences with conflicts %v, expected 2 and one on %s",
+			len(resp.Bookings), resp.Conflicts, taken.Date)
+	}
+}
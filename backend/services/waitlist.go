@@ -0,0 +1,406 @@
+// pickle/backend/services/waitlist.go
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/carlostbanks/pickle/notifications"
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/schedule"
+	"github.com/carlostbanks/pickle/storage"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// waitlistClaimWindow is how long a waitlisted user has to claim an offered slot
+const waitlistClaimWindow = 15 * time.Minute
+
+// waitlistStatusValues maps the database representation of waitlist statuses
+var waitlistStatusValues = map[string]proto.WaitlistStatus{
+	"WAITING": proto.WaitlistStatus_WAITING,
+	"OFFERED": proto.WaitlistStatus_OFFERED,
+	"CLAIMED": proto.WaitlistStatus_CLAIMED,
+	"EXPIRED": proto.WaitlistStatus_EXPIRED,
+	"LEFT":    proto.WaitlistStatus_LEFT,
+}
+
+// errOfferLapsed is returned when a waitlist offer expired before it was claimed
+var errOfferLapsed = status.Error(codes.FailedPrecondition, "offer has expired")
+
+// JoinWaitlist puts the user in line for a fully booked time slot
+func (s *SchedulerServer) JoinWaitlist(ctx context.Context, req *proto.JoinWaitlistRequest) (*proto.WaitlistEntry, error) {
+	// Get user ID from context
+	userID := getUserIDFromContext(ctx)
+	if userID == "" {
+		return nil, errUnauthenticated
+	}
+
+	window, err := schedule.ParseWindow(req.StartTime, req.EndTime)
+	if err != nil {
+		return nil, invalidArgument(err)
+	}
+
+	// Check if court exists
+	court, err := s.checkCourt(ctx, req.CourtId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the players now rather than when the slot is offered
+	players, err := s.newRoster(ctx, userID, req.PlayerEmails)
+	if err != nil {
+		return nil, err
+	}
+	numberOfPlayers, err := checkRoster(req.NumberOfPlayers, players, court.MaxPlayers)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check opening hours, closures and blackouts
+	if err := s.store.Courts.LoadCalendar(ctx, court, req.Date, req.Date); err != nil {
+		return nil, err
+	}
+	hours := courtHours(court)
+	if err := hours.Check(req.Date, window); err != nil {
+		return nil, hoursError(err)
+	}
+
+	if req.CourtUnitId != "" {
+		if err := s.checkCourtUnit(ctx, req.CourtId, req.CourtUnitId); err != nil {
+			return nil, err
+		}
+	}
+
+	// Check the minimum duration now rather than when the slot is offered
+	rates, member, err := s.loadPricing(ctx, req.CourtId, userID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := rates.Quote(req.Date, window, member); err != nil {
+		return nil, invalidArgument(err)
+	}
+
+	// Only fully booked slots can be waited for
+	unitID, err := s.findFreeUnit(ctx, req.CourtId, req.CourtUnitId, "", "", req.Date, window, hours)
+	if err != nil {
+		return nil, err
+	}
+
+	if unitID != "" {
+		return nil, status.Error(codes.FailedPrecondition, "time slot is available, book it directly")
+	}
+
+	now := time.Now().Format(time.RFC3339)
+
+	entry := &proto.WaitlistEntry{
+		Id:              uuid.New().String(),
+		CourtId:         req.CourtId,
+		CourtUnitId:     req.CourtUnitId,
+		UserId:          userID,
+		Date:            req.Date,
+		StartTime:       req.StartTime,
+		EndTime:         req.EndTime,
+		NumberOfPlayers: numberOfPlayers,
+		PlayerEmails:    rosterEmails(players),
+		Status:          proto.WaitlistStatus_WAITING,
+		CreatedAt:       now,
+	}
+
+	// The user may wait for the same slot only once
+	err = s.store.Waitlist.InsertEntry(ctx, entry)
+	if errors.Is(err, storage.ErrConflict) {
+		return nil, status.Error(codes.AlreadyExists, "already on the waitlist for this time slot")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// GetWaitlist returns the waitlist entries of the user
+func (s *SchedulerServer) GetWaitlist(ctx context.Context, req *proto.GetWaitlistRequest) (*proto.GetWaitlistResponse, error) {
+	// Get user ID from context
+	userID := getUserIDFromContext(ctx)
+	if userID == "" {
+		return nil, errUnauthenticated
+	}
+
+	filter := storage.WaitlistFilter{UserID: userID}
+	if req.Status != "" {
+		entryStatus, ok := waitlistStatusValues[req.Status]
+		if !ok {
+			return &proto.GetWaitlistResponse{}, nil
+		}
+		filter.Statuses = []proto.WaitlistStatus{entryStatus}
+	}
+
+	entries, err := s.store.Waitlist.ListEntries(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Date != entries[j].Date {
+			return entries[i].Date < entries[j].Date
+		}
+		return entries[i].StartTime < entries[j].StartTime
+	})
+
+	return &proto.GetWaitlistResponse{Entries: entries}, nil
+}
+
+// LeaveWaitlist removes the user from the waitlist. Leaving with an open
+// offer declines it, passing the slot on to the next user.
+func (s *SchedulerServer) LeaveWaitlist(ctx context.Context, req *proto.LeaveWaitlistRequest) (*proto.LeaveWaitlistResponse, error) {
+	// Get user ID from context
+	userID := getUserIDFromContext(ctx)
+	if userID == "" {
+		return nil, errUnauthenticated
+	}
+
+	entry, err := s.fetchWaitlistEntry(ctx, req.EntryId, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.Status != proto.WaitlistStatus_WAITING && entry.Status != proto.WaitlistStatus_OFFERED {
+		return nil, status.Error(codes.FailedPrecondition, "waitlist entry is no longer active")
+	}
+
+	err = s.store.Waitlist.LeaveEntry(ctx, entry.Id, entry.Status, time.Now())
+	if err != nil && !errors.Is(err, storage.ErrStale) {
+		return nil, err
+	}
+
+	if err == nil && entry.Status == proto.WaitlistStatus_OFFERED {
+		if err := s.promoteWaitlist(ctx, entry.CourtId, entry.Date); err != nil {
+			log.Printf("Error promoting waitlist: %v", err)
+		}
+	}
+
+	return &proto.LeaveWaitlistResponse{
+		Success: true,
+		Message: "Left the waitlist successfully",
+	}, nil
+}
+
+// ClaimWaitlistOffer confirms the PENDING booking of an offered slot. Priced
+// slots must be paid first, like holds taken at checkout.
+func (s *SchedulerServer) ClaimWaitlistOffer(ctx context.Context, req *proto.ClaimWaitlistOfferRequest) (*proto.Booking, error) {
+	// Get user ID from context
+	userID := getUserIDFromContext(ctx)
+	if userID == "" {
+		return nil, errUnauthenticated
+	}
+
+	entry, err := s.fetchWaitlistEntry(ctx, req.EntryId, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.Status != proto.WaitlistStatus_OFFERED || entry.BookingId == "" {
+		return nil, status.Error(codes.FailedPrecondition, "no open offer for this waitlist entry")
+	}
+
+	booking, err := s.getBooking(ctx, entry.BookingId)
+	if err != nil {
+		return nil, err
+	}
+	if booking.Status != proto.BookingStatus_PENDING {
+		return nil, errOfferLapsed
+	}
+
+	// Claiming confirms the held booking, paying for it like any other;
+	// the hold of the booking ends with the offer
+	return s.confirmHold(ctx, booking, errOfferLapsed)
+}
+
+// fetchWaitlistEntry loads a waitlist entry and verifies it belongs to the user
+func (s *SchedulerServer) fetchWaitlistEntry(ctx context.Context, entryID, userID string) (*proto.WaitlistEntry, error) {
+	entry, err := s.store.Waitlist.GetEntry(ctx, entryID)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, status.Error(codes.NotFound, "waitlist entry not found")
+		}
+		return nil, err
+	}
+
+	if entry.UserId != userID {
+		return nil, status.Error(codes.PermissionDenied, "not authorized to access this waitlist entry")
+	}
+
+	return entry, nil
+}
+
+// promoteWaitlist offers the free time slots of a facility on a date to the
+// waitlisted users, first come first served
+func (s *SchedulerServer) promoteWaitlist(ctx context.Context, courtID, date string) error {
+	// Dates read back from the database carry a time component
+	day, err := schedule.ParseDate(date)
+	if err != nil {
+		return err
+	}
+	date = day.Format(schedule.DateLayout)
+
+	entries, err := s.store.Waitlist.ListEntries(ctx, storage.WaitlistFilter{
+		CourtID:  courtID,
+		Date:     date,
+		Statuses: []proto.WaitlistStatus{proto.WaitlistStatus_WAITING},
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	court := &proto.Court{Id: courtID}
+	if err := s.store.Courts.LoadCalendar(ctx, court, date, date); err != nil {
+		return err
+	}
+	hours := courtHours(court)
+
+	for _, entry := range entries {
+		window, err := schedule.ParseWindow(entry.StartTime, entry.EndTime)
+		if err != nil || hours.Check(date, window) != nil {
+			continue
+		}
+		err = s.offerSlot(ctx, entry, window, hours)
+		switch {
+		case errors.Is(err, errBookingConflict):
+			// Still booked; the entry keeps its place in line
+		case err != nil:
+			// One entry failing, e.g. to be priced, must not strand the
+			// entries behind it
+			log.Printf("Error offering waitlist entry %s: %v", entry.Id, err)
+		}
+	}
+
+	return nil
+}
+
+// offerSlot holds the slot of a waitlist entry as a PENDING booking, marks
+// the entry OFFERED until the claim deadline and emails the offer to the
+// user. It returns errBookingConflict if the slot is still booked.
+func (s *SchedulerServer) offerSlot(ctx context.Context, entry *proto.WaitlistEntry, window schedule.Window, hours schedule.Hours) error {
+	// Price the booking at the current rates
+	rates, member, err := s.loadPricing(ctx, entry.CourtId, entry.UserId)
+	if err != nil {
+		return err
+	}
+	quote, err := rates.Quote(entry.Date, window, member)
+	if err != nil {
+		return err
+	}
+
+	// Invite the players the user listed when joining, which were checked
+	// against the capacity of a court then
+	players, err := s.newRoster(ctx, entry.UserId, entry.PlayerEmails)
+	if err != nil {
+		return err
+	}
+
+	// Take the entry first, so concurrent promotions cannot offer it twice
+	expiresAt := time.Now().Add(waitlistClaimWindow)
+	err = s.store.Waitlist.OfferEntry(ctx, entry.Id, expiresAt, time.Now())
+	if errors.Is(err, storage.ErrStale) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Format(time.RFC3339)
+
+	booking := &proto.Booking{
+		Id:              uuid.New().String(),
+		CourtId:         entry.CourtId,
+		UserId:          entry.UserId,
+		PriceCents:      quote.Total,
+		Currency:        quote.Currency,
+		Date:            entry.Date,
+		StartTime:       entry.StartTime,
+		EndTime:         entry.EndTime,
+		NumberOfPlayers: entry.NumberOfPlayers,
+		PlayerEmails:    rosterEmails(players),
+		Players:         players,
+		Status:          proto.BookingStatus_PENDING,
+		HoldExpiresAt:   expiresAt.Format(timestampLayout),
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+
+	// The offer is emailed with the booking holding the slot
+	var messages []*notifications.Message
+	if msg, err := s.offerMessage(ctx, booking, expiresAt); err != nil {
+		log.Printf("Failed to render the waitlist offer email for booking %s: %v", booking.Id, err)
+	} else {
+		messages = append(messages, msg)
+	}
+
+	if err := s.insertBooking(ctx, booking, entry.CourtUnitId, window, hours, messages...); err != nil {
+		// Put the entry back in line
+		if revertErr := s.store.Waitlist.ReturnEntry(ctx, entry.Id); revertErr != nil {
+			log.Printf("Error reverting waitlist entry: %v", revertErr)
+		}
+		return err
+	}
+
+	s.notifier.Wake()
+
+	return s.store.Waitlist.AttachBooking(ctx, entry.Id, booking.Id)
+}
+
+// offerMessage renders the email offering a waitlisted user the slot held
+// for them by a PENDING booking until expiresAt
+func (s *SchedulerServer) offerMessage(ctx context.Context, booking *proto.Booking, expiresAt time.Time) (*notifications.Message, error) {
+	data, user, err := s.notificationData(ctx, booking)
+	if err != nil {
+		return nil, err
+	}
+	data.ExpiresAt = expiresAt.Format("2006-01-02 15:04")
+	return notifications.Render(notifications.KindWaitlistOffer, user.Email, data)
+}
+
+// ExpireWaitlistOffers releases the PENDING bookings of offers that were not
+// claimed in time and passes their slots on to the next users in line
+func (s *SchedulerServer) ExpireWaitlistOffers(ctx context.Context) error {
+	offered, err := s.store.Waitlist.ListEntries(ctx, storage.WaitlistFilter{
+		Statuses: []proto.WaitlistStatus{proto.WaitlistStatus_OFFERED},
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, entry := range offered {
+		// Offers expire in facility local time
+		expiresAt, err := time.ParseInLocation(timestampLayout, entry.OfferExpiresAt, time.Local)
+		if err != nil || expiresAt.After(now) {
+			continue
+		}
+
+		// The offer may have been claimed in the meantime
+		err = s.store.Waitlist.ExpireOffer(ctx, entry.Id, now)
+		if errors.Is(err, storage.ErrStale) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if entry.BookingId != "" {
+			s.settlePayments(ctx, map[string]int64{entry.BookingId: 0})
+		}
+		if err := s.promoteWaitlist(ctx, entry.CourtId, entry.Date); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
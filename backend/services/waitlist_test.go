@@ -0,0 +1,88 @@
+// pickle/backend/services/waitlist_test.go
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/carlostbanks/pickle/notifications"
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/storage"
+)
+
+func TestWaitlistPromotion(t *testing.T) {
+	f := newFixture(t)
+	ctx := context.Background()
+	booked := f.book(t, f.other, "10:00", "11:00")
+	second := f.bookingRequest("10:00", "11:00")
+	second.CourtUnitId = f.court.Units[1].Id
+	if _, err := f.server.CreateBooking(f.as(f.other), second); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first entry in line cannot be offered its slot: its player email
+	// only fails when the booking is made
+	for i, entry := range []*proto.WaitlistEntry{
+		{Id: "broken", UserId: f.player.UserID, PlayerEmails: []string{"not an email"}},
+		{Id: "waiting", UserId: f.staff.UserID},
+	} {
+		entry.CourtId = f.court.Id
+		entry.Date = booked.Date
+		entry.StartTime = "10:00"
+		entry.EndTime = "11:00"
+		entry.NumberOfPlayers = 2
+		entry.Status = proto.WaitlistStatus_WAITING
+		entry.CreatedAt = time.Now().Add(time.Duration(i-2) * time.Minute).Format(time.RFC3339)
+		if err := f.store.Waitlist.InsertEntry(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := f.server.CancelBooking(f.as(f.other), &proto.CancelBookingRequest{BookingId: booked.Id}); err != nil {
+		t.Fatalf("cancelling: %v", err)
+	}
+
+	// The failing entry is skipped and stays in line
+	broken, err := f.store.Waitlist.GetEntry(ctx, "broken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if broken.Status != proto.WaitlistStatus_WAITING {
+		t.Errorf("failing entry is %v, expected it to keep waiting", broken.Status)
+	}
+
+	// The next one is offered the slot and told about it
+	offered, err := f.store.Waitlist.GetEntry(ctx, "waiting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offered.Status != proto.WaitlistStatus_OFFERED || offered.BookingId == "" {
+		t.Fatalf("next entry is %v with booking %q, expected an offer", offered.Status, offered.BookingId)
+	}
+	hold, err := f.store.Bookings.GetBooking(ctx, offered.BookingId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hold.Status != proto.BookingStatus_PENDING || hold.UserId != f.staff.UserID {
+		t.Errorf("offer holds a %v booking of %s, expected a pending one of %s", hold.Status, hold.UserId, f.staff.UserID)
+	}
+
+	var offers []*notifications.Message
+	for _, msg := range f.sent(t) {
+		if msg.Kind == notifications.KindWaitlistOffer {
+			offers = append(offers, msg)
+		}
+	}
+	if len(offers) != 1 || offers[0].To != f.staff.Email {
+		t.Errorf("queued offers %v, expected one to %s", offers, f.staff.Email)
+	}
+
+	listed, err := f.store.Waitlist.ListEntries(ctx, storage.WaitlistFilter{CourtID: f.court.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 {
+		t.Errorf("waitlist has %d entries, expected 2", len(listed))
+	}
+}
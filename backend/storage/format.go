@@ -0,0 +1,140 @@
+// pickle/backend/storage/format.go
+package storage
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/schedule"
+)
+
+// calendarLayout is the format of blackout start and end times (facility
+// local time)
+const calendarLayout = "2006-01-02T15:04:05"
+
+// earthRadius is the radius of the earth in meters used by the earthdistance
+// extension, so radius searches match those of Postgres
+const earthRadius = 6378168
+
+// normalizeCalendar checks the opening hours, hours exceptions and blackouts
+// of a court, and rewrites their dates and times in the formats repositories
+// return, for stores that keep them as text
+func normalizeCalendar(court *proto.Court) error {
+	for _, oh := range court.OpeningHours {
+		if oh.Weekday < 0 || oh.Weekday > 6 {
+			return fmt.Errorf("invalid weekday %d", oh.Weekday)
+		}
+		window, err := schedule.ParseWindow(oh.OpenTime, oh.CloseTime)
+		if err != nil {
+			return err
+		}
+		oh.OpenTime, oh.CloseTime = window.StartTime(), window.EndTime()
+	}
+
+	for _, ex := range court.HourExceptions {
+		date, err := schedule.ParseDate(ex.Date)
+		if err != nil {
+			return err
+		}
+		ex.Date = date.Format(schedule.DateLayout)
+		if ex.OpenTime != "" || ex.CloseTime != "" {
+			window, err := schedule.ParseWindow(ex.OpenTime, ex.CloseTime)
+			if err != nil {
+				return err
+			}
+			ex.OpenTime, ex.CloseTime = window.StartTime(), window.EndTime()
+		} else if !ex.Closed {
+			return fmt.Errorf("hours exception on %s needs opening hours unless closed", ex.Date)
+		}
+	}
+
+	for _, b := range court.Blackouts {
+		startsAt, err := time.Parse(calendarLayout, b.StartsAt)
+		if err != nil {
+			return err
+		}
+		endsAt, err := time.Parse(calendarLayout, b.EndsAt)
+		if err != nil {
+			return err
+		}
+		if !endsAt.After(startsAt) {
+			return fmt.Errorf("blackout %s ends before it starts", b.Id)
+		}
+		b.StartsAt, b.EndsAt = startsAt.Format(calendarLayout), endsAt.Format(calendarLayout)
+	}
+
+	return nil
+}
+
+// normalizeRates checks the peak windows of a price list, and rewrites their
+// times in the format repositories return
+func normalizeRates(rates *proto.CourtRates) error {
+	for _, peak := range rates.PeakRates {
+		if peak.Weekday < 0 || peak.Weekday > 6 {
+			return fmt.Errorf("invalid weekday %d", peak.Weekday)
+		}
+		window, err := schedule.ParseWindow(peak.StartTime, peak.EndTime)
+		if err != nil {
+			return err
+		}
+		peak.StartTime, peak.EndTime = window.StartTime(), window.EndTime()
+	}
+	return nil
+}
+
+// normalizeSlot checks the date and times of a series or waitlist entry,
+// and rewrites them in the formats repositories return
+func normalizeSlot(date, startTime, endTime *string) error {
+	day, err := schedule.ParseDate(*date)
+	if err != nil {
+		return err
+	}
+	window, err := schedule.ParseWindow(*startTime, *endTime)
+	if err != nil {
+		return err
+	}
+
+	*date = day.Format(schedule.DateLayout)
+	*startTime, *endTime = window.StartTime(), window.EndTime()
+	return nil
+}
+
+// normalizeBooking checks the date and times of a booking, and rewrites them
+// in the formats repositories return
+func normalizeBooking(booking *proto.Booking) error {
+	date, err := schedule.ParseDate(booking.Date)
+	if err != nil {
+		return err
+	}
+	window, err := schedule.ParseWindow(booking.StartTime, booking.EndTime)
+	if err != nil {
+		return err
+	}
+
+	booking.Date = date.Format(schedule.DateLayout)
+	booking.StartTime, booking.EndTime = window.StartTime(), window.EndTime()
+	booking.PlayerEmails = playerEmails(booking.Players)
+	return nil
+}
+
+// playerEmails lists the emails of players, which Booking.PlayerEmails
+// mirrors
+func playerEmails(players []*proto.BookingPlayer) []string {
+	var emails []string
+	for _, player := range players {
+		emails = append(emails, player.Email)
+	}
+	return emails
+}
+
+// distance returns the great-circle distance in meters between two points
+func distance(lat1, lng1, lat2, lng2 float64) float64 {
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+	dLat := toRadians(lat2 - lat1)
+	dLng := toRadians(lng2 - lng1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
@@ -0,0 +1,1735 @@
+// pickle/backend/storage/memory.go
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/carlostbanks/pickle/notifications"
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/schedule"
+	"github.com/google/uuid"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+// NewMemory returns repositories keeping everything in memory, with the same
+// constraints as the Postgres schema: unknown courts, units and users are
+// rejected with ErrNotFound, taken IDs and emails with ErrConflict and
+// overlapping bookings with ErrOverlap. As in SQLite, series IDs of bookings
+// are not checked.
+func NewMemory() *Store {
+	m := &memory{
+		courts:     make(map[string]*proto.Court),
+		units:      make(map[string]*proto.CourtUnit),
+		bookings:   make(map[string]*proto.Booking),
+		users:      make(map[string]*User),
+		rates:      make(map[string]*proto.CourtRates),
+		policies:   make(map[string]*proto.CancellationPolicy),
+		members:    make(map[[2]string]bool),
+		series:     make(map[string]*proto.BookingSeries),
+		identities: make(map[[2]string]*Identity),
+		staff:      make(map[[2]string]string),
+		sessions:   make(map[string]*memorySession),
+		tokens:     make(map[string]*memoryToken),
+		codes:      make(map[string]*memoryToken),
+		links:      make(map[string]*memoryToken),
+	}
+	return &Store{
+		Courts:   (*memoryCourts)(m),
+		Bookings: (*memoryBookings)(m),
+		Users:    (*memoryUsers)(m),
+		Series:   (*memorySeries)(m),
+		Waitlist: (*memoryWaitlist)(m),
+		Payments: (*memoryPayments)(m),
+		Outbox:   (*memoryOutbox)(m),
+
+		Sessions:   (*memorySessions)(m),
+		APIKeys:    (*memoryAPIKeys)(m),
+		MagicLinks: (*memoryMagicLinks)(m),
+	}
+}
+
+// memory is the state shared by the in-memory repositories. Records are
+// cloned on the way in and out, so callers never share them.
+type memory struct {
+	mu         sync.Mutex
+	courts     map[string]*proto.Court     // With their active units and calendar
+	units      map[string]*proto.CourtUnit // Archived ones included
+	bookings   map[string]*proto.Booking
+	users      map[string]*User
+	rates      map[string]*proto.CourtRates
+	policies   map[string]*proto.CancellationPolicy
+	members    map[[2]string]bool // Court and user IDs
+	series     map[string]*proto.BookingSeries
+	identities map[[2]string]*Identity // By provider and subject
+	staff      map[[2]string]string    // Roles by court and user IDs
+	waitlist   []*proto.WaitlistEntry  // In the order they were created
+	payments   []*Payment              // In the order they were created
+	outbox     []*outboxMessage        // In the order they were queued
+	sessions   map[string]*memorySession
+	tokens     map[string]*memoryToken // Refresh tokens by hash
+	codes      map[string]*memoryToken // Login codes by hash
+	links      map[string]*memoryToken // Magic links by hash, with the email in subject
+	apiKeys    []*APIKey               // In the order they were created
+}
+
+type memoryCourts memory
+
+// CreateCourt implements CourtRepository
+func (r *memoryCourts) CreateCourt(ctx context.Context, court *proto.Court) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.courts[court.Id]; ok {
+		return fmt.Errorf("%w: court %s", ErrConflict, court.Id)
+	}
+
+	court = gproto.Clone(court).(*proto.Court)
+	court.Rates = nil
+	court.CancellationPolicy = nil
+	court.ArchivedAt = ""
+
+	if err := normalizeCalendar(court); err != nil {
+		return err
+	}
+
+	unitIDs := make(map[string]bool)
+	for _, unit := range court.Units {
+		if _, ok := m.units[unit.Id]; ok || unitIDs[unit.Id] {
+			return fmt.Errorf("%w: court unit %s", ErrConflict, unit.Id)
+		}
+		unitIDs[unit.Id] = true
+		unit.CourtId = court.Id
+	}
+
+	weekdays := make(map[int32]bool)
+	for _, oh := range court.OpeningHours {
+		if weekdays[oh.Weekday] {
+			return fmt.Errorf("%w: opening hours of weekday %d", ErrConflict, oh.Weekday)
+		}
+		weekdays[oh.Weekday] = true
+	}
+
+	dates := make(map[string]bool)
+	for _, ex := range court.HourExceptions {
+		if dates[ex.Date] {
+			return fmt.Errorf("%w: hours exception on %s", ErrConflict, ex.Date)
+		}
+		dates[ex.Date] = true
+	}
+
+	blackoutIDs := make(map[string]bool)
+	for _, other := range m.courts {
+		for _, b := range other.Blackouts {
+			blackoutIDs[b.Id] = true
+		}
+	}
+	for _, b := range court.Blackouts {
+		if blackoutIDs[b.Id] {
+			return fmt.Errorf("%w: blackout %s", ErrConflict, b.Id)
+		}
+		blackoutIDs[b.Id] = true
+		if b.CourtUnitId != "" && !unitIDs[b.CourtUnitId] && m.units[b.CourtUnitId] == nil {
+			return fmt.Errorf("%w: court unit %s", ErrNotFound, b.CourtUnitId)
+		}
+	}
+
+	m.courts[court.Id] = court
+	for _, unit := range court.Units {
+		m.units[unit.Id] = unit
+	}
+	return nil
+}
+
+// GetCourt implements CourtRepository
+func (r *memoryCourts) GetCourt(ctx context.Context, courtID string) (*proto.Court, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	court, ok := m.courts[courtID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return courtDetails(court), nil
+}
+
+// ListCourts implements CourtRepository
+func (r *memoryCourts) ListCourts(ctx context.Context, filter CourtFilter) ([]*proto.Court, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var courts []*proto.Court
+	for _, court := range m.courts {
+		if court.ArchivedAt != "" || !strings.Contains(court.Address, filter.City) {
+			continue
+		}
+		if filter.Latitude != 0 &&
+			distance(filter.Latitude, filter.Longitude, court.Latitude, court.Longitude) > filter.RadiusKm*1000 {
+			continue
+		}
+		courts = append(courts, courtDetails(court))
+	}
+
+	sort.Slice(courts, func(i, j int) bool {
+		if courts[i].Name != courts[j].Name {
+			return courts[i].Name < courts[j].Name
+		}
+		return courts[i].Id < courts[j].Id
+	})
+	return courts, nil
+}
+
+// ListUnits implements CourtRepository
+func (r *memoryCourts) ListUnits(ctx context.Context, courtID string) ([]*proto.CourtUnit, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	court, ok := m.courts[courtID]
+	if !ok {
+		return nil, nil
+	}
+
+	var units []*proto.CourtUnit
+	for _, unit := range court.Units {
+		units = append(units, gproto.Clone(unit).(*proto.CourtUnit))
+	}
+	sort.SliceStable(units, func(i, j int) bool { return units[i].Position < units[j].Position })
+	return units, nil
+}
+
+// LoadCalendar implements CourtRepository
+func (r *memoryCourts) LoadCalendar(ctx context.Context, court *proto.Court, fromDate, toDate string) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.courts[court.Id]
+	if !ok {
+		return nil
+	}
+
+	// Blackouts overlapping the days from fromDate to toDate
+	from, err := schedule.ParseDate(fromDate)
+	if err != nil {
+		return err
+	}
+	var to time.Time
+	if toDate != "" {
+		if to, err = schedule.ParseDate(toDate); err != nil {
+			return err
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+
+	var openingHours []*proto.OpeningHours
+	for _, oh := range stored.OpeningHours {
+		openingHours = append(openingHours, gproto.Clone(oh).(*proto.OpeningHours))
+	}
+	sort.SliceStable(openingHours, func(i, j int) bool { return openingHours[i].Weekday < openingHours[j].Weekday })
+	court.OpeningHours = append(court.OpeningHours, openingHours...)
+
+	var exceptions []*proto.HoursException
+	for _, ex := range stored.HourExceptions {
+		if ex.Date >= fromDate && (toDate == "" || ex.Date <= toDate) {
+			exceptions = append(exceptions, gproto.Clone(ex).(*proto.HoursException))
+		}
+	}
+	sort.SliceStable(exceptions, func(i, j int) bool { return exceptions[i].Date < exceptions[j].Date })
+	court.HourExceptions = append(court.HourExceptions, exceptions...)
+
+	var blackouts []*proto.Blackout
+	for _, b := range stored.Blackouts {
+		startsAt, _ := time.Parse(calendarLayout, b.StartsAt)
+		endsAt, _ := time.Parse(calendarLayout, b.EndsAt)
+		if endsAt.After(from) && (toDate == "" || startsAt.Before(to)) {
+			blackouts = append(blackouts, gproto.Clone(b).(*proto.Blackout))
+		}
+	}
+	sort.SliceStable(blackouts, func(i, j int) bool { return blackouts[i].StartsAt < blackouts[j].StartsAt })
+	court.Blackouts = append(court.Blackouts, blackouts...)
+
+	return nil
+}
+
+// courtDetails returns a copy of a stored court without its units and
+// calendar, as GetCourt returns it
+func courtDetails(court *proto.Court) *proto.Court {
+	details := gproto.Clone(court).(*proto.Court)
+	details.Units = nil
+	details.OpeningHours = nil
+	details.HourExceptions = nil
+	details.Blackouts = nil
+	return details
+}
+
+// UpdateCourt implements CourtRepository
+func (r *memoryCourts) UpdateCourt(ctx context.Context, court *proto.Court, fromDate string) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.courts[court.Id]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.ArchivedAt != "" {
+		return ErrArchived
+	}
+
+	// Restore archived units at the listed positions, keeping their IDs
+	listed := make(map[int32]bool)
+	var units []*proto.CourtUnit
+	for _, unit := range court.Units {
+		listed[unit.Position] = true
+		restored := m.unitAt(court.Id, unit.Position)
+		if restored == nil {
+			if _, ok := m.units[unit.Id]; ok {
+				return fmt.Errorf("%w: court unit %s", ErrConflict, unit.Id)
+			}
+			restored = gproto.Clone(unit).(*proto.CourtUnit)
+			restored.CourtId = court.Id
+		}
+		units = append(units, restored)
+	}
+
+	for _, unit := range stored.Units {
+		if !listed[unit.Position] && m.booked(court.Id, fromDate, unit.Id) {
+			return ErrBooked
+		}
+	}
+
+	stored.Name = court.Name
+	stored.Address = court.Address
+	stored.Latitude = court.Latitude
+	stored.Longitude = court.Longitude
+	stored.NumberOfCourts = court.NumberOfCourts
+	stored.MaxPlayers = court.MaxPlayers
+	stored.Amenities = append([]string(nil), court.Amenities...)
+	stored.ImageUrl = court.ImageUrl
+	stored.Units = units
+	for _, unit := range units {
+		m.units[unit.Id] = unit
+	}
+	return nil
+}
+
+// unitAt returns the unit of a facility at a position, archived or not
+func (m *memory) unitAt(courtID string, position int32) *proto.CourtUnit {
+	for _, unit := range m.units {
+		if unit.CourtId == courtID && unit.Position == position {
+			return unit
+		}
+	}
+	return nil
+}
+
+// booked reports whether a facility has pending or confirmed bookings from
+// a date on, on the given unit unless it is empty
+func (m *memory) booked(courtID, fromDate, unitID string) bool {
+	for _, booking := range m.bookings {
+		if booking.CourtId == courtID && booking.Date >= fromDate && (unitID == "" || booking.CourtUnitId == unitID) &&
+			(booking.Status == proto.BookingStatus_PENDING || booking.Status == proto.BookingStatus_CONFIRMED) {
+			return true
+		}
+	}
+	return false
+}
+
+// ArchiveCourt implements CourtRepository
+func (r *memoryCourts) ArchiveCourt(ctx context.Context, courtID, fromDate string, at time.Time) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	court, ok := m.courts[courtID]
+	if !ok {
+		return ErrNotFound
+	}
+	if court.ArchivedAt != "" {
+		return ErrArchived
+	}
+	if m.booked(courtID, fromDate, "") {
+		return ErrBooked
+	}
+
+	court.ArchivedAt = at.Format(calendarLayout)
+	for _, entry := range m.waitlist {
+		if entry.CourtId == courtID && entry.Status == proto.WaitlistStatus_WAITING {
+			entry.Status = proto.WaitlistStatus_EXPIRED
+		}
+	}
+	return nil
+}
+
+// GetRates implements CourtRepository
+func (r *memoryCourts) GetRates(ctx context.Context, courtID string) (*proto.CourtRates, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rates, ok := m.rates[courtID]
+	if !ok {
+		return nil, nil
+	}
+	return gproto.Clone(rates).(*proto.CourtRates), nil
+}
+
+// SetRates implements CourtRepository
+func (r *memoryCourts) SetRates(ctx context.Context, courtID string, rates *proto.CourtRates) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.courts[courtID]; !ok {
+		return fmt.Errorf("%w: court %s", ErrNotFound, courtID)
+	}
+	if rates == nil {
+		delete(m.rates, courtID)
+		return nil
+	}
+
+	rates = gproto.Clone(rates).(*proto.CourtRates)
+	if err := normalizeRates(rates); err != nil {
+		return err
+	}
+	starts := make(map[string]bool)
+	for _, peak := range rates.PeakRates {
+		key := fmt.Sprintf("%d %s", peak.Weekday, peak.StartTime)
+		if starts[key] {
+			return fmt.Errorf("%w: peak rate of weekday %d at %s", ErrConflict, peak.Weekday, peak.StartTime)
+		}
+		starts[key] = true
+	}
+	sort.SliceStable(rates.PeakRates, func(i, j int) bool {
+		a, b := rates.PeakRates[i], rates.PeakRates[j]
+		if a.Weekday != b.Weekday {
+			return a.Weekday < b.Weekday
+		}
+		return a.StartTime < b.StartTime
+	})
+
+	m.rates[courtID] = rates
+	return nil
+}
+
+// GetCancellationPolicy implements CourtRepository
+func (r *memoryCourts) GetCancellationPolicy(ctx context.Context, courtID string) (*proto.CancellationPolicy, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	policy, ok := m.policies[courtID]
+	if !ok {
+		return nil, nil
+	}
+	return gproto.Clone(policy).(*proto.CancellationPolicy), nil
+}
+
+// SetCancellationPolicy implements CourtRepository
+func (r *memoryCourts) SetCancellationPolicy(ctx context.Context, courtID string, policy *proto.CancellationPolicy) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.courts[courtID]; !ok {
+		return fmt.Errorf("%w: court %s", ErrNotFound, courtID)
+	}
+	if policy == nil {
+		delete(m.policies, courtID)
+		return nil
+	}
+	m.policies[courtID] = gproto.Clone(policy).(*proto.CancellationPolicy)
+	return nil
+}
+
+// IsMember implements CourtRepository
+func (r *memoryCourts) IsMember(ctx context.Context, courtID, userID string) (bool, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.members[[2]string{courtID, userID}], nil
+}
+
+// AddMember implements CourtRepository
+func (r *memoryCourts) AddMember(ctx context.Context, courtID, userID string) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.courts[courtID]; !ok {
+		return fmt.Errorf("%w: court %s", ErrNotFound, courtID)
+	}
+	if _, ok := m.users[userID]; !ok {
+		return fmt.Errorf("%w: user %s", ErrNotFound, userID)
+	}
+	key := [2]string{courtID, userID}
+	if m.members[key] {
+		return fmt.Errorf("%w: member %s", ErrConflict, userID)
+	}
+	m.members[key] = true
+	return nil
+}
+
+type memoryBookings memory
+
+// InsertBooking implements BookingRepository
+func (r *memoryBookings) InsertBooking(ctx context.Context, booking *proto.Booking, messages ...*notifications.Message) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.bookings[booking.Id]; ok {
+		return fmt.Errorf("%w: booking %s", ErrConflict, booking.Id)
+	}
+	if _, ok := m.courts[booking.CourtId]; !ok {
+		return fmt.Errorf("%w: court %s", ErrNotFound, booking.CourtId)
+	}
+	if _, ok := m.units[booking.CourtUnitId]; booking.CourtUnitId != "" && !ok {
+		return fmt.Errorf("%w: court unit %s", ErrNotFound, booking.CourtUnitId)
+	}
+	if _, ok := m.users[booking.UserId]; !ok {
+		return fmt.Errorf("%w: user %s", ErrNotFound, booking.UserId)
+	}
+	if err := m.checkPlayers(booking.Players); err != nil {
+		return err
+	}
+
+	booking = gproto.Clone(booking).(*proto.Booking)
+	if err := normalizeBooking(booking); err != nil {
+		return err
+	}
+
+	if m.overlaps(booking, nil) {
+		return ErrOverlap
+	}
+
+	m.bookings[booking.Id] = booking
+	m.enqueue(messages)
+	return nil
+}
+
+// overlaps reports whether a booking is active and overlaps another active
+// booking of its unit, taking the bookings in changed instead of the stored
+// ones with the same IDs
+func (m *memory) overlaps(booking *proto.Booking, changed map[string]*proto.Booking) bool {
+	if !active(booking) || booking.CourtUnitId == "" {
+		return false
+	}
+	for id, other := range m.bookings {
+		if changedOther, ok := changed[id]; ok {
+			other = changedOther
+		}
+		if id != booking.Id && active(other) && other.CourtUnitId == booking.CourtUnitId && other.Date == booking.Date &&
+			other.StartTime < booking.EndTime && booking.StartTime < other.EndTime {
+			return true
+		}
+	}
+	return false
+}
+
+// GetBooking implements BookingRepository
+func (r *memoryBookings) GetBooking(ctx context.Context, bookingID string) (*proto.Booking, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	booking, ok := m.bookings[bookingID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return gproto.Clone(booking).(*proto.Booking), nil
+}
+
+// SetPlayers implements BookingRepository
+func (r *memoryBookings) SetPlayers(ctx context.Context, bookingID string, players []*proto.BookingPlayer, messages ...*notifications.Message) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	booking, ok := m.bookings[bookingID]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := m.checkPlayers(players); err != nil {
+		return err
+	}
+
+	booking.Players = nil
+	for _, player := range players {
+		booking.Players = append(booking.Players, gproto.Clone(player).(*proto.BookingPlayer))
+	}
+	booking.PlayerEmails = playerEmails(booking.Players)
+	m.enqueue(messages)
+	return nil
+}
+
+// UpdatePlayer implements BookingRepository
+func (r *memoryBookings) UpdatePlayer(ctx context.Context, bookingID string, player *proto.BookingPlayer) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	booking, ok := m.bookings[bookingID]
+	if !ok {
+		return ErrNotFound
+	}
+	if _, ok := m.users[player.UserId]; player.UserId != "" && !ok {
+		return fmt.Errorf("%w: user %s", ErrNotFound, player.UserId)
+	}
+
+	for i, listed := range booking.Players {
+		if listed.Email == player.Email {
+			booking.Players[i] = gproto.Clone(player).(*proto.BookingPlayer)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: player %s", ErrNotFound, player.Email)
+}
+
+// checkPlayers checks that the players of a booking are registered users,
+// or guests, listed once each
+func (m *memory) checkPlayers(players []*proto.BookingPlayer) error {
+	listed := make(map[string]bool)
+	for _, player := range players {
+		if listed[player.Email] {
+			return fmt.Errorf("%w: player %s", ErrConflict, player.Email)
+		}
+		listed[player.Email] = true
+		if _, ok := m.users[player.UserId]; player.UserId != "" && !ok {
+			return fmt.Errorf("%w: user %s", ErrNotFound, player.UserId)
+		}
+	}
+	return nil
+}
+
+// ListBookings implements BookingRepository
+func (r *memoryBookings) ListBookings(ctx context.Context, filter BookingFilter) ([]*proto.Booking, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var bookings []*proto.Booking
+	for _, booking := range m.bookings {
+		if (filter.UserID != "" && !involves(booking, filter.UserID)) ||
+			(filter.CourtID != "" && booking.CourtId != filter.CourtID) ||
+			(filter.Date != "" && booking.Date != filter.Date) ||
+			(filter.SeriesID != "" && booking.SeriesId != filter.SeriesID) ||
+			(filter.Visible != nil && !filter.Visible.allows(booking)) {
+			continue
+		}
+		bookings = append(bookings, gproto.Clone(booking).(*proto.Booking))
+	}
+
+	sort.Slice(bookings, func(i, j int) bool {
+		a, b := bookings[i], bookings[j]
+		if a.Date != b.Date {
+			return a.Date < b.Date
+		}
+		if a.StartTime != b.StartTime {
+			return a.StartTime < b.StartTime
+		}
+		return a.Id < b.Id
+	})
+	return bookings, nil
+}
+
+// Booked implements BookingRepository
+func (r *memoryBookings) Booked(ctx context.Context, courtID, fromDate, toDate, excludeID string) (map[string][]schedule.Booked, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	booked := make(map[string][]schedule.Booked)
+	for _, booking := range m.bookings {
+		if booking.CourtId != courtID || booking.Date < fromDate || booking.Date > toDate ||
+			booking.Id == excludeID || !active(booking) {
+			continue
+		}
+
+		window, err := schedule.ParseWindow(booking.StartTime, booking.EndTime)
+		if err != nil {
+			return nil, err
+		}
+		booked[booking.Date] = append(booked[booking.Date], schedule.Booked{UnitID: booking.CourtUnitId, Window: window})
+	}
+
+	return booked, nil
+}
+
+// UpdateBookings implements BookingRepository
+func (r *memoryBookings) UpdateBookings(ctx context.Context, bookings []*proto.Booking, messages ...*notifications.Message) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	changed := make(map[string]*proto.Booking)
+	for _, change := range bookings {
+		stored, ok := m.bookings[change.Id]
+		if !ok {
+			return fmt.Errorf("%w: booking %s", ErrNotFound, change.Id)
+		}
+		if _, ok := m.units[change.CourtUnitId]; change.CourtUnitId != "" && !ok {
+			return fmt.Errorf("%w: court unit %s", ErrNotFound, change.CourtUnitId)
+		}
+		window, err := schedule.ParseWindow(change.StartTime, change.EndTime)
+		if err != nil {
+			return err
+		}
+
+		booking := gproto.Clone(stored).(*proto.Booking)
+		booking.CourtUnitId = change.CourtUnitId
+		booking.StartTime, booking.EndTime = window.StartTime(), window.EndTime()
+		booking.NumberOfPlayers = change.NumberOfPlayers
+		booking.PriceCents = change.PriceCents
+		booking.Currency = change.Currency
+		booking.UpdatedAt = change.UpdatedAt
+		changed[booking.Id] = booking
+	}
+
+	for _, booking := range changed {
+		if m.overlaps(booking, changed) {
+			return ErrOverlap
+		}
+	}
+	for id, booking := range changed {
+		m.bookings[id] = booking
+	}
+	m.enqueue(messages)
+	return nil
+}
+
+// ConfirmBooking implements BookingRepository
+func (r *memoryBookings) ConfirmBooking(ctx context.Context, bookingID string, at time.Time, messages ...*notifications.Message) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	booking, ok := m.bookings[bookingID]
+	if !ok || booking.Status != proto.BookingStatus_PENDING || holdExpired(booking, at) {
+		return ErrStale
+	}
+
+	booking.Status = proto.BookingStatus_CONFIRMED
+	booking.HoldExpiresAt = ""
+	booking.UpdatedAt = at.Format(time.RFC3339)
+	for _, entry := range m.waitlist {
+		if entry.BookingId == bookingID && entry.Status == proto.WaitlistStatus_OFFERED {
+			entry.Status = proto.WaitlistStatus_CLAIMED
+		}
+	}
+	m.enqueue(messages)
+	return nil
+}
+
+// CancelBookings implements BookingRepository
+func (r *memoryBookings) CancelBookings(ctx context.Context, cancellations []*proto.Cancellation, at time.Time, messages ...*notifications.Message) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, c := range cancellations {
+		if _, ok := m.bookings[c.BookingId]; !ok {
+			return fmt.Errorf("%w: booking %s", ErrNotFound, c.BookingId)
+		}
+	}
+
+	cancelled := make(map[string]bool)
+	for _, c := range cancellations {
+		booking := m.bookings[c.BookingId]
+		booking.Status = proto.BookingStatus_CANCELLED
+		booking.CancellationRule = c.Rule
+		booking.CancellationFeeCents = c.FeeCents
+		booking.CancelledAt = at.Format(calendarLayout)
+		booking.UpdatedAt = at.Format(time.RFC3339)
+		cancelled[c.BookingId] = true
+	}
+	for _, entry := range m.waitlist {
+		if cancelled[entry.BookingId] && entry.Status == proto.WaitlistStatus_OFFERED {
+			entry.Status = proto.WaitlistStatus_LEFT
+		}
+	}
+	m.enqueue(messages)
+	return nil
+}
+
+// MarkNoShow implements BookingRepository
+func (r *memoryBookings) MarkNoShow(ctx context.Context, bookingID, rule string, feeCents int64, at time.Time) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	booking, ok := m.bookings[bookingID]
+	if !ok || booking.Status != proto.BookingStatus_CONFIRMED {
+		return ErrStale
+	}
+
+	booking.Status = proto.BookingStatus_NO_SHOW
+	booking.CancellationRule = rule
+	booking.CancellationFeeCents = feeCents
+	booking.CancelledAt = at.Format(calendarLayout)
+	booking.UpdatedAt = at.Format(time.RFC3339)
+	return nil
+}
+
+// ExpireHolds implements BookingRepository
+func (r *memoryBookings) ExpireHolds(ctx context.Context, at time.Time) ([]*proto.Booking, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var expired []*proto.Booking
+	for _, booking := range m.bookings {
+		if booking.Status == proto.BookingStatus_PENDING && holdExpired(booking, at) {
+			booking.Status = proto.BookingStatus_CANCELLED
+			booking.UpdatedAt = at.Format(time.RFC3339)
+			expired = append(expired, gproto.Clone(booking).(*proto.Booking))
+		}
+	}
+	return expired, nil
+}
+
+// holdExpired reports whether the hold of a booking, in the local time of
+// the facility, expired by the given time
+func holdExpired(booking *proto.Booking, at time.Time) bool {
+	if booking.HoldExpiresAt == "" {
+		return false
+	}
+	expiresAt, err := time.ParseInLocation(calendarLayout, booking.HoldExpiresAt, time.Local)
+	return err == nil && !expiresAt.After(at)
+}
+
+// active reports whether a booking occupies its unit
+func active(booking *proto.Booking) bool {
+	return booking.Status != proto.BookingStatus_CANCELLED
+}
+
+// involves reports whether a user organized a booking or is one of its
+// players
+func involves(booking *proto.Booking, userID string) bool {
+	if booking.UserId == userID {
+		return true
+	}
+	for _, player := range booking.Players {
+		if player.UserId == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether a booking is visible
+func (v *Visibility) allows(booking *proto.Booking) bool {
+	if involves(booking, v.UserID) {
+		return true
+	}
+	for _, courtID := range v.CourtIDs {
+		if booking.CourtId == courtID {
+			return true
+		}
+	}
+	return false
+}
+
+type memoryUsers memory
+
+// CreateUser implements UserRepository
+func (r *memoryUsers) CreateUser(ctx context.Context, user *User) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.createUser(user)
+}
+
+// createUser creates a user with a unique ID and email
+func (m *memory) createUser(user *User) error {
+	if _, ok := m.users[user.ID]; ok {
+		return fmt.Errorf("%w: user %s", ErrConflict, user.ID)
+	}
+	for _, other := range m.users {
+		if other.Email == user.Email {
+			return fmt.Errorf("%w: email %s", ErrConflict, user.Email)
+		}
+	}
+
+	stored := *user
+	m.users[user.ID] = &stored
+	return nil
+}
+
+// GetUser implements UserRepository
+func (r *memoryUsers) GetUser(ctx context.Context, userID string) (*User, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	found := *user
+	return &found, nil
+}
+
+// GetUserByEmail implements UserRepository
+func (r *memoryUsers) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, user := range m.users {
+		if strings.EqualFold(user.Email, email) {
+			found := *user
+			return &found, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// UpdateProfile implements UserRepository
+func (r *memoryUsers) UpdateProfile(ctx context.Context, userID, name, picture string) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return fmt.Errorf("%w: user %s", ErrNotFound, userID)
+	}
+	if name != "" {
+		user.Name = name
+	}
+	if picture != "" {
+		user.Picture = picture
+	}
+	return nil
+}
+
+// GetIdentity implements UserRepository
+func (r *memoryUsers) GetIdentity(ctx context.Context, provider, subject string) (*Identity, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	identity, ok := m.identities[[2]string{provider, subject}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	found := *identity
+	return &found, nil
+}
+
+// LinkIdentity implements UserRepository
+func (r *memoryUsers) LinkIdentity(ctx context.Context, identity *Identity) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := [2]string{identity.Provider, identity.Subject}
+	if _, ok := m.identities[key]; ok {
+		return fmt.Errorf("%w: identity %s/%s", ErrConflict, identity.Provider, identity.Subject)
+	}
+	if _, ok := m.users[identity.UserID]; !ok {
+		return fmt.Errorf("%w: user %s", ErrNotFound, identity.UserID)
+	}
+	stored := *identity
+	m.identities[key] = &stored
+	return nil
+}
+
+// GrantRole implements UserRepository
+func (r *memoryUsers) GrantRole(ctx context.Context, courtID, userID, role string) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.courts[courtID]; !ok {
+		return fmt.Errorf("%w: court %s", ErrNotFound, courtID)
+	}
+	if _, ok := m.users[userID]; !ok {
+		return fmt.Errorf("%w: user %s", ErrNotFound, userID)
+	}
+	m.staff[[2]string{courtID, userID}] = role
+	return nil
+}
+
+// ListRoles implements UserRepository
+func (r *memoryUsers) ListRoles(ctx context.Context, userID string) ([]StaffRole, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var roles []StaffRole
+	for key, role := range m.staff {
+		if key[1] == userID {
+			roles = append(roles, StaffRole{CourtID: key[0], Role: role})
+		}
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].CourtID < roles[j].CourtID })
+	return roles, nil
+}
+
+type memorySeries memory
+
+// InsertSeries implements SeriesRepository
+func (r *memorySeries) InsertSeries(ctx context.Context, series *proto.BookingSeries) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.series[series.Id]; ok {
+		return fmt.Errorf("%w: booking series %s", ErrConflict, series.Id)
+	}
+	if err := m.checkSlot(series.CourtId, series.CourtUnitId, series.UserId); err != nil {
+		return err
+	}
+
+	series = gproto.Clone(series).(*proto.BookingSeries)
+	if err := normalizeSlot(&series.StartDate, &series.StartTime, &series.EndTime); err != nil {
+		return err
+	}
+
+	m.series[series.Id] = series
+	return nil
+}
+
+// checkSlot checks that the facility, unit (unless empty) and user a
+// booking, series or waitlist entry refers to exist
+func (m *memory) checkSlot(courtID, unitID, userID string) error {
+	if _, ok := m.courts[courtID]; !ok {
+		return fmt.Errorf("%w: court %s", ErrNotFound, courtID)
+	}
+	if _, ok := m.units[unitID]; unitID != "" && !ok {
+		return fmt.Errorf("%w: court unit %s", ErrNotFound, unitID)
+	}
+	if _, ok := m.users[userID]; !ok {
+		return fmt.Errorf("%w: user %s", ErrNotFound, userID)
+	}
+	return nil
+}
+
+// GetSeries implements SeriesRepository
+func (r *memorySeries) GetSeries(ctx context.Context, seriesID string) (*proto.BookingSeries, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	series, ok := m.series[seriesID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return gproto.Clone(series).(*proto.BookingSeries), nil
+}
+
+// DeleteSeries implements SeriesRepository
+func (r *memorySeries) DeleteSeries(ctx context.Context, seriesID string) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.series, seriesID)
+	return nil
+}
+
+// CancelSeries implements SeriesRepository
+func (r *memorySeries) CancelSeries(ctx context.Context, seriesID string, at time.Time) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	series, ok := m.series[seriesID]
+	if !ok {
+		return ErrNotFound
+	}
+	series.Status = "CANCELLED"
+	series.UpdatedAt = at.Format(time.RFC3339)
+	return nil
+}
+
+type memoryWaitlist memory
+
+// InsertEntry implements WaitlistRepository
+func (r *memoryWaitlist) InsertEntry(ctx context.Context, entry *proto.WaitlistEntry) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkSlot(entry.CourtId, entry.CourtUnitId, entry.UserId); err != nil {
+		return err
+	}
+
+	entry = gproto.Clone(entry).(*proto.WaitlistEntry)
+	if err := normalizeSlot(&entry.Date, &entry.StartTime, &entry.EndTime); err != nil {
+		return err
+	}
+
+	for _, other := range m.waitlist {
+		if other.Id == entry.Id {
+			return fmt.Errorf("%w: waitlist entry %s", ErrConflict, entry.Id)
+		}
+		if other.UserId == entry.UserId && other.CourtId == entry.CourtId && other.Date == entry.Date &&
+			other.StartTime == entry.StartTime && other.EndTime == entry.EndTime && waiting(other) {
+			return fmt.Errorf("%w: waitlist entry for the slot", ErrConflict)
+		}
+	}
+
+	m.waitlist = append(m.waitlist, entry)
+	return nil
+}
+
+// waiting reports whether a waitlist entry is waiting for its slot or was
+// offered it
+func waiting(entry *proto.WaitlistEntry) bool {
+	return entry.Status == proto.WaitlistStatus_WAITING || entry.Status == proto.WaitlistStatus_OFFERED
+}
+
+// entry returns the stored waitlist entry with an ID, or nil
+func (m *memory) entry(entryID string) *proto.WaitlistEntry {
+	for _, entry := range m.waitlist {
+		if entry.Id == entryID {
+			return entry
+		}
+	}
+	return nil
+}
+
+// GetEntry implements WaitlistRepository
+func (r *memoryWaitlist) GetEntry(ctx context.Context, entryID string) (*proto.WaitlistEntry, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.entry(entryID)
+	if entry == nil {
+		return nil, ErrNotFound
+	}
+	return gproto.Clone(entry).(*proto.WaitlistEntry), nil
+}
+
+// ListEntries implements WaitlistRepository
+func (r *memoryWaitlist) ListEntries(ctx context.Context, filter WaitlistFilter) ([]*proto.WaitlistEntry, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var entries []*proto.WaitlistEntry
+	for _, entry := range m.waitlist {
+		if (filter.UserID != "" && entry.UserId != filter.UserID) ||
+			(filter.CourtID != "" && entry.CourtId != filter.CourtID) ||
+			(filter.Date != "" && entry.Date != filter.Date) ||
+			(len(filter.Statuses) > 0 && !hasStatus(filter.Statuses, entry.Status)) {
+			continue
+		}
+		entries = append(entries, gproto.Clone(entry).(*proto.WaitlistEntry))
+	}
+	return entries, nil
+}
+
+// hasStatus reports whether status is one of statuses
+func hasStatus(statuses []proto.WaitlistStatus, status proto.WaitlistStatus) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// OfferEntry implements WaitlistRepository
+func (r *memoryWaitlist) OfferEntry(ctx context.Context, entryID string, expiresAt, at time.Time) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.entry(entryID)
+	if entry == nil || entry.Status != proto.WaitlistStatus_WAITING {
+		return ErrStale
+	}
+	entry.Status = proto.WaitlistStatus_OFFERED
+	entry.OfferExpiresAt = expiresAt.Format(calendarLayout)
+	return nil
+}
+
+// AttachBooking implements WaitlistRepository
+func (r *memoryWaitlist) AttachBooking(ctx context.Context, entryID, bookingID string) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.entry(entryID)
+	if entry == nil {
+		return ErrNotFound
+	}
+	if _, ok := m.bookings[bookingID]; !ok {
+		return fmt.Errorf("%w: booking %s", ErrNotFound, bookingID)
+	}
+	entry.BookingId = bookingID
+	return nil
+}
+
+// ReturnEntry implements WaitlistRepository
+func (r *memoryWaitlist) ReturnEntry(ctx context.Context, entryID string) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.entry(entryID)
+	if entry == nil {
+		return ErrNotFound
+	}
+	entry.Status = proto.WaitlistStatus_WAITING
+	entry.OfferExpiresAt = ""
+	return nil
+}
+
+// LeaveEntry implements WaitlistRepository
+func (r *memoryWaitlist) LeaveEntry(ctx context.Context, entryID string, from proto.WaitlistStatus, at time.Time) error {
+	return (*memory)(r).endEntry(entryID, from, proto.WaitlistStatus_LEFT, at)
+}
+
+// ExpireOffer implements WaitlistRepository
+func (r *memoryWaitlist) ExpireOffer(ctx context.Context, entryID string, at time.Time) error {
+	return (*memory)(r).endEntry(entryID, proto.WaitlistStatus_OFFERED, proto.WaitlistStatus_EXPIRED, at)
+}
+
+// endEntry moves a waitlist entry from one status to a final one and
+// cancels the pending booking of its offer
+func (m *memory) endEntry(entryID string, from, to proto.WaitlistStatus, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.entry(entryID)
+	if entry == nil || entry.Status != from {
+		return ErrStale
+	}
+	entry.Status = to
+
+	if booking, ok := m.bookings[entry.BookingId]; ok && booking.Status == proto.BookingStatus_PENDING {
+		booking.Status = proto.BookingStatus_CANCELLED
+		booking.UpdatedAt = at.Format(time.RFC3339)
+	}
+	return nil
+}
+
+type memoryPayments memory
+
+// InsertPayment implements PaymentRepository
+func (r *memoryPayments) InsertPayment(ctx context.Context, payment *Payment) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.bookings[payment.BookingID]; !ok {
+		return fmt.Errorf("%w: booking %s", ErrNotFound, payment.BookingID)
+	}
+	for _, other := range m.payments {
+		switch {
+		case other.ID == payment.ID:
+			return fmt.Errorf("%w: payment %s", ErrConflict, payment.ID)
+		case other.Provider == payment.Provider && other.IntentID == payment.IntentID:
+			return fmt.Errorf("%w: payment intent %s", ErrConflict, payment.IntentID)
+		case other.BookingID == payment.BookingID && activePayment(other) && activePayment(payment):
+			return fmt.Errorf("%w: active payment of booking %s", ErrConflict, payment.BookingID)
+		}
+	}
+
+	stored := *payment
+	m.payments = append(m.payments, &stored)
+	return nil
+}
+
+// LatestPayment implements PaymentRepository
+func (r *memoryPayments) LatestPayment(ctx context.Context, bookingID string) (*Payment, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var latest *Payment
+	for _, payment := range m.payments {
+		if payment.BookingID == bookingID && (latest == nil || !payment.CreatedAt.Before(latest.CreatedAt)) {
+			latest = payment
+		}
+	}
+	if latest == nil {
+		return nil, ErrNotFound
+	}
+	found := *latest
+	return &found, nil
+}
+
+// ActivePayments implements PaymentRepository
+func (r *memoryPayments) ActivePayments(ctx context.Context, bookingIDs []string) ([]*Payment, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var active []*Payment
+	for _, payment := range m.payments {
+		for _, bookingID := range bookingIDs {
+			if payment.BookingID == bookingID && activePayment(payment) {
+				found := *payment
+				active = append(active, &found)
+			}
+		}
+	}
+	return active, nil
+}
+
+// UpdatePayment implements PaymentRepository
+func (r *memoryPayments) UpdatePayment(ctx context.Context, payment *Payment) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, stored := range m.payments {
+		if stored.ID == payment.ID {
+			stored.Status = payment.Status
+			stored.RefundedCents = payment.RefundedCents
+			stored.UpdatedAt = payment.UpdatedAt
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// UpdateIntentStatus implements PaymentRepository
+func (r *memoryPayments) UpdateIntentStatus(ctx context.Context, provider, intentID, from, to string, at time.Time) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, stored := range m.payments {
+		if stored.Provider == provider && stored.IntentID == intentID && stored.Status == from {
+			stored.Status = to
+			stored.UpdatedAt = at
+			return nil
+		}
+	}
+	return ErrStale
+}
+
+// outboxMessage is a message of the in-memory outbox with its delivery state
+type outboxMessage struct {
+	notifications.Queued
+	status      string // PENDING, SENT or FAILED
+	lastError   string
+	nextAttempt time.Time
+}
+
+type memoryOutbox memory
+
+// Enqueue implements OutboxRepository
+func (r *memoryOutbox) Enqueue(ctx context.Context, messages ...*notifications.Message) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.enqueue(messages)
+	return nil
+}
+
+// enqueue queues messages in the outbox, dropping those with the key of a
+// message already queued
+func (m *memory) enqueue(messages []*notifications.Message) {
+	now := time.Now()
+	for _, msg := range messages {
+		if msg.Key != "" && m.queued(msg.Key) {
+			continue
+		}
+		m.outbox = append(m.outbox, &outboxMessage{
+			Queued:      notifications.Queued{Message: *msg, ID: uuid.New().String()},
+			status:      "PENDING",
+			nextAttempt: now,
+		})
+	}
+}
+
+// queued reports whether a message with the key was queued
+func (m *memory) queued(key string) bool {
+	for _, queued := range m.outbox {
+		if queued.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// ClaimMessages implements OutboxRepository
+func (r *memoryOutbox) ClaimMessages(ctx context.Context, at time.Time, lease time.Duration, limit int) ([]*notifications.Queued, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var due []*outboxMessage
+	for _, queued := range m.outbox {
+		if queued.status == "PENDING" && !queued.nextAttempt.After(at) {
+			due = append(due, queued)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].nextAttempt.Before(due[j].nextAttempt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	claimed := make([]*notifications.Queued, len(due))
+	for i, queued := range due {
+		queued.Attempt++
+		queued.nextAttempt = at.Add(lease)
+		claim := queued.Queued
+		claimed[i] = &claim
+	}
+	return claimed, nil
+}
+
+// MarkSent implements OutboxRepository
+func (r *memoryOutbox) MarkSent(ctx context.Context, id string, at time.Time) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, queued := range m.outbox {
+		if queued.ID == id && queued.status == "PENDING" {
+			queued.status = "SENT"
+			queued.lastError = ""
+		}
+	}
+	return nil
+}
+
+// MarkFailed implements OutboxRepository
+func (r *memoryOutbox) MarkFailed(ctx context.Context, id string, attempt int, lastError string, retryAt time.Time) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, queued := range m.outbox {
+		if queued.ID != id || queued.Attempt != attempt || queued.status != "PENDING" {
+			continue
+		}
+		queued.lastError = lastError
+		if retryAt.IsZero() {
+			queued.status = "FAILED"
+		} else {
+			queued.nextAttempt = retryAt
+		}
+	}
+	return nil
+}
+
+// memorySession is a session of the in-memory store with its revocation
+type memorySession struct {
+	Session
+	revoked bool
+	reason  string
+}
+
+// memoryToken is a refresh token, login code or magic link of the in-memory
+// store
+type memoryToken struct {
+	subject   string    // Session ID, or email of magic links
+	expiresAt time.Time // Zero for refresh tokens, which last as long as their session
+	used      bool
+}
+
+type memorySessions memory
+
+// CreateSession implements SessionRepository
+func (r *memorySessions) CreateSession(ctx context.Context, session *Session, tokenHash string) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[session.UserID]; !ok {
+		return fmt.Errorf("%w: user %s", ErrNotFound, session.UserID)
+	}
+	if _, ok := m.sessions[session.ID]; ok {
+		return fmt.Errorf("%w: session %s", ErrConflict, session.ID)
+	}
+	if _, ok := m.tokens[tokenHash]; ok {
+		return fmt.Errorf("%w: refresh token", ErrConflict)
+	}
+	m.sessions[session.ID] = &memorySession{Session: *session}
+	m.tokens[tokenHash] = &memoryToken{subject: session.ID}
+	return nil
+}
+
+// RotateRefreshToken implements SessionRepository
+func (r *memorySessions) RotateRefreshToken(ctx context.Context, tokenHash, nextHash string, at time.Time) (*Session, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.tokens[tokenHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	session := m.sessions[token.subject]
+	if !session.live(at) {
+		return nil, ErrNotFound
+	}
+	if token.used {
+		session.revoke(RevokedReuse)
+		return nil, ErrReused
+	}
+	if _, ok := m.tokens[nextHash]; ok {
+		return nil, fmt.Errorf("%w: refresh token", ErrConflict)
+	}
+
+	token.used = true
+	m.tokens[nextHash] = &memoryToken{subject: session.ID}
+	found := session.Session
+	return &found, nil
+}
+
+// CreateLoginCode implements SessionRepository
+func (r *memorySessions) CreateLoginCode(ctx context.Context, codeHash, sessionID string, at, expiresAt time.Time) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sessions[sessionID]; !ok {
+		return fmt.Errorf("%w: session %s", ErrNotFound, sessionID)
+	}
+	if _, ok := m.codes[codeHash]; ok {
+		return fmt.Errorf("%w: login code", ErrConflict)
+	}
+	m.codes[codeHash] = &memoryToken{subject: sessionID, expiresAt: expiresAt}
+	return nil
+}
+
+// RedeemLoginCode implements SessionRepository
+func (r *memorySessions) RedeemLoginCode(ctx context.Context, codeHash string, at time.Time) (*Session, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	code, ok := m.codes[codeHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	session := m.sessions[code.subject]
+	if code.used {
+		session.revoke(RevokedReuse)
+		return nil, ErrReused
+	}
+	if !code.expiresAt.After(at) || !session.live(at) {
+		return nil, ErrNotFound
+	}
+
+	code.used = true
+	found := session.Session
+	return &found, nil
+}
+
+// GetSessionByRefreshToken implements SessionRepository
+func (r *memorySessions) GetSessionByRefreshToken(ctx context.Context, tokenHash string) (*Session, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.tokens[tokenHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	found := m.sessions[token.subject].Session
+	return &found, nil
+}
+
+// RevokeSession implements SessionRepository
+func (r *memorySessions) RevokeSession(ctx context.Context, sessionID, reason string, at time.Time) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if session, ok := m.sessions[sessionID]; ok {
+		session.revoke(reason)
+	}
+	return nil
+}
+
+// RevokeUserSessions implements SessionRepository
+func (r *memorySessions) RevokeUserSessions(ctx context.Context, userID, reason string, at time.Time) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, session := range m.sessions {
+		if session.UserID == userID {
+			session.revoke(reason)
+		}
+	}
+	return nil
+}
+
+// SessionLive implements SessionRepository
+func (r *memorySessions) SessionLive(ctx context.Context, sessionID string, at time.Time) (bool, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	return ok && session.live(at), nil
+}
+
+// live reports whether a session is live at the given time
+func (s *memorySession) live(at time.Time) bool {
+	return !s.revoked && s.ExpiresAt.After(at)
+}
+
+// revoke revokes a session for a reason, unless it was revoked already
+func (s *memorySession) revoke(reason string) {
+	if !s.revoked {
+		s.revoked, s.reason = true, reason
+	}
+}
+
+type memoryAPIKeys memory
+
+// CreateAPIKey implements APIKeyRepository
+func (r *memoryAPIKeys) CreateAPIKey(ctx context.Context, key *APIKey, account *User, role string) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, other := range m.apiKeys {
+		if other.ID == key.ID {
+			return fmt.Errorf("%w: API key %s", ErrConflict, key.ID)
+		}
+	}
+	if key.CourtID != "" {
+		if _, ok := m.courts[key.CourtID]; !ok {
+			return fmt.Errorf("%w: court %s", ErrNotFound, key.CourtID)
+		}
+	}
+	if _, ok := m.users[key.CreatedBy]; !ok {
+		return fmt.Errorf("%w: user %s", ErrNotFound, key.CreatedBy)
+	}
+	if _, ok := m.users[key.UserID]; !ok && (account == nil || account.ID != key.UserID) {
+		return fmt.Errorf("%w: user %s", ErrNotFound, key.UserID)
+	}
+	if account != nil {
+		if err := m.createUser(account); err != nil {
+			return err
+		}
+		m.staff[[2]string{key.CourtID, account.ID}] = role
+	}
+
+	m.apiKeys = append(m.apiKeys, cloneAPIKey(key))
+	return nil
+}
+
+// cloneAPIKey copies an API key with its scopes
+func cloneAPIKey(key *APIKey) *APIKey {
+	clone := *key
+	clone.Scopes = append([]string(nil), key.Scopes...)
+	return &clone
+}
+
+// GetAPIKey implements APIKeyRepository
+func (r *memoryAPIKeys) GetAPIKey(ctx context.Context, keyID string) (*APIKey, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range m.apiKeys {
+		if key.ID == keyID {
+			return cloneAPIKey(key), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// ListUserAPIKeys implements APIKeyRepository
+func (r *memoryAPIKeys) ListUserAPIKeys(ctx context.Context, userID string) ([]*APIKey, error) {
+	return r.list(func(key *APIKey) bool { return key.UserID == userID && key.CourtID == "" }), nil
+}
+
+// ListCourtAPIKeys implements APIKeyRepository
+func (r *memoryAPIKeys) ListCourtAPIKeys(ctx context.Context, courtID string) ([]*APIKey, error) {
+	return r.list(func(key *APIKey) bool { return key.CourtID == courtID }), nil
+}
+
+// list returns the keys matching, newest first
+func (r *memoryAPIKeys) list(match func(*APIKey) bool) []*APIKey {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []*APIKey
+	for i := len(m.apiKeys) - 1; i >= 0; i-- {
+		if match(m.apiKeys[i]) {
+			keys = append(keys, cloneAPIKey(m.apiKeys[i]))
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys
+}
+
+// RevokeAPIKey implements APIKeyRepository
+func (r *memoryAPIKeys) RevokeAPIKey(ctx context.Context, keyID string, at time.Time) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range m.apiKeys {
+		if key.ID == keyID && key.RevokedAt == nil {
+			key.RevokedAt = &at
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: API key %s", ErrNotFound, keyID)
+}
+
+// MarkAPIKeyUsed implements APIKeyRepository
+func (r *memoryAPIKeys) MarkAPIKeyUsed(ctx context.Context, keyID string, at, since time.Time) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range m.apiKeys {
+		if key.ID == keyID && (key.LastUsedAt == nil || key.LastUsedAt.Before(since)) {
+			key.LastUsedAt = &at
+		}
+	}
+	return nil
+}
+
+type memoryMagicLinks memory
+
+// CreateMagicLink implements MagicLinkRepository
+func (r *memoryMagicLinks) CreateMagicLink(ctx context.Context, tokenHash, email string, at, expiresAt time.Time) error {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.links[tokenHash]; ok {
+		return fmt.Errorf("%w: magic link", ErrConflict)
+	}
+	m.links[tokenHash] = &memoryToken{subject: email, expiresAt: expiresAt}
+	return nil
+}
+
+// ConsumeMagicLink implements MagicLinkRepository
+func (r *memoryMagicLinks) ConsumeMagicLink(ctx context.Context, tokenHash string, at time.Time) (string, error) {
+	m := (*memory)(r)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	link, ok := m.links[tokenHash]
+	if !ok || link.used || !link.expiresAt.After(at) {
+		return "", ErrNotFound
+	}
+	link.used = true
+	return link.subject, nil
+}
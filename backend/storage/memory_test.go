@@ -0,0 +1,15 @@
+// pickle/backend/storage/memory_test.go
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/carlostbanks/pickle/storage"
+	"github.com/carlostbanks/pickle/storage/storagetest"
+)
+
+func TestMemory(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) *storage.Store {
+		return storage.NewMemory()
+	})
+}
@@ -0,0 +1,1951 @@
+// pickle/backend/storage/postgres.go
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/carlostbanks/pickle/notifications"
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/schedule"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// NewPostgres returns the repositories of a Postgres database migrated with
+// the db package
+func NewPostgres(db *sql.DB) *Store {
+	return &Store{
+		Courts:   &postgresCourts{db: db},
+		Bookings: &postgresBookings{db: db},
+		Series:   &postgresSeries{db: db},
+		Waitlist: &postgresWaitlist{db: db},
+		Payments: &postgresPayments{db: db},
+		Users:    &postgresUsers{db: db},
+		Outbox:   &postgresOutbox{db: db},
+
+		Sessions:   &postgresSessions{db: db},
+		APIKeys:    &postgresAPIKeys{db: db},
+		MagicLinks: &postgresMagicLinks{db: db},
+	}
+}
+
+// postgresError maps the errors of constraints to the repository errors
+func postgresError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+	switch pqErr.Code {
+	case "23505": // unique_violation
+		return fmt.Errorf("%w: %s", ErrConflict, pqErr.Constraint)
+	case "23503": // foreign_key_violation
+		return fmt.Errorf("%w: %s", ErrNotFound, pqErr.Detail)
+	case "23P01": // exclusion_violation, of bookings_no_overlap
+		return ErrOverlap
+	}
+	return err
+}
+
+// nullString maps an empty string to SQL NULL, for optional columns
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+// nullTime maps a nil time to SQL NULL, for optional columns
+func nullTime(value *time.Time) sql.NullTime {
+	if value == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: *value, Valid: true}
+}
+
+// timePtr maps SQL NULL to a nil time, for optional columns
+func timePtr(value sql.NullTime) *time.Time {
+	if !value.Valid {
+		return nil
+	}
+	return &value.Time
+}
+
+type postgresCourts struct {
+	db *sql.DB
+}
+
+// CreateCourt implements CourtRepository
+func (r *postgresCourts) CreateCourt(ctx context.Context, court *proto.Court) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO courts (id, name, address, latitude, longitude, number_of_courts, max_players, amenities, image_url, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $10)
+	`, court.Id, court.Name, court.Address, court.Latitude, court.Longitude, court.NumberOfCourts, court.MaxPlayers,
+		pq.Array(court.Amenities), nullString(court.ImageUrl), time.Now())
+	if err != nil {
+		return postgresError(err)
+	}
+
+	for _, unit := range court.Units {
+		_, err := tx.ExecContext(ctx, "INSERT INTO court_units (id, court_id, name, position) VALUES ($1, $2, $3, $4)",
+			unit.Id, court.Id, unit.Name, unit.Position)
+		if err != nil {
+			return postgresError(err)
+		}
+	}
+
+	for _, oh := range court.OpeningHours {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO court_opening_hours (court_id, weekday, open_time, close_time) VALUES ($1, $2, $3, $4)
+		`, court.Id, oh.Weekday, oh.OpenTime, oh.CloseTime)
+		if err != nil {
+			return postgresError(err)
+		}
+	}
+
+	for _, ex := range court.HourExceptions {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO court_hour_exceptions (court_id, date, closed, open_time, close_time, reason)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, court.Id, ex.Date, ex.Closed, nullString(ex.OpenTime), nullString(ex.CloseTime), nullString(ex.Reason))
+		if err != nil {
+			return postgresError(err)
+		}
+	}
+
+	for _, b := range court.Blackouts {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO court_blackouts (id, court_id, court_unit_id, starts_at, ends_at, reason)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, b.Id, court.Id, nullString(b.CourtUnitId), b.StartsAt, b.EndsAt, nullString(b.Reason))
+		if err != nil {
+			return postgresError(err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetCourt implements CourtRepository
+func (r *postgresCourts) GetCourt(ctx context.Context, courtID string) (*proto.Court, error) {
+	var court proto.Court
+	var amenitiesArray []string
+
+	err := r.db.QueryRowContext(ctx, `
+		SELECT id, name, address, latitude, longitude, number_of_courts, max_players, amenities, COALESCE(image_url, ''),
+			   COALESCE(to_char(archived_at, 'YYYY-MM-DD"T"HH24:MI:SS'), '')
+		FROM courts
+		WHERE id = $1
+	`, courtID).Scan(
+		&court.Id,
+		&court.Name,
+		&court.Address,
+		&court.Latitude,
+		&court.Longitude,
+		&court.NumberOfCourts,
+		&court.MaxPlayers,
+		pq.Array(&amenitiesArray),
+		&court.ImageUrl,
+		&court.ArchivedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	court.Amenities = amenitiesArray
+	return &court, nil
+}
+
+// ListCourts implements CourtRepository
+func (r *postgresCourts) ListCourts(ctx context.Context, filter CourtFilter) ([]*proto.Court, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, name, address, latitude, longitude, number_of_courts, max_players, amenities, COALESCE(image_url, '')
+		FROM courts
+		WHERE
+			archived_at IS NULL
+			AND ($1 = '' OR address LIKE '%' || $1 || '%')
+			AND ($2::float8 = 0 OR
+				(
+					earth_distance(
+						ll_to_earth($2, $3),
+						ll_to_earth(latitude, longitude)
+					) <= $4 * 1000
+				)
+			)
+		ORDER BY name, id
+	`, filter.City, filter.Latitude, filter.Longitude, filter.RadiusKm)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var courts []*proto.Court
+	for rows.Next() {
+		var court proto.Court
+		var amenitiesArray []string
+
+		err := rows.Scan(
+			&court.Id,
+			&court.Name,
+			&court.Address,
+			&court.Latitude,
+			&court.Longitude,
+			&court.NumberOfCourts,
+			&court.MaxPlayers,
+			pq.Array(&amenitiesArray),
+			&court.ImageUrl,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		court.Amenities = amenitiesArray
+		courts = append(courts, &court)
+	}
+
+	return courts, rows.Err()
+}
+
+// ListUnits implements CourtRepository
+func (r *postgresCourts) ListUnits(ctx context.Context, courtID string) ([]*proto.CourtUnit, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, court_id, name, position
+		FROM court_units
+		WHERE court_id = $1 AND archived_at IS NULL
+		ORDER BY position
+	`, courtID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var units []*proto.CourtUnit
+	for rows.Next() {
+		var unit proto.CourtUnit
+		if err := rows.Scan(&unit.Id, &unit.CourtId, &unit.Name, &unit.Position); err != nil {
+			return nil, err
+		}
+		units = append(units, &unit)
+	}
+
+	return units, rows.Err()
+}
+
+// LoadCalendar implements CourtRepository
+func (r *postgresCourts) LoadCalendar(ctx context.Context, court *proto.Court, fromDate, toDate string) error {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT weekday, to_char(open_time, 'HH24:MI'), to_char(close_time, 'HH24:MI')
+		FROM court_opening_hours
+		WHERE court_id = $1
+		ORDER BY weekday
+	`, court.Id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var oh proto.OpeningHours
+		if err := rows.Scan(&oh.Weekday, &oh.OpenTime, &oh.CloseTime); err != nil {
+			return err
+		}
+		court.OpeningHours = append(court.OpeningHours, &oh)
+	}
+
+	exceptionsQuery := `
+		SELECT to_char(date, 'YYYY-MM-DD'), closed,
+			COALESCE(to_char(open_time, 'HH24:MI'), ''), COALESCE(to_char(close_time, 'HH24:MI'), ''),
+			COALESCE(reason, '')
+		FROM court_hour_exceptions
+		WHERE court_id = $1 AND date >= $2
+	`
+	blackoutsQuery := `
+		SELECT id, COALESCE(court_unit_id, ''), starts_at, ends_at, COALESCE(reason, '')
+		FROM court_blackouts
+		WHERE court_id = $1 AND ends_at > $2::date
+	`
+	args := []interface{}{court.Id, fromDate}
+	if toDate != "" {
+		exceptionsQuery += " AND date <= $3"
+		blackoutsQuery += " AND starts_at < $3::date + 1"
+		args = append(args, toDate)
+	}
+
+	exceptionRows, err := r.db.QueryContext(ctx, exceptionsQuery+" ORDER BY date", args...)
+	if err != nil {
+		return err
+	}
+	defer exceptionRows.Close()
+
+	for exceptionRows.Next() {
+		var ex proto.HoursException
+		if err := exceptionRows.Scan(&ex.Date, &ex.Closed, &ex.OpenTime, &ex.CloseTime, &ex.Reason); err != nil {
+			return err
+		}
+		court.HourExceptions = append(court.HourExceptions, &ex)
+	}
+
+	blackoutRows, err := r.db.QueryContext(ctx, blackoutsQuery+" ORDER BY starts_at", args...)
+	if err != nil {
+		return err
+	}
+	defer blackoutRows.Close()
+
+	for blackoutRows.Next() {
+		var b proto.Blackout
+		var startsAt, endsAt time.Time
+		if err := blackoutRows.Scan(&b.Id, &b.CourtUnitId, &startsAt, &endsAt, &b.Reason); err != nil {
+			return err
+		}
+		b.StartsAt = startsAt.Format(calendarLayout)
+		b.EndsAt = endsAt.Format(calendarLayout)
+		court.Blackouts = append(court.Blackouts, &b)
+	}
+
+	return blackoutRows.Err()
+}
+
+// UpdateCourt implements CourtRepository
+func (r *postgresCourts) UpdateCourt(ctx context.Context, court *proto.Court, fromDate string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the facility against concurrent updates
+	if err := lockCourt(ctx, tx, court.Id); err != nil {
+		return err
+	}
+
+	positions := make([]int64, len(court.Units))
+	for i, unit := range court.Units {
+		positions[i] = int64(unit.Position)
+	}
+
+	var booked bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1
+			FROM bookings b
+			JOIN court_units u ON u.id = b.court_unit_id
+			WHERE u.court_id = $1 AND u.archived_at IS NULL AND NOT (u.position = ANY($2))
+				AND b.date >= $3 AND b.status IN ('PENDING', 'CONFIRMED')
+		)
+	`, court.Id, pq.Array(positions), fromDate).Scan(&booked)
+	if err != nil {
+		return err
+	}
+	if booked {
+		return ErrBooked
+	}
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `
+		UPDATE courts
+		SET name = $1, address = $2, latitude = $3, longitude = $4, number_of_courts = $5, max_players = $6,
+			amenities = $7, image_url = $8, updated_at = $9
+		WHERE id = $10
+	`, court.Name, court.Address, court.Latitude, court.Longitude, court.NumberOfCourts, court.MaxPlayers,
+		pq.Array(court.Amenities), nullString(court.ImageUrl), now, court.Id)
+	if err != nil {
+		return postgresError(err)
+	}
+
+	for _, unit := range court.Units {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO court_units (id, court_id, name, position) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (court_id, position) DO UPDATE SET archived_at = NULL
+		`, unit.Id, court.Id, unit.Name, unit.Position)
+		if err != nil {
+			return postgresError(err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE court_units
+		SET archived_at = $1
+		WHERE court_id = $2 AND NOT (position = ANY($3)) AND archived_at IS NULL
+	`, now, court.Id, pq.Array(positions))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// lockCourt locks a facility that is not archived for the rest of tx
+func lockCourt(ctx context.Context, tx *sql.Tx, courtID string) error {
+	var archived bool
+	err := tx.QueryRowContext(ctx, "SELECT archived_at IS NOT NULL FROM courts WHERE id = $1 FOR UPDATE", courtID).Scan(&archived)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if archived {
+		return ErrArchived
+	}
+	return nil
+}
+
+// ArchiveCourt implements CourtRepository
+func (r *postgresCourts) ArchiveCourt(ctx context.Context, courtID, fromDate string, at time.Time) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockCourt(ctx, tx, courtID); err != nil {
+		return err
+	}
+
+	var booked bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM bookings
+			WHERE court_id = $1 AND date >= $2 AND status IN ('PENDING', 'CONFIRMED')
+		)
+	`, courtID, fromDate).Scan(&booked)
+	if err != nil {
+		return err
+	}
+	if booked {
+		return ErrBooked
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE courts SET archived_at = $1, updated_at = $1 WHERE id = $2", at, courtID); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE waitlist_entries
+		SET status = 'EXPIRED', updated_at = $1
+		WHERE court_id = $2 AND status = 'WAITING'
+	`, at, courtID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetRates implements CourtRepository
+func (r *postgresCourts) GetRates(ctx context.Context, courtID string) (*proto.CourtRates, error) {
+	var rates proto.CourtRates
+	err := r.db.QueryRowContext(ctx, `
+		SELECT currency, guest_rate_cents, member_rate_cents, min_duration_minutes
+		FROM court_rates
+		WHERE court_id = $1
+	`, courtID).Scan(&rates.Currency, &rates.GuestRateCents, &rates.MemberRateCents, &rates.MinDurationMinutes)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT weekday, to_char(start_time, 'HH24:MI'), to_char(end_time, 'HH24:MI'), guest_rate_cents, member_rate_cents
+		FROM court_peak_rates
+		WHERE court_id = $1
+		ORDER BY weekday, start_time
+	`, courtID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var peak proto.PeakRate
+		if err := rows.Scan(&peak.Weekday, &peak.StartTime, &peak.EndTime, &peak.GuestRateCents, &peak.MemberRateCents); err != nil {
+			return nil, err
+		}
+		rates.PeakRates = append(rates.PeakRates, &peak)
+	}
+
+	return &rates, rows.Err()
+}
+
+// SetRates implements CourtRepository
+func (r *postgresCourts) SetRates(ctx context.Context, courtID string, rates *proto.CourtRates) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM court_peak_rates WHERE court_id = $1", courtID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM court_rates WHERE court_id = $1", courtID); err != nil {
+		return err
+	}
+
+	if rates != nil {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO court_rates (court_id, currency, guest_rate_cents, member_rate_cents, min_duration_minutes)
+			VALUES ($1, $2, $3, $4, $5)
+		`, courtID, rates.Currency, rates.GuestRateCents, rates.MemberRateCents, rates.MinDurationMinutes)
+		if err != nil {
+			return postgresError(err)
+		}
+
+		for _, peak := range rates.PeakRates {
+			_, err := tx.ExecContext(ctx, `
+				INSERT INTO court_peak_rates (court_id, weekday, start_time, end_time, guest_rate_cents, member_rate_cents)
+				VALUES ($1, $2, $3, $4, $5, $6)
+			`, courtID, peak.Weekday, peak.StartTime, peak.EndTime, peak.GuestRateCents, peak.MemberRateCents)
+			if err != nil {
+				return postgresError(err)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetCancellationPolicy implements CourtRepository
+func (r *postgresCourts) GetCancellationPolicy(ctx context.Context, courtID string) (*proto.CancellationPolicy, error) {
+	var policy proto.CancellationPolicy
+	err := r.db.QueryRowContext(ctx, `
+		SELECT free_until_hours, partial_refund_until_hours, partial_refund_percent, no_cancel_hours, no_show_fee_percent
+		FROM court_cancellation_policies
+		WHERE court_id = $1
+	`, courtID).Scan(&policy.FreeUntilHours, &policy.PartialRefundUntilHours, &policy.PartialRefundPercent,
+		&policy.NoCancelHours, &policy.NoShowFeePercent)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// SetCancellationPolicy implements CourtRepository
+func (r *postgresCourts) SetCancellationPolicy(ctx context.Context, courtID string, policy *proto.CancellationPolicy) error {
+	if policy == nil {
+		_, err := r.db.ExecContext(ctx, "DELETE FROM court_cancellation_policies WHERE court_id = $1", courtID)
+		return err
+	}
+
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO court_cancellation_policies (
+			court_id, free_until_hours, partial_refund_until_hours, partial_refund_percent, no_cancel_hours, no_show_fee_percent
+		) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (court_id) DO UPDATE SET
+			free_until_hours = EXCLUDED.free_until_hours,
+			partial_refund_until_hours = EXCLUDED.partial_refund_until_hours,
+			partial_refund_percent = EXCLUDED.partial_refund_percent,
+			no_cancel_hours = EXCLUDED.no_cancel_hours,
+			no_show_fee_percent = EXCLUDED.no_show_fee_percent
+	`, courtID, policy.FreeUntilHours, policy.PartialRefundUntilHours, policy.PartialRefundPercent,
+		policy.NoCancelHours, policy.NoShowFeePercent)
+	return postgresError(err)
+}
+
+// IsMember implements CourtRepository
+func (r *postgresCourts) IsMember(ctx context.Context, courtID, userID string) (bool, error) {
+	var member bool
+	err := r.db.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM court_members WHERE court_id = $1 AND user_id = $2)",
+		courtID, userID).Scan(&member)
+	return member, err
+}
+
+// AddMember implements CourtRepository
+func (r *postgresCourts) AddMember(ctx context.Context, courtID, userID string) error {
+	_, err := r.db.ExecContext(ctx, "INSERT INTO court_members (court_id, user_id) VALUES ($1, $2)", courtID, userID)
+	return postgresError(err)
+}
+
+type postgresBookings struct {
+	db *sql.DB
+}
+
+// bookingColumns are the columns scanned by scanBooking
+const bookingColumns = `
+	id, court_id, COALESCE(court_unit_id, ''), COALESCE(series_id, ''), user_id, to_char(date, 'YYYY-MM-DD'),
+	to_char(start_time, 'HH24:MI'), to_char(end_time, 'HH24:MI'), number_of_players,
+	price_cents, currency, status, COALESCE(to_char(hold_expires_at, 'YYYY-MM-DD"T"HH24:MI:SS'), ''),
+	cancellation_rule, cancellation_fee_cents, COALESCE(to_char(cancelled_at, 'YYYY-MM-DD"T"HH24:MI:SS'), ''),
+	created_at, updated_at
+`
+
+// scanBooking scans a row of bookingColumns
+func scanBooking(row interface{ Scan(...interface{}) error }) (*proto.Booking, error) {
+	var booking proto.Booking
+	var statusName string
+
+	err := row.Scan(
+		&booking.Id,
+		&booking.CourtId,
+		&booking.CourtUnitId,
+		&booking.SeriesId,
+		&booking.UserId,
+		&booking.Date,
+		&booking.StartTime,
+		&booking.EndTime,
+		&booking.NumberOfPlayers,
+		&booking.PriceCents,
+		&booking.Currency,
+		&statusName,
+		&booking.HoldExpiresAt,
+		&booking.CancellationRule,
+		&booking.CancellationFeeCents,
+		&booking.CancelledAt,
+		&booking.CreatedAt,
+		&booking.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	booking.Status = proto.BookingStatus(proto.BookingStatus_value[statusName])
+	return &booking, nil
+}
+
+// InsertBooking implements BookingRepository. The bookings_no_overlap
+// exclusion constraint rejects overlapping bookings, even those of
+// concurrent requests.
+func (r *postgresBookings) InsertBooking(ctx context.Context, booking *proto.Booking, messages ...*notifications.Message) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO bookings (
+			id, court_id, court_unit_id, series_id, user_id, date, start_time, end_time,
+			number_of_players, price_cents, currency, status, hold_expires_at, created_at, updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+	`, booking.Id, booking.CourtId, nullString(booking.CourtUnitId), nullString(booking.SeriesId), booking.UserId,
+		booking.Date, booking.StartTime, booking.EndTime, booking.NumberOfPlayers,
+		booking.PriceCents, booking.Currency, booking.Status.String(), nullString(booking.HoldExpiresAt),
+		booking.CreatedAt, booking.UpdatedAt)
+	if err != nil {
+		return postgresError(err)
+	}
+
+	if err := insertPlayers(ctx, tx, booking.Id, booking.Players); err != nil {
+		return err
+	}
+	if err := enqueuePostgres(ctx, tx, messages); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// insertPlayers inserts the players of a booking in order
+func insertPlayers(ctx context.Context, tx *sql.Tx, bookingID string, players []*proto.BookingPlayer) error {
+	for position, player := range players {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO booking_players (booking_id, email, user_id, position, status, responded_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, bookingID, player.Email, nullString(player.UserId), position+1, player.Status.String(), nullString(player.RespondedAt))
+		if err != nil {
+			return postgresError(err)
+		}
+	}
+	return nil
+}
+
+// GetBooking implements BookingRepository
+func (r *postgresBookings) GetBooking(ctx context.Context, bookingID string) (*proto.Booking, error) {
+	booking, err := scanBooking(r.db.QueryRowContext(ctx, "SELECT "+bookingColumns+" FROM bookings WHERE id = $1", bookingID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.loadPlayers(ctx, []*proto.Booking{booking}); err != nil {
+		return nil, err
+	}
+	return booking, nil
+}
+
+// SetPlayers implements BookingRepository
+func (r *postgresBookings) SetPlayers(ctx context.Context, bookingID string, players []*proto.BookingPlayer, messages ...*notifications.Message) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the booking, so concurrent changes of its players apply in turn
+	var id string
+	err = tx.QueryRowContext(ctx, "SELECT id FROM bookings WHERE id = $1 FOR UPDATE", bookingID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM booking_players WHERE booking_id = $1", bookingID); err != nil {
+		return err
+	}
+	if err := insertPlayers(ctx, tx, bookingID, players); err != nil {
+		return err
+	}
+	if err := enqueuePostgres(ctx, tx, messages); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdatePlayer implements BookingRepository
+func (r *postgresBookings) UpdatePlayer(ctx context.Context, bookingID string, player *proto.BookingPlayer) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE booking_players
+		SET user_id = $1, status = $2, responded_at = $3
+		WHERE booking_id = $4 AND email = $5
+	`, nullString(player.UserId), player.Status.String(), nullString(player.RespondedAt), bookingID, player.Email)
+	if err != nil {
+		return postgresError(err)
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return fmt.Errorf("%w: player %s", ErrNotFound, player.Email)
+	}
+	return nil
+}
+
+// playsIn is the condition that the user in parameter n is a player of a
+// booking
+func playsIn(n int) string {
+	return fmt.Sprintf("id IN (SELECT booking_id FROM booking_players WHERE user_id = $%d)", n)
+}
+
+// loadPlayers loads the players of bookings
+func (r *postgresBookings) loadPlayers(ctx context.Context, bookings []*proto.Booking) error {
+	if len(bookings) == 0 {
+		return nil
+	}
+
+	byID := make(map[string]*proto.Booking, len(bookings))
+	var ids []string
+	for _, booking := range bookings {
+		byID[booking.Id] = booking
+		ids = append(ids, booking.Id)
+	}
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT booking_id, email, COALESCE(user_id, ''), status,
+			   COALESCE(to_char(responded_at, 'YYYY-MM-DD"T"HH24:MI:SS'), '')
+		FROM booking_players
+		WHERE booking_id = ANY($1)
+		ORDER BY booking_id, position
+	`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bookingID, statusName string
+		var player proto.BookingPlayer
+		if err := rows.Scan(&bookingID, &player.Email, &player.UserId, &statusName, &player.RespondedAt); err != nil {
+			return err
+		}
+		player.Status = proto.PlayerStatus(proto.PlayerStatus_value[statusName])
+		booking := byID[bookingID]
+		booking.Players = append(booking.Players, &player)
+		booking.PlayerEmails = append(booking.PlayerEmails, player.Email)
+	}
+
+	return rows.Err()
+}
+
+// ListBookings implements BookingRepository
+func (r *postgresBookings) ListBookings(ctx context.Context, filter BookingFilter) ([]*proto.Booking, error) {
+	// Build query based on filters
+	query := "SELECT " + bookingColumns + " FROM bookings WHERE 1=1"
+	var args []interface{}
+	var argCount int = 1
+
+	if filter.UserID != "" {
+		query += fmt.Sprintf(" AND (user_id = $%d OR %s)", argCount, playsIn(argCount))
+		args = append(args, filter.UserID)
+		argCount++
+	}
+
+	if filter.CourtID != "" {
+		query += fmt.Sprintf(" AND court_id = $%d", argCount)
+		args = append(args, filter.CourtID)
+		argCount++
+	}
+
+	if filter.Date != "" {
+		query += fmt.Sprintf(" AND date = $%d", argCount)
+		args = append(args, filter.Date)
+		argCount++
+	}
+
+	if filter.SeriesID != "" {
+		query += fmt.Sprintf(" AND series_id = $%d", argCount)
+		args = append(args, filter.SeriesID)
+		argCount++
+	}
+
+	if filter.Visible != nil {
+		query += fmt.Sprintf(" AND (user_id = $%d OR %s OR court_id = ANY($%d))", argCount, playsIn(argCount), argCount+1)
+		args = append(args, filter.Visible.UserID, pq.Array(filter.Visible.CourtIDs))
+	}
+
+	query += " ORDER BY date, start_time, id"
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bookings []*proto.Booking
+	for rows.Next() {
+		booking, err := scanBooking(rows)
+		if err != nil {
+			return nil, err
+		}
+		bookings = append(bookings, booking)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := r.loadPlayers(ctx, bookings); err != nil {
+		return nil, err
+	}
+	return bookings, nil
+}
+
+// Booked implements BookingRepository
+func (r *postgresBookings) Booked(ctx context.Context, courtID, fromDate, toDate, excludeID string) (map[string][]schedule.Booked, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT COALESCE(court_unit_id, ''), to_char(date, 'YYYY-MM-DD'),
+			to_char(start_time, 'HH24:MI'), to_char(end_time, 'HH24:MI')
+		FROM bookings
+		WHERE court_id = $1
+		AND date BETWEEN $2 AND $3
+		AND id != $4
+		AND status != 'CANCELLED'
+	`, courtID, fromDate, toDate, excludeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	booked := make(map[string][]schedule.Booked)
+	for rows.Next() {
+		var unitID, date, startTime, endTime string
+		if err := rows.Scan(&unitID, &date, &startTime, &endTime); err != nil {
+			return nil, err
+		}
+
+		window, err := schedule.ParseWindow(startTime, endTime)
+		if err != nil {
+			return nil, err
+		}
+		booked[date] = append(booked[date], schedule.Booked{UnitID: unitID, Window: window})
+	}
+
+	return booked, rows.Err()
+}
+
+// UpdateBookings implements BookingRepository
+func (r *postgresBookings) UpdateBookings(ctx context.Context, bookings []*proto.Booking, messages ...*notifications.Message) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, booking := range bookings {
+		result, err := tx.ExecContext(ctx, `
+			UPDATE bookings
+			SET court_unit_id = $1, start_time = $2, end_time = $3, number_of_players = $4,
+				price_cents = $5, currency = $6, updated_at = $7
+			WHERE id = $8
+		`, nullString(booking.CourtUnitId), booking.StartTime, booking.EndTime, booking.NumberOfPlayers,
+			booking.PriceCents, booking.Currency, booking.UpdatedAt, booking.Id)
+		if err != nil {
+			return postgresError(err)
+		}
+		if err := checkUpdated(result, fmt.Errorf("%w: booking %s", ErrNotFound, booking.Id)); err != nil {
+			return err
+		}
+	}
+	if err := enqueuePostgres(ctx, tx, messages); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// checkUpdated returns missing if a statement changed no row
+func checkUpdated(result sql.Result, missing error) error {
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return missing
+	}
+	return nil
+}
+
+// ConfirmBooking implements BookingRepository
+func (r *postgresBookings) ConfirmBooking(ctx context.Context, bookingID string, at time.Time, messages ...*notifications.Message) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE bookings
+		SET status = 'CONFIRMED', hold_expires_at = NULL, updated_at = $1
+		WHERE id = $2 AND status = 'PENDING' AND (hold_expires_at IS NULL OR hold_expires_at > $1)
+	`, at, bookingID)
+	if err != nil {
+		return err
+	}
+	if err := checkUpdated(result, ErrStale); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE waitlist_entries
+		SET status = 'CLAIMED', updated_at = $1
+		WHERE booking_id = $2 AND status = 'OFFERED'
+	`, at, bookingID)
+	if err != nil {
+		return err
+	}
+	if err := enqueuePostgres(ctx, tx, messages); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CancelBookings implements BookingRepository
+func (r *postgresBookings) CancelBookings(ctx context.Context, cancellations []*proto.Cancellation, at time.Time, messages ...*notifications.Message) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var ids []string
+	for _, c := range cancellations {
+		result, err := tx.ExecContext(ctx, `
+			UPDATE bookings
+			SET status = 'CANCELLED', cancellation_rule = $1, cancellation_fee_cents = $2, cancelled_at = $3, updated_at = $3
+			WHERE id = $4
+		`, c.Rule, c.FeeCents, at, c.BookingId)
+		if err != nil {
+			return err
+		}
+		if err := checkUpdated(result, fmt.Errorf("%w: booking %s", ErrNotFound, c.BookingId)); err != nil {
+			return err
+		}
+		ids = append(ids, c.BookingId)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE waitlist_entries
+		SET status = 'LEFT', updated_at = $1
+		WHERE booking_id = ANY($2) AND status = 'OFFERED'
+	`, at, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	if err := enqueuePostgres(ctx, tx, messages); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MarkNoShow implements BookingRepository
+func (r *postgresBookings) MarkNoShow(ctx context.Context, bookingID, rule string, feeCents int64, at time.Time) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE bookings
+		SET status = 'NO_SHOW', cancellation_rule = $1, cancellation_fee_cents = $2, cancelled_at = $3, updated_at = $3
+		WHERE id = $4 AND status = 'CONFIRMED'
+	`, rule, feeCents, at, bookingID)
+	if err != nil {
+		return err
+	}
+	return checkUpdated(result, ErrStale)
+}
+
+// ExpireHolds implements BookingRepository
+func (r *postgresBookings) ExpireHolds(ctx context.Context, at time.Time) ([]*proto.Booking, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		UPDATE bookings
+		SET status = 'CANCELLED', updated_at = $1
+		WHERE status = 'PENDING' AND hold_expires_at <= $1
+		RETURNING `+bookingColumns, at)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var expired []*proto.Booking
+	for rows.Next() {
+		booking, err := scanBooking(rows)
+		if err != nil {
+			return nil, err
+		}
+		expired = append(expired, booking)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := r.loadPlayers(ctx, expired); err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
+
+type postgresUsers struct {
+	db *sql.DB
+}
+
+// CreateUser implements UserRepository
+func (r *postgresUsers) CreateUser(ctx context.Context, user *User) error {
+	return insertPostgresUser(ctx, r.db, user)
+}
+
+// insertPostgresUser creates a user, within a transaction or not
+func insertPostgresUser(ctx context.Context, db execer, user *User) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO users (id, email, name, picture, platform_admin, service_account, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, user.ID, user.Email, user.Name, nullString(user.Picture), user.PlatformAdmin, user.ServiceAccount, user.CreatedAt)
+	return postgresError(err)
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// GetUser implements UserRepository
+func (r *postgresUsers) GetUser(ctx context.Context, userID string) (*User, error) {
+	return r.getUser(ctx, "id", userID)
+}
+
+// GetUserByEmail implements UserRepository
+func (r *postgresUsers) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	return r.getUser(ctx, "LOWER(email)", strings.ToLower(email))
+}
+
+// UpdateProfile implements UserRepository
+func (r *postgresUsers) UpdateProfile(ctx context.Context, userID, name, picture string) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE users
+		SET name = COALESCE(NULLIF($1, ''), name), picture = COALESCE(NULLIF($2, ''), picture)
+		WHERE id = $3
+	`, name, picture, userID)
+	if err != nil {
+		return err
+	}
+	return checkUpdated(result, fmt.Errorf("%w: user %s", ErrNotFound, userID))
+}
+
+// GetIdentity implements UserRepository
+func (r *postgresUsers) GetIdentity(ctx context.Context, provider, subject string) (*Identity, error) {
+	identity := Identity{Provider: provider, Subject: subject}
+	err := r.db.QueryRowContext(ctx, `
+		SELECT user_id, created_at FROM user_identities WHERE provider = $1 AND subject = $2
+	`, provider, subject).Scan(&identity.UserID, &identity.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+// LinkIdentity implements UserRepository
+func (r *postgresUsers) LinkIdentity(ctx context.Context, identity *Identity) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO user_identities (provider, subject, user_id, created_at) VALUES ($1, $2, $3, $4)
+	`, identity.Provider, identity.Subject, identity.UserID, identity.CreatedAt)
+	return postgresError(err)
+}
+
+// GrantRole implements UserRepository
+func (r *postgresUsers) GrantRole(ctx context.Context, courtID, userID, role string) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO court_staff (court_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (court_id, user_id) DO UPDATE SET role = EXCLUDED.role
+	`, courtID, userID, role)
+	return postgresError(err)
+}
+
+// ListRoles implements UserRepository
+func (r *postgresUsers) ListRoles(ctx context.Context, userID string) ([]StaffRole, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT court_id, role FROM court_staff WHERE user_id = $1 ORDER BY court_id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []StaffRole
+	for rows.Next() {
+		var role StaffRole
+		if err := rows.Scan(&role.CourtID, &role.Role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// getUser returns the user whose column has a value
+func (r *postgresUsers) getUser(ctx context.Context, column, value string) (*User, error) {
+	var user User
+	var picture sql.NullString
+	err := r.db.QueryRowContext(ctx, `
+		SELECT id, email, name, picture, platform_admin, service_account, created_at FROM users WHERE `+column+` = $1
+	`, value).Scan(&user.ID, &user.Email, &user.Name, &picture, &user.PlatformAdmin, &user.ServiceAccount, &user.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	user.Picture = picture.String
+	return &user, nil
+}
+
+type postgresSeries struct {
+	db *sql.DB
+}
+
+// InsertSeries implements SeriesRepository
+func (r *postgresSeries) InsertSeries(ctx context.Context, series *proto.BookingSeries) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO booking_series (
+			id, court_id, court_unit_id, user_id, rrule, start_date, start_time, end_time,
+			number_of_players, player_emails, status, created_at, updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+	`, series.Id, series.CourtId, nullString(series.CourtUnitId), series.UserId, series.Rrule,
+		series.StartDate, series.StartTime, series.EndTime,
+		series.NumberOfPlayers, pq.Array(series.PlayerEmails), series.Status, series.CreatedAt, series.UpdatedAt)
+	return postgresError(err)
+}
+
+// GetSeries implements SeriesRepository
+func (r *postgresSeries) GetSeries(ctx context.Context, seriesID string) (*proto.BookingSeries, error) {
+	var series proto.BookingSeries
+	err := r.db.QueryRowContext(ctx, `
+		SELECT id, court_id, COALESCE(court_unit_id, ''), user_id, rrule, to_char(start_date, 'YYYY-MM-DD'),
+			   to_char(start_time, 'HH24:MI'), to_char(end_time, 'HH24:MI'), number_of_players, player_emails,
+			   status, created_at, updated_at
+		FROM booking_series
+		WHERE id = $1
+	`, seriesID).Scan(
+		&series.Id,
+		&series.CourtId,
+		&series.CourtUnitId,
+		&series.UserId,
+		&series.Rrule,
+		&series.StartDate,
+		&series.StartTime,
+		&series.EndTime,
+		&series.NumberOfPlayers,
+		pq.Array(&series.PlayerEmails),
+		&series.Status,
+		&series.CreatedAt,
+		&series.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &series, nil
+}
+
+// DeleteSeries implements SeriesRepository
+func (r *postgresSeries) DeleteSeries(ctx context.Context, seriesID string) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM booking_series WHERE id = $1", seriesID)
+	return postgresError(err)
+}
+
+// CancelSeries implements SeriesRepository
+func (r *postgresSeries) CancelSeries(ctx context.Context, seriesID string, at time.Time) error {
+	result, err := r.db.ExecContext(ctx,
+		"UPDATE booking_series SET status = 'CANCELLED', updated_at = $1 WHERE id = $2", at, seriesID)
+	if err != nil {
+		return err
+	}
+	return checkUpdated(result, ErrNotFound)
+}
+
+type postgresWaitlist struct {
+	db *sql.DB
+}
+
+// waitlistColumns are the columns scanned by scanEntry
+const waitlistColumns = `
+	id, court_id, COALESCE(court_unit_id, ''), user_id, to_char(date, 'YYYY-MM-DD'),
+	to_char(start_time, 'HH24:MI'), to_char(end_time, 'HH24:MI'), number_of_players, player_emails,
+	status, COALESCE(booking_id, ''), COALESCE(to_char(offer_expires_at, 'YYYY-MM-DD"T"HH24:MI:SS'), ''),
+	created_at
+`
+
+// scanEntry scans a row of waitlistColumns
+func scanEntry(row interface{ Scan(...interface{}) error }) (*proto.WaitlistEntry, error) {
+	var entry proto.WaitlistEntry
+	var statusName string
+
+	err := row.Scan(
+		&entry.Id,
+		&entry.CourtId,
+		&entry.CourtUnitId,
+		&entry.UserId,
+		&entry.Date,
+		&entry.StartTime,
+		&entry.EndTime,
+		&entry.NumberOfPlayers,
+		pq.Array(&entry.PlayerEmails),
+		&statusName,
+		&entry.BookingId,
+		&entry.OfferExpiresAt,
+		&entry.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.Status = proto.WaitlistStatus(proto.WaitlistStatus_value[statusName])
+	return &entry, nil
+}
+
+// InsertEntry implements WaitlistRepository
+func (r *postgresWaitlist) InsertEntry(ctx context.Context, entry *proto.WaitlistEntry) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the user, so concurrent requests for one slot are checked in turn
+	var id string
+	err = tx.QueryRowContext(ctx, "SELECT id FROM users WHERE id = $1 FOR UPDATE", entry.UserId).Scan(&id)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: user %s", ErrNotFound, entry.UserId)
+	}
+	if err != nil {
+		return err
+	}
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM waitlist_entries
+			WHERE user_id = $1 AND court_id = $2 AND date = $3 AND start_time = $4 AND end_time = $5
+			AND status IN ('WAITING', 'OFFERED')
+		)
+	`, entry.UserId, entry.CourtId, entry.Date, entry.StartTime, entry.EndTime).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("%w: waitlist entry for the slot", ErrConflict)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO waitlist_entries (
+			id, court_id, court_unit_id, user_id, date, start_time, end_time,
+			number_of_players, player_emails, status, created_at, updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	`, entry.Id, entry.CourtId, nullString(entry.CourtUnitId), entry.UserId, entry.Date, entry.StartTime, entry.EndTime,
+		entry.NumberOfPlayers, pq.Array(entry.PlayerEmails), entry.Status.String(), entry.CreatedAt, entry.CreatedAt)
+	if err != nil {
+		return postgresError(err)
+	}
+
+	return tx.Commit()
+}
+
+// GetEntry implements WaitlistRepository
+func (r *postgresWaitlist) GetEntry(ctx context.Context, entryID string) (*proto.WaitlistEntry, error) {
+	entry, err := scanEntry(r.db.QueryRowContext(ctx, "SELECT "+waitlistColumns+" FROM waitlist_entries WHERE id = $1", entryID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return entry, err
+}
+
+// ListEntries implements WaitlistRepository
+func (r *postgresWaitlist) ListEntries(ctx context.Context, filter WaitlistFilter) ([]*proto.WaitlistEntry, error) {
+	query := "SELECT " + waitlistColumns + " FROM waitlist_entries WHERE 1=1"
+	var args []interface{}
+
+	if filter.UserID != "" {
+		args = append(args, filter.UserID)
+		query += fmt.Sprintf(" AND user_id = $%d", len(args))
+	}
+	if filter.CourtID != "" {
+		args = append(args, filter.CourtID)
+		query += fmt.Sprintf(" AND court_id = $%d", len(args))
+	}
+	if filter.Date != "" {
+		args = append(args, filter.Date)
+		query += fmt.Sprintf(" AND date = $%d", len(args))
+	}
+	if len(filter.Statuses) > 0 {
+		var names []string
+		for _, status := range filter.Statuses {
+			names = append(names, status.String())
+		}
+		args = append(args, pq.Array(names))
+		query += fmt.Sprintf(" AND status = ANY($%d)", len(args))
+	}
+
+	query += " ORDER BY created_at, id"
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*proto.WaitlistEntry
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// OfferEntry implements WaitlistRepository
+func (r *postgresWaitlist) OfferEntry(ctx context.Context, entryID string, expiresAt, at time.Time) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE waitlist_entries
+		SET status = 'OFFERED', offer_expires_at = $1, updated_at = $2
+		WHERE id = $3 AND status = 'WAITING'
+	`, expiresAt, at, entryID)
+	if err != nil {
+		return err
+	}
+	return checkUpdated(result, ErrStale)
+}
+
+// AttachBooking implements WaitlistRepository
+func (r *postgresWaitlist) AttachBooking(ctx context.Context, entryID, bookingID string) error {
+	result, err := r.db.ExecContext(ctx, "UPDATE waitlist_entries SET booking_id = $1 WHERE id = $2", bookingID, entryID)
+	if err != nil {
+		return postgresError(err)
+	}
+	return checkUpdated(result, ErrNotFound)
+}
+
+// ReturnEntry implements WaitlistRepository
+func (r *postgresWaitlist) ReturnEntry(ctx context.Context, entryID string) error {
+	result, err := r.db.ExecContext(ctx,
+		"UPDATE waitlist_entries SET status = 'WAITING', offer_expires_at = NULL WHERE id = $1", entryID)
+	if err != nil {
+		return err
+	}
+	return checkUpdated(result, ErrNotFound)
+}
+
+// LeaveEntry implements WaitlistRepository
+func (r *postgresWaitlist) LeaveEntry(ctx context.Context, entryID string, from proto.WaitlistStatus, at time.Time) error {
+	return r.endEntry(ctx, entryID, from, proto.WaitlistStatus_LEFT, at)
+}
+
+// ExpireOffer implements WaitlistRepository
+func (r *postgresWaitlist) ExpireOffer(ctx context.Context, entryID string, at time.Time) error {
+	return r.endEntry(ctx, entryID, proto.WaitlistStatus_OFFERED, proto.WaitlistStatus_EXPIRED, at)
+}
+
+// endEntry moves a waitlist entry from one status to a final one and
+// cancels the pending booking of its offer
+func (r *postgresWaitlist) endEntry(ctx context.Context, entryID string, from, to proto.WaitlistStatus, at time.Time) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var bookingID string
+	err = tx.QueryRowContext(ctx, `
+		UPDATE waitlist_entries
+		SET status = $1, updated_at = $2
+		WHERE id = $3 AND status = $4
+		RETURNING COALESCE(booking_id, '')
+	`, to.String(), at, entryID, from.String()).Scan(&bookingID)
+	if err == sql.ErrNoRows {
+		return ErrStale
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE bookings
+		SET status = 'CANCELLED', updated_at = $1
+		WHERE id = $2 AND status = 'PENDING'
+	`, at, bookingID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type postgresPayments struct {
+	db *sql.DB
+}
+
+// paymentColumns are the columns scanned by scanPayment
+const paymentColumns = `
+	id, booking_id, provider, provider_intent_id, amount_cents, refunded_cents, currency, status, created_at, updated_at
+`
+
+// scanPayment scans a row of paymentColumns
+func scanPayment(row interface{ Scan(...interface{}) error }) (*Payment, error) {
+	var payment Payment
+	err := row.Scan(
+		&payment.ID,
+		&payment.BookingID,
+		&payment.Provider,
+		&payment.IntentID,
+		&payment.AmountCents,
+		&payment.RefundedCents,
+		&payment.Currency,
+		&payment.Status,
+		&payment.CreatedAt,
+		&payment.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+// InsertPayment implements PaymentRepository. The payments_active_booking_idx
+// index rejects a second active payment, even of concurrent requests.
+func (r *postgresPayments) InsertPayment(ctx context.Context, payment *Payment) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO payments (
+			id, booking_id, provider, provider_intent_id, amount_cents, refunded_cents, currency, status, created_at, updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, payment.ID, payment.BookingID, payment.Provider, payment.IntentID, payment.AmountCents, payment.RefundedCents,
+		payment.Currency, payment.Status, payment.CreatedAt, payment.UpdatedAt)
+	return postgresError(err)
+}
+
+// LatestPayment implements PaymentRepository
+func (r *postgresPayments) LatestPayment(ctx context.Context, bookingID string) (*Payment, error) {
+	payment, err := scanPayment(r.db.QueryRowContext(ctx, `
+		SELECT `+paymentColumns+`
+		FROM payments
+		WHERE booking_id = $1
+		ORDER BY created_at DESC
+		LIMIT 1
+	`, bookingID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return payment, err
+}
+
+// ActivePayments implements PaymentRepository
+func (r *postgresPayments) ActivePayments(ctx context.Context, bookingIDs []string) ([]*Payment, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT `+paymentColumns+`
+		FROM payments
+		WHERE booking_id = ANY($1) AND status = ANY($2)
+		ORDER BY created_at, id
+	`, pq.Array(bookingIDs), pq.Array(activePaymentStatuses))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var active []*Payment
+	for rows.Next() {
+		payment, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		active = append(active, payment)
+	}
+
+	return active, rows.Err()
+}
+
+// UpdatePayment implements PaymentRepository
+func (r *postgresPayments) UpdatePayment(ctx context.Context, payment *Payment) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE payments
+		SET status = $1, refunded_cents = $2, updated_at = $3
+		WHERE id = $4
+	`, payment.Status, payment.RefundedCents, payment.UpdatedAt, payment.ID)
+	if err != nil {
+		return postgresError(err)
+	}
+	return checkUpdated(result, ErrNotFound)
+}
+
+// UpdateIntentStatus implements PaymentRepository
+func (r *postgresPayments) UpdateIntentStatus(ctx context.Context, provider, intentID, from, to string, at time.Time) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE payments
+		SET status = $1, updated_at = $2
+		WHERE provider = $3 AND provider_intent_id = $4 AND status = $5
+	`, to, at, provider, intentID, from)
+	if err != nil {
+		return postgresError(err)
+	}
+	return checkUpdated(result, ErrStale)
+}
+
+type postgresOutbox struct {
+	db *sql.DB
+}
+
+// Enqueue implements OutboxRepository
+func (r *postgresOutbox) Enqueue(ctx context.Context, messages ...*notifications.Message) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := enqueuePostgres(ctx, tx, messages); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// enqueuePostgres queues messages in the outbox within a transaction
+func enqueuePostgres(ctx context.Context, tx *sql.Tx, messages []*notifications.Message) error {
+	now := time.Now()
+	for _, msg := range messages {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO notification_outbox (id, kind, recipient, subject, body, dedup_key, next_attempt_at, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $7)
+			ON CONFLICT (dedup_key) DO NOTHING
+		`, uuid.New().String(), msg.Kind, msg.To, msg.Subject, msg.Body, nullString(msg.Key), now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClaimMessages implements OutboxRepository. Concurrent claims skip the
+// messages the other is claiming.
+func (r *postgresOutbox) ClaimMessages(ctx context.Context, at time.Time, lease time.Duration, limit int) ([]*notifications.Queued, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		UPDATE notification_outbox
+		SET attempts = attempts + 1, next_attempt_at = $2
+		WHERE id IN (
+			SELECT id FROM notification_outbox
+			WHERE status = 'PENDING' AND next_attempt_at <= $1
+			ORDER BY next_attempt_at
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, kind, recipient, subject, body, COALESCE(dedup_key, ''), attempts
+	`, at, at.Add(lease), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var claimed []*notifications.Queued
+	for rows.Next() {
+		var q notifications.Queued
+		if err := rows.Scan(&q.ID, &q.Kind, &q.To, &q.Subject, &q.Body, &q.Key, &q.Attempt); err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, &q)
+	}
+	return claimed, rows.Err()
+}
+
+// MarkSent implements OutboxRepository
+func (r *postgresOutbox) MarkSent(ctx context.Context, id string, at time.Time) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE notification_outbox
+		SET status = 'SENT', last_error = NULL, sent_at = $1
+		WHERE id = $2 AND status = 'PENDING'
+	`, at, id)
+	return err
+}
+
+// MarkFailed implements OutboxRepository
+func (r *postgresOutbox) MarkFailed(ctx context.Context, id string, attempt int, lastError string, retryAt time.Time) error {
+	status := "PENDING"
+	if retryAt.IsZero() {
+		status = "FAILED"
+	}
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE notification_outbox
+		SET status = $1, last_error = $2, next_attempt_at = COALESCE($3, next_attempt_at)
+		WHERE id = $4 AND attempts = $5 AND status = 'PENDING'
+	`, status, lastError, sql.NullTime{Time: retryAt, Valid: !retryAt.IsZero()}, id, attempt)
+	return err
+}
+
+type postgresSessions struct {
+	db *sql.DB
+}
+
+// CreateSession implements SessionRepository
+func (r *postgresSessions) CreateSession(ctx context.Context, session *Session, tokenHash string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO sessions (id, user_id, user_agent, created_at, last_used_at, expires_at)
+		VALUES ($1, $2, $3, $4, $4, $5)
+	`, session.ID, session.UserID, session.UserAgent, session.CreatedAt, session.ExpiresAt)
+	if err != nil {
+		return postgresError(err)
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (token_hash, session_id, created_at) VALUES ($1, $2, $3)
+	`, tokenHash, session.ID, session.CreatedAt)
+	if err != nil {
+		return postgresError(err)
+	}
+
+	return tx.Commit()
+}
+
+// sessionColumns are the columns of sessions s scanned by scanSession
+const sessionColumns = "s.id, s.user_id, s.user_agent, s.created_at, s.expires_at"
+
+// scanSession scans the sessionColumns of a row, followed by dest
+func scanSession(row interface{ Scan(...interface{}) error }, dest ...interface{}) (*Session, error) {
+	var session Session
+	err := row.Scan(append([]interface{}{&session.ID, &session.UserID, &session.UserAgent, &session.CreatedAt, &session.ExpiresAt}, dest...)...)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// RotateRefreshToken implements SessionRepository
+func (r *postgresSessions) RotateRefreshToken(ctx context.Context, tokenHash, nextHash string, at time.Time) (*Session, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var usedAt, revokedAt sql.NullTime
+	session, err := scanSession(tx.QueryRowContext(ctx, `
+		SELECT `+sessionColumns+`, s.revoked_at, t.used_at
+		FROM refresh_tokens t
+		JOIN sessions s ON s.id = t.session_id
+		WHERE t.token_hash = $1
+		FOR UPDATE
+	`, tokenHash), &revokedAt, &usedAt)
+	if err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid || !session.ExpiresAt.After(at) {
+		return nil, ErrNotFound
+	}
+
+	if usedAt.Valid {
+		if err := revokePostgresSessions(ctx, tx, "id", session.ID, RevokedReuse, at); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrReused
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET used_at = $1 WHERE token_hash = $2", at, tokenHash); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE sessions SET last_used_at = $1 WHERE id = $2", at, session.ID); err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (token_hash, session_id, created_at) VALUES ($1, $2, $3)
+	`, nextHash, session.ID, at)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+
+	return session, tx.Commit()
+}
+
+// CreateLoginCode implements SessionRepository
+func (r *postgresSessions) CreateLoginCode(ctx context.Context, codeHash, sessionID string, at, expiresAt time.Time) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO login_codes (code_hash, session_id, created_at, expires_at) VALUES ($1, $2, $3, $4)
+	`, codeHash, sessionID, at, expiresAt)
+	return postgresError(err)
+}
+
+// RedeemLoginCode implements SessionRepository
+func (r *postgresSessions) RedeemLoginCode(ctx context.Context, codeHash string, at time.Time) (*Session, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var codeExpiresAt time.Time
+	var usedAt, revokedAt sql.NullTime
+	session, err := scanSession(tx.QueryRowContext(ctx, `
+		SELECT `+sessionColumns+`, s.revoked_at, c.expires_at, c.used_at
+		FROM login_codes c
+		JOIN sessions s ON s.id = c.session_id
+		WHERE c.code_hash = $1
+		FOR UPDATE
+	`, codeHash), &revokedAt, &codeExpiresAt, &usedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if usedAt.Valid {
+		if err := revokePostgresSessions(ctx, tx, "id", session.ID, RevokedReuse, at); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrReused
+	}
+	if revokedAt.Valid || !codeExpiresAt.After(at) || !session.ExpiresAt.After(at) {
+		return nil, ErrNotFound
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE login_codes SET used_at = $1 WHERE code_hash = $2", at, codeHash); err != nil {
+		return nil, err
+	}
+
+	return session, tx.Commit()
+}
+
+// GetSessionByRefreshToken implements SessionRepository
+func (r *postgresSessions) GetSessionByRefreshToken(ctx context.Context, tokenHash string) (*Session, error) {
+	return scanSession(r.db.QueryRowContext(ctx, `
+		SELECT `+sessionColumns+`
+		FROM refresh_tokens t
+		JOIN sessions s ON s.id = t.session_id
+		WHERE t.token_hash = $1
+	`, tokenHash))
+}
+
+// RevokeSession implements SessionRepository
+func (r *postgresSessions) RevokeSession(ctx context.Context, sessionID, reason string, at time.Time) error {
+	return revokePostgresSessions(ctx, r.db, "id", sessionID, reason, at)
+}
+
+// RevokeUserSessions implements SessionRepository
+func (r *postgresSessions) RevokeUserSessions(ctx context.Context, userID, reason string, at time.Time) error {
+	return revokePostgresSessions(ctx, r.db, "user_id", userID, reason, at)
+}
+
+// revokePostgresSessions revokes the sessions not revoked yet whose column
+// has a value
+func revokePostgresSessions(ctx context.Context, db execer, column, value, reason string, at time.Time) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE sessions
+		SET revoked_at = $1, revoked_reason = $2
+		WHERE revoked_at IS NULL AND `+column+` = $3
+	`, at, reason, value)
+	return err
+}
+
+// SessionLive implements SessionRepository
+func (r *postgresSessions) SessionLive(ctx context.Context, sessionID string, at time.Time) (bool, error) {
+	var live bool
+	err := r.db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM sessions WHERE id = $1 AND revoked_at IS NULL AND expires_at > $2)
+	`, sessionID, at).Scan(&live)
+	return live, err
+}
+
+type postgresAPIKeys struct {
+	db *sql.DB
+}
+
+// CreateAPIKey implements APIKeyRepository
+func (r *postgresAPIKeys) CreateAPIKey(ctx context.Context, key *APIKey, account *User, role string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if account != nil {
+		if err := insertPostgresUser(ctx, tx, account); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "INSERT INTO court_staff (court_id, user_id, role) VALUES ($1, $2, $3)",
+			key.CourtID, account.ID, role)
+		if err != nil {
+			return postgresError(err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO api_keys (id, user_id, court_id, name, secret_hash, scopes, rate_limit, created_by, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, key.ID, key.UserID, nullString(key.CourtID), key.Name, key.SecretHash, pq.Array(key.Scopes),
+		key.RateLimit, key.CreatedBy, key.CreatedAt, nullTime(key.ExpiresAt))
+	if err != nil {
+		return postgresError(err)
+	}
+
+	return tx.Commit()
+}
+
+// apiKeyColumns are the columns of api_keys scanned by scanPostgresAPIKey
+const apiKeyColumns = `
+	id, user_id, court_id, name, secret_hash, scopes, rate_limit, created_by, created_at,
+	last_used_at, expires_at, revoked_at`
+
+// scanPostgresAPIKey scans the apiKeyColumns of a row
+func scanPostgresAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	var key APIKey
+	var courtID sql.NullString
+	var lastUsedAt, expiresAt, revokedAt sql.NullTime
+	err := row.Scan(&key.ID, &key.UserID, &courtID, &key.Name, &key.SecretHash, pq.Array(&key.Scopes), &key.RateLimit,
+		&key.CreatedBy, &key.CreatedAt, &lastUsedAt, &expiresAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	key.CourtID = courtID.String
+	key.LastUsedAt = timePtr(lastUsedAt)
+	key.ExpiresAt = timePtr(expiresAt)
+	key.RevokedAt = timePtr(revokedAt)
+	return &key, nil
+}
+
+// GetAPIKey implements APIKeyRepository
+func (r *postgresAPIKeys) GetAPIKey(ctx context.Context, keyID string) (*APIKey, error) {
+	key, err := scanPostgresAPIKey(r.db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE id = $1", keyID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return key, err
+}
+
+// ListUserAPIKeys implements APIKeyRepository
+func (r *postgresAPIKeys) ListUserAPIKeys(ctx context.Context, userID string) ([]*APIKey, error) {
+	return r.list(ctx, "user_id = $1 AND court_id IS NULL", userID)
+}
+
+// ListCourtAPIKeys implements APIKeyRepository
+func (r *postgresAPIKeys) ListCourtAPIKeys(ctx context.Context, courtID string) ([]*APIKey, error) {
+	return r.list(ctx, "court_id = $1", courtID)
+}
+
+// list returns the keys matching where, whose only parameter is $1, newest
+// first
+func (r *postgresAPIKeys) list(ctx context.Context, where, arg string) ([]*APIKey, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE "+where+" ORDER BY created_at DESC", arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		key, err := scanPostgresAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey implements APIKeyRepository
+func (r *postgresAPIKeys) RevokeAPIKey(ctx context.Context, keyID string, at time.Time) error {
+	result, err := r.db.ExecContext(ctx, "UPDATE api_keys SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL", at, keyID)
+	if err != nil {
+		return err
+	}
+	return checkUpdated(result, fmt.Errorf("%w: API key %s", ErrNotFound, keyID))
+}
+
+// MarkAPIKeyUsed implements APIKeyRepository
+func (r *postgresAPIKeys) MarkAPIKeyUsed(ctx context.Context, keyID string, at, since time.Time) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE api_keys SET last_used_at = $1
+		WHERE id = $2 AND (last_used_at IS NULL OR last_used_at < $3)
+	`, at, keyID, since)
+	return err
+}
+
+type postgresMagicLinks struct {
+	db *sql.DB
+}
+
+// CreateMagicLink implements MagicLinkRepository
+func (r *postgresMagicLinks) CreateMagicLink(ctx context.Context, tokenHash, email string, at, expiresAt time.Time) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO magic_links (token_hash, email, created_at, expires_at) VALUES ($1, $2, $3, $4)
+	`, tokenHash, email, at, expiresAt)
+	return postgresError(err)
+}
+
+// ConsumeMagicLink implements MagicLinkRepository
+func (r *postgresMagicLinks) ConsumeMagicLink(ctx context.Context, tokenHash string, at time.Time) (string, error) {
+	var email string
+	err := r.db.QueryRowContext(ctx, `
+		UPDATE magic_links
+		SET used_at = $1
+		WHERE token_hash = $2 AND used_at IS NULL AND expires_at > $1
+		RETURNING email
+	`, at, tokenHash).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return email, err
+}
@@ -0,0 +1,35 @@
+// pickle/backend/storage/postgres_test.go
+package storage_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/carlostbanks/pickle/db"
+	"github.com/carlostbanks/pickle/storage"
+	"github.com/carlostbanks/pickle/storage/storagetest"
+	_ "github.com/lib/pq"
+)
+
+// TestPostgres runs the suite against the migrated database at DATABASE_URL.
+// The records it creates have fresh IDs and are left behind.
+func TestPostgres(t *testing.T) {
+	url := os.Getenv("DATABASE_URL")
+	if url == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+	conn, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := db.CheckMigrations(context.Background(), conn); err != nil {
+		t.Fatal(err)
+	}
+
+	storagetest.Run(t, func(t *testing.T) *storage.Store {
+		return storage.NewPostgres(conn)
+	})
+}
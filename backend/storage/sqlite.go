@@ -0,0 +1,2208 @@
+// pickle/backend/storage/sqlite.go
+package storage
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/carlostbanks/pickle/notifications"
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/schedule"
+	"github.com/google/uuid"
+	"github.com/mattn/go-sqlite3"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+// sqliteSchema creates the tables of the SQLite store
+//
+//go:embed sqlite_schema.sql
+var sqliteSchema string
+
+// sqliteSchemaVersion is recorded in PRAGMA user_version once the schema is
+// created; bump it and add an upgrade to sqliteUpgrades when changing it
+const sqliteSchemaVersion = 6
+
+// sqliteUpgrades bring files of an older schema to the version they are keyed
+// by, one version at a time
+var sqliteUpgrades = map[int]string{
+	// Players move from bookings.player_emails to booking_players
+	2: `
+		ALTER TABLE courts ADD COLUMN max_players INTEGER NOT NULL DEFAULT 4 CHECK (max_players > 0);
+
+		CREATE TABLE booking_players (
+			booking_id TEXT NOT NULL REFERENCES bookings(id) ON DELETE CASCADE,
+			email TEXT NOT NULL,
+			user_id TEXT REFERENCES users(id),
+			position INTEGER NOT NULL,
+			status TEXT NOT NULL DEFAULT 'INVITED' CHECK (status IN ('INVITED', 'ACCEPTED', 'DECLINED')),
+			responded_at TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (booking_id, email)
+		);
+		CREATE INDEX booking_players_user_id_idx ON booking_players (user_id);
+
+		INSERT OR IGNORE INTO booking_players (booking_id, email, user_id, position)
+		SELECT b.id, lower(trim(e.value)), (SELECT u.id FROM users u WHERE lower(u.email) = lower(trim(e.value))), e.key + 1
+		FROM bookings b, json_each(b.player_emails) e
+		WHERE trim(e.value) != ''
+		ORDER BY b.id, e.key;
+
+		ALTER TABLE bookings DROP COLUMN player_emails;
+	`,
+	// Price lists, memberships, cancellation policies, series, the waitlist
+	// and payments move from Postgres-only queries to the repositories
+	3: `
+		CREATE TABLE court_rates (
+			court_id TEXT PRIMARY KEY REFERENCES courts(id),
+			currency TEXT NOT NULL DEFAULT 'USD',
+			guest_rate_cents INTEGER NOT NULL CHECK (guest_rate_cents >= 0),
+			member_rate_cents INTEGER NOT NULL CHECK (member_rate_cents >= 0),
+			min_duration_minutes INTEGER NOT NULL DEFAULT 0
+		);
+
+		CREATE TABLE court_peak_rates (
+			court_id TEXT NOT NULL REFERENCES courts(id),
+			weekday INTEGER NOT NULL CHECK (weekday BETWEEN 0 AND 6),
+			start_time TEXT NOT NULL,
+			end_time TEXT NOT NULL CHECK (end_time > start_time),
+			guest_rate_cents INTEGER NOT NULL CHECK (guest_rate_cents >= 0),
+			member_rate_cents INTEGER NOT NULL CHECK (member_rate_cents >= 0),
+			PRIMARY KEY (court_id, weekday, start_time)
+		);
+
+		CREATE TABLE court_members (
+			court_id TEXT NOT NULL REFERENCES courts(id),
+			user_id TEXT NOT NULL REFERENCES users(id),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (court_id, user_id)
+		);
+
+		CREATE TABLE court_cancellation_policies (
+			court_id TEXT PRIMARY KEY REFERENCES courts(id),
+			free_until_hours INTEGER NOT NULL DEFAULT 0 CHECK (free_until_hours >= 0),
+			partial_refund_until_hours INTEGER NOT NULL DEFAULT 0 CHECK (partial_refund_until_hours >= 0),
+			partial_refund_percent INTEGER NOT NULL DEFAULT 0 CHECK (partial_refund_percent BETWEEN 0 AND 100),
+			no_cancel_hours INTEGER NOT NULL DEFAULT 0 CHECK (no_cancel_hours >= 0),
+			no_show_fee_percent INTEGER NOT NULL DEFAULT 100 CHECK (no_show_fee_percent BETWEEN 0 AND 100)
+		);
+
+		CREATE TABLE booking_series (
+			id TEXT PRIMARY KEY,
+			court_id TEXT NOT NULL REFERENCES courts(id),
+			court_unit_id TEXT REFERENCES court_units(id),
+			user_id TEXT NOT NULL REFERENCES users(id),
+			rrule TEXT NOT NULL,
+			start_date TEXT NOT NULL,
+			start_time TEXT NOT NULL,
+			end_time TEXT NOT NULL,
+			number_of_players INTEGER NOT NULL,
+			player_emails TEXT NOT NULL DEFAULT '[]',
+			status TEXT NOT NULL,
+			created_at TEXT,
+			updated_at TEXT
+		);
+
+		CREATE TABLE waitlist_entries (
+			id TEXT PRIMARY KEY,
+			court_id TEXT NOT NULL REFERENCES courts(id),
+			court_unit_id TEXT REFERENCES court_units(id),
+			user_id TEXT NOT NULL REFERENCES users(id),
+			date TEXT NOT NULL,
+			start_time TEXT NOT NULL,
+			end_time TEXT NOT NULL,
+			number_of_players INTEGER NOT NULL,
+			player_emails TEXT NOT NULL DEFAULT '[]',
+			status TEXT NOT NULL,
+			booking_id TEXT REFERENCES bookings(id),
+			offer_expires_at TEXT,
+			created_at TEXT,
+			updated_at TEXT
+		);
+
+		CREATE INDEX waitlist_entries_slot_idx ON waitlist_entries (court_id, date, status);
+
+		CREATE TABLE payments (
+			id TEXT PRIMARY KEY,
+			booking_id TEXT NOT NULL REFERENCES bookings(id),
+			provider TEXT NOT NULL,
+			provider_intent_id TEXT NOT NULL,
+			amount_cents INTEGER NOT NULL,
+			refunded_cents INTEGER NOT NULL DEFAULT 0,
+			currency TEXT NOT NULL,
+			status TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (provider, provider_intent_id)
+		);
+
+		CREATE INDEX payments_booking_id_idx ON payments (booking_id);
+		CREATE UNIQUE INDEX payments_active_booking_idx ON payments (booking_id)
+			WHERE status IN ('REQUIRES_PAYMENT', 'AUTHORIZED', 'CAPTURED', 'PARTIALLY_REFUNDED');
+	`,
+	// Identities and facility roles move from Postgres-only queries to the
+	// user repository
+	4: `
+		CREATE TABLE user_identities (
+			provider TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			user_id TEXT NOT NULL REFERENCES users(id),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (provider, subject)
+		);
+
+		CREATE INDEX user_identities_user_id_idx ON user_identities (user_id);
+
+		CREATE TABLE court_staff (
+			court_id TEXT NOT NULL REFERENCES courts(id),
+			user_id TEXT NOT NULL REFERENCES users(id),
+			role TEXT NOT NULL DEFAULT 'staff' CHECK (role IN ('staff', 'facility_admin')),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (court_id, user_id)
+		);
+	`,
+	// Emails are queued in the outbox like in Postgres
+	5: `
+		CREATE TABLE notification_outbox (
+			id TEXT PRIMARY KEY,
+			kind TEXT NOT NULL,
+			recipient TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			body TEXT NOT NULL,
+			dedup_key TEXT UNIQUE,
+			status TEXT NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'SENT', 'FAILED')),
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT,
+			next_attempt_at TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			sent_at TEXT
+		);
+
+		CREATE INDEX notification_outbox_pending_idx ON notification_outbox (next_attempt_at) WHERE status = 'PENDING';
+	`,
+	// Sessions, API keys and magic links move from Postgres-only queries to
+	// the repositories
+	6: `
+		ALTER TABLE users ADD COLUMN service_account BOOLEAN NOT NULL DEFAULT FALSE;
+
+		CREATE TABLE sessions (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL REFERENCES users(id),
+			user_agent TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			last_used_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP,
+			revoked_reason TEXT
+		);
+
+		CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+
+		CREATE TABLE refresh_tokens (
+			token_hash TEXT PRIMARY KEY,
+			session_id TEXT NOT NULL REFERENCES sessions(id),
+			created_at TIMESTAMP NOT NULL,
+			used_at TIMESTAMP
+		);
+
+		CREATE INDEX refresh_tokens_session_id_idx ON refresh_tokens (session_id);
+
+		CREATE TABLE login_codes (
+			code_hash TEXT PRIMARY KEY,
+			session_id TEXT NOT NULL REFERENCES sessions(id),
+			created_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			used_at TIMESTAMP
+		);
+
+		CREATE TABLE magic_links (
+			token_hash TEXT PRIMARY KEY,
+			email TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			used_at TIMESTAMP
+		);
+
+		CREATE TABLE api_keys (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL REFERENCES users(id),
+			court_id TEXT REFERENCES courts(id),
+			name TEXT NOT NULL,
+			secret_hash TEXT NOT NULL,
+			scopes TEXT NOT NULL DEFAULT '[]',
+			rate_limit INTEGER NOT NULL,
+			created_by TEXT NOT NULL REFERENCES users(id),
+			created_at TIMESTAMP NOT NULL,
+			last_used_at TIMESTAMP,
+			expires_at TIMESTAMP,
+			revoked_at TIMESTAMP
+		);
+
+		CREATE INDEX api_keys_user_id_idx ON api_keys (user_id);
+		CREATE INDEX api_keys_court_id_idx ON api_keys (court_id);
+	`,
+}
+
+// OpenSQLite opens the SQLite database at path, creating the file and its
+// schema if needed, and returns its repositories with the connection, which
+// the caller closes. Unlike Postgres, SQLite needs no extensions: radius
+// searches are filtered in Go.
+func OpenSQLite(ctx context.Context, path string) (*Store, *sql.DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=true&_busy_timeout=5000")
+	if err != nil {
+		return nil, nil, err
+	}
+	// SQLite has a single writer; a single connection avoids busy errors
+	db.SetMaxOpenConns(1)
+
+	if err := createSQLiteSchema(ctx, db); err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("creating SQLite schema: %w", err)
+	}
+
+	return &Store{
+		Courts:   &sqliteCourts{db: db},
+		Bookings: &sqliteBookings{db: db},
+		Series:   &sqliteSeries{db: db},
+		Waitlist: &sqliteWaitlist{db: db},
+		Payments: &sqlitePayments{db: db},
+		Users:    &sqliteUsers{db: db},
+		Outbox:   &sqliteOutbox{db: db},
+
+		Sessions:   &sqliteSessions{db: db},
+		APIKeys:    &sqliteAPIKeys{db: db},
+		MagicLinks: &sqliteMagicLinks{db: db},
+	}, db, nil
+}
+
+// createSQLiteSchema creates the schema of a new database or upgrades that of
+// an older one, and refuses files written by a newer version
+func createSQLiteSchema(ctx context.Context, db *sql.DB) error {
+	var version int
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version == sqliteSchemaVersion {
+		return nil
+	}
+	if version > sqliteSchemaVersion {
+		return fmt.Errorf("database has schema version %d, which this build does not know", version)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if version == 0 {
+		if _, err := tx.ExecContext(ctx, sqliteSchema); err != nil {
+			return err
+		}
+	} else {
+		for v := version + 1; v <= sqliteSchemaVersion; v++ {
+			if _, err := tx.ExecContext(ctx, sqliteUpgrades[v]); err != nil {
+				return fmt.Errorf("upgrading to schema version %d: %w", v, err)
+			}
+		}
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", sqliteSchemaVersion)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqliteError maps the errors of constraints to the repository errors
+func sqliteError(err error) error {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return err
+	}
+	switch sqliteErr.ExtendedCode {
+	case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+		return fmt.Errorf("%w: %s", ErrConflict, sqliteErr.Error())
+	case sqlite3.ErrConstraintForeignKey:
+		return fmt.Errorf("%w: %s", ErrNotFound, sqliteErr.Error())
+	case sqlite3.ErrConstraintTrigger:
+		if strings.Contains(sqliteErr.Error(), "bookings_no_overlap") {
+			return ErrOverlap
+		}
+	}
+	return err
+}
+
+// sqliteTimeLayout is the format of the times the SQLite store compares in
+// queries, those of the outbox and of logins. They are kept in UTC, so they
+// sort as text; those read back are in TIMESTAMP columns, so they scan as
+// times.
+const sqliteTimeLayout = "2006-01-02 15:04:05.000000"
+
+// sqliteTime formats a time for a column compared in queries
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+// sqliteNullTime formats an optional time for a column compared in queries
+func sqliteNullTime(t *time.Time) sql.NullString {
+	if t == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: sqliteTime(*t), Valid: true}
+}
+
+// jsonList encodes a list for a JSON array column
+func jsonList(items []string) string {
+	if items == nil {
+		items = []string{}
+	}
+	encoded, _ := json.Marshal(items)
+	return string(encoded)
+}
+
+// parseList decodes a JSON array column, returning nil for empty lists
+func parseList(encoded string) ([]string, error) {
+	var items []string
+	if err := json.Unmarshal([]byte(encoded), &items); err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	return items, nil
+}
+
+type sqliteCourts struct {
+	db *sql.DB
+}
+
+// CreateCourt implements CourtRepository
+func (r *sqliteCourts) CreateCourt(ctx context.Context, court *proto.Court) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Check formats here, where Postgres has typed columns
+	calendar := gproto.Clone(court).(*proto.Court)
+	if err := normalizeCalendar(calendar); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO courts (id, name, address, latitude, longitude, number_of_courts, max_players, amenities, image_url, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, court.Id, court.Name, court.Address, court.Latitude, court.Longitude, court.NumberOfCourts, court.MaxPlayers,
+		jsonList(court.Amenities), nullString(court.ImageUrl), time.Now(), time.Now())
+	if err != nil {
+		return sqliteError(err)
+	}
+
+	for _, unit := range court.Units {
+		_, err := tx.ExecContext(ctx, "INSERT INTO court_units (id, court_id, name, position) VALUES (?, ?, ?, ?)",
+			unit.Id, court.Id, unit.Name, unit.Position)
+		if err != nil {
+			return sqliteError(err)
+		}
+	}
+
+	for _, oh := range calendar.OpeningHours {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO court_opening_hours (court_id, weekday, open_time, close_time) VALUES (?, ?, ?, ?)
+		`, court.Id, oh.Weekday, oh.OpenTime, oh.CloseTime)
+		if err != nil {
+			return sqliteError(err)
+		}
+	}
+
+	for _, ex := range calendar.HourExceptions {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO court_hour_exceptions (court_id, date, closed, open_time, close_time, reason)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, court.Id, ex.Date, ex.Closed, nullString(ex.OpenTime), nullString(ex.CloseTime), nullString(ex.Reason))
+		if err != nil {
+			return sqliteError(err)
+		}
+	}
+
+	for _, b := range calendar.Blackouts {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO court_blackouts (id, court_id, court_unit_id, starts_at, ends_at, reason)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, b.Id, court.Id, nullString(b.CourtUnitId), b.StartsAt, b.EndsAt, nullString(b.Reason))
+		if err != nil {
+			return sqliteError(err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetCourt implements CourtRepository
+func (r *sqliteCourts) GetCourt(ctx context.Context, courtID string) (*proto.Court, error) {
+	court, err := scanCourt(r.db.QueryRowContext(ctx, `
+		SELECT id, name, address, latitude, longitude, number_of_courts, max_players, amenities, COALESCE(image_url, ''),
+			   COALESCE(archived_at, '')
+		FROM courts
+		WHERE id = ?
+	`, courtID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return court, err
+}
+
+// ListCourts implements CourtRepository. The address is matched case
+// sensitively, as LIKE does in Postgres.
+func (r *sqliteCourts) ListCourts(ctx context.Context, filter CourtFilter) ([]*proto.Court, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, name, address, latitude, longitude, number_of_courts, max_players, amenities, COALESCE(image_url, ''), ''
+		FROM courts
+		WHERE archived_at IS NULL AND (? = '' OR instr(address, ?) > 0)
+		ORDER BY name, id
+	`, filter.City, filter.City)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var courts []*proto.Court
+	for rows.Next() {
+		court, err := scanCourt(rows)
+		if err != nil {
+			return nil, err
+		}
+		if filter.Latitude != 0 &&
+			distance(filter.Latitude, filter.Longitude, court.Latitude, court.Longitude) > filter.RadiusKm*1000 {
+			continue
+		}
+		courts = append(courts, court)
+	}
+
+	return courts, rows.Err()
+}
+
+// scanCourt scans the details of a court
+func scanCourt(row interface{ Scan(...interface{}) error }) (*proto.Court, error) {
+	var court proto.Court
+	var amenities string
+
+	err := row.Scan(
+		&court.Id,
+		&court.Name,
+		&court.Address,
+		&court.Latitude,
+		&court.Longitude,
+		&court.NumberOfCourts,
+		&court.MaxPlayers,
+		&amenities,
+		&court.ImageUrl,
+		&court.ArchivedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if court.Amenities, err = parseList(amenities); err != nil {
+		return nil, err
+	}
+	return &court, nil
+}
+
+// ListUnits implements CourtRepository
+func (r *sqliteCourts) ListUnits(ctx context.Context, courtID string) ([]*proto.CourtUnit, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, court_id, name, position
+		FROM court_units
+		WHERE court_id = ? AND archived_at IS NULL
+		ORDER BY position
+	`, courtID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var units []*proto.CourtUnit
+	for rows.Next() {
+		var unit proto.CourtUnit
+		if err := rows.Scan(&unit.Id, &unit.CourtId, &unit.Name, &unit.Position); err != nil {
+			return nil, err
+		}
+		units = append(units, &unit)
+	}
+
+	return units, rows.Err()
+}
+
+// LoadCalendar implements CourtRepository
+func (r *sqliteCourts) LoadCalendar(ctx context.Context, court *proto.Court, fromDate, toDate string) error {
+	from, err := schedule.ParseDate(fromDate)
+	if err != nil {
+		return err
+	}
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT weekday, open_time, close_time
+		FROM court_opening_hours
+		WHERE court_id = ?
+		ORDER BY weekday
+	`, court.Id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var oh proto.OpeningHours
+		if err := rows.Scan(&oh.Weekday, &oh.OpenTime, &oh.CloseTime); err != nil {
+			return err
+		}
+		court.OpeningHours = append(court.OpeningHours, &oh)
+	}
+
+	// Calendar timestamps compare as text; blackouts must end after the
+	// first day starts and start before the day after the last one
+	exceptionsQuery := `
+		SELECT date, closed, COALESCE(open_time, ''), COALESCE(close_time, ''), COALESCE(reason, '')
+		FROM court_hour_exceptions
+		WHERE court_id = ? AND date >= ?
+	`
+	blackoutsQuery := `
+		SELECT id, COALESCE(court_unit_id, ''), starts_at, ends_at, COALESCE(reason, '')
+		FROM court_blackouts
+		WHERE court_id = ? AND ends_at > ?
+	`
+	exceptionArgs := []interface{}{court.Id, from.Format(schedule.DateLayout)}
+	blackoutArgs := []interface{}{court.Id, from.Format(calendarLayout)}
+	if toDate != "" {
+		to, err := schedule.ParseDate(toDate)
+		if err != nil {
+			return err
+		}
+		exceptionsQuery += " AND date <= ?"
+		blackoutsQuery += " AND starts_at < ?"
+		exceptionArgs = append(exceptionArgs, to.Format(schedule.DateLayout))
+		blackoutArgs = append(blackoutArgs, to.AddDate(0, 0, 1).Format(calendarLayout))
+	}
+
+	exceptionRows, err := r.db.QueryContext(ctx, exceptionsQuery+" ORDER BY date", exceptionArgs...)
+	if err != nil {
+		return err
+	}
+	defer exceptionRows.Close()
+
+	for exceptionRows.Next() {
+		var ex proto.HoursException
+		if err := exceptionRows.Scan(&ex.Date, &ex.Closed, &ex.OpenTime, &ex.CloseTime, &ex.Reason); err != nil {
+			return err
+		}
+		court.HourExceptions = append(court.HourExceptions, &ex)
+	}
+
+	blackoutRows, err := r.db.QueryContext(ctx, blackoutsQuery+" ORDER BY starts_at", blackoutArgs...)
+	if err != nil {
+		return err
+	}
+	defer blackoutRows.Close()
+
+	for blackoutRows.Next() {
+		var b proto.Blackout
+		if err := blackoutRows.Scan(&b.Id, &b.CourtUnitId, &b.StartsAt, &b.EndsAt, &b.Reason); err != nil {
+			return err
+		}
+		court.Blackouts = append(court.Blackouts, &b)
+	}
+
+	return blackoutRows.Err()
+}
+
+// UpdateCourt implements CourtRepository
+func (r *sqliteCourts) UpdateCourt(ctx context.Context, court *proto.Court, fromDate string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkSQLiteCourt(ctx, tx, court.Id); err != nil {
+		return err
+	}
+
+	positions := make([]int32, len(court.Units))
+	for i, unit := range court.Units {
+		positions[i] = unit.Position
+	}
+	listed, _ := json.Marshal(positions)
+
+	var booked bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1
+			FROM bookings b
+			JOIN court_units u ON u.id = b.court_unit_id
+			WHERE u.court_id = ? AND u.archived_at IS NULL AND u.position NOT IN (SELECT value FROM json_each(?))
+				AND b.date >= ? AND b.status IN ('PENDING', 'CONFIRMED')
+		)
+	`, court.Id, string(listed), fromDate).Scan(&booked)
+	if err != nil {
+		return err
+	}
+	if booked {
+		return ErrBooked
+	}
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `
+		UPDATE courts
+		SET name = ?, address = ?, latitude = ?, longitude = ?, number_of_courts = ?, max_players = ?,
+			amenities = ?, image_url = ?, updated_at = ?
+		WHERE id = ?
+	`, court.Name, court.Address, court.Latitude, court.Longitude, court.NumberOfCourts, court.MaxPlayers,
+		jsonList(court.Amenities), nullString(court.ImageUrl), now, court.Id)
+	if err != nil {
+		return sqliteError(err)
+	}
+
+	for _, unit := range court.Units {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO court_units (id, court_id, name, position) VALUES (?, ?, ?, ?)
+			ON CONFLICT (court_id, position) DO UPDATE SET archived_at = NULL
+		`, unit.Id, court.Id, unit.Name, unit.Position)
+		if err != nil {
+			return sqliteError(err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE court_units
+		SET archived_at = ?
+		WHERE court_id = ? AND position NOT IN (SELECT value FROM json_each(?)) AND archived_at IS NULL
+	`, now.Format(calendarLayout), court.Id, string(listed))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// checkSQLiteCourt checks that a facility exists and is not archived
+func checkSQLiteCourt(ctx context.Context, tx *sql.Tx, courtID string) error {
+	var archived bool
+	err := tx.QueryRowContext(ctx, "SELECT archived_at IS NOT NULL FROM courts WHERE id = ?", courtID).Scan(&archived)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if archived {
+		return ErrArchived
+	}
+	return nil
+}
+
+// ArchiveCourt implements CourtRepository
+func (r *sqliteCourts) ArchiveCourt(ctx context.Context, courtID, fromDate string, at time.Time) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkSQLiteCourt(ctx, tx, courtID); err != nil {
+		return err
+	}
+
+	var booked bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM bookings
+			WHERE court_id = ? AND date >= ? AND status IN ('PENDING', 'CONFIRMED')
+		)
+	`, courtID, fromDate).Scan(&booked)
+	if err != nil {
+		return err
+	}
+	if booked {
+		return ErrBooked
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE courts SET archived_at = ?, updated_at = ? WHERE id = ?",
+		at.Format(calendarLayout), at, courtID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE waitlist_entries
+		SET status = 'EXPIRED', updated_at = ?
+		WHERE court_id = ? AND status = 'WAITING'
+	`, at.Format(time.RFC3339), courtID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetRates implements CourtRepository
+func (r *sqliteCourts) GetRates(ctx context.Context, courtID string) (*proto.CourtRates, error) {
+	var rates proto.CourtRates
+	err := r.db.QueryRowContext(ctx, `
+		SELECT currency, guest_rate_cents, member_rate_cents, min_duration_minutes
+		FROM court_rates
+		WHERE court_id = ?
+	`, courtID).Scan(&rates.Currency, &rates.GuestRateCents, &rates.MemberRateCents, &rates.MinDurationMinutes)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT weekday, start_time, end_time, guest_rate_cents, member_rate_cents
+		FROM court_peak_rates
+		WHERE court_id = ?
+		ORDER BY weekday, start_time
+	`, courtID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var peak proto.PeakRate
+		if err := rows.Scan(&peak.Weekday, &peak.StartTime, &peak.EndTime, &peak.GuestRateCents, &peak.MemberRateCents); err != nil {
+			return nil, err
+		}
+		rates.PeakRates = append(rates.PeakRates, &peak)
+	}
+
+	return &rates, rows.Err()
+}
+
+// SetRates implements CourtRepository
+func (r *sqliteCourts) SetRates(ctx context.Context, courtID string, rates *proto.CourtRates) error {
+	if rates != nil {
+		rates = gproto.Clone(rates).(*proto.CourtRates)
+		if err := normalizeRates(rates); err != nil {
+			return err
+		}
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM court_peak_rates WHERE court_id = ?", courtID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM court_rates WHERE court_id = ?", courtID); err != nil {
+		return err
+	}
+
+	if rates != nil {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO court_rates (court_id, currency, guest_rate_cents, member_rate_cents, min_duration_minutes)
+			VALUES (?, ?, ?, ?, ?)
+		`, courtID, rates.Currency, rates.GuestRateCents, rates.MemberRateCents, rates.MinDurationMinutes)
+		if err != nil {
+			return sqliteError(err)
+		}
+
+		for _, peak := range rates.PeakRates {
+			_, err := tx.ExecContext(ctx, `
+				INSERT INTO court_peak_rates (court_id, weekday, start_time, end_time, guest_rate_cents, member_rate_cents)
+				VALUES (?, ?, ?, ?, ?, ?)
+			`, courtID, peak.Weekday, peak.StartTime, peak.EndTime, peak.GuestRateCents, peak.MemberRateCents)
+			if err != nil {
+				return sqliteError(err)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetCancellationPolicy implements CourtRepository
+func (r *sqliteCourts) GetCancellationPolicy(ctx context.Context, courtID string) (*proto.CancellationPolicy, error) {
+	var policy proto.CancellationPolicy
+	err := r.db.QueryRowContext(ctx, `
+		SELECT free_until_hours, partial_refund_until_hours, partial_refund_percent, no_cancel_hours, no_show_fee_percent
+		FROM court_cancellation_policies
+		WHERE court_id = ?
+	`, courtID).Scan(&policy.FreeUntilHours, &policy.PartialRefundUntilHours, &policy.PartialRefundPercent,
+		&policy.NoCancelHours, &policy.NoShowFeePercent)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// SetCancellationPolicy implements CourtRepository
+func (r *sqliteCourts) SetCancellationPolicy(ctx context.Context, courtID string, policy *proto.CancellationPolicy) error {
+	if policy == nil {
+		_, err := r.db.ExecContext(ctx, "DELETE FROM court_cancellation_policies WHERE court_id = ?", courtID)
+		return err
+	}
+
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO court_cancellation_policies (
+			court_id, free_until_hours, partial_refund_until_hours, partial_refund_percent, no_cancel_hours, no_show_fee_percent
+		) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (court_id) DO UPDATE SET
+			free_until_hours = excluded.free_until_hours,
+			partial_refund_until_hours = excluded.partial_refund_until_hours,
+			partial_refund_percent = excluded.partial_refund_percent,
+			no_cancel_hours = excluded.no_cancel_hours,
+			no_show_fee_percent = excluded.no_show_fee_percent
+	`, courtID, policy.FreeUntilHours, policy.PartialRefundUntilHours, policy.PartialRefundPercent,
+		policy.NoCancelHours, policy.NoShowFeePercent)
+	return sqliteError(err)
+}
+
+// IsMember implements CourtRepository
+func (r *sqliteCourts) IsMember(ctx context.Context, courtID, userID string) (bool, error) {
+	var member bool
+	err := r.db.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM court_members WHERE court_id = ? AND user_id = ?)",
+		courtID, userID).Scan(&member)
+	return member, err
+}
+
+// AddMember implements CourtRepository
+func (r *sqliteCourts) AddMember(ctx context.Context, courtID, userID string) error {
+	_, err := r.db.ExecContext(ctx, "INSERT INTO court_members (court_id, user_id) VALUES (?, ?)", courtID, userID)
+	return sqliteError(err)
+}
+
+type sqliteBookings struct {
+	db *sql.DB
+}
+
+// sqliteBookingColumns are the columns scanned by scanSQLiteBooking
+const sqliteBookingColumns = `
+	id, court_id, COALESCE(court_unit_id, ''), COALESCE(series_id, ''), user_id, date, start_time, end_time,
+	number_of_players, price_cents, currency, status, COALESCE(hold_expires_at, ''),
+	cancellation_rule, cancellation_fee_cents, COALESCE(cancelled_at, ''), created_at, updated_at
+`
+
+// scanSQLiteBooking scans a row of sqliteBookingColumns
+func scanSQLiteBooking(row interface{ Scan(...interface{}) error }) (*proto.Booking, error) {
+	var booking proto.Booking
+	var statusName string
+
+	err := row.Scan(
+		&booking.Id,
+		&booking.CourtId,
+		&booking.CourtUnitId,
+		&booking.SeriesId,
+		&booking.UserId,
+		&booking.Date,
+		&booking.StartTime,
+		&booking.EndTime,
+		&booking.NumberOfPlayers,
+		&booking.PriceCents,
+		&booking.Currency,
+		&statusName,
+		&booking.HoldExpiresAt,
+		&booking.CancellationRule,
+		&booking.CancellationFeeCents,
+		&booking.CancelledAt,
+		&booking.CreatedAt,
+		&booking.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	booking.Status = proto.BookingStatus(proto.BookingStatus_value[statusName])
+	return &booking, nil
+}
+
+// InsertBooking implements BookingRepository. The bookings_no_overlap
+// triggers reject overlapping bookings.
+func (r *sqliteBookings) InsertBooking(ctx context.Context, booking *proto.Booking, messages ...*notifications.Message) error {
+	normalized := gproto.Clone(booking).(*proto.Booking)
+	if err := normalizeBooking(normalized); err != nil {
+		return err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO bookings (
+			id, court_id, court_unit_id, series_id, user_id, date, start_time, end_time,
+			number_of_players, price_cents, currency, status, hold_expires_at, created_at, updated_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, normalized.Id, normalized.CourtId, nullString(normalized.CourtUnitId), nullString(normalized.SeriesId), normalized.UserId,
+		normalized.Date, normalized.StartTime, normalized.EndTime, normalized.NumberOfPlayers,
+		normalized.PriceCents, normalized.Currency, normalized.Status.String(), nullString(normalized.HoldExpiresAt),
+		normalized.CreatedAt, normalized.UpdatedAt)
+	if err != nil {
+		return sqliteError(err)
+	}
+
+	if err := insertSQLitePlayers(ctx, tx, normalized.Id, normalized.Players); err != nil {
+		return err
+	}
+	if err := enqueueSQLite(ctx, tx, messages); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// insertSQLitePlayers inserts the players of a booking in order
+func insertSQLitePlayers(ctx context.Context, tx *sql.Tx, bookingID string, players []*proto.BookingPlayer) error {
+	for position, player := range players {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO booking_players (booking_id, email, user_id, position, status, responded_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, bookingID, player.Email, nullString(player.UserId), position+1, player.Status.String(), nullString(player.RespondedAt))
+		if err != nil {
+			return sqliteError(err)
+		}
+	}
+	return nil
+}
+
+// GetBooking implements BookingRepository
+func (r *sqliteBookings) GetBooking(ctx context.Context, bookingID string) (*proto.Booking, error) {
+	booking, err := scanSQLiteBooking(r.db.QueryRowContext(ctx, "SELECT "+sqliteBookingColumns+" FROM bookings WHERE id = ?", bookingID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.loadPlayers(ctx, []*proto.Booking{booking}); err != nil {
+		return nil, err
+	}
+	return booking, nil
+}
+
+// SetPlayers implements BookingRepository
+func (r *sqliteBookings) SetPlayers(ctx context.Context, bookingID string, players []*proto.BookingPlayer, messages ...*notifications.Message) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id string
+	err = tx.QueryRowContext(ctx, "SELECT id FROM bookings WHERE id = ?", bookingID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM booking_players WHERE booking_id = ?", bookingID); err != nil {
+		return err
+	}
+	if err := insertSQLitePlayers(ctx, tx, bookingID, players); err != nil {
+		return err
+	}
+	if err := enqueueSQLite(ctx, tx, messages); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdatePlayer implements BookingRepository
+func (r *sqliteBookings) UpdatePlayer(ctx context.Context, bookingID string, player *proto.BookingPlayer) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE booking_players
+		SET user_id = ?, status = ?, responded_at = ?
+		WHERE booking_id = ? AND email = ?
+	`, nullString(player.UserId), player.Status.String(), nullString(player.RespondedAt), bookingID, player.Email)
+	if err != nil {
+		return sqliteError(err)
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return fmt.Errorf("%w: player %s", ErrNotFound, player.Email)
+	}
+	return nil
+}
+
+// loadPlayers loads the players of bookings
+func (r *sqliteBookings) loadPlayers(ctx context.Context, bookings []*proto.Booking) error {
+	if len(bookings) == 0 {
+		return nil
+	}
+
+	byID := make(map[string]*proto.Booking, len(bookings))
+	var ids []string
+	for _, booking := range bookings {
+		byID[booking.Id] = booking
+		ids = append(ids, booking.Id)
+	}
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT booking_id, email, COALESCE(user_id, ''), status, COALESCE(responded_at, '')
+		FROM booking_players
+		WHERE booking_id IN (SELECT value FROM json_each(?))
+		ORDER BY booking_id, position
+	`, jsonList(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bookingID, statusName string
+		var player proto.BookingPlayer
+		if err := rows.Scan(&bookingID, &player.Email, &player.UserId, &statusName, &player.RespondedAt); err != nil {
+			return err
+		}
+		player.Status = proto.PlayerStatus(proto.PlayerStatus_value[statusName])
+		booking := byID[bookingID]
+		booking.Players = append(booking.Players, &player)
+		booking.PlayerEmails = append(booking.PlayerEmails, player.Email)
+	}
+
+	return rows.Err()
+}
+
+// ListBookings implements BookingRepository
+func (r *sqliteBookings) ListBookings(ctx context.Context, filter BookingFilter) ([]*proto.Booking, error) {
+	query := "SELECT " + sqliteBookingColumns + " FROM bookings WHERE 1=1"
+	var args []interface{}
+
+	if filter.UserID != "" {
+		query += " AND (user_id = ? OR id IN (SELECT booking_id FROM booking_players WHERE user_id = ?))"
+		args = append(args, filter.UserID, filter.UserID)
+	}
+
+	if filter.CourtID != "" {
+		query += " AND court_id = ?"
+		args = append(args, filter.CourtID)
+	}
+
+	if filter.Date != "" {
+		query += " AND date = ?"
+		args = append(args, filter.Date)
+	}
+
+	if filter.SeriesID != "" {
+		query += " AND series_id = ?"
+		args = append(args, filter.SeriesID)
+	}
+
+	if filter.Visible != nil {
+		query += " AND (user_id = ? OR id IN (SELECT booking_id FROM booking_players WHERE user_id = ?)" +
+			" OR court_id IN (SELECT value FROM json_each(?)))"
+		args = append(args, filter.Visible.UserID, filter.Visible.UserID, jsonList(filter.Visible.CourtIDs))
+	}
+
+	query += " ORDER BY date, start_time, id"
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bookings []*proto.Booking
+	for rows.Next() {
+		booking, err := scanSQLiteBooking(rows)
+		if err != nil {
+			return nil, err
+		}
+		bookings = append(bookings, booking)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// Release the only connection before loading the players
+	rows.Close()
+
+	if err := r.loadPlayers(ctx, bookings); err != nil {
+		return nil, err
+	}
+	return bookings, nil
+}
+
+// Booked implements BookingRepository
+func (r *sqliteBookings) Booked(ctx context.Context, courtID, fromDate, toDate, excludeID string) (map[string][]schedule.Booked, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT COALESCE(court_unit_id, ''), date, start_time, end_time
+		FROM bookings
+		WHERE court_id = ?
+		AND date BETWEEN ? AND ?
+		AND id != ?
+		AND status != 'CANCELLED'
+	`, courtID, fromDate, toDate, excludeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	booked := make(map[string][]schedule.Booked)
+	for rows.Next() {
+		var unitID, date, startTime, endTime string
+		if err := rows.Scan(&unitID, &date, &startTime, &endTime); err != nil {
+			return nil, err
+		}
+
+		window, err := schedule.ParseWindow(startTime, endTime)
+		if err != nil {
+			return nil, err
+		}
+		booked[date] = append(booked[date], schedule.Booked{UnitID: unitID, Window: window})
+	}
+
+	return booked, rows.Err()
+}
+
+// UpdateBookings implements BookingRepository
+func (r *sqliteBookings) UpdateBookings(ctx context.Context, bookings []*proto.Booking, messages ...*notifications.Message) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, booking := range bookings {
+		window, err := schedule.ParseWindow(booking.StartTime, booking.EndTime)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.ExecContext(ctx, `
+			UPDATE bookings
+			SET court_unit_id = ?, start_time = ?, end_time = ?, number_of_players = ?,
+				price_cents = ?, currency = ?, updated_at = ?
+			WHERE id = ?
+		`, nullString(booking.CourtUnitId), window.StartTime(), window.EndTime(), booking.NumberOfPlayers,
+			booking.PriceCents, booking.Currency, booking.UpdatedAt, booking.Id)
+		if err != nil {
+			return sqliteError(err)
+		}
+		if err := checkUpdated(result, fmt.Errorf("%w: booking %s", ErrNotFound, booking.Id)); err != nil {
+			return err
+		}
+	}
+	if err := enqueueSQLite(ctx, tx, messages); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ConfirmBooking implements BookingRepository
+func (r *sqliteBookings) ConfirmBooking(ctx context.Context, bookingID string, at time.Time, messages ...*notifications.Message) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE bookings
+		SET status = 'CONFIRMED', hold_expires_at = NULL, updated_at = ?
+		WHERE id = ? AND status = 'PENDING' AND (hold_expires_at IS NULL OR hold_expires_at > ?)
+	`, at.Format(time.RFC3339), bookingID, at.Format(calendarLayout))
+	if err != nil {
+		return err
+	}
+	if err := checkUpdated(result, ErrStale); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE waitlist_entries
+		SET status = 'CLAIMED', updated_at = ?
+		WHERE booking_id = ? AND status = 'OFFERED'
+	`, at.Format(time.RFC3339), bookingID)
+	if err != nil {
+		return err
+	}
+	if err := enqueueSQLite(ctx, tx, messages); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CancelBookings implements BookingRepository
+func (r *sqliteBookings) CancelBookings(ctx context.Context, cancellations []*proto.Cancellation, at time.Time, messages ...*notifications.Message) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var ids []string
+	for _, c := range cancellations {
+		result, err := tx.ExecContext(ctx, `
+			UPDATE bookings
+			SET status = 'CANCELLED', cancellation_rule = ?, cancellation_fee_cents = ?, cancelled_at = ?, updated_at = ?
+			WHERE id = ?
+		`, c.Rule, c.FeeCents, at.Format(calendarLayout), at.Format(time.RFC3339), c.BookingId)
+		if err != nil {
+			return err
+		}
+		if err := checkUpdated(result, fmt.Errorf("%w: booking %s", ErrNotFound, c.BookingId)); err != nil {
+			return err
+		}
+		ids = append(ids, c.BookingId)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE waitlist_entries
+		SET status = 'LEFT', updated_at = ?
+		WHERE booking_id IN (SELECT value FROM json_each(?)) AND status = 'OFFERED'
+	`, at.Format(time.RFC3339), jsonList(ids))
+	if err != nil {
+		return err
+	}
+	if err := enqueueSQLite(ctx, tx, messages); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MarkNoShow implements BookingRepository
+func (r *sqliteBookings) MarkNoShow(ctx context.Context, bookingID, rule string, feeCents int64, at time.Time) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE bookings
+		SET status = 'NO_SHOW', cancellation_rule = ?, cancellation_fee_cents = ?, cancelled_at = ?, updated_at = ?
+		WHERE id = ? AND status = 'CONFIRMED'
+	`, rule, feeCents, at.Format(calendarLayout), at.Format(time.RFC3339), bookingID)
+	if err != nil {
+		return err
+	}
+	return checkUpdated(result, ErrStale)
+}
+
+// ExpireHolds implements BookingRepository
+func (r *sqliteBookings) ExpireHolds(ctx context.Context, at time.Time) ([]*proto.Booking, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		UPDATE bookings
+		SET status = 'CANCELLED', updated_at = ?
+		WHERE status = 'PENDING' AND hold_expires_at <= ?
+		RETURNING `+sqliteBookingColumns, at.Format(time.RFC3339), at.Format(calendarLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var expired []*proto.Booking
+	for rows.Next() {
+		booking, err := scanSQLiteBooking(rows)
+		if err != nil {
+			return nil, err
+		}
+		expired = append(expired, booking)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := r.loadPlayers(ctx, expired); err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
+
+type sqliteUsers struct {
+	db *sql.DB
+}
+
+// CreateUser implements UserRepository
+func (r *sqliteUsers) CreateUser(ctx context.Context, user *User) error {
+	return insertSQLiteUser(ctx, r.db, user)
+}
+
+// insertSQLiteUser creates a user, within a transaction or not
+func insertSQLiteUser(ctx context.Context, db execer, user *User) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO users (id, email, name, picture, platform_admin, service_account, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, user.ID, user.Email, user.Name, nullString(user.Picture), user.PlatformAdmin, user.ServiceAccount, user.CreatedAt)
+	return sqliteError(err)
+}
+
+// GetUser implements UserRepository
+func (r *sqliteUsers) GetUser(ctx context.Context, userID string) (*User, error) {
+	return r.getUser(ctx, "id", userID)
+}
+
+// GetUserByEmail implements UserRepository
+func (r *sqliteUsers) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	return r.getUser(ctx, "lower(email)", strings.ToLower(email))
+}
+
+// UpdateProfile implements UserRepository
+func (r *sqliteUsers) UpdateProfile(ctx context.Context, userID, name, picture string) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE users
+		SET name = COALESCE(NULLIF(?, ''), name), picture = COALESCE(NULLIF(?, ''), picture)
+		WHERE id = ?
+	`, name, picture, userID)
+	if err != nil {
+		return err
+	}
+	return checkUpdated(result, fmt.Errorf("%w: user %s", ErrNotFound, userID))
+}
+
+// GetIdentity implements UserRepository
+func (r *sqliteUsers) GetIdentity(ctx context.Context, provider, subject string) (*Identity, error) {
+	identity := Identity{Provider: provider, Subject: subject}
+	err := r.db.QueryRowContext(ctx, `
+		SELECT user_id, created_at FROM user_identities WHERE provider = ? AND subject = ?
+	`, provider, subject).Scan(&identity.UserID, &identity.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+// LinkIdentity implements UserRepository
+func (r *sqliteUsers) LinkIdentity(ctx context.Context, identity *Identity) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO user_identities (provider, subject, user_id, created_at) VALUES (?, ?, ?, ?)
+	`, identity.Provider, identity.Subject, identity.UserID, identity.CreatedAt)
+	return sqliteError(err)
+}
+
+// GrantRole implements UserRepository
+func (r *sqliteUsers) GrantRole(ctx context.Context, courtID, userID, role string) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO court_staff (court_id, user_id, role) VALUES (?, ?, ?)
+		ON CONFLICT (court_id, user_id) DO UPDATE SET role = excluded.role
+	`, courtID, userID, role)
+	return sqliteError(err)
+}
+
+// ListRoles implements UserRepository
+func (r *sqliteUsers) ListRoles(ctx context.Context, userID string) ([]StaffRole, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT court_id, role FROM court_staff WHERE user_id = ? ORDER BY court_id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []StaffRole
+	for rows.Next() {
+		var role StaffRole
+		if err := rows.Scan(&role.CourtID, &role.Role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// getUser returns the user whose column has a value
+func (r *sqliteUsers) getUser(ctx context.Context, column, value string) (*User, error) {
+	var user User
+	var picture sql.NullString
+	err := r.db.QueryRowContext(ctx, `
+		SELECT id, email, name, picture, platform_admin, service_account, created_at FROM users WHERE `+column+` = ?
+	`, value).Scan(&user.ID, &user.Email, &user.Name, &picture, &user.PlatformAdmin, &user.ServiceAccount, &user.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	user.Picture = picture.String
+	return &user, nil
+}
+
+type sqliteSeries struct {
+	db *sql.DB
+}
+
+// InsertSeries implements SeriesRepository
+func (r *sqliteSeries) InsertSeries(ctx context.Context, series *proto.BookingSeries) error {
+	series = gproto.Clone(series).(*proto.BookingSeries)
+	if err := normalizeSlot(&series.StartDate, &series.StartTime, &series.EndTime); err != nil {
+		return err
+	}
+
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO booking_series (
+			id, court_id, court_unit_id, user_id, rrule, start_date, start_time, end_time,
+			number_of_players, player_emails, status, created_at, updated_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, series.Id, series.CourtId, nullString(series.CourtUnitId), series.UserId, series.Rrule,
+		series.StartDate, series.StartTime, series.EndTime,
+		series.NumberOfPlayers, jsonList(series.PlayerEmails), series.Status, series.CreatedAt, series.UpdatedAt)
+	return sqliteError(err)
+}
+
+// GetSeries implements SeriesRepository
+func (r *sqliteSeries) GetSeries(ctx context.Context, seriesID string) (*proto.BookingSeries, error) {
+	var series proto.BookingSeries
+	var emails string
+	err := r.db.QueryRowContext(ctx, `
+		SELECT id, court_id, COALESCE(court_unit_id, ''), user_id, rrule, start_date, start_time, end_time,
+			   number_of_players, player_emails, status, created_at, updated_at
+		FROM booking_series
+		WHERE id = ?
+	`, seriesID).Scan(
+		&series.Id,
+		&series.CourtId,
+		&series.CourtUnitId,
+		&series.UserId,
+		&series.Rrule,
+		&series.StartDate,
+		&series.StartTime,
+		&series.EndTime,
+		&series.NumberOfPlayers,
+		&emails,
+		&series.Status,
+		&series.CreatedAt,
+		&series.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if series.PlayerEmails, err = parseList(emails); err != nil {
+		return nil, err
+	}
+	return &series, nil
+}
+
+// DeleteSeries implements SeriesRepository
+func (r *sqliteSeries) DeleteSeries(ctx context.Context, seriesID string) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM booking_series WHERE id = ?", seriesID)
+	return sqliteError(err)
+}
+
+// CancelSeries implements SeriesRepository
+func (r *sqliteSeries) CancelSeries(ctx context.Context, seriesID string, at time.Time) error {
+	result, err := r.db.ExecContext(ctx,
+		"UPDATE booking_series SET status = 'CANCELLED', updated_at = ? WHERE id = ?", at.Format(time.RFC3339), seriesID)
+	if err != nil {
+		return err
+	}
+	return checkUpdated(result, ErrNotFound)
+}
+
+type sqliteWaitlist struct {
+	db *sql.DB
+}
+
+// sqliteWaitlistColumns are the columns scanned by scanSQLiteEntry
+const sqliteWaitlistColumns = `
+	id, court_id, COALESCE(court_unit_id, ''), user_id, date, start_time, end_time, number_of_players, player_emails,
+	status, COALESCE(booking_id, ''), COALESCE(offer_expires_at, ''), created_at
+`
+
+// scanSQLiteEntry scans a row of sqliteWaitlistColumns
+func scanSQLiteEntry(row interface{ Scan(...interface{}) error }) (*proto.WaitlistEntry, error) {
+	var entry proto.WaitlistEntry
+	var emails, statusName string
+
+	err := row.Scan(
+		&entry.Id,
+		&entry.CourtId,
+		&entry.CourtUnitId,
+		&entry.UserId,
+		&entry.Date,
+		&entry.StartTime,
+		&entry.EndTime,
+		&entry.NumberOfPlayers,
+		&emails,
+		&statusName,
+		&entry.BookingId,
+		&entry.OfferExpiresAt,
+		&entry.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.PlayerEmails, err = parseList(emails); err != nil {
+		return nil, err
+	}
+	entry.Status = proto.WaitlistStatus(proto.WaitlistStatus_value[statusName])
+	return &entry, nil
+}
+
+// InsertEntry implements WaitlistRepository
+func (r *sqliteWaitlist) InsertEntry(ctx context.Context, entry *proto.WaitlistEntry) error {
+	entry = gproto.Clone(entry).(*proto.WaitlistEntry)
+	if err := normalizeSlot(&entry.Date, &entry.StartTime, &entry.EndTime); err != nil {
+		return err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM waitlist_entries
+			WHERE user_id = ? AND court_id = ? AND date = ? AND start_time = ? AND end_time = ?
+			AND status IN ('WAITING', 'OFFERED')
+		)
+	`, entry.UserId, entry.CourtId, entry.Date, entry.StartTime, entry.EndTime).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("%w: waitlist entry for the slot", ErrConflict)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO waitlist_entries (
+			id, court_id, court_unit_id, user_id, date, start_time, end_time,
+			number_of_players, player_emails, status, created_at, updated_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, entry.Id, entry.CourtId, nullString(entry.CourtUnitId), entry.UserId, entry.Date, entry.StartTime, entry.EndTime,
+		entry.NumberOfPlayers, jsonList(entry.PlayerEmails), entry.Status.String(), entry.CreatedAt, entry.CreatedAt)
+	if err != nil {
+		return sqliteError(err)
+	}
+
+	return tx.Commit()
+}
+
+// GetEntry implements WaitlistRepository
+func (r *sqliteWaitlist) GetEntry(ctx context.Context, entryID string) (*proto.WaitlistEntry, error) {
+	entry, err := scanSQLiteEntry(r.db.QueryRowContext(ctx,
+		"SELECT "+sqliteWaitlistColumns+" FROM waitlist_entries WHERE id = ?", entryID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return entry, err
+}
+
+// ListEntries implements WaitlistRepository
+func (r *sqliteWaitlist) ListEntries(ctx context.Context, filter WaitlistFilter) ([]*proto.WaitlistEntry, error) {
+	query := "SELECT " + sqliteWaitlistColumns + " FROM waitlist_entries WHERE 1=1"
+	var args []interface{}
+
+	if filter.UserID != "" {
+		query += " AND user_id = ?"
+		args = append(args, filter.UserID)
+	}
+	if filter.CourtID != "" {
+		query += " AND court_id = ?"
+		args = append(args, filter.CourtID)
+	}
+	if filter.Date != "" {
+		query += " AND date = ?"
+		args = append(args, filter.Date)
+	}
+	if len(filter.Statuses) > 0 {
+		var names []string
+		for _, status := range filter.Statuses {
+			names = append(names, status.String())
+		}
+		query += " AND status IN (SELECT value FROM json_each(?))"
+		args = append(args, jsonList(names))
+	}
+
+	query += " ORDER BY created_at, rowid"
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*proto.WaitlistEntry
+	for rows.Next() {
+		entry, err := scanSQLiteEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// OfferEntry implements WaitlistRepository
+func (r *sqliteWaitlist) OfferEntry(ctx context.Context, entryID string, expiresAt, at time.Time) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE waitlist_entries
+		SET status = 'OFFERED', offer_expires_at = ?, updated_at = ?
+		WHERE id = ? AND status = 'WAITING'
+	`, expiresAt.Format(calendarLayout), at.Format(time.RFC3339), entryID)
+	if err != nil {
+		return err
+	}
+	return checkUpdated(result, ErrStale)
+}
+
+// AttachBooking implements WaitlistRepository
+func (r *sqliteWaitlist) AttachBooking(ctx context.Context, entryID, bookingID string) error {
+	result, err := r.db.ExecContext(ctx, "UPDATE waitlist_entries SET booking_id = ? WHERE id = ?", bookingID, entryID)
+	if err != nil {
+		return sqliteError(err)
+	}
+	return checkUpdated(result, ErrNotFound)
+}
+
+// ReturnEntry implements WaitlistRepository
+func (r *sqliteWaitlist) ReturnEntry(ctx context.Context, entryID string) error {
+	result, err := r.db.ExecContext(ctx,
+		"UPDATE waitlist_entries SET status = 'WAITING', offer_expires_at = NULL WHERE id = ?", entryID)
+	if err != nil {
+		return err
+	}
+	return checkUpdated(result, ErrNotFound)
+}
+
+// LeaveEntry implements WaitlistRepository
+func (r *sqliteWaitlist) LeaveEntry(ctx context.Context, entryID string, from proto.WaitlistStatus, at time.Time) error {
+	return r.endEntry(ctx, entryID, from, proto.WaitlistStatus_LEFT, at)
+}
+
+// ExpireOffer implements WaitlistRepository
+func (r *sqliteWaitlist) ExpireOffer(ctx context.Context, entryID string, at time.Time) error {
+	return r.endEntry(ctx, entryID, proto.WaitlistStatus_OFFERED, proto.WaitlistStatus_EXPIRED, at)
+}
+
+// endEntry moves a waitlist entry from one status to a final one and
+// cancels the pending booking of its offer
+func (r *sqliteWaitlist) endEntry(ctx context.Context, entryID string, from, to proto.WaitlistStatus, at time.Time) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var bookingID string
+	err = tx.QueryRowContext(ctx, `
+		UPDATE waitlist_entries
+		SET status = ?, updated_at = ?
+		WHERE id = ? AND status = ?
+		RETURNING COALESCE(booking_id, '')
+	`, to.String(), at.Format(time.RFC3339), entryID, from.String()).Scan(&bookingID)
+	if err == sql.ErrNoRows {
+		return ErrStale
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE bookings
+		SET status = 'CANCELLED', updated_at = ?
+		WHERE id = ? AND status = 'PENDING'
+	`, at.Format(time.RFC3339), bookingID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type sqlitePayments struct {
+	db *sql.DB
+}
+
+// InsertPayment implements PaymentRepository. The payments_active_booking_idx
+// index rejects a second active payment.
+func (r *sqlitePayments) InsertPayment(ctx context.Context, payment *Payment) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO payments (
+			id, booking_id, provider, provider_intent_id, amount_cents, refunded_cents, currency, status, created_at, updated_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, payment.ID, payment.BookingID, payment.Provider, payment.IntentID, payment.AmountCents, payment.RefundedCents,
+		payment.Currency, payment.Status, payment.CreatedAt, payment.UpdatedAt)
+	return sqliteError(err)
+}
+
+// LatestPayment implements PaymentRepository
+func (r *sqlitePayments) LatestPayment(ctx context.Context, bookingID string) (*Payment, error) {
+	payment, err := scanPayment(r.db.QueryRowContext(ctx, `
+		SELECT `+paymentColumns+`
+		FROM payments
+		WHERE booking_id = ?
+		ORDER BY created_at DESC, rowid DESC
+		LIMIT 1
+	`, bookingID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return payment, err
+}
+
+// ActivePayments implements PaymentRepository
+func (r *sqlitePayments) ActivePayments(ctx context.Context, bookingIDs []string) ([]*Payment, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT `+paymentColumns+`
+		FROM payments
+		WHERE booking_id IN (SELECT value FROM json_each(?)) AND status IN (SELECT value FROM json_each(?))
+		ORDER BY created_at, rowid
+	`, jsonList(bookingIDs), jsonList(activePaymentStatuses))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var active []*Payment
+	for rows.Next() {
+		payment, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		active = append(active, payment)
+	}
+
+	return active, rows.Err()
+}
+
+// UpdatePayment implements PaymentRepository
+func (r *sqlitePayments) UpdatePayment(ctx context.Context, payment *Payment) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE payments
+		SET status = ?, refunded_cents = ?, updated_at = ?
+		WHERE id = ?
+	`, payment.Status, payment.RefundedCents, payment.UpdatedAt, payment.ID)
+	if err != nil {
+		return sqliteError(err)
+	}
+	return checkUpdated(result, ErrNotFound)
+}
+
+// UpdateIntentStatus implements PaymentRepository
+func (r *sqlitePayments) UpdateIntentStatus(ctx context.Context, provider, intentID, from, to string, at time.Time) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE payments
+		SET status = ?, updated_at = ?
+		WHERE provider = ? AND provider_intent_id = ? AND status = ?
+	`, to, at, provider, intentID, from)
+	if err != nil {
+		return sqliteError(err)
+	}
+	return checkUpdated(result, ErrStale)
+}
+
+type sqliteOutbox struct {
+	db *sql.DB
+}
+
+// Enqueue implements OutboxRepository
+func (r *sqliteOutbox) Enqueue(ctx context.Context, messages ...*notifications.Message) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := enqueueSQLite(ctx, tx, messages); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// enqueueSQLite queues messages in the outbox within a transaction
+func enqueueSQLite(ctx context.Context, tx *sql.Tx, messages []*notifications.Message) error {
+	now := sqliteTime(time.Now())
+	for _, msg := range messages {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO notification_outbox (id, kind, recipient, subject, body, dedup_key, next_attempt_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (dedup_key) DO NOTHING
+		`, uuid.New().String(), msg.Kind, msg.To, msg.Subject, msg.Body, nullString(msg.Key), now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClaimMessages implements OutboxRepository. SQLite has a single writer, so
+// concurrent claims take turns.
+func (r *sqliteOutbox) ClaimMessages(ctx context.Context, at time.Time, lease time.Duration, limit int) ([]*notifications.Queued, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		UPDATE notification_outbox
+		SET attempts = attempts + 1, next_attempt_at = ?
+		WHERE id IN (
+			SELECT id FROM notification_outbox
+			WHERE status = 'PENDING' AND next_attempt_at <= ?
+			ORDER BY next_attempt_at
+			LIMIT ?
+		)
+		RETURNING id, kind, recipient, subject, body, COALESCE(dedup_key, ''), attempts
+	`, sqliteTime(at.Add(lease)), sqliteTime(at), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var claimed []*notifications.Queued
+	for rows.Next() {
+		var q notifications.Queued
+		if err := rows.Scan(&q.ID, &q.Kind, &q.To, &q.Subject, &q.Body, &q.Key, &q.Attempt); err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, &q)
+	}
+	return claimed, rows.Err()
+}
+
+// MarkSent implements OutboxRepository
+func (r *sqliteOutbox) MarkSent(ctx context.Context, id string, at time.Time) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE notification_outbox
+		SET status = 'SENT', last_error = NULL, sent_at = ?
+		WHERE id = ? AND status = 'PENDING'
+	`, sqliteTime(at), id)
+	return err
+}
+
+// MarkFailed implements OutboxRepository
+func (r *sqliteOutbox) MarkFailed(ctx context.Context, id string, attempt int, lastError string, retryAt time.Time) error {
+	status := "PENDING"
+	retry := sql.NullString{String: sqliteTime(retryAt), Valid: !retryAt.IsZero()}
+	if retryAt.IsZero() {
+		status = "FAILED"
+	}
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE notification_outbox
+		SET status = ?, last_error = ?, next_attempt_at = COALESCE(?, next_attempt_at)
+		WHERE id = ? AND attempts = ? AND status = 'PENDING'
+	`, status, lastError, retry, id, attempt)
+	return err
+}
+
+type sqliteSessions struct {
+	db *sql.DB
+}
+
+// CreateSession implements SessionRepository
+func (r *sqliteSessions) CreateSession(ctx context.Context, session *Session, tokenHash string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO sessions (id, user_id, user_agent, created_at, last_used_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, session.ID, session.UserID, session.UserAgent, sqliteTime(session.CreatedAt), sqliteTime(session.CreatedAt),
+		sqliteTime(session.ExpiresAt))
+	if err != nil {
+		return sqliteError(err)
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (token_hash, session_id, created_at) VALUES (?, ?, ?)
+	`, tokenHash, session.ID, sqliteTime(session.CreatedAt))
+	if err != nil {
+		return sqliteError(err)
+	}
+
+	return tx.Commit()
+}
+
+// RotateRefreshToken implements SessionRepository. SQLite has a single
+// writer, so the transaction needs no row locks.
+func (r *sqliteSessions) RotateRefreshToken(ctx context.Context, tokenHash, nextHash string, at time.Time) (*Session, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var usedAt, revokedAt sql.NullTime
+	session, err := scanSession(tx.QueryRowContext(ctx, `
+		SELECT `+sessionColumns+`, s.revoked_at, t.used_at
+		FROM refresh_tokens t
+		JOIN sessions s ON s.id = t.session_id
+		WHERE t.token_hash = ?
+	`, tokenHash), &revokedAt, &usedAt)
+	if err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid || !session.ExpiresAt.After(at) {
+		return nil, ErrNotFound
+	}
+
+	if usedAt.Valid {
+		if err := revokeSQLiteSessions(ctx, tx, "id", session.ID, RevokedReuse, at); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrReused
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET used_at = ? WHERE token_hash = ?", sqliteTime(at), tokenHash); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE sessions SET last_used_at = ? WHERE id = ?", sqliteTime(at), session.ID); err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (token_hash, session_id, created_at) VALUES (?, ?, ?)
+	`, nextHash, session.ID, sqliteTime(at))
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+
+	return session, tx.Commit()
+}
+
+// CreateLoginCode implements SessionRepository
+func (r *sqliteSessions) CreateLoginCode(ctx context.Context, codeHash, sessionID string, at, expiresAt time.Time) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO login_codes (code_hash, session_id, created_at, expires_at) VALUES (?, ?, ?, ?)
+	`, codeHash, sessionID, sqliteTime(at), sqliteTime(expiresAt))
+	return sqliteError(err)
+}
+
+// RedeemLoginCode implements SessionRepository
+func (r *sqliteSessions) RedeemLoginCode(ctx context.Context, codeHash string, at time.Time) (*Session, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var codeExpiresAt time.Time
+	var usedAt, revokedAt sql.NullTime
+	session, err := scanSession(tx.QueryRowContext(ctx, `
+		SELECT `+sessionColumns+`, s.revoked_at, c.expires_at, c.used_at
+		FROM login_codes c
+		JOIN sessions s ON s.id = c.session_id
+		WHERE c.code_hash = ?
+	`, codeHash), &revokedAt, &codeExpiresAt, &usedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if usedAt.Valid {
+		if err := revokeSQLiteSessions(ctx, tx, "id", session.ID, RevokedReuse, at); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrReused
+	}
+	if revokedAt.Valid || !codeExpiresAt.After(at) || !session.ExpiresAt.After(at) {
+		return nil, ErrNotFound
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE login_codes SET used_at = ? WHERE code_hash = ?", sqliteTime(at), codeHash); err != nil {
+		return nil, err
+	}
+
+	return session, tx.Commit()
+}
+
+// GetSessionByRefreshToken implements SessionRepository
+func (r *sqliteSessions) GetSessionByRefreshToken(ctx context.Context, tokenHash string) (*Session, error) {
+	return scanSession(r.db.QueryRowContext(ctx, `
+		SELECT `+sessionColumns+`
+		FROM refresh_tokens t
+		JOIN sessions s ON s.id = t.session_id
+		WHERE t.token_hash = ?
+	`, tokenHash))
+}
+
+// RevokeSession implements SessionRepository
+func (r *sqliteSessions) RevokeSession(ctx context.Context, sessionID, reason string, at time.Time) error {
+	return revokeSQLiteSessions(ctx, r.db, "id", sessionID, reason, at)
+}
+
+// RevokeUserSessions implements SessionRepository
+func (r *sqliteSessions) RevokeUserSessions(ctx context.Context, userID, reason string, at time.Time) error {
+	return revokeSQLiteSessions(ctx, r.db, "user_id", userID, reason, at)
+}
+
+// revokeSQLiteSessions revokes the sessions not revoked yet whose column has
+// a value
+func revokeSQLiteSessions(ctx context.Context, db execer, column, value, reason string, at time.Time) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE sessions
+		SET revoked_at = ?, revoked_reason = ?
+		WHERE revoked_at IS NULL AND `+column+` = ?
+	`, sqliteTime(at), reason, value)
+	return err
+}
+
+// SessionLive implements SessionRepository
+func (r *sqliteSessions) SessionLive(ctx context.Context, sessionID string, at time.Time) (bool, error) {
+	var live bool
+	err := r.db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM sessions WHERE id = ? AND revoked_at IS NULL AND expires_at > ?)
+	`, sessionID, sqliteTime(at)).Scan(&live)
+	return live, err
+}
+
+type sqliteAPIKeys struct {
+	db *sql.DB
+}
+
+// CreateAPIKey implements APIKeyRepository
+func (r *sqliteAPIKeys) CreateAPIKey(ctx context.Context, key *APIKey, account *User, role string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if account != nil {
+		if err := insertSQLiteUser(ctx, tx, account); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "INSERT INTO court_staff (court_id, user_id, role) VALUES (?, ?, ?)",
+			key.CourtID, account.ID, role)
+		if err != nil {
+			return sqliteError(err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO api_keys (id, user_id, court_id, name, secret_hash, scopes, rate_limit, created_by, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, key.ID, key.UserID, nullString(key.CourtID), key.Name, key.SecretHash, jsonList(key.Scopes),
+		key.RateLimit, key.CreatedBy, sqliteTime(key.CreatedAt), sqliteNullTime(key.ExpiresAt))
+	if err != nil {
+		return sqliteError(err)
+	}
+
+	return tx.Commit()
+}
+
+// scanSQLiteAPIKey scans the apiKeyColumns of a row
+func scanSQLiteAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	var key APIKey
+	var courtID sql.NullString
+	var scopes string
+	var lastUsedAt, expiresAt, revokedAt sql.NullTime
+	err := row.Scan(&key.ID, &key.UserID, &courtID, &key.Name, &key.SecretHash, &scopes, &key.RateLimit,
+		&key.CreatedBy, &key.CreatedAt, &lastUsedAt, &expiresAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	if key.Scopes, err = parseList(scopes); err != nil {
+		return nil, err
+	}
+	key.CourtID = courtID.String
+	key.LastUsedAt = timePtr(lastUsedAt)
+	key.ExpiresAt = timePtr(expiresAt)
+	key.RevokedAt = timePtr(revokedAt)
+	return &key, nil
+}
+
+// GetAPIKey implements APIKeyRepository
+func (r *sqliteAPIKeys) GetAPIKey(ctx context.Context, keyID string) (*APIKey, error) {
+	key, err := scanSQLiteAPIKey(r.db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE id = ?", keyID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return key, err
+}
+
+// ListUserAPIKeys implements APIKeyRepository
+func (r *sqliteAPIKeys) ListUserAPIKeys(ctx context.Context, userID string) ([]*APIKey, error) {
+	return r.list(ctx, "user_id = ? AND court_id IS NULL", userID)
+}
+
+// ListCourtAPIKeys implements APIKeyRepository
+func (r *sqliteAPIKeys) ListCourtAPIKeys(ctx context.Context, courtID string) ([]*APIKey, error) {
+	return r.list(ctx, "court_id = ?", courtID)
+}
+
+// list returns the keys matching where, whose only parameter is arg, newest
+// first
+func (r *sqliteAPIKeys) list(ctx context.Context, where, arg string) ([]*APIKey, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE "+where+" ORDER BY created_at DESC, rowid DESC", arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		key, err := scanSQLiteAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey implements APIKeyRepository
+func (r *sqliteAPIKeys) RevokeAPIKey(ctx context.Context, keyID string, at time.Time) error {
+	result, err := r.db.ExecContext(ctx, "UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", sqliteTime(at), keyID)
+	if err != nil {
+		return err
+	}
+	return checkUpdated(result, fmt.Errorf("%w: API key %s", ErrNotFound, keyID))
+}
+
+// MarkAPIKeyUsed implements APIKeyRepository
+func (r *sqliteAPIKeys) MarkAPIKeyUsed(ctx context.Context, keyID string, at, since time.Time) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE api_keys SET last_used_at = ?
+		WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)
+	`, sqliteTime(at), keyID, sqliteTime(since))
+	return err
+}
+
+type sqliteMagicLinks struct {
+	db *sql.DB
+}
+
+// CreateMagicLink implements MagicLinkRepository
+func (r *sqliteMagicLinks) CreateMagicLink(ctx context.Context, tokenHash, email string, at, expiresAt time.Time) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO magic_links (token_hash, email, created_at, expires_at) VALUES (?, ?, ?, ?)
+	`, tokenHash, email, sqliteTime(at), sqliteTime(expiresAt))
+	return sqliteError(err)
+}
+
+// ConsumeMagicLink implements MagicLinkRepository
+func (r *sqliteMagicLinks) ConsumeMagicLink(ctx context.Context, tokenHash string, at time.Time) (string, error) {
+	var email string
+	err := r.db.QueryRowContext(ctx, `
+		UPDATE magic_links
+		SET used_at = ?1
+		WHERE token_hash = ?2 AND used_at IS NULL AND expires_at > ?1
+		RETURNING email
+	`, sqliteTime(at), tokenHash).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return email, err
+}
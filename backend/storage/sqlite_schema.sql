@@ -0,0 +1,322 @@
+-- Schema of the SQLite store, the tables of the storage repositories only.
+-- Dates are kept as YYYY-MM-DD, times of day as HH:MM and calendar
+-- timestamps as YYYY-MM-DDTHH:MM:SS, so they compare as text. Lists are JSON
+-- arrays.
+
+CREATE TABLE IF NOT EXISTS users (
+    id TEXT PRIMARY KEY,
+    email TEXT NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    picture TEXT,
+    platform_admin BOOLEAN NOT NULL DEFAULT FALSE,
+    service_account BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS courts (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    address TEXT NOT NULL,
+    latitude REAL NOT NULL,
+    longitude REAL NOT NULL,
+    number_of_courts INTEGER NOT NULL,
+    max_players INTEGER NOT NULL DEFAULT 4 CHECK (max_players > 0),
+    amenities TEXT NOT NULL DEFAULT '[]',
+    image_url TEXT,
+    archived_at TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS court_units (
+    id TEXT PRIMARY KEY,
+    court_id TEXT NOT NULL REFERENCES courts(id),
+    name TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    archived_at TEXT,
+    UNIQUE (court_id, position)
+);
+
+CREATE TABLE IF NOT EXISTS court_opening_hours (
+    court_id TEXT NOT NULL REFERENCES courts(id),
+    weekday INTEGER NOT NULL CHECK (weekday BETWEEN 0 AND 6),
+    open_time TEXT NOT NULL,
+    close_time TEXT NOT NULL CHECK (close_time > open_time),
+    PRIMARY KEY (court_id, weekday)
+);
+
+CREATE TABLE IF NOT EXISTS court_hour_exceptions (
+    court_id TEXT NOT NULL REFERENCES courts(id),
+    date TEXT NOT NULL,
+    closed BOOLEAN NOT NULL DEFAULT FALSE,
+    open_time TEXT,
+    close_time TEXT,
+    reason TEXT,
+    PRIMARY KEY (court_id, date),
+    CHECK (closed OR (open_time IS NOT NULL AND close_time > open_time))
+);
+
+CREATE TABLE IF NOT EXISTS court_blackouts (
+    id TEXT PRIMARY KEY,
+    court_id TEXT NOT NULL REFERENCES courts(id),
+    court_unit_id TEXT REFERENCES court_units(id),
+    starts_at TEXT NOT NULL,
+    ends_at TEXT NOT NULL CHECK (ends_at > starts_at),
+    reason TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- series_id has no foreign key: files older than schema version 3 did not
+-- keep series
+CREATE TABLE IF NOT EXISTS bookings (
+    id TEXT PRIMARY KEY,
+    court_id TEXT REFERENCES courts(id),
+    court_unit_id TEXT REFERENCES court_units(id),
+    series_id TEXT,
+    user_id TEXT REFERENCES users(id),
+    date TEXT NOT NULL,
+    start_time TEXT NOT NULL,
+    end_time TEXT NOT NULL,
+    number_of_players INTEGER NOT NULL,
+    price_cents INTEGER NOT NULL DEFAULT 0,
+    currency TEXT NOT NULL DEFAULT 'USD',
+    status TEXT NOT NULL,
+    hold_expires_at TEXT,
+    cancellation_rule TEXT NOT NULL DEFAULT '',
+    cancellation_fee_cents INTEGER NOT NULL DEFAULT 0,
+    cancelled_at TEXT,
+    created_at TEXT,
+    updated_at TEXT
+);
+
+CREATE INDEX IF NOT EXISTS bookings_court_date_idx ON bookings (court_id, date);
+CREATE INDEX IF NOT EXISTS bookings_series_id_idx ON bookings (series_id);
+
+-- Price lists; rates are hourly, in the smallest currency unit
+CREATE TABLE IF NOT EXISTS court_rates (
+    court_id TEXT PRIMARY KEY REFERENCES courts(id),
+    currency TEXT NOT NULL DEFAULT 'USD',
+    guest_rate_cents INTEGER NOT NULL CHECK (guest_rate_cents >= 0),
+    member_rate_cents INTEGER NOT NULL CHECK (member_rate_cents >= 0),
+    min_duration_minutes INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS court_peak_rates (
+    court_id TEXT NOT NULL REFERENCES courts(id),
+    weekday INTEGER NOT NULL CHECK (weekday BETWEEN 0 AND 6),
+    start_time TEXT NOT NULL,
+    end_time TEXT NOT NULL CHECK (end_time > start_time),
+    guest_rate_cents INTEGER NOT NULL CHECK (guest_rate_cents >= 0),
+    member_rate_cents INTEGER NOT NULL CHECK (member_rate_cents >= 0),
+    PRIMARY KEY (court_id, weekday, start_time)
+);
+
+CREATE TABLE IF NOT EXISTS court_members (
+    court_id TEXT NOT NULL REFERENCES courts(id),
+    user_id TEXT NOT NULL REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (court_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS court_cancellation_policies (
+    court_id TEXT PRIMARY KEY REFERENCES courts(id),
+    free_until_hours INTEGER NOT NULL DEFAULT 0 CHECK (free_until_hours >= 0),
+    partial_refund_until_hours INTEGER NOT NULL DEFAULT 0 CHECK (partial_refund_until_hours >= 0),
+    partial_refund_percent INTEGER NOT NULL DEFAULT 0 CHECK (partial_refund_percent BETWEEN 0 AND 100),
+    no_cancel_hours INTEGER NOT NULL DEFAULT 0 CHECK (no_cancel_hours >= 0),
+    no_show_fee_percent INTEGER NOT NULL DEFAULT 100 CHECK (no_show_fee_percent BETWEEN 0 AND 100)
+);
+
+-- Series and waitlist entries list the emails to invite; the answers are
+-- kept with the bookings in booking_players
+CREATE TABLE IF NOT EXISTS booking_series (
+    id TEXT PRIMARY KEY,
+    court_id TEXT NOT NULL REFERENCES courts(id),
+    court_unit_id TEXT REFERENCES court_units(id),
+    user_id TEXT NOT NULL REFERENCES users(id),
+    rrule TEXT NOT NULL,
+    start_date TEXT NOT NULL,
+    start_time TEXT NOT NULL,
+    end_time TEXT NOT NULL,
+    number_of_players INTEGER NOT NULL,
+    player_emails TEXT NOT NULL DEFAULT '[]',
+    status TEXT NOT NULL,
+    created_at TEXT,
+    updated_at TEXT
+);
+
+CREATE TABLE IF NOT EXISTS waitlist_entries (
+    id TEXT PRIMARY KEY,
+    court_id TEXT NOT NULL REFERENCES courts(id),
+    court_unit_id TEXT REFERENCES court_units(id),
+    user_id TEXT NOT NULL REFERENCES users(id),
+    date TEXT NOT NULL,
+    start_time TEXT NOT NULL,
+    end_time TEXT NOT NULL,
+    number_of_players INTEGER NOT NULL,
+    player_emails TEXT NOT NULL DEFAULT '[]',
+    status TEXT NOT NULL,
+    booking_id TEXT REFERENCES bookings(id),
+    offer_expires_at TEXT,
+    created_at TEXT,
+    updated_at TEXT
+);
+
+CREATE INDEX IF NOT EXISTS waitlist_entries_slot_idx ON waitlist_entries (court_id, date, status);
+
+-- A booking has at most one payment that still holds or may still collect
+-- money
+CREATE TABLE IF NOT EXISTS payments (
+    id TEXT PRIMARY KEY,
+    booking_id TEXT NOT NULL REFERENCES bookings(id),
+    provider TEXT NOT NULL,
+    provider_intent_id TEXT NOT NULL,
+    amount_cents INTEGER NOT NULL,
+    refunded_cents INTEGER NOT NULL DEFAULT 0,
+    currency TEXT NOT NULL,
+    status TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (provider, provider_intent_id)
+);
+
+CREATE INDEX IF NOT EXISTS payments_booking_id_idx ON payments (booking_id);
+CREATE UNIQUE INDEX IF NOT EXISTS payments_active_booking_idx ON payments (booking_id)
+    WHERE status IN ('REQUIRES_PAYMENT', 'AUTHORIZED', 'CAPTURED', 'PARTIALLY_REFUNDED');
+
+-- The players of a booking besides its organizer, in the order they were
+-- listed. Guests have no user_id.
+CREATE TABLE IF NOT EXISTS booking_players (
+    booking_id TEXT NOT NULL REFERENCES bookings(id) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    user_id TEXT REFERENCES users(id),
+    position INTEGER NOT NULL,
+    status TEXT NOT NULL DEFAULT 'INVITED' CHECK (status IN ('INVITED', 'ACCEPTED', 'DECLINED')),
+    responded_at TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (booking_id, email)
+);
+
+CREATE INDEX IF NOT EXISTS booking_players_user_id_idx ON booking_players (user_id);
+
+CREATE TABLE IF NOT EXISTS user_identities (
+    provider TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    user_id TEXT NOT NULL REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (provider, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities (user_id);
+
+CREATE TABLE IF NOT EXISTS court_staff (
+    court_id TEXT NOT NULL REFERENCES courts(id),
+    user_id TEXT NOT NULL REFERENCES users(id),
+    role TEXT NOT NULL DEFAULT 'staff' CHECK (role IN ('staff', 'facility_admin')),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (court_id, user_id)
+);
+
+-- Emails waiting to be sent, see OutboxRepository. Times are UTC, formatted
+-- to sort as text.
+CREATE TABLE IF NOT EXISTS notification_outbox (
+    id TEXT PRIMARY KEY,
+    kind TEXT NOT NULL,
+    recipient TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    body TEXT NOT NULL,
+    dedup_key TEXT UNIQUE,
+    status TEXT NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'SENT', 'FAILED')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    sent_at TEXT
+);
+
+CREATE INDEX IF NOT EXISTS notification_outbox_pending_idx ON notification_outbox (next_attempt_at) WHERE status = 'PENDING';
+
+-- Login sessions, their refresh tokens and login codes, magic links and API
+-- keys keep hashes of their secrets. Times are UTC, formatted to sort as
+-- text.
+CREATE TABLE IF NOT EXISTS sessions (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id),
+    user_agent TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP,
+    revoked_reason TEXT
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    token_hash TEXT PRIMARY KEY,
+    session_id TEXT NOT NULL REFERENCES sessions(id),
+    created_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_session_id_idx ON refresh_tokens (session_id);
+
+CREATE TABLE IF NOT EXISTS login_codes (
+    code_hash TEXT PRIMARY KEY,
+    session_id TEXT NOT NULL REFERENCES sessions(id),
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS magic_links (
+    token_hash TEXT PRIMARY KEY,
+    email TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id),
+    court_id TEXT REFERENCES courts(id),
+    name TEXT NOT NULL,
+    secret_hash TEXT NOT NULL,
+    scopes TEXT NOT NULL DEFAULT '[]',
+    rate_limit INTEGER NOT NULL,
+    created_by TEXT NOT NULL REFERENCES users(id),
+    created_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP,
+    expires_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_user_id_idx ON api_keys (user_id);
+CREATE INDEX IF NOT EXISTS api_keys_court_id_idx ON api_keys (court_id);
+
+-- Active bookings may not overlap on the same unit. SQLite has no exclusion
+-- constraints; the triggers run in the writing transaction, and SQLite has a
+-- single writer, so concurrent bookings cannot both pass.
+CREATE TRIGGER IF NOT EXISTS bookings_no_overlap_insert
+BEFORE INSERT ON bookings
+WHEN NEW.status != 'CANCELLED' AND NEW.court_unit_id IS NOT NULL AND EXISTS (
+    SELECT 1 FROM bookings
+    WHERE court_unit_id = NEW.court_unit_id AND date = NEW.date AND status != 'CANCELLED'
+        AND start_time < NEW.end_time AND NEW.start_time < end_time
+)
+BEGIN
+    SELECT RAISE(ABORT, 'bookings_no_overlap');
+END;
+
+CREATE TRIGGER IF NOT EXISTS bookings_no_overlap_update
+BEFORE UPDATE OF court_unit_id, date, start_time, end_time, status ON bookings
+WHEN NEW.status != 'CANCELLED' AND NEW.court_unit_id IS NOT NULL AND EXISTS (
+    SELECT 1 FROM bookings
+    WHERE id != NEW.id AND court_unit_id = NEW.court_unit_id AND date = NEW.date AND status != 'CANCELLED'
+        AND start_time < NEW.end_time AND NEW.start_time < end_time
+)
+BEGIN
+    SELECT RAISE(ABORT, 'bookings_no_overlap');
+END;
+
@@ -0,0 +1,22 @@
+// pickle/backend/storage/sqlite_test.go
+package storage_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/carlostbanks/pickle/storage"
+	"github.com/carlostbanks/pickle/storage/storagetest"
+)
+
+func TestSQLite(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) *storage.Store {
+		store, conn, err := storage.OpenSQLite(context.Background(), filepath.Join(t.TempDir(), "pickle.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return store
+	})
+}
@@ -0,0 +1,532 @@
+// pickle/backend/storage/storage.go
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/carlostbanks/pickle/config"
+	"github.com/carlostbanks/pickle/db"
+	"github.com/carlostbanks/pickle/notifications"
+	"github.com/carlostbanks/pickle/payments"
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/schedule"
+)
+
+// Repositories return dates as YYYY-MM-DD, times of day as HH:MM and
+// timestamps of the facility calendar as 2006-01-02T15:04:05, whatever the
+// store keeps them as.
+
+var (
+	// ErrNotFound is returned for unknown records, and for records
+	// referring to unknown ones
+	ErrNotFound = errors.New("not found")
+
+	// ErrConflict is returned when creating a record whose ID, or another
+	// unique field, is already taken
+	ErrConflict = errors.New("already exists")
+
+	// ErrOverlap is returned when an active booking would overlap another
+	// active booking of the same court unit
+	ErrOverlap = errors.New("booking overlaps another booking of the court unit")
+
+	// ErrStale is returned when a record is no longer in the state a change
+	// applies to, e.g. because a concurrent request changed it first
+	ErrStale = errors.New("record was changed")
+
+	// ErrArchived is returned when changing an archived facility
+	ErrArchived = errors.New("court is archived")
+
+	// ErrBooked is returned when court units with upcoming bookings would
+	// stop taking bookings
+	ErrBooked = errors.New("court units have upcoming bookings")
+
+	// ErrReused is returned when a single-use refresh token or login code
+	// is presented again
+	ErrReused = errors.New("already used")
+)
+
+// Store groups the repositories of one database
+type Store struct {
+	Courts   CourtRepository
+	Bookings BookingRepository
+	Users    UserRepository
+	Series   SeriesRepository
+	Waitlist WaitlistRepository
+	Payments PaymentRepository
+	Outbox   OutboxRepository
+
+	Sessions   SessionRepository
+	APIKeys    APIKeyRepository
+	MagicLinks MagicLinkRepository
+}
+
+// Open connects to the database cfg selects and returns its repositories with
+// the connection, which the caller closes. Postgres databases are migrated by
+// the db package; SQLite files get their schema here.
+func Open(ctx context.Context, cfg config.DatabaseConfig) (*Store, *sql.DB, error) {
+	switch cfg.Driver {
+	case config.DriverSQLite:
+		return OpenSQLite(ctx, cfg.Path)
+	case config.DriverPostgres:
+		conn, err := db.Open(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return NewPostgres(conn), conn, nil
+	}
+	return nil, nil, fmt.Errorf("unknown database driver %q", cfg.Driver)
+}
+
+// CourtFilter selects the facilities listed by ListCourts
+type CourtFilter struct {
+	City      string  // Matched against the address; empty for any
+	Latitude  float64 // Center of the search; a latitude of 0 disables it
+	Longitude float64
+	RadiusKm  float64
+}
+
+// CourtRepository keeps facilities, their court units and their calendar
+type CourtRepository interface {
+	// CreateCourt creates a facility with its units, weekly opening hours,
+	// hours exceptions and blackouts. Rates, policies and staff are not
+	// part of it.
+	CreateCourt(ctx context.Context, court *proto.Court) error
+
+	// GetCourt returns the details of a facility, archived or not, without
+	// its units or calendar
+	GetCourt(ctx context.Context, courtID string) (*proto.Court, error)
+
+	// ListCourts returns the facilities that are not archived and match the
+	// filter, ordered by name
+	ListCourts(ctx context.Context, filter CourtFilter) ([]*proto.Court, error)
+
+	// ListUnits returns the units of a facility that are not archived, in
+	// display order
+	ListUnits(ctx context.Context, courtID string) ([]*proto.CourtUnit, error)
+
+	// LoadCalendar loads the weekly opening hours of a facility into court,
+	// with the hours exceptions and blackouts between two dates (inclusive).
+	// An empty toDate leaves the range open-ended.
+	LoadCalendar(ctx context.Context, court *proto.Court, fromDate, toDate string) error
+
+	// UpdateCourt replaces the details of a facility that is not archived,
+	// or fails with ErrArchived. Its units become those of court: listed
+	// units are created, or restored by position, and the others archived.
+	// It fails with ErrBooked if a unit to archive has a pending or
+	// confirmed booking from fromDate on.
+	UpdateCourt(ctx context.Context, court *proto.Court, fromDate string) error
+
+	// ArchiveCourt archives a facility at the given time and expires the
+	// waitlist entries still waiting for one of its slots. It fails with
+	// ErrArchived if it is archived already, and with ErrBooked if it has
+	// pending or confirmed bookings from fromDate on.
+	ArchiveCourt(ctx context.Context, courtID, fromDate string, at time.Time) error
+
+	// GetRates returns the price list of a facility, with its peak rates by
+	// weekday and start time, or nil if it has none
+	GetRates(ctx context.Context, courtID string) (*proto.CourtRates, error)
+
+	// SetRates replaces the price list of a facility; nil removes it
+	SetRates(ctx context.Context, courtID string, rates *proto.CourtRates) error
+
+	// GetCancellationPolicy returns the cancellation policy of a facility,
+	// or nil if it has none
+	GetCancellationPolicy(ctx context.Context, courtID string) (*proto.CancellationPolicy, error)
+
+	// SetCancellationPolicy replaces the cancellation policy of a facility;
+	// nil removes it
+	SetCancellationPolicy(ctx context.Context, courtID string, policy *proto.CancellationPolicy) error
+
+	// IsMember reports whether a user is a member of a facility
+	IsMember(ctx context.Context, courtID, userID string) (bool, error)
+
+	// AddMember makes a user a member of a facility
+	AddMember(ctx context.Context, courtID, userID string) error
+}
+
+// BookingFilter selects the bookings listed by ListBookings; empty fields
+// match every booking
+type BookingFilter struct {
+	UserID   string // Bookings the user organized or is a player of
+	CourtID  string
+	Date     string
+	SeriesID string
+
+	// Visible restricts the bookings to those a user may see, unless nil
+	Visible *Visibility
+}
+
+// Visibility restricts listed bookings to those a user organized or is a
+// player of, and those at the facilities they work at
+type Visibility struct {
+	UserID   string
+	CourtIDs []string
+}
+
+// BookingRepository keeps bookings. Active bookings, which are all but
+// cancelled ones, never overlap on a court unit. Bookings are returned with
+// their players, and with PlayerEmails listing the players' emails. Changes
+// queue the emails they are given about them in the outbox in the same
+// transaction, so the emails go out if and only if the change is made.
+type BookingRepository interface {
+	// InsertBooking creates a booking with its players; PlayerEmails is
+	// ignored. It fails with ErrOverlap if the booking is active and
+	// overlaps another active booking of its unit.
+	InsertBooking(ctx context.Context, booking *proto.Booking, messages ...*notifications.Message) error
+
+	// GetBooking returns a booking
+	GetBooking(ctx context.Context, bookingID string) (*proto.Booking, error)
+
+	// SetPlayers replaces the players of a booking, keeping their order.
+	// Players are the organizer's guests and other users; an email is
+	// listed at most once, or ErrConflict is returned.
+	SetPlayers(ctx context.Context, bookingID string, players []*proto.BookingPlayer, messages ...*notifications.Message) error
+
+	// UpdatePlayer records the answer of the booking's player with the
+	// email of player: its user, status and response time. It fails with
+	// ErrNotFound if the booking has no such player.
+	UpdatePlayer(ctx context.Context, bookingID string, player *proto.BookingPlayer) error
+
+	// ListBookings returns the bookings matching the filter, ordered by
+	// date and start time
+	ListBookings(ctx context.Context, filter BookingFilter) ([]*proto.Booking, error)
+
+	// Booked returns what active bookings of a facility occupy between two
+	// dates (inclusive), keyed by date, ignoring the booking excludeID
+	Booked(ctx context.Context, courtID, fromDate, toDate, excludeID string) (map[string][]schedule.Booked, error)
+
+	// UpdateBookings moves bookings to the unit, times, number of players
+	// and price they are given with, all or none. It fails with ErrOverlap
+	// if a booking would overlap another, and with ErrNotFound for unknown
+	// bookings.
+	UpdateBookings(ctx context.Context, bookings []*proto.Booking, messages ...*notifications.Message) error
+
+	// ConfirmBooking confirms a pending booking whose hold has not expired
+	// at the given time, and marks the waitlist offer it holds the slot of
+	// claimed. It fails with ErrStale otherwise.
+	ConfirmBooking(ctx context.Context, bookingID string, at time.Time, messages ...*notifications.Message) error
+
+	// CancelBookings cancels bookings with the outcome of their
+	// cancellation, all or none, and declines the waitlist offers they hold
+	// the slots of
+	CancelBookings(ctx context.Context, cancellations []*proto.Cancellation, at time.Time, messages ...*notifications.Message) error
+
+	// MarkNoShow marks a confirmed booking as a no-show with the rule and
+	// fee that apply, or fails with ErrStale if it is not confirmed
+	MarkNoShow(ctx context.Context, bookingID, rule string, feeCents int64, at time.Time) error
+
+	// ExpireHolds cancels the pending bookings whose hold expired by the
+	// given time and returns them
+	ExpireHolds(ctx context.Context, at time.Time) ([]*proto.Booking, error)
+}
+
+// SeriesRepository keeps recurring bookings; their occurrences are bookings
+// with the series ID. A series lists the emails its occurrences invite;
+// the answers of the players are kept with each occurrence.
+type SeriesRepository interface {
+	// InsertSeries creates a series
+	InsertSeries(ctx context.Context, series *proto.BookingSeries) error
+
+	// GetSeries returns a series
+	GetSeries(ctx context.Context, seriesID string) (*proto.BookingSeries, error)
+
+	// DeleteSeries deletes a series none of whose occurrences was booked
+	DeleteSeries(ctx context.Context, seriesID string) error
+
+	// CancelSeries marks a series cancelled
+	CancelSeries(ctx context.Context, seriesID string, at time.Time) error
+}
+
+// WaitlistFilter selects the entries listed by ListEntries; empty fields
+// match every entry
+type WaitlistFilter struct {
+	UserID   string
+	CourtID  string
+	Date     string
+	Statuses []proto.WaitlistStatus
+}
+
+// WaitlistRepository keeps the users waiting for fully booked slots. An
+// offer holds the freed slot for the user as a pending booking. Like series,
+// entries list the emails the offered booking invites.
+type WaitlistRepository interface {
+	// InsertEntry puts a user in line. It fails with ErrConflict if the
+	// user is already waiting for, or was offered, the same slot.
+	InsertEntry(ctx context.Context, entry *proto.WaitlistEntry) error
+
+	// GetEntry returns a waitlist entry
+	GetEntry(ctx context.Context, entryID string) (*proto.WaitlistEntry, error)
+
+	// ListEntries returns the entries matching the filter, in the order
+	// they were created
+	ListEntries(ctx context.Context, filter WaitlistFilter) ([]*proto.WaitlistEntry, error)
+
+	// OfferEntry marks a waiting entry offered until expiresAt, or fails
+	// with ErrStale if it is no longer waiting
+	OfferEntry(ctx context.Context, entryID string, expiresAt, at time.Time) error
+
+	// AttachBooking records the booking holding the slot offered to an entry
+	AttachBooking(ctx context.Context, entryID, bookingID string) error
+
+	// ReturnEntry puts an offered entry back in line, for offers whose slot
+	// could not be held
+	ReturnEntry(ctx context.Context, entryID string) error
+
+	// LeaveEntry takes an entry with the given status off the waitlist and
+	// cancels the booking of its offer, if pending. It fails with ErrStale
+	// if the entry no longer has that status.
+	LeaveEntry(ctx context.Context, entryID string, from proto.WaitlistStatus, at time.Time) error
+
+	// ExpireOffer marks an offered entry expired and cancels the booking of
+	// the offer, if pending. It fails with ErrStale if the entry is no
+	// longer offered.
+	ExpireOffer(ctx context.Context, entryID string, at time.Time) error
+}
+
+// Payment is a payment collected for a booking through a provider
+type Payment struct {
+	ID            string
+	BookingID     string
+	Provider      string
+	IntentID      string // ID of the intent with the provider
+	AmountCents   int64
+	RefundedCents int64
+	Currency      string
+	Status        string // One of the payments.Status* values
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// PaymentRepository keeps payments. A booking has at most one active
+// payment, which still holds or may still collect money.
+type PaymentRepository interface {
+	// InsertPayment records a payment. It fails with ErrConflict if the
+	// booking already has an active payment or the intent is recorded.
+	InsertPayment(ctx context.Context, payment *Payment) error
+
+	// LatestPayment returns the payment of a booking created last
+	LatestPayment(ctx context.Context, bookingID string) (*Payment, error)
+
+	// ActivePayments returns the active payments of bookings
+	ActivePayments(ctx context.Context, bookingIDs []string) ([]*Payment, error)
+
+	// UpdatePayment records the status and refunded amount of a payment
+	UpdatePayment(ctx context.Context, payment *Payment) error
+
+	// UpdateIntentStatus moves the payment of an intent from one status to
+	// another, or fails with ErrStale if it is unknown or has another status
+	UpdateIntentStatus(ctx context.Context, provider, intentID, from, to string, at time.Time) error
+}
+
+// activePaymentStatuses are the statuses of active payments
+var activePaymentStatuses = []string{
+	payments.StatusRequiresPayment,
+	payments.StatusAuthorized,
+	payments.StatusCaptured,
+	payments.StatusPartiallyRefunded,
+}
+
+// activePayment reports whether a payment is active
+func activePayment(payment *Payment) bool {
+	return payments.Intent{Status: payment.Status}.Active()
+}
+
+// User is a user of the app
+type User struct {
+	ID            string
+	Email         string
+	Name          string
+	Picture       string
+	PlatformAdmin bool
+	// ServiceAccount is set for the users facilities' API keys act as, who
+	// have no identity to log in with
+	ServiceAccount bool
+	CreatedAt      time.Time
+}
+
+// Identity links an account at an identity provider to the user it logs in
+type Identity struct {
+	Provider  string // e.g. google, or email for magic links
+	Subject   string // The provider's ID of the account
+	UserID    string
+	CreatedAt time.Time
+}
+
+// StaffRole is a role a user holds at a facility, staff or facility_admin
+type StaffRole struct {
+	CourtID string
+	Role    string
+}
+
+// UserRepository keeps users, the identities they log in with and the roles
+// they hold at facilities
+type UserRepository interface {
+	// CreateUser creates a user; emails are unique
+	CreateUser(ctx context.Context, user *User) error
+
+	// GetUser returns a user
+	GetUser(ctx context.Context, userID string) (*User, error)
+
+	// GetUserByEmail returns the user with an email address, ignoring case
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+
+	// UpdateProfile changes the name and picture of a user; empty values
+	// keep the current ones
+	UpdateProfile(ctx context.Context, userID, name, picture string) error
+
+	// GetIdentity returns the identity of a provider's account
+	GetIdentity(ctx context.Context, provider, subject string) (*Identity, error)
+
+	// LinkIdentity links an identity to its user. It fails with ErrConflict
+	// if the account is linked already, and ErrNotFound for unknown users.
+	LinkIdentity(ctx context.Context, identity *Identity) error
+
+	// GrantRole gives a user a role at a facility, replacing the one they
+	// held there. Unknown users and facilities fail with ErrNotFound.
+	GrantRole(ctx context.Context, courtID, userID, role string) error
+
+	// ListRoles returns the roles a user holds, ordered by facility
+	ListRoles(ctx context.Context, userID string) ([]StaffRole, error)
+}
+
+// OutboxRepository keeps the emails waiting to be sent, see
+// notifications.Outbox. Messages are claimed by a delivery for a lease, so
+// they are sent without holding locks, and the messages of a delivery that
+// stopped are claimed again once its lease is over. Each claim counts as an
+// attempt.
+type OutboxRepository interface {
+	// Enqueue queues messages to be sent now. A message with the key of a
+	// message already queued is dropped.
+	Enqueue(ctx context.Context, messages ...*notifications.Message) error
+
+	// ClaimMessages claims up to limit of the pending messages due by at,
+	// those due first, and puts their next attempt off until the lease is
+	// over
+	ClaimMessages(ctx context.Context, at time.Time, lease time.Duration, limit int) ([]*notifications.Queued, error)
+
+	// MarkSent marks a pending message sent
+	MarkSent(ctx context.Context, id string, at time.Time) error
+
+	// MarkFailed records the error of a failed attempt at a message, which
+	// is retried at retryAt or, if retryAt is zero, marked failed. Messages
+	// claimed again since the attempt, or no longer pending, are left alone.
+	MarkFailed(ctx context.Context, id string, attempt int, lastError string, retryAt time.Time) error
+}
+
+// Reasons recorded when a session is revoked
+const (
+	RevokedLogout    = "LOGOUT"     // The user logged out of the session
+	RevokedLogoutAll = "LOGOUT_ALL" // The user logged out everywhere
+	RevokedReuse     = "REUSE"      // A spent refresh token or login code was presented again
+)
+
+// Session is a login of a user on a device. Its refresh tokens form a
+// family: each refresh spends the current token for a new one.
+type Session struct {
+	ID        string
+	UserID    string
+	UserAgent string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// SessionRepository keeps login sessions with their refresh tokens and the
+// login codes redeemed for their first access token. Tokens and codes are
+// kept as hashes. A session is live until it expires or is revoked;
+// presenting one of its spent tokens or codes again revokes it with
+// RevokedReuse, since they may have been stolen.
+type SessionRepository interface {
+	// CreateSession creates a session with its first refresh token
+	CreateSession(ctx context.Context, session *Session, tokenHash string) error
+
+	// RotateRefreshToken spends a refresh token of a live session, adds the
+	// next one to the session and returns the session. Unknown tokens and
+	// those of sessions that are not live at the given time fail with
+	// ErrNotFound, spent tokens with ErrReused.
+	RotateRefreshToken(ctx context.Context, tokenHash, nextHash string, at time.Time) (*Session, error)
+
+	// CreateLoginCode creates a login code of a session, valid until
+	// expiresAt
+	CreateLoginCode(ctx context.Context, codeHash, sessionID string, at, expiresAt time.Time) error
+
+	// RedeemLoginCode spends a login code and returns its session. Spent
+	// codes fail with ErrReused, and unknown codes, expired ones and those
+	// of sessions that are not live at the given time with ErrNotFound.
+	RedeemLoginCode(ctx context.Context, codeHash string, at time.Time) (*Session, error)
+
+	// GetSessionByRefreshToken returns the session of a refresh token,
+	// spent or not
+	GetSessionByRefreshToken(ctx context.Context, tokenHash string) (*Session, error)
+
+	// RevokeSession revokes a session for a reason, unless it was revoked
+	// already
+	RevokeSession(ctx context.Context, sessionID, reason string, at time.Time) error
+
+	// RevokeUserSessions revokes the sessions of a user that were not
+	// revoked already
+	RevokeUserSessions(ctx context.Context, userID, reason string, at time.Time) error
+
+	// SessionLive reports whether a session is live at the given time
+	SessionLive(ctx context.Context, sessionID string, at time.Time) (bool, error)
+}
+
+// APIKey is a key for the API acting as its user; only the hash of its
+// secret is kept
+type APIKey struct {
+	ID         string
+	UserID     string
+	CourtID    string // Facility of service account keys
+	Name       string
+	SecretHash string
+	Scopes     []string
+	RateLimit  int // Requests per minute
+	CreatedBy  string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	ExpiresAt  *time.Time
+	RevokedAt  *time.Time
+}
+
+// APIKeyRepository keeps API keys
+type APIKeyRepository interface {
+	// CreateAPIKey creates an API key. With an account, the service account
+	// the key acts as is created in the same transaction, holding role at
+	// the key's facility. Unknown users and facilities fail with
+	// ErrNotFound.
+	CreateAPIKey(ctx context.Context, key *APIKey, account *User, role string) error
+
+	// GetAPIKey returns an API key, revoked and expired ones included
+	GetAPIKey(ctx context.Context, keyID string) (*APIKey, error)
+
+	// ListUserAPIKeys returns the personal keys of a user, newest first
+	ListUserAPIKeys(ctx context.Context, userID string) ([]*APIKey, error)
+
+	// ListCourtAPIKeys returns the service account keys of a facility,
+	// newest first
+	ListCourtAPIKeys(ctx context.Context, courtID string) ([]*APIKey, error)
+
+	// RevokeAPIKey revokes a key, or fails with ErrNotFound if it is unknown
+	// or revoked already
+	RevokeAPIKey(ctx context.Context, keyID string, at time.Time) error
+
+	// MarkAPIKeyUsed records that a key was used at the given time, unless
+	// it was recorded used since then
+	MarkAPIKeyUsed(ctx context.Context, keyID string, at, since time.Time) error
+}
+
+// MagicLinkRepository keeps the login links sent by email, by the hashes of
+// their tokens
+type MagicLinkRepository interface {
+	// CreateMagicLink creates a link sent to an email address, valid until
+	// expiresAt
+	CreateMagicLink(ctx context.Context, tokenHash, email string, at, expiresAt time.Time) error
+
+	// ConsumeMagicLink spends a link that is unused and valid at the given
+	// time, and returns the email address it was sent to. Other links fail
+	// with ErrNotFound.
+	ConsumeMagicLink(ctx context.Context, tokenHash string, at time.Time) (string, error)
+}
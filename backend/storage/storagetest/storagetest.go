@@ -0,0 +1,1547 @@
+// pickle/backend/storage/storagetest/storagetest.go
+
+// Package storagetest checks that implementations of the storage
+// repositories behave the same.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/carlostbanks/pickle/notifications"
+	"github.com/carlostbanks/pickle/payments"
+	"github.com/carlostbanks/pickle/proto"
+	"github.com/carlostbanks/pickle/storage"
+	"github.com/google/uuid"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+// Run checks the stores returned by newStore against the behavior documented
+// by the storage package. Each check gets a store of its own. Records get
+// fresh IDs, so stores may share a database holding other data; they are
+// left behind afterwards.
+func Run(t *testing.T, newStore func(t *testing.T) *storage.Store) {
+	checks := []struct {
+		name string
+		run  func(s *suite, t *testing.T)
+	}{
+		{"Users", (*suite).users},
+		{"Identities", (*suite).identities},
+		{"Roles", (*suite).roles},
+		{"Courts", (*suite).courts},
+		{"Calendar", (*suite).calendar},
+		{"Bookings", (*suite).bookings},
+		{"ConcurrentBookings", (*suite).concurrentBookings},
+		{"Players", (*suite).players},
+		{"CourtAdmin", (*suite).courtAdmin},
+		{"Prices", (*suite).prices},
+		{"Transitions", (*suite).transitions},
+		{"Series", (*suite).series},
+		{"Waitlist", (*suite).waitlist},
+		{"Payments", (*suite).payments},
+		{"Outbox", (*suite).outbox},
+		{"Sessions", (*suite).sessions},
+		{"LoginCodes", (*suite).loginCodes},
+		{"APIKeys", (*suite).apiKeys},
+		{"MagicLinks", (*suite).magicLinks},
+	}
+	for _, check := range checks {
+		t.Run(check.name, func(t *testing.T) {
+			s := &suite{store: newStore(t), prefix: uuid.New().String()[:8], ctx: context.Background()}
+			check.run(s, t)
+		})
+	}
+}
+
+// suite holds the records a check works with
+type suite struct {
+	store  *storage.Store
+	prefix string // Makes the IDs, emails and addresses of a check unique
+	ctx    context.Context
+
+	player, other string // User IDs
+	court         *proto.Court
+	nearby        string // Court ID
+	elsewhere     string // Court ID
+}
+
+// id returns a unique ID for a record of the check
+func (s *suite) id(name string) string {
+	return s.prefix + "-" + name
+}
+
+// town is where the first two facilities of the check are
+func (s *suite) town() string {
+	return "Town " + s.prefix
+}
+
+// seed creates two users and three facilities: s.court with two units and a
+// calendar, s.nearby about 8.5 km east of it with one unit, and s.elsewhere
+// in another town without units
+func (s *suite) seed(t *testing.T) {
+	t.Helper()
+	s.player, s.other = s.id("player"), s.id("other")
+
+	users := []*storage.User{
+		{ID: s.player, Email: s.player + "@example.com", Name: "Suite Player", Picture: "https://example.com/player.png", CreatedAt: time.Now()},
+		{ID: s.other, Email: s.other + "@example.com", Name: "Suite Other", CreatedAt: time.Now()},
+	}
+	for _, user := range users {
+		if err := s.store.Users.CreateUser(s.ctx, user); err != nil {
+			t.Fatalf("creating user %s: %v", user.ID, err)
+		}
+	}
+
+	s.court = &proto.Court{
+		Id:             s.id("court"),
+		Name:           "Suite " + s.prefix + " 1",
+		Address:        "1 Main St, " + s.town(),
+		Latitude:       40.0,
+		Longitude:      -75.0,
+		NumberOfCourts: 2,
+		MaxPlayers:     6,
+		Amenities:      []string{"lights", "parking"},
+		ImageUrl:       "https://example.com/court.png",
+		Units: []*proto.CourtUnit{
+			{Id: s.id("court-2"), Name: "Court 2", Position: 2},
+			{Id: s.id("court-1"), Name: "Court 1", Position: 1},
+		},
+		OpeningHours: []*proto.OpeningHours{
+			{Weekday: 3, OpenTime: "08:00", CloseTime: "22:00"},
+			{Weekday: 1, OpenTime: "07:00", CloseTime: "21:00"},
+		},
+		HourExceptions: []*proto.HoursException{
+			{Date: "2030-01-20", OpenTime: "10:00", CloseTime: "14:00", Reason: "Tournament"},
+			{Date: "2030-01-10", Closed: true, Reason: "Holiday"},
+		},
+		Blackouts: []*proto.Blackout{
+			{Id: s.id("blackout-2"), StartsAt: "2030-01-25T00:00:00", EndsAt: "2030-01-26T00:00:00", Reason: "Resurfacing"},
+			{Id: s.id("blackout-1"), CourtUnitId: s.id("court-1"), StartsAt: "2030-01-15T10:00:00", EndsAt: "2030-01-15T12:00:00"},
+		},
+	}
+	nearby := &proto.Court{
+		Id:             s.id("nearby"),
+		Name:           "Suite " + s.prefix + " 2",
+		Address:        "2 Main St, " + s.town(),
+		Latitude:       40.0,
+		Longitude:      -74.9,
+		NumberOfCourts: 1,
+		MaxPlayers:     4,
+		Units:          []*proto.CourtUnit{{Id: s.id("nearby-1"), Name: "Court 1", Position: 1}},
+	}
+	elsewhere := &proto.Court{
+		Id:             s.id("elsewhere"),
+		Name:           "Suite " + s.prefix + " 3",
+		Address:        "3 Main St, Elsewhere " + s.prefix,
+		Latitude:       40.0,
+		Longitude:      -75.0,
+		NumberOfCourts: 1,
+		MaxPlayers:     4,
+	}
+	for _, court := range []*proto.Court{s.court, nearby, elsewhere} {
+		if err := s.store.Courts.CreateCourt(s.ctx, court); err != nil {
+			t.Fatalf("creating court %s: %v", court.Id, err)
+		}
+	}
+	s.nearby, s.elsewhere = nearby.Id, elsewhere.Id
+}
+
+// booking returns a booking of the check on 2030-02-01, with one guest
+func (s *suite) booking(name, userID, courtID, unitID, startTime, endTime string, status proto.BookingStatus) *proto.Booking {
+	now := time.Now().Format(time.RFC3339)
+	return &proto.Booking{
+		Id:              s.id(name),
+		CourtId:         courtID,
+		CourtUnitId:     unitID,
+		UserId:          userID,
+		Date:            "2030-02-01",
+		StartTime:       startTime,
+		EndTime:         endTime,
+		NumberOfPlayers: 4,
+		Players:         []*proto.BookingPlayer{{Email: "partner@example.com"}},
+		PriceCents:      2500,
+		Currency:        "USD",
+		Status:          status,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+}
+
+// insert inserts bookings that must be accepted
+func (s *suite) insert(t *testing.T, bookings ...*proto.Booking) {
+	t.Helper()
+	for _, booking := range bookings {
+		if err := s.store.Bookings.InsertBooking(s.ctx, booking); err != nil {
+			t.Fatalf("inserting booking %s: %v", booking.Id, err)
+		}
+	}
+}
+
+// names returns the IDs of bookings without the prefix of the check
+func (s *suite) names(bookings []*proto.Booking) []string {
+	var names []string
+	for _, booking := range bookings {
+		names = append(names, booking.Id[len(s.prefix)+1:])
+	}
+	return names
+}
+
+// users checks creating and finding users
+func (s *suite) users(t *testing.T) {
+	repo := s.store.Users
+	s.seed(t)
+
+	got, err := repo.GetUser(s.ctx, s.player)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != s.player || got.Email != s.player+"@example.com" || got.Name != "Suite Player" ||
+		got.Picture != "https://example.com/player.png" || got.PlatformAdmin {
+		t.Errorf("GetUser returned %+v", got)
+	}
+
+	got, err = repo.GetUserByEmail(s.ctx, s.player+"@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != s.player {
+		t.Errorf("GetUserByEmail returned user %s, expected %s", got.ID, s.player)
+	}
+
+	err = repo.CreateUser(s.ctx, &storage.User{ID: s.id("copy"), Email: s.player + "@example.com", Name: "Copy", CreatedAt: time.Now()})
+	expect(t, err, storage.ErrConflict, "creating a user with a taken email")
+	err = repo.CreateUser(s.ctx, &storage.User{ID: s.player, Email: s.id("copy") + "@example.com", Name: "Copy", CreatedAt: time.Now()})
+	expect(t, err, storage.ErrConflict, "creating a user with a taken ID")
+
+	_, err = repo.GetUser(s.ctx, s.id("nobody"))
+	expect(t, err, storage.ErrNotFound, "getting an unknown user")
+	_, err = repo.GetUserByEmail(s.ctx, s.id("nobody")+"@example.com")
+	expect(t, err, storage.ErrNotFound, "getting an unknown email")
+
+	// Emails are found whatever their case
+	got, err = repo.GetUserByEmail(s.ctx, strings.ToUpper(s.player)+"@Example.com")
+	if err != nil || got.ID != s.player {
+		t.Errorf("GetUserByEmail in upper case returned %+v, %v", got, err)
+	}
+
+	// Empty values keep the profile as it was
+	expect(t, repo.UpdateProfile(s.ctx, s.player, "Renamed Player", ""), nil, "renaming a user")
+	if got, err = repo.GetUser(s.ctx, s.player); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "Renamed Player" || got.Picture != "https://example.com/player.png" {
+		t.Errorf("updated profile is %+v", got)
+	}
+	expect(t, repo.UpdateProfile(s.ctx, s.id("nobody"), "Nobody", ""), storage.ErrNotFound, "updating an unknown user")
+}
+
+// identities checks linking the accounts users log in with
+func (s *suite) identities(t *testing.T) {
+	repo := s.store.Users
+	s.seed(t)
+	subject := s.id("subject")
+
+	_, err := repo.GetIdentity(s.ctx, "google", subject)
+	expect(t, err, storage.ErrNotFound, "getting an unlinked identity")
+
+	identity := &storage.Identity{Provider: "google", Subject: subject, UserID: s.player, CreatedAt: time.Now()}
+	expect(t, repo.LinkIdentity(s.ctx, identity), nil, "linking an identity")
+	got, err := repo.GetIdentity(s.ctx, "google", subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UserID != s.player || got.Provider != "google" || got.Subject != subject {
+		t.Errorf("GetIdentity returned %+v", got)
+	}
+
+	// The same subject at another provider is another account
+	_, err = repo.GetIdentity(s.ctx, "email", subject)
+	expect(t, err, storage.ErrNotFound, "getting the subject at another provider")
+	expect(t, repo.LinkIdentity(s.ctx, &storage.Identity{Provider: "email", Subject: subject, UserID: s.other, CreatedAt: time.Now()}),
+		nil, "linking the subject at another provider")
+
+	expect(t, repo.LinkIdentity(s.ctx, &storage.Identity{Provider: "google", Subject: subject, UserID: s.other, CreatedAt: time.Now()}),
+		storage.ErrConflict, "linking a linked identity")
+	expect(t, repo.LinkIdentity(s.ctx, &storage.Identity{Provider: "google", Subject: s.id("other"), UserID: s.id("nobody"), CreatedAt: time.Now()}),
+		storage.ErrNotFound, "linking an identity to an unknown user")
+}
+
+// roles checks the roles users hold at facilities
+func (s *suite) roles(t *testing.T) {
+	repo := s.store.Users
+	s.seed(t)
+
+	roles, err := repo.ListRoles(s.ctx, s.player)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 0 {
+		t.Errorf("a new user holds %v", roles)
+	}
+
+	expect(t, repo.GrantRole(s.ctx, s.nearby, s.player, "staff"), nil, "granting staff")
+	expect(t, repo.GrantRole(s.ctx, s.court.Id, s.player, "staff"), nil, "granting staff at another facility")
+	expect(t, repo.GrantRole(s.ctx, s.court.Id, s.player, "facility_admin"), nil, "promoting to facility admin")
+	expect(t, repo.GrantRole(s.ctx, s.id("nowhere"), s.player, "staff"), storage.ErrNotFound, "granting a role at an unknown facility")
+	expect(t, repo.GrantRole(s.ctx, s.court.Id, s.id("nobody"), "staff"), storage.ErrNotFound, "granting a role to an unknown user")
+
+	if roles, err = repo.ListRoles(s.ctx, s.player); err != nil {
+		t.Fatal(err)
+	}
+	want := []storage.StaffRole{{CourtID: s.court.Id, Role: "facility_admin"}, {CourtID: s.nearby, Role: "staff"}}
+	if fmt.Sprint(roles) != fmt.Sprint(want) {
+		t.Errorf("ListRoles returned %v, expected %v", roles, want)
+	}
+	if roles, err = repo.ListRoles(s.ctx, s.other); err != nil || len(roles) != 0 {
+		t.Errorf("another user holds %v, %v", roles, err)
+	}
+}
+
+// courts checks creating, getting and searching facilities
+func (s *suite) courts(t *testing.T) {
+	repo := s.store.Courts
+	s.seed(t)
+
+	err := repo.CreateCourt(s.ctx, &proto.Court{Id: s.court.Id, Name: "Copy", Address: s.town(), NumberOfCourts: 1, MaxPlayers: 4})
+	expect(t, err, storage.ErrConflict, "creating a court with a taken ID")
+
+	got, err := repo.GetCourt(s.ctx, s.court.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != s.court.Name || got.Address != s.court.Address || got.Latitude != s.court.Latitude ||
+		got.NumberOfCourts != s.court.NumberOfCourts || got.MaxPlayers != s.court.MaxPlayers || got.ImageUrl != s.court.ImageUrl ||
+		fmt.Sprint(got.Amenities) != fmt.Sprint(s.court.Amenities) || got.ArchivedAt != "" {
+		t.Errorf("GetCourt returned %v", got)
+	}
+	if len(got.Units) != 0 || len(got.OpeningHours) != 0 || len(got.Blackouts) != 0 {
+		t.Error("GetCourt returned units or a calendar")
+	}
+	_, err = repo.GetCourt(s.ctx, s.id("nowhere"))
+	expect(t, err, storage.ErrNotFound, "getting an unknown court")
+
+	searches := []struct {
+		filter storage.CourtFilter
+		want   []string
+	}{
+		{storage.CourtFilter{City: s.town()}, []string{s.court.Id, s.nearby}},
+		{storage.CourtFilter{City: s.town(), Latitude: 40.0, Longitude: -75.0, RadiusKm: 5}, []string{s.court.Id}},
+		{storage.CourtFilter{City: s.town(), Latitude: 40.0, Longitude: -75.0, RadiusKm: 10}, []string{s.court.Id, s.nearby}},
+		{storage.CourtFilter{City: "Elsewhere " + s.prefix}, []string{s.elsewhere}},
+	}
+	for _, search := range searches {
+		courts, err := repo.ListCourts(s.ctx, search.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, court := range courts {
+			ids = append(ids, court.Id)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(search.want) {
+			t.Errorf("ListCourts(%+v) returned %v, expected %v", search.filter, ids, search.want)
+		}
+	}
+
+	units, err := repo.ListUnits(s.ctx, s.court.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(units) != 2 || units[0].Id != s.id("court-1") || units[1].Id != s.id("court-2") || units[0].CourtId != s.court.Id {
+		t.Errorf("ListUnits returned %v, expected the units by position", units)
+	}
+}
+
+// calendar checks loading opening hours, exceptions and blackouts by date
+func (s *suite) calendar(t *testing.T) {
+	s.seed(t)
+
+	ranges := []struct {
+		from, to   string
+		exceptions []string // Dates
+		blackouts  []string // IDs
+	}{
+		{"2030-01-12", "2030-01-20", []string{"2030-01-20"}, []string{s.id("blackout-1")}},
+		{"2030-01-01", "", []string{"2030-01-10", "2030-01-20"}, []string{s.id("blackout-1"), s.id("blackout-2")}},
+		{"2030-01-15", "2030-01-15", nil, []string{s.id("blackout-1")}},
+		// A blackout ending at midnight is over on the next day
+		{"2030-01-26", "2030-01-26", nil, nil},
+	}
+
+	for _, r := range ranges {
+		court := &proto.Court{Id: s.court.Id}
+		if err := s.store.Courts.LoadCalendar(s.ctx, court, r.from, r.to); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(court.OpeningHours) != 2 || court.OpeningHours[0].Weekday != 1 ||
+			court.OpeningHours[0].OpenTime != "07:00" || court.OpeningHours[0].CloseTime != "21:00" {
+			t.Errorf("LoadCalendar returned opening hours %v, expected them by weekday", court.OpeningHours)
+		}
+
+		var dates, ids []string
+		for _, ex := range court.HourExceptions {
+			dates = append(dates, ex.Date)
+			if ex.Date == "2030-01-20" && (ex.Closed || ex.OpenTime != "10:00" || ex.CloseTime != "14:00" || ex.Reason != "Tournament") {
+				t.Errorf("LoadCalendar returned exception %v", ex)
+			}
+		}
+		for _, b := range court.Blackouts {
+			ids = append(ids, b.Id)
+			if b.Id == s.id("blackout-1") && (b.CourtUnitId != s.id("court-1") || b.StartsAt != "2030-01-15T10:00:00" || b.EndsAt != "2030-01-15T12:00:00") {
+				t.Errorf("LoadCalendar returned blackout %v", b)
+			}
+		}
+		if fmt.Sprint(dates) != fmt.Sprint(r.exceptions) || fmt.Sprint(ids) != fmt.Sprint(r.blackouts) {
+			t.Errorf("LoadCalendar from %q to %q returned exceptions %v and blackouts %v, expected %v and %v",
+				r.from, r.to, dates, ids, r.exceptions, r.blackouts)
+		}
+	}
+}
+
+// bookings checks that active bookings never overlap on a unit, and finding
+// bookings
+func (s *suite) bookings(t *testing.T) {
+	repo := s.store.Bookings
+	s.seed(t)
+	date := "2030-02-01"
+	unit1, unit2 := s.id("court-1"), s.id("court-2")
+
+	inserts := []struct {
+		booking *proto.Booking
+		want    error
+		step    string
+	}{
+		{s.booking("booking-1", s.player, s.court.Id, unit1, "10:00", "11:00", proto.BookingStatus_CONFIRMED), nil, "booking a free unit"},
+		{s.booking("booking-2", s.player, s.court.Id, unit1, "10:30", "11:30", proto.BookingStatus_PENDING), storage.ErrOverlap, "booking an overlapping time"},
+		{s.booking("booking-3", s.player, s.court.Id, unit1, "11:00", "12:00", proto.BookingStatus_CONFIRMED), nil, "booking right after another booking"},
+		{s.booking("booking-4", s.player, s.court.Id, unit2, "10:00", "11:00", proto.BookingStatus_CONFIRMED), nil, "booking the same time on another unit"},
+		{s.booking("booking-5", s.player, s.court.Id, unit1, "10:00", "11:00", proto.BookingStatus_CANCELLED), nil, "inserting a cancelled booking over another booking"},
+		{s.booking("booking-6", s.other, s.nearby, s.id("nearby-1"), "09:00", "10:00", proto.BookingStatus_CONFIRMED), nil, "booking another facility"},
+		{s.booking("booking-1", s.player, s.court.Id, unit2, "15:00", "16:00", proto.BookingStatus_CONFIRMED), storage.ErrConflict, "inserting a booking with a taken ID"},
+		{s.booking("booking-7", s.player, s.id("nowhere"), "", "15:00", "16:00", proto.BookingStatus_CONFIRMED), storage.ErrNotFound, "booking an unknown court"},
+		{s.booking("booking-8", s.id("nobody"), s.court.Id, unit2, "15:00", "16:00", proto.BookingStatus_CONFIRMED), storage.ErrNotFound, "booking for an unknown user"},
+	}
+	for _, insert := range inserts {
+		expect(t, repo.InsertBooking(s.ctx, insert.booking), insert.want, insert.step)
+	}
+
+	got, err := repo.GetBooking(s.ctx, s.id("booking-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Date != date || got.StartTime != "10:00" || got.EndTime != "11:00" || got.CourtUnitId != unit1 ||
+		got.Status != proto.BookingStatus_CONFIRMED || got.PriceCents != 2500 || got.Currency != "USD" ||
+		fmt.Sprint(got.PlayerEmails) != "[partner@example.com]" || len(got.Players) != 1 ||
+		got.Players[0].Email != "partner@example.com" || got.Players[0].UserId != "" || got.Players[0].Status != proto.PlayerStatus_INVITED {
+		t.Errorf("GetBooking returned %v", got)
+	}
+	_, err = repo.GetBooking(s.ctx, s.id("booking-2"))
+	expect(t, err, storage.ErrNotFound, "getting a rejected booking")
+
+	booked, err := repo.Booked(s.ctx, s.court.Id, date, date, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(booked) != 1 || len(booked[date]) != 3 {
+		t.Errorf("Booked returned %v, expected the three active bookings", booked)
+	}
+	booked, err = repo.Booked(s.ctx, s.court.Id, date, date, s.id("booking-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(booked[date]) != 2 {
+		t.Errorf("Booked excluding a booking returned %v, expected two bookings", booked)
+	}
+
+	lists := []struct {
+		filter storage.BookingFilter
+		want   []string
+	}{
+		{storage.BookingFilter{CourtID: s.court.Id}, []string{"booking-1", "booking-4", "booking-5", "booking-3"}},
+		{storage.BookingFilter{UserID: s.other}, []string{"booking-6"}},
+		{storage.BookingFilter{CourtID: s.court.Id, Date: "2030-02-02"}, nil},
+		{storage.BookingFilter{Date: date, Visible: &storage.Visibility{UserID: s.other}}, []string{"booking-6"}},
+		{storage.BookingFilter{Date: date, Visible: &storage.Visibility{UserID: s.other, CourtIDs: []string{s.court.Id}}},
+			[]string{"booking-6", "booking-1", "booking-4", "booking-5", "booking-3"}},
+	}
+	for _, list := range lists {
+		bookings, err := repo.ListBookings(s.ctx, list.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := s.names(bookings); fmt.Sprint(names) != fmt.Sprint(list.want) {
+			t.Errorf("ListBookings(%+v) returned %v, expected %v", list.filter, names, list.want)
+		}
+		for _, booking := range bookings {
+			if len(booking.Players) != 1 || fmt.Sprint(booking.PlayerEmails) != "[partner@example.com]" {
+				t.Errorf("ListBookings returned %v without its players", booking)
+			}
+		}
+	}
+}
+
+// concurrentBookings checks that of overlapping bookings inserted at the
+// same time, only one is accepted
+func (s *suite) concurrentBookings(t *testing.T) {
+	s.seed(t)
+	const parallel = 10
+
+	// Every pair of the bookings overlaps from 10:30 to 11:00
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make([]error, parallel)
+	for i := range errs {
+		startTime, endTime := "10:00", "11:00"
+		if i%2 == 1 {
+			startTime, endTime = "10:30", "11:30"
+		}
+		booking := s.booking(fmt.Sprintf("parallel-%d", i), s.player, s.court.Id, s.id("court-1"),
+			startTime, endTime, proto.BookingStatus_CONFIRMED)
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			errs[i] = s.store.Bookings.InsertBooking(s.ctx, booking)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	inserted := 0
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			inserted++
+		case !errors.Is(err, storage.ErrOverlap):
+			t.Errorf("inserting booking %d: got %v, expected nil or %v", i, err, storage.ErrOverlap)
+		}
+	}
+	if inserted != 1 {
+		t.Errorf("%d of %d overlapping bookings were inserted, expected one", inserted, parallel)
+	}
+
+	bookings, err := s.store.Bookings.ListBookings(s.ctx, storage.BookingFilter{CourtID: s.court.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bookings) != 1 {
+		t.Errorf("store has %v, expected one booking", s.names(bookings))
+	}
+}
+
+// players checks the rosters of bookings
+func (s *suite) players(t *testing.T) {
+	repo := s.store.Bookings
+	s.seed(t)
+	s.insert(t,
+		s.booking("booking-1", s.player, s.court.Id, s.id("court-1"), "10:00", "11:00", proto.BookingStatus_CONFIRMED),
+		s.booking("booking-2", s.other, s.nearby, s.id("nearby-1"), "09:00", "10:00", proto.BookingStatus_CONFIRMED),
+	)
+	bookingID := s.id("booking-1")
+	otherEmail := s.other + "@example.com"
+
+	rejected := []struct {
+		players []*proto.BookingPlayer
+		want    error
+		step    string
+	}{
+		{[]*proto.BookingPlayer{{Email: "twice@example.com"}, {Email: "twice@example.com"}}, storage.ErrConflict, "listing a player twice"},
+		{[]*proto.BookingPlayer{{Email: "ghost@example.com", UserId: s.id("nobody")}}, storage.ErrNotFound, "listing an unknown user"},
+	}
+	for i, reject := range rejected {
+		insert := s.booking(fmt.Sprintf("rejected-%d", i), s.player, s.court.Id, s.id("court-2"), "10:00", "11:00", proto.BookingStatus_CONFIRMED)
+		insert.Players = reject.players
+		expect(t, repo.InsertBooking(s.ctx, insert), reject.want, "inserting a booking "+reject.step)
+		_, err := repo.GetBooking(s.ctx, insert.Id)
+		expect(t, err, storage.ErrNotFound, "getting a booking rejected for "+reject.step)
+		expect(t, repo.SetPlayers(s.ctx, bookingID, reject.players), reject.want, reject.step)
+	}
+
+	err := repo.SetPlayers(s.ctx, s.id("nowhere"), nil)
+	expect(t, err, storage.ErrNotFound, "setting the players of an unknown booking")
+
+	players := []*proto.BookingPlayer{
+		{Email: otherEmail, UserId: s.other, Status: proto.PlayerStatus_ACCEPTED, RespondedAt: "2030-01-31T12:00:00"},
+		{Email: "friend@example.com"},
+		{Email: "busy@example.com", Status: proto.PlayerStatus_DECLINED, RespondedAt: "2030-01-31T13:30:00"},
+	}
+	if err := repo.SetPlayers(s.ctx, bookingID, players); err != nil {
+		t.Fatal(err)
+	}
+	got, err := repo.GetBooking(s.ctx, bookingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPlayers(t, got, players)
+	if want := fmt.Sprint([]string{otherEmail, "friend@example.com", "busy@example.com"}); fmt.Sprint(got.PlayerEmails) != want {
+		t.Errorf("GetBooking returned player emails %v, expected %s", got.PlayerEmails, want)
+	}
+
+	// Players see the bookings they were invited to
+	for _, filter := range []storage.BookingFilter{
+		{UserID: s.other, Date: got.Date},
+		{Date: got.Date, Visible: &storage.Visibility{UserID: s.other}},
+	} {
+		bookings, err := repo.ListBookings(s.ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := s.names(bookings); fmt.Sprint(names) != "[booking-2 booking-1]" {
+			t.Errorf("ListBookings(%+v) for a player returned %v, expected [booking-2 booking-1]", filter, names)
+		}
+	}
+
+	answer := &proto.BookingPlayer{Email: "friend@example.com", UserId: s.player, Status: proto.PlayerStatus_ACCEPTED, RespondedAt: "2030-02-01T08:15:00"}
+	if err := repo.UpdatePlayer(s.ctx, bookingID, answer); err != nil {
+		t.Fatal(err)
+	}
+	unknown := []struct {
+		bookingID string
+		player    *proto.BookingPlayer
+		step      string
+	}{
+		{bookingID, &proto.BookingPlayer{Email: "stranger@example.com", Status: proto.PlayerStatus_ACCEPTED}, "answering for a player not invited"},
+		{s.id("nowhere"), answer, "answering for the player of an unknown booking"},
+		{bookingID, &proto.BookingPlayer{Email: "busy@example.com", UserId: s.id("nobody")}, "linking a player to an unknown user"},
+	}
+	for _, u := range unknown {
+		expect(t, repo.UpdatePlayer(s.ctx, u.bookingID, u.player), storage.ErrNotFound, u.step)
+	}
+	got, err = repo.GetBooking(s.ctx, bookingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	players[1] = answer
+	checkPlayers(t, got, players)
+
+	if err := repo.SetPlayers(s.ctx, bookingID, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err = repo.GetBooking(s.ctx, bookingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Players) != 0 || len(got.PlayerEmails) != 0 {
+		t.Errorf("GetBooking returned players %v after removing them", got.Players)
+	}
+}
+
+// courtAdmin checks changing the details and units of facilities, and
+// archiving them
+func (s *suite) courtAdmin(t *testing.T) {
+	repo := s.store.Courts
+	s.seed(t)
+	// The booking on unit 2 is in the past from 2030-02-02 on
+	s.insert(t, s.booking("booking-1", s.player, s.court.Id, s.id("court-2"), "10:00", "11:00", proto.BookingStatus_CONFIRMED))
+
+	update := &proto.Court{
+		Id:             s.court.Id,
+		Name:           "Renamed " + s.prefix,
+		Address:        s.court.Address,
+		Latitude:       41.0,
+		Longitude:      -75.0,
+		NumberOfCourts: 1,
+		MaxPlayers:     4,
+		Amenities:      []string{"lights"},
+		Units:          []*proto.CourtUnit{{Id: s.id("court-1"), Name: "Court 1", Position: 1}},
+	}
+	expect(t, repo.UpdateCourt(s.ctx, update, "2030-02-01"), storage.ErrBooked, "archiving a unit with upcoming bookings")
+	if err := repo.UpdateCourt(s.ctx, update, "2030-02-02"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := repo.GetCourt(s.ctx, s.court.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != update.Name || got.Latitude != 41.0 || got.NumberOfCourts != 1 || got.MaxPlayers != 4 ||
+		fmt.Sprint(got.Amenities) != "[lights]" || got.ImageUrl != "" {
+		t.Errorf("GetCourt returned %v after an update", got)
+	}
+	s.checkUnits(t, s.court.Id, s.id("court-1"))
+
+	// Units listed again are restored with their IDs; new ones are created
+	update.NumberOfCourts = 3
+	update.Units = append(update.Units,
+		&proto.CourtUnit{Id: s.id("court-2-again"), Name: "Court 2", Position: 2},
+		&proto.CourtUnit{Id: s.id("court-3"), Name: "Court 3", Position: 3},
+	)
+	if err := repo.UpdateCourt(s.ctx, update, "2030-02-02"); err != nil {
+		t.Fatal(err)
+	}
+	s.checkUnits(t, s.court.Id, s.id("court-1"), s.id("court-2"), s.id("court-3"))
+
+	err = repo.UpdateCourt(s.ctx, &proto.Court{Id: s.id("nowhere"), Name: "Nowhere", Address: s.town(), NumberOfCourts: 1, MaxPlayers: 4}, "2030-02-02")
+	expect(t, err, storage.ErrNotFound, "updating an unknown court")
+
+	expect(t, repo.ArchiveCourt(s.ctx, s.court.Id, "2030-02-01", time.Now()), storage.ErrBooked, "archiving a court with upcoming bookings")
+	expect(t, repo.ArchiveCourt(s.ctx, s.id("nowhere"), "2030-02-02", time.Now()), storage.ErrNotFound, "archiving an unknown court")
+	if err := repo.ArchiveCourt(s.ctx, s.court.Id, "2030-02-02", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	got, err = repo.GetCourt(s.ctx, s.court.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ArchivedAt == "" {
+		t.Error("GetCourt returned an archived court without its archiving time")
+	}
+	courts, err := repo.ListCourts(s.ctx, storage.CourtFilter{City: s.town()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(courts) != 1 || courts[0].Id != s.nearby {
+		t.Errorf("ListCourts returned %v, expected only the court not archived", courts)
+	}
+	expect(t, repo.UpdateCourt(s.ctx, update, "2030-02-02"), storage.ErrArchived, "updating an archived court")
+	expect(t, repo.ArchiveCourt(s.ctx, s.court.Id, "2030-02-02", time.Now()), storage.ErrArchived, "archiving a court twice")
+}
+
+// checkUnits checks the IDs of the units of a facility, by position
+func (s *suite) checkUnits(t *testing.T, courtID string, want ...string) {
+	t.Helper()
+	units, err := s.store.Courts.ListUnits(s.ctx, courtID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, unit := range units {
+		ids = append(ids, unit.Id)
+	}
+	if fmt.Sprint(ids) != fmt.Sprint(want) {
+		t.Errorf("ListUnits returned %v, expected %v", ids, want)
+	}
+}
+
+// prices checks price lists, cancellation policies and memberships
+func (s *suite) prices(t *testing.T) {
+	repo := s.store.Courts
+	s.seed(t)
+
+	rates, err := repo.GetRates(s.ctx, s.court.Id)
+	if err != nil || rates != nil {
+		t.Errorf("GetRates returned %v, %v for a court without rates", rates, err)
+	}
+	rates = &proto.CourtRates{
+		Currency:           "EUR",
+		GuestRateCents:     2000,
+		MemberRateCents:    1500,
+		MinDurationMinutes: 60,
+		PeakRates: []*proto.PeakRate{
+			{Weekday: 5, StartTime: "17:00", EndTime: "21:00", GuestRateCents: 3000, MemberRateCents: 2500},
+			{Weekday: 1, StartTime: "7:00", EndTime: "9:00", GuestRateCents: 2500, MemberRateCents: 2000},
+		},
+	}
+	if err := repo.SetRates(s.ctx, s.court.Id, rates); err != nil {
+		t.Fatal(err)
+	}
+	got, err := repo.GetRates(s.ctx, s.court.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Currency != "EUR" || got.GuestRateCents != 2000 || got.MemberRateCents != 1500 || got.MinDurationMinutes != 60 ||
+		len(got.PeakRates) != 2 || got.PeakRates[0].Weekday != 1 || got.PeakRates[0].StartTime != "07:00" ||
+		got.PeakRates[1].EndTime != "21:00" || got.PeakRates[1].MemberRateCents != 2500 {
+		t.Errorf("GetRates returned %v", got)
+	}
+	rates.PeakRates = append(rates.PeakRates, &proto.PeakRate{Weekday: 5, StartTime: "17:00", EndTime: "18:00"})
+	expect(t, repo.SetRates(s.ctx, s.court.Id, rates), storage.ErrConflict, "setting two peak rates starting together")
+	if got, err := repo.GetRates(s.ctx, s.court.Id); err != nil || len(got.PeakRates) != 2 {
+		t.Errorf("GetRates returned %v, %v after rejected rates, expected the previous rates", got, err)
+	}
+	if err := repo.SetRates(s.ctx, s.court.Id, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := repo.GetRates(s.ctx, s.court.Id); err != nil || got != nil {
+		t.Errorf("GetRates returned %v, %v after removing the rates", got, err)
+	}
+
+	policy := &proto.CancellationPolicy{FreeUntilHours: 48, PartialRefundUntilHours: 24, PartialRefundPercent: 50, NoCancelHours: 2, NoShowFeePercent: 100}
+	for _, p := range []*proto.CancellationPolicy{{FreeUntilHours: 1}, policy} {
+		if err := repo.SetCancellationPolicy(s.ctx, s.court.Id, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gotPolicy, err := repo.GetCancellationPolicy(s.ctx, s.court.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotPolicy.FreeUntilHours != 48 || gotPolicy.PartialRefundUntilHours != 24 || gotPolicy.PartialRefundPercent != 50 ||
+		gotPolicy.NoCancelHours != 2 || gotPolicy.NoShowFeePercent != 100 {
+		t.Errorf("GetCancellationPolicy returned %v, expected %v", gotPolicy, policy)
+	}
+	if err := repo.SetCancellationPolicy(s.ctx, s.court.Id, nil); err != nil {
+		t.Fatal(err)
+	}
+	if gotPolicy, err := repo.GetCancellationPolicy(s.ctx, s.court.Id); err != nil || gotPolicy != nil {
+		t.Errorf("GetCancellationPolicy returned %v, %v after removing the policy", gotPolicy, err)
+	}
+
+	if err := repo.AddMember(s.ctx, s.court.Id, s.player); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, repo.AddMember(s.ctx, s.court.Id, s.player), storage.ErrConflict, "adding a member twice")
+	expect(t, repo.AddMember(s.ctx, s.court.Id, s.id("nobody")), storage.ErrNotFound, "adding an unknown user")
+	for _, m := range []struct {
+		courtID, userID string
+		want            bool
+	}{
+		{s.court.Id, s.player, true},
+		{s.court.Id, s.other, false},
+		{s.nearby, s.player, false},
+	} {
+		if member, err := repo.IsMember(s.ctx, m.courtID, m.userID); err != nil || member != m.want {
+			t.Errorf("IsMember(%s, %s) returned %v, %v, expected %v", m.courtID, m.userID, member, err, m.want)
+		}
+	}
+}
+
+// transitions checks moving, confirming, cancelling and expiring bookings
+func (s *suite) transitions(t *testing.T) {
+	repo := s.store.Bookings
+	s.seed(t)
+	unit1, unit2 := s.id("court-1"), s.id("court-2")
+	now := time.Now()
+
+	held := s.booking("held", s.player, s.court.Id, unit2, "12:00", "13:00", proto.BookingStatus_PENDING)
+	held.HoldExpiresAt = now.Add(10 * time.Minute).Format("2006-01-02T15:04:05")
+	lapsed := s.booking("lapsed", s.player, s.court.Id, unit2, "14:00", "15:00", proto.BookingStatus_PENDING)
+	lapsed.HoldExpiresAt = now.Add(-time.Minute).Format("2006-01-02T15:04:05")
+	s.insert(t,
+		s.booking("booking-1", s.player, s.court.Id, unit1, "10:00", "11:00", proto.BookingStatus_CONFIRMED),
+		s.booking("booking-2", s.player, s.court.Id, unit1, "11:00", "12:00", proto.BookingStatus_CONFIRMED),
+		held, lapsed,
+	)
+
+	move := func(name, unitID, startTime, endTime string) *proto.Booking {
+		return &proto.Booking{Id: s.id(name), CourtUnitId: unitID, StartTime: startTime, EndTime: endTime,
+			NumberOfPlayers: 2, PriceCents: 3000, Currency: "USD", UpdatedAt: now.Format(time.RFC3339)}
+	}
+	err := repo.UpdateBookings(s.ctx, []*proto.Booking{move("booking-1", unit1, "9:30", "10:30"), move("booking-2", unit1, "10:00", "11:00")})
+	expect(t, err, storage.ErrOverlap, "moving a booking over another")
+	err = repo.UpdateBookings(s.ctx, []*proto.Booking{move("booking-1", unit1, "10:00", "11:00"), move("nowhere", unit1, "16:00", "17:00")})
+	expect(t, err, storage.ErrNotFound, "moving an unknown booking")
+	got, err := repo.GetBooking(s.ctx, s.id("booking-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CourtUnitId != unit1 || got.StartTime != "10:00" || got.NumberOfPlayers != 4 || got.PriceCents != 2500 {
+		t.Errorf("GetBooking returned %v after rejected moves, expected the booking unchanged", got)
+	}
+	if err := repo.UpdateBookings(s.ctx, []*proto.Booking{move("booking-1", unit2, "9:00", "10:00")}); err != nil {
+		t.Fatal(err)
+	}
+	got, err = repo.GetBooking(s.ctx, s.id("booking-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CourtUnitId != unit2 || got.StartTime != "09:00" || got.EndTime != "10:00" || got.NumberOfPlayers != 2 ||
+		got.PriceCents != 3000 || len(got.Players) != 1 {
+		t.Errorf("GetBooking returned %v after a move", got)
+	}
+
+	expect(t, repo.ConfirmBooking(s.ctx, lapsed.Id, now), storage.ErrStale, "confirming a lapsed hold")
+	expect(t, repo.ConfirmBooking(s.ctx, s.id("booking-2"), now), storage.ErrStale, "confirming a confirmed booking")
+	if err := repo.ConfirmBooking(s.ctx, held.Id, now); err != nil {
+		t.Fatal(err)
+	}
+	got, err = repo.GetBooking(s.ctx, held.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != proto.BookingStatus_CONFIRMED || got.HoldExpiresAt != "" {
+		t.Errorf("GetBooking returned %v after confirming it", got)
+	}
+
+	expired, err := repo.ExpireHolds(s.ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := s.names(expired); fmt.Sprint(names) != "[lapsed]" || expired[0].Status != proto.BookingStatus_CANCELLED {
+		t.Errorf("ExpireHolds returned %v, expected the lapsed hold cancelled", expired)
+	}
+	if expired, err := repo.ExpireHolds(s.ctx, now); err != nil || len(expired) != 0 {
+		t.Errorf("ExpireHolds returned %v, %v the second time", expired, err)
+	}
+
+	expect(t, repo.MarkNoShow(s.ctx, lapsed.Id, "NO_SHOW", 2500, now), storage.ErrStale, "marking a cancelled booking as a no-show")
+	if err := repo.MarkNoShow(s.ctx, held.Id, "NO_SHOW", 2500, now); err != nil {
+		t.Fatal(err)
+	}
+	got, err = repo.GetBooking(s.ctx, held.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != proto.BookingStatus_NO_SHOW || got.CancellationRule != "NO_SHOW" || got.CancellationFeeCents != 2500 || got.CancelledAt == "" {
+		t.Errorf("GetBooking returned %v after marking it as a no-show", got)
+	}
+
+	cancellations := []*proto.Cancellation{
+		{BookingId: s.id("booking-1"), Rule: "FREE"},
+		{BookingId: s.id("booking-2"), Rule: "LATE", FeeCents: 1250},
+	}
+	err = repo.CancelBookings(s.ctx, append(cancellations[:1:1], &proto.Cancellation{BookingId: s.id("nowhere")}), now)
+	expect(t, err, storage.ErrNotFound, "cancelling an unknown booking")
+	if got, err := repo.GetBooking(s.ctx, s.id("booking-1")); err != nil || got.Status != proto.BookingStatus_CONFIRMED {
+		t.Errorf("GetBooking returned %v, %v after a rejected cancellation, expected it confirmed", got, err)
+	}
+	if err := repo.CancelBookings(s.ctx, cancellations, now); err != nil {
+		t.Fatal(err)
+	}
+	got, err = repo.GetBooking(s.ctx, s.id("booking-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != proto.BookingStatus_CANCELLED || got.CancellationRule != "LATE" || got.CancellationFeeCents != 1250 || got.CancelledAt == "" {
+		t.Errorf("GetBooking returned %v after cancelling it", got)
+	}
+	// The freed unit takes bookings again
+	s.insert(t, s.booking("booking-3", s.other, s.court.Id, unit1, "11:00", "12:00", proto.BookingStatus_CONFIRMED))
+}
+
+// series checks keeping recurring bookings
+func (s *suite) series(t *testing.T) {
+	repo := s.store.Series
+	s.seed(t)
+	now := time.Now().Format(time.RFC3339)
+
+	series := &proto.BookingSeries{
+		Id:              s.id("series"),
+		CourtId:         s.court.Id,
+		CourtUnitId:     s.id("court-1"),
+		UserId:          s.player,
+		Rrule:           "FREQ=WEEKLY;COUNT=4",
+		StartDate:       "2030-02-01",
+		StartTime:       "9:00",
+		EndTime:         "10:30",
+		NumberOfPlayers: 4,
+		PlayerEmails:    []string{"partner@example.com", "friend@example.com"},
+		Status:          "ACTIVE",
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	if err := repo.InsertSeries(s.ctx, series); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, repo.InsertSeries(s.ctx, series), storage.ErrConflict, "inserting a series with a taken ID")
+	unknown := gproto.Clone(series).(*proto.BookingSeries)
+	unknown.Id, unknown.UserId = s.id("unknown"), s.id("nobody")
+	expect(t, repo.InsertSeries(s.ctx, unknown), storage.ErrNotFound, "inserting a series for an unknown user")
+
+	got, err := repo.GetSeries(s.ctx, series.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CourtId != s.court.Id || got.CourtUnitId != s.id("court-1") || got.UserId != s.player || got.Rrule != series.Rrule ||
+		got.StartDate != "2030-02-01" || got.StartTime != "09:00" || got.EndTime != "10:30" || got.NumberOfPlayers != 4 ||
+		fmt.Sprint(got.PlayerEmails) != "[partner@example.com friend@example.com]" || got.Status != "ACTIVE" {
+		t.Errorf("GetSeries returned %v", got)
+	}
+
+	if err := repo.CancelSeries(s.ctx, series.Id, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := repo.GetSeries(s.ctx, series.Id); err != nil || got.Status != "CANCELLED" {
+		t.Errorf("GetSeries returned %v, %v after cancelling it", got, err)
+	}
+	expect(t, repo.CancelSeries(s.ctx, s.id("nowhere"), time.Now()), storage.ErrNotFound, "cancelling an unknown series")
+
+	if err := repo.DeleteSeries(s.ctx, series.Id); err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.GetSeries(s.ctx, series.Id)
+	expect(t, err, storage.ErrNotFound, "getting a deleted series")
+}
+
+// waitlist checks the waitlist and its offers
+func (s *suite) waitlist(t *testing.T) {
+	repo := s.store.Waitlist
+	s.seed(t)
+	now := time.Now()
+
+	entry := func(name, userID, startTime string) *proto.WaitlistEntry {
+		return &proto.WaitlistEntry{
+			Id:              s.id(name),
+			CourtId:         s.court.Id,
+			UserId:          userID,
+			Date:            "2030-02-01",
+			StartTime:       startTime,
+			EndTime:         "11:00",
+			NumberOfPlayers: 2,
+			PlayerEmails:    []string{"partner@example.com"},
+			Status:          proto.WaitlistStatus_WAITING,
+			CreatedAt:       now.Format(time.RFC3339),
+		}
+	}
+	for _, e := range []*proto.WaitlistEntry{entry("entry-1", s.player, "10:00"), entry("entry-2", s.other, "10:00"), entry("entry-3", s.player, "9:00")} {
+		if err := repo.InsertEntry(s.ctx, e); err != nil {
+			t.Fatalf("inserting waitlist entry %s: %v", e.Id, err)
+		}
+	}
+	expect(t, repo.InsertEntry(s.ctx, entry("entry-4", s.player, "10:00")), storage.ErrConflict, "waiting twice for a slot")
+	expect(t, repo.InsertEntry(s.ctx, entry("entry-5", s.id("nobody"), "10:00")), storage.ErrNotFound, "waiting as an unknown user")
+
+	got, err := repo.GetEntry(s.ctx, s.id("entry-3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CourtId != s.court.Id || got.UserId != s.player || got.Date != "2030-02-01" || got.StartTime != "09:00" ||
+		got.EndTime != "11:00" || got.NumberOfPlayers != 2 || fmt.Sprint(got.PlayerEmails) != "[partner@example.com]" ||
+		got.Status != proto.WaitlistStatus_WAITING || got.BookingId != "" || got.OfferExpiresAt != "" {
+		t.Errorf("GetEntry returned %v", got)
+	}
+	_, err = repo.GetEntry(s.ctx, s.id("nowhere"))
+	expect(t, err, storage.ErrNotFound, "getting an unknown waitlist entry")
+
+	// An offer holds the slot with a pending booking
+	booking := s.booking("offer", s.player, s.court.Id, s.id("court-1"), "10:00", "11:00", proto.BookingStatus_PENDING)
+	booking.HoldExpiresAt = now.Add(10 * time.Minute).Format("2006-01-02T15:04:05")
+	if err := repo.OfferEntry(s.ctx, s.id("entry-1"), now.Add(10*time.Minute), now); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, repo.OfferEntry(s.ctx, s.id("entry-1"), now.Add(10*time.Minute), now), storage.ErrStale, "offering a slot twice")
+	s.insert(t, booking)
+	if err := repo.AttachBooking(s.ctx, s.id("entry-1"), booking.Id); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, repo.AttachBooking(s.ctx, s.id("entry-1"), s.id("nowhere")), storage.ErrNotFound, "attaching an unknown booking")
+	got, err = repo.GetEntry(s.ctx, s.id("entry-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != proto.WaitlistStatus_OFFERED || got.BookingId != booking.Id || got.OfferExpiresAt == "" {
+		t.Errorf("GetEntry returned %v after an offer", got)
+	}
+
+	lists := []struct {
+		filter storage.WaitlistFilter
+		want   []string
+	}{
+		{storage.WaitlistFilter{CourtID: s.court.Id}, []string{"entry-1", "entry-2", "entry-3"}},
+		{storage.WaitlistFilter{UserID: s.player}, []string{"entry-1", "entry-3"}},
+		{storage.WaitlistFilter{CourtID: s.court.Id, Date: "2030-02-01", Statuses: []proto.WaitlistStatus{proto.WaitlistStatus_WAITING}}, []string{"entry-2", "entry-3"}},
+		{storage.WaitlistFilter{CourtID: s.nearby}, nil},
+	}
+	for _, list := range lists {
+		entries, err := repo.ListEntries(s.ctx, list.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Id[len(s.prefix)+1:])
+		}
+		if fmt.Sprint(names) != fmt.Sprint(list.want) {
+			t.Errorf("ListEntries(%+v) returned %v, expected %v", list.filter, names, list.want)
+		}
+	}
+
+	// Claiming confirms the booking and the entry
+	if err := s.store.Bookings.ConfirmBooking(s.ctx, booking.Id, now); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := repo.GetEntry(s.ctx, s.id("entry-1")); err != nil || got.Status != proto.WaitlistStatus_CLAIMED {
+		t.Errorf("GetEntry returned %v, %v after a claim, expected it claimed", got, err)
+	}
+
+	// An offer that is not claimed releases its booking
+	if err := repo.OfferEntry(s.ctx, s.id("entry-2"), now.Add(-time.Minute), now); err != nil {
+		t.Fatal(err)
+	}
+	declined := s.booking("declined", s.other, s.court.Id, s.id("court-2"), "10:00", "11:00", proto.BookingStatus_PENDING)
+	s.insert(t, declined)
+	if err := repo.AttachBooking(s.ctx, s.id("entry-2"), declined.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.ExpireOffer(s.ctx, s.id("entry-2"), now); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, repo.ExpireOffer(s.ctx, s.id("entry-2"), now), storage.ErrStale, "expiring an offer twice")
+	if got, err := s.store.Bookings.GetBooking(s.ctx, declined.Id); err != nil || got.Status != proto.BookingStatus_CANCELLED {
+		t.Errorf("GetBooking returned %v, %v for an expired offer, expected it cancelled", got, err)
+	}
+
+	// Entries whose slot could not be held go back in line
+	if err := repo.OfferEntry(s.ctx, s.id("entry-3"), now.Add(10*time.Minute), now); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.ReturnEntry(s.ctx, s.id("entry-3")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := repo.GetEntry(s.ctx, s.id("entry-3")); err != nil || got.Status != proto.WaitlistStatus_WAITING || got.OfferExpiresAt != "" {
+		t.Errorf("GetEntry returned %v, %v after returning it, expected it waiting", got, err)
+	}
+	expect(t, repo.LeaveEntry(s.ctx, s.id("entry-3"), proto.WaitlistStatus_OFFERED, now), storage.ErrStale, "leaving with another status")
+	if err := repo.LeaveEntry(s.ctx, s.id("entry-3"), proto.WaitlistStatus_WAITING, now); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := repo.GetEntry(s.ctx, s.id("entry-3")); err != nil || got.Status != proto.WaitlistStatus_LEFT {
+		t.Errorf("GetEntry returned %v, %v after leaving, expected it left", got, err)
+	}
+	// The slot may be waited for again
+	if err := repo.InsertEntry(s.ctx, entry("entry-6", s.player, "9:00")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// payments checks keeping payments
+func (s *suite) payments(t *testing.T) {
+	repo := s.store.Payments
+	s.seed(t)
+	s.insert(t, s.booking("booking-1", s.player, s.court.Id, s.id("court-1"), "10:00", "11:00", proto.BookingStatus_PENDING))
+	bookingID := s.id("booking-1")
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	payment := func(name, status string, createdAt time.Time) *storage.Payment {
+		return &storage.Payment{
+			ID:          s.id(name),
+			BookingID:   bookingID,
+			Provider:    "fake",
+			IntentID:    s.id(name + "-intent"),
+			AmountCents: 2500,
+			Currency:    "USD",
+			Status:      status,
+			CreatedAt:   createdAt,
+			UpdatedAt:   createdAt,
+		}
+	}
+	_, err := repo.LatestPayment(s.ctx, bookingID)
+	expect(t, err, storage.ErrNotFound, "getting the payment of a booking without one")
+
+	if err := repo.InsertPayment(s.ctx, payment("payment-1", payments.StatusFailed, created)); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.InsertPayment(s.ctx, payment("payment-2", payments.StatusAuthorized, created.Add(time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, repo.InsertPayment(s.ctx, payment("payment-3", payments.StatusRequiresPayment, created.Add(2*time.Minute))),
+		storage.ErrConflict, "inserting a second active payment")
+	copied := payment("payment-4", payments.StatusFailed, created)
+	copied.IntentID = s.id("payment-2-intent")
+	expect(t, repo.InsertPayment(s.ctx, copied), storage.ErrConflict, "inserting a payment of a recorded intent")
+	unknown := payment("payment-5", payments.StatusFailed, created)
+	unknown.BookingID = s.id("nowhere")
+	expect(t, repo.InsertPayment(s.ctx, unknown), storage.ErrNotFound, "inserting a payment of an unknown booking")
+
+	got, err := repo.LatestPayment(s.ctx, bookingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != s.id("payment-2") || got.Provider != "fake" || got.IntentID != s.id("payment-2-intent") ||
+		got.AmountCents != 2500 || got.Currency != "USD" || got.Status != payments.StatusAuthorized || !got.CreatedAt.Equal(created.Add(time.Minute)) {
+		t.Errorf("LatestPayment returned %+v", got)
+	}
+
+	active, err := repo.ActivePayments(s.ctx, []string{bookingID, s.id("nowhere")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 1 || active[0].ID != s.id("payment-2") {
+		t.Errorf("ActivePayments returned %+v, expected payment-2", active)
+	}
+
+	err = repo.UpdateIntentStatus(s.ctx, "fake", s.id("payment-2-intent"), payments.StatusRequiresPayment, payments.StatusFailed, time.Now())
+	expect(t, err, storage.ErrStale, "moving an intent from a status it does not have")
+	err = repo.UpdateIntentStatus(s.ctx, "fake", s.id("payment-2-intent"), payments.StatusAuthorized, payments.StatusCaptured, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got.Status = payments.StatusPartiallyRefunded
+	got.RefundedCents = 1000
+	got.UpdatedAt = time.Now()
+	if err := repo.UpdatePayment(s.ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, repo.UpdatePayment(s.ctx, payment("nowhere", payments.StatusFailed, created)), storage.ErrNotFound, "updating an unknown payment")
+	got, err = repo.LatestPayment(s.ctx, bookingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != payments.StatusPartiallyRefunded || got.RefundedCents != 1000 {
+		t.Errorf("LatestPayment returned %+v after an update", got)
+	}
+
+	got.Status = payments.StatusRefunded
+	if err := repo.UpdatePayment(s.ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if active, err := repo.ActivePayments(s.ctx, []string{bookingID}); err != nil || len(active) != 0 {
+		t.Errorf("ActivePayments returned %+v, %v after a refund", active, err)
+	}
+	// Once refunded, the booking may be paid again
+	if err := repo.InsertPayment(s.ctx, payment("payment-6", payments.StatusRequiresPayment, created.Add(2*time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// message returns a message to a recipient of the check
+func (s *suite) message(to, key string) *notifications.Message {
+	message := &notifications.Message{Kind: notifications.KindBookingConfirmed, To: s.id(to) + "@example.com",
+		Subject: "Subject " + to, Body: "Body " + to}
+	if key != "" {
+		message.Key = s.id(key)
+	}
+	return message
+}
+
+// claim claims the messages due by at and returns those of the check by
+// recipient. Messages of others due in a shared database are claimed along
+// the way.
+func (s *suite) claim(t *testing.T, at time.Time, lease time.Duration) map[string]*notifications.Queued {
+	t.Helper()
+	claimed, err := s.store.Outbox.ClaimMessages(s.ctx, at, lease, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ours := make(map[string]*notifications.Queued)
+	for _, q := range claimed {
+		if strings.HasPrefix(q.To, s.prefix) {
+			ours[strings.TrimSuffix(strings.TrimPrefix(q.To, s.prefix+"-"), "@example.com")] = q
+		}
+	}
+	return ours
+}
+
+func (s *suite) outbox(t *testing.T) {
+	repo := s.store.Outbox
+	now := time.Now()
+	lease := time.Minute
+
+	if err := repo.Enqueue(s.ctx, s.message("first", "reminder"), s.message("second", ""), s.message("third", "")); err != nil {
+		t.Fatal(err)
+	}
+	// A message with the key of a queued one is dropped
+	if err := repo.Enqueue(s.ctx, s.message("copy", "reminder")); err != nil {
+		t.Fatal(err)
+	}
+
+	claimed := s.claim(t, now.Add(time.Second), lease)
+	if len(claimed) != 3 || claimed["first"] == nil || claimed["second"] == nil || claimed["third"] == nil {
+		t.Fatalf("claimed %v, expected first, second and third", claimed)
+	}
+	first := claimed["first"]
+	if first.Attempt != 1 || first.Kind != notifications.KindBookingConfirmed || first.Subject != "Subject first" ||
+		first.Body != "Body first" || first.Key != s.id("reminder") {
+		t.Errorf("claimed %+v", first)
+	}
+	if claimed := s.claim(t, now.Add(time.Second), lease); len(claimed) != 0 {
+		t.Errorf("claimed %v again during the lease", claimed)
+	}
+
+	// The first is sent, the second put off and the third left to its lease
+	if err := repo.MarkSent(s.ctx, first.ID, now); err != nil {
+		t.Fatal(err)
+	}
+	second := claimed["second"]
+	if err := repo.MarkFailed(s.ctx, second.ID, second.Attempt, "mail server unavailable", now.Add(2*lease)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the lease is over, the third is claimed again, with another attempt
+	claimed = s.claim(t, now.Add(lease+time.Second), lease)
+	if len(claimed) != 1 || claimed["third"] == nil || claimed["third"].Attempt != 2 {
+		t.Fatalf("claimed %v after the lease, expected the third again", claimed)
+	}
+	// The failure of an earlier attempt is ignored
+	third := claimed["third"]
+	if err := repo.MarkFailed(s.ctx, third.ID, 1, "timeout", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	claimed = s.claim(t, now.Add(3*lease), lease)
+	if len(claimed) != 2 || claimed["second"] == nil || claimed["second"].Attempt != 2 ||
+		claimed["third"] == nil || claimed["third"].Attempt != 3 {
+		t.Fatalf("claimed %v after the retry, expected the second and third again", claimed)
+	}
+	if err := repo.MarkFailed(s.ctx, second.ID, 2, "mail server unavailable", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.MarkSent(s.ctx, third.ID, now); err != nil {
+		t.Fatal(err)
+	}
+	if claimed := s.claim(t, now.Add(time.Hour), lease); len(claimed) != 0 {
+		t.Errorf("claimed %v, expected the messages to be sent or given up", claimed)
+	}
+
+	// Keys are kept once messages are sent
+	if err := repo.Enqueue(s.ctx, s.message("again", "reminder")); err != nil {
+		t.Fatal(err)
+	}
+	if claimed := s.claim(t, time.Now().Add(time.Hour), lease); len(claimed) != 0 {
+		t.Errorf("claimed %v, expected the message with a sent key to be dropped", claimed)
+	}
+
+	// Bookings queue their messages if and only if they are made
+	s.seed(t)
+	booking := s.booking("booking-1", s.player, s.court.Id, s.id("court-1"), "10:00", "11:00", proto.BookingStatus_CONFIRMED)
+	if err := s.store.Bookings.InsertBooking(s.ctx, booking, s.message("booked", "")); err != nil {
+		t.Fatal(err)
+	}
+	overlapping := s.booking("booking-2", s.other, s.court.Id, s.id("court-1"), "10:30", "11:30", proto.BookingStatus_CONFIRMED)
+	expect(t, s.store.Bookings.InsertBooking(s.ctx, overlapping, s.message("overlapping", "")), storage.ErrOverlap,
+		"inserting an overlapping booking")
+	cancellation := &proto.Cancellation{BookingId: booking.Id, Rule: "FREE"}
+	if err := s.store.Bookings.CancelBookings(s.ctx, []*proto.Cancellation{cancellation}, time.Now(), s.message("cancelled", "")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, s.store.Bookings.ConfirmBooking(s.ctx, booking.Id, time.Now(), s.message("confirmed", "")), storage.ErrStale,
+		"confirming a cancelled booking")
+
+	claimed = s.claim(t, time.Now().Add(time.Hour), lease)
+	if len(claimed) != 2 || claimed["booked"] == nil || claimed["cancelled"] == nil {
+		t.Errorf("claimed %v, expected the messages of the booking and its cancellation", claimed)
+	}
+}
+
+// session creates a session of a user lasting a day, with the refresh token
+// hash name
+func (s *suite) session(t *testing.T, name, userID string, now time.Time) *storage.Session {
+	t.Helper()
+	session := &storage.Session{ID: s.id(name), UserID: userID, UserAgent: "suite", CreatedAt: now, ExpiresAt: now.Add(24 * time.Hour)}
+	if err := s.store.Sessions.CreateSession(s.ctx, session, s.id(name+"-token")); err != nil {
+		t.Fatalf("creating session %s: %v", name, err)
+	}
+	return session
+}
+
+// live checks whether a session is live
+func (s *suite) live(t *testing.T, sessionID string, at time.Time, want bool) {
+	t.Helper()
+	live, err := s.store.Sessions.SessionLive(s.ctx, sessionID, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live != want {
+		t.Errorf("session %s is live: %v, expected %v", sessionID, live, want)
+	}
+}
+
+// sessions checks rotating refresh tokens and revoking sessions
+func (s *suite) sessions(t *testing.T) {
+	repo := s.store.Sessions
+	s.seed(t)
+	now := time.Now().Truncate(time.Second)
+
+	first := s.session(t, "first", s.player, now)
+	s.live(t, first.ID, now, true)
+	s.live(t, first.ID, first.ExpiresAt, false)
+	s.live(t, s.id("nowhere"), now, false)
+	expect(t, repo.CreateSession(s.ctx, &storage.Session{ID: s.id("nobody"), UserID: s.id("nobody"), CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+		s.id("nobody-token")), storage.ErrNotFound, "creating a session of an unknown user")
+
+	got, err := repo.RotateRefreshToken(s.ctx, s.id("first-token"), s.id("first-token-2"), now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != first.ID || got.UserID != s.player || got.UserAgent != "suite" || !got.ExpiresAt.Equal(first.ExpiresAt) {
+		t.Errorf("RotateRefreshToken returned %+v", got)
+	}
+	_, err = repo.RotateRefreshToken(s.ctx, s.id("nowhere"), s.id("nowhere-2"), now)
+	expect(t, err, storage.ErrNotFound, "rotating an unknown token")
+	_, err = repo.RotateRefreshToken(s.ctx, s.id("first-token-2"), s.id("first-token-3"), first.ExpiresAt)
+	expect(t, err, storage.ErrNotFound, "rotating a token of an expired session")
+
+	// Spent tokens still name their session
+	if got, err := repo.GetSessionByRefreshToken(s.ctx, s.id("first-token")); err != nil || got.ID != first.ID {
+		t.Errorf("GetSessionByRefreshToken returned %+v, %v for a spent token", got, err)
+	}
+	_, err = repo.GetSessionByRefreshToken(s.ctx, s.id("nowhere"))
+	expect(t, err, storage.ErrNotFound, "getting the session of an unknown token")
+
+	// Presenting a spent token again revokes the session, so the current
+	// token stops working too
+	_, err = repo.RotateRefreshToken(s.ctx, s.id("first-token"), s.id("first-token-4"), now.Add(2*time.Minute))
+	expect(t, err, storage.ErrReused, "rotating a spent token")
+	s.live(t, first.ID, now.Add(2*time.Minute), false)
+	_, err = repo.RotateRefreshToken(s.ctx, s.id("first-token-2"), s.id("first-token-5"), now.Add(3*time.Minute))
+	expect(t, err, storage.ErrNotFound, "rotating the current token of a revoked session")
+
+	// Sessions are revoked one at a time, or all those of a user
+	second := s.session(t, "second", s.player, now)
+	third := s.session(t, "third", s.player, now)
+	other := s.session(t, "other", s.other, now)
+	expect(t, repo.RevokeSession(s.ctx, second.ID, storage.RevokedLogout, now), nil, "revoking a session")
+	s.live(t, second.ID, now, false)
+	s.live(t, third.ID, now, true)
+	expect(t, repo.RevokeUserSessions(s.ctx, s.player, storage.RevokedLogoutAll, now), nil, "revoking the sessions of a user")
+	s.live(t, third.ID, now, false)
+	s.live(t, other.ID, now, true)
+	_, err = repo.RotateRefreshToken(s.ctx, s.id("third-token"), s.id("third-token-2"), now)
+	expect(t, err, storage.ErrNotFound, "rotating a token of a revoked session")
+}
+
+// loginCodes checks redeeming the codes of sessions
+func (s *suite) loginCodes(t *testing.T) {
+	repo := s.store.Sessions
+	s.seed(t)
+	now := time.Now().Truncate(time.Second)
+	session := s.session(t, "session", s.player, now)
+
+	expect(t, repo.CreateLoginCode(s.ctx, s.id("code"), session.ID, now, now.Add(time.Minute)), nil, "creating a login code")
+	expect(t, repo.CreateLoginCode(s.ctx, s.id("expired"), session.ID, now, now.Add(time.Minute)), nil, "creating a login code")
+	expect(t, repo.CreateLoginCode(s.ctx, s.id("orphan"), s.id("nowhere"), now, now.Add(time.Minute)),
+		storage.ErrNotFound, "creating a login code of an unknown session")
+
+	_, err := repo.RedeemLoginCode(s.ctx, s.id("expired"), now.Add(time.Minute))
+	expect(t, err, storage.ErrNotFound, "redeeming an expired code")
+	_, err = repo.RedeemLoginCode(s.ctx, s.id("nowhere"), now)
+	expect(t, err, storage.ErrNotFound, "redeeming an unknown code")
+
+	got, err := repo.RedeemLoginCode(s.ctx, s.id("code"), now.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != session.ID || got.UserID != s.player {
+		t.Errorf("RedeemLoginCode returned %+v", got)
+	}
+	s.live(t, session.ID, now, true)
+
+	// Redeeming a code twice revokes its session
+	_, err = repo.RedeemLoginCode(s.ctx, s.id("code"), now.Add(2*time.Second))
+	expect(t, err, storage.ErrReused, "redeeming a code twice")
+	s.live(t, session.ID, now, false)
+}
+
+// apiKeys checks keeping API keys
+func (s *suite) apiKeys(t *testing.T) {
+	repo := s.store.APIKeys
+	s.seed(t)
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	expires := created.Add(48 * time.Hour)
+
+	key := func(name, userID, courtID string, createdAt time.Time) *storage.APIKey {
+		return &storage.APIKey{ID: s.id(name), UserID: userID, CourtID: courtID, Name: "Key " + name, SecretHash: "hash-" + name,
+			Scopes: []string{"bookings:read", "bookings:write"}, RateLimit: 60, CreatedBy: s.player, CreatedAt: createdAt}
+	}
+
+	personal := key("personal", s.player, "", created)
+	personal.ExpiresAt = &expires
+	expect(t, repo.CreateAPIKey(s.ctx, personal, nil, ""), nil, "creating a personal key")
+	expect(t, repo.CreateAPIKey(s.ctx, key("newer", s.player, "", created.Add(time.Minute)), nil, ""), nil, "creating a personal key")
+	expect(t, repo.CreateAPIKey(s.ctx, key("personal", s.player, "", created), nil, ""), storage.ErrConflict, "creating a key with a taken ID")
+	expect(t, repo.CreateAPIKey(s.ctx, key("orphan", s.id("nobody"), "", created), nil, ""), storage.ErrNotFound, "creating a key of an unknown user")
+
+	// Service account keys create their account with its role
+	account := &storage.User{ID: s.id("svc"), Email: s.id("svc") + "@service-accounts.invalid", Name: "Key service",
+		ServiceAccount: true, CreatedAt: created}
+	service := key("service", account.ID, s.court.Id, created)
+	expect(t, repo.CreateAPIKey(s.ctx, service, account, "facility_admin"), nil, "creating a service account key")
+	if got, err := s.store.Users.GetUser(s.ctx, account.ID); err != nil || !got.ServiceAccount {
+		t.Errorf("GetUser returned %+v, %v for the service account", got, err)
+	}
+	roles, err := s.store.Users.ListRoles(s.ctx, account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []storage.StaffRole{{CourtID: s.court.Id, Role: "facility_admin"}}; fmt.Sprint(roles) != fmt.Sprint(want) {
+		t.Errorf("the service account holds %v, expected %v", roles, want)
+	}
+	orphan := &storage.User{ID: s.id("svc-2"), Email: s.id("svc-2") + "@service-accounts.invalid", Name: "Orphan", ServiceAccount: true, CreatedAt: created}
+	expect(t, repo.CreateAPIKey(s.ctx, key("orphan-service", orphan.ID, s.id("nowhere"), created), orphan, "staff"),
+		storage.ErrNotFound, "creating a service account key of an unknown facility")
+	_, err = s.store.Users.GetUser(s.ctx, orphan.ID)
+	expect(t, err, storage.ErrNotFound, "getting the account of a key that was not created")
+
+	got, err := repo.GetAPIKey(s.ctx, personal.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UserID != s.player || got.CourtID != "" || got.Name != "Key personal" || got.SecretHash != "hash-personal" ||
+		fmt.Sprint(got.Scopes) != "[bookings:read bookings:write]" || got.RateLimit != 60 || got.CreatedBy != s.player ||
+		!got.CreatedAt.Equal(created) || got.ExpiresAt == nil || !got.ExpiresAt.Equal(expires) || got.LastUsedAt != nil || got.RevokedAt != nil {
+		t.Errorf("GetAPIKey returned %+v", got)
+	}
+	_, err = repo.GetAPIKey(s.ctx, s.id("nowhere"))
+	expect(t, err, storage.ErrNotFound, "getting an unknown key")
+
+	keys, err := repo.ListUserAPIKeys(s.ctx, s.player)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].ID != s.id("newer") || keys[1].ID != personal.ID {
+		t.Errorf("ListUserAPIKeys returned %+v, expected newer and personal", keys)
+	}
+	keys, err = repo.ListCourtAPIKeys(s.ctx, s.court.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].ID != service.ID || keys[0].CourtID != s.court.Id {
+		t.Errorf("ListCourtAPIKeys returned %+v, expected the service key", keys)
+	}
+
+	// Uses are recorded at most once per period
+	used := created.Add(time.Minute)
+	expect(t, repo.MarkAPIKeyUsed(s.ctx, personal.ID, used, used.Add(-time.Minute)), nil, "marking a key used")
+	expect(t, repo.MarkAPIKeyUsed(s.ctx, personal.ID, used.Add(30*time.Second), used.Add(-30*time.Second)), nil, "marking a key used again")
+	if got, err := repo.GetAPIKey(s.ctx, personal.ID); err != nil || got.LastUsedAt == nil || !got.LastUsedAt.Equal(used) {
+		t.Errorf("GetAPIKey returned %+v, %v, expected it last used at %v", got, err, used)
+	}
+	later := used.Add(2 * time.Minute)
+	expect(t, repo.MarkAPIKeyUsed(s.ctx, personal.ID, later, later.Add(-time.Minute)), nil, "marking a key used later")
+	if got, err := repo.GetAPIKey(s.ctx, personal.ID); err != nil || got.LastUsedAt == nil || !got.LastUsedAt.Equal(later) {
+		t.Errorf("GetAPIKey returned %+v, %v, expected it last used at %v", got, err, later)
+	}
+
+	revoked := time.Now().Truncate(time.Second)
+	expect(t, repo.RevokeAPIKey(s.ctx, personal.ID, revoked), nil, "revoking a key")
+	expect(t, repo.RevokeAPIKey(s.ctx, personal.ID, revoked), storage.ErrNotFound, "revoking a revoked key")
+	expect(t, repo.RevokeAPIKey(s.ctx, s.id("nowhere"), revoked), storage.ErrNotFound, "revoking an unknown key")
+	if got, err := repo.GetAPIKey(s.ctx, personal.ID); err != nil || got.RevokedAt == nil || !got.RevokedAt.Equal(revoked) {
+		t.Errorf("GetAPIKey returned %+v, %v after revoking it", got, err)
+	}
+}
+
+// magicLinks checks spending login links
+func (s *suite) magicLinks(t *testing.T) {
+	repo := s.store.MagicLinks
+	now := time.Now()
+	email := s.id("player") + "@example.com"
+
+	expect(t, repo.CreateMagicLink(s.ctx, s.id("link"), email, now, now.Add(15*time.Minute)), nil, "creating a link")
+	expect(t, repo.CreateMagicLink(s.ctx, s.id("expired"), email, now, now.Add(15*time.Minute)), nil, "creating a link")
+
+	_, err := repo.ConsumeMagicLink(s.ctx, s.id("expired"), now.Add(15*time.Minute))
+	expect(t, err, storage.ErrNotFound, "consuming an expired link")
+	_, err = repo.ConsumeMagicLink(s.ctx, s.id("nowhere"), now)
+	expect(t, err, storage.ErrNotFound, "consuming an unknown link")
+
+	got, err := repo.ConsumeMagicLink(s.ctx, s.id("link"), now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != email {
+		t.Errorf("ConsumeMagicLink returned %s, expected %s", got, email)
+	}
+	_, err = repo.ConsumeMagicLink(s.ctx, s.id("link"), now.Add(time.Minute))
+	expect(t, err, storage.ErrNotFound, "consuming a link twice")
+}
+
+// checkPlayers checks the players of a booking, in order
+func checkPlayers(t *testing.T, booking *proto.Booking, want []*proto.BookingPlayer) {
+	t.Helper()
+	if len(booking.Players) != len(want) {
+		t.Fatalf("booking %s has players %v, expected %v", booking.Id, booking.Players, want)
+	}
+	for i, player := range want {
+		if g := booking.Players[i]; g.Email != player.Email || g.UserId != player.UserId || g.Status != player.Status || g.RespondedAt != player.RespondedAt {
+			t.Errorf("booking %s has player %v, expected %v", booking.Id, g, player)
+		}
+	}
+}
+
+// expect reports an error unless err is want, or nil when want is
+func expect(t *testing.T, err, want error, step string) {
+	t.Helper()
+	if want == nil && err != nil {
+		t.Errorf("%s: %v", step, err)
+	} else if !errors.Is(err, want) {
+		t.Errorf("%s: got %v, expected %v", step, err, want)
+	}
+}
@@ -9,6 +9,7 @@ import CourtDetailPage from './pages/CourtDetailPage';
 import BookingsPage from './pages/BookingsPage';
 import NotFound from './pages/NotFound';
 import AuthCallback from './pages/AuthCallback';
+import InvitationPage from './pages/InvitationPage';
 import './App.css';
 
 // Protected route component
@@ -36,6 +37,7 @@ const App: React.FC = () => {
           <Route path="/courts" element={<CourtsPage />} />
           <Route path="/courts/:id" element={<CourtDetailPage />} />
           <Route path="/auth-callback" element={<AuthCallback />} />
+          <Route path="/invitations/:token" element={<InvitationPage />} />
           <Route
             path="/bookings"
             element={
@@ -6,7 +6,7 @@ import apiService from '../services/api';
 // Create the context
 interface AuthContextType {
   auth: AuthState;
-  login: () => void;
+  login: (provider?: string) => void;
   logout: () => Promise<void>;
   loginWithToken: (token: string) => Promise<void>;
 }
@@ -60,9 +60,9 @@ export const AuthProvider: React.FC<{ children: React.ReactNode }> = ({ children
     checkAuth();
   }, []);
 
-  // Redirect to Google OAuth login
-  const login = () => {
-    window.location.href = `${import.meta.env.VITE_API_URL || 'http://localhost:8080'}/auth/google/login`;
+  // Redirect to the identity provider's login, Google by default
+  const login = (provider: string = 'google') => {
+    window.location.href = `${import.meta.env.VITE_API_URL || 'http://localhost:8080'}/auth/${provider}/login`;
   };
 
   // Log out
@@ -1,27 +1,41 @@
 // src/pages/AuthCallback.tsx
-import React, { useEffect } from 'react';
+import React, { useEffect, useRef } from 'react';
 import { useNavigate, useSearchParams } from 'react-router-dom';
 import { useAuth } from '../hooks/useAuth';
+import apiService from '../services/api';
 
 const AuthCallback: React.FC = () => {
   const [searchParams] = useSearchParams();
   const navigate = useNavigate();
   const { loginWithToken } = useAuth();
+  // Codes are single-use: redeeming one twice ends the session
+  const redeemed = useRef(false);
   
   useEffect(() => {
-    const token = searchParams.get('token');
-    if (token) {
-      // Save token to localStorage
-      localStorage.setItem('token', token);
-      
-      // Update auth context
-      loginWithToken(token);
-      
-      // Redirect to home page
-      navigate('/', { replace: true });
-    } else {
+    const code = searchParams.get('code');
+    if (!code) {
       navigate('/');
+      return;
     }
+    if (redeemed.current) {
+      return;
+    }
+    redeemed.current = true;
+
+    // Redeem the one-time login code for a token
+    apiService.auth
+      .exchangeCode(code)
+      .then(async (token) => {
+        // Save token to localStorage
+        localStorage.setItem('token', token);
+
+        // Update auth context
+        await loginWithToken(token);
+
+        // Redirect to home page
+        navigate('/', { replace: true });
+      })
+      .catch(() => navigate('/', { replace: true }));
   }, [searchParams, navigate, loginWithToken]);
   
   return (
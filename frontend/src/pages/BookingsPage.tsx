@@ -3,7 +3,7 @@ import { Link } from 'react-router-dom';
 import { format, parseISO, isBefore } from 'date-fns';
 import apiService from '../services/api';
 import { useAuth } from '../hooks/useAuth';
-import { Booking, BookingStatus, Court } from '../types';
+import { Booking, BookingStatus, Court, PlayerStatus } from '../types';
 import './BookingsPage.css';
 
 const BookingsPage: React.FC = () => {
@@ -108,6 +108,12 @@ const BookingsPage: React.FC = () => {
       endTime: booking.end_time,
       numberOfPlayers: booking.number_of_players,
       playerEmails: booking.player_emails || [],
+      players: (booking.players || []).map((player: any) => ({
+        email: player.email,
+        userId: player.user_id || undefined,
+        status: player.status as PlayerStatus,
+        respondedAt: player.responded_at || undefined
+      })),
       status: booking.status as BookingStatus,
       createdAt: booking.created_at,
       updatedAt: booking.updated_at
@@ -224,9 +230,9 @@ const BookingsPage: React.FC = () => {
                   {court && <div className="court-address">{court.address}</div>}
                   <div className="booking-details">
                     <span>{booking.numberOfPlayers || 0} Players</span>
-                    {booking.playerEmails && booking.playerEmails.length > 0 && (
+                    {booking.players && booking.players.length > 0 && (
                       <div className="player-emails">
-                        Invited: {booking.playerEmails.join(', ')}
+                        Invited: {booking.players.map((player) => `${player.email} (${player.status.toLowerCase()})`).join(', ')}
                       </div>
                     )}
                   </div>
@@ -235,13 +241,16 @@ const BookingsPage: React.FC = () => {
                 <div className="booking-right">
                   {activeTab === 'upcoming' && booking.status !== BookingStatus.CANCELLED && (
                     <>
-                      <button
-                        className="btn btn-cancel"
-                        onClick={() => handleCancelBooking(booking.id)}
-                        disabled={cancellingBookingId === booking.id}
-                      >
-                        {cancellingBookingId === booking.id ? 'Cancelling...' : 'Cancel Booking'}
-                      </button>
+                      {/* Players see the bookings they were invited to, which only the organizer may cancel */}
+                      {booking.userId === auth.user?.id && (
+                        <button
+                          className="btn btn-cancel"
+                          onClick={() => handleCancelBooking(booking.id)}
+                          disabled={cancellingBookingId === booking.id}
+                        >
+                          {cancellingBookingId === booking.id ? 'Cancelling...' : 'Cancel Booking'}
+                        </button>
+                      )}
                       {court && (
                         <Link to={`/courts/${court.id}`} className="btn btn-view">
                           View Court
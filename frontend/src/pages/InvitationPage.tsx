@@ -0,0 +1,98 @@
+// pickle/frontend/src/pages/InvitationPage.tsx
+import React, { useEffect, useState } from 'react';
+import { Link, useParams } from 'react-router-dom';
+import apiService from '../services/api';
+import { BookingStatus, Invitation, PlayerStatus } from '../types';
+import './InvitationPage.css';
+
+// Invited players land here from the link in their invitation; the token in
+// the link lets them answer without logging in
+const InvitationPage: React.FC = () => {
+  const { token } = useParams<{ token: string }>();
+  const [invitation, setInvitation] = useState<Invitation | null>(null);
+  const [loading, setLoading] = useState(true);
+  const [answering, setAnswering] = useState(false);
+  const [error, setError] = useState<string | null>(null);
+
+  useEffect(() => {
+    if (!token) {
+      return;
+    }
+    apiService.invitations
+      .getInvitation(token)
+      .then(setInvitation)
+      .catch((err) => {
+        setError('This invitation is invalid or has expired.');
+        console.error(err);
+      })
+      .finally(() => setLoading(false));
+  }, [token]);
+
+  const answer = async (accept: boolean) => {
+    if (!token) {
+      return;
+    }
+    setAnswering(true);
+    setError(null);
+    try {
+      setInvitation(await apiService.invitations.answerInvitation(token, accept));
+    } catch (err: any) {
+      setError(err.response?.data?.message || 'Failed to answer the invitation. Please try again.');
+      console.error(err);
+    } finally {
+      setAnswering(false);
+    }
+  };
+
+  if (loading) {
+    return <div className="loading">Loading your invitation...</div>;
+  }
+
+  return (
+    <div className="invitation-page">
+      <div className="invitation-content">
+        {error && <div className="error-message">{error}</div>}
+
+        {invitation && (
+          <>
+            <h2>{invitation.organizerName} invited you to play</h2>
+            <p>
+              <strong>{invitation.courtName}</strong>
+              <br />
+              {invitation.date}, {invitation.startTime} - {invitation.endTime}
+            </p>
+
+            {invitation.bookingStatus === BookingStatus.CANCELLED ? (
+              <p>This booking was cancelled.</p>
+            ) : (
+              <>
+                {invitation.status === PlayerStatus.ACCEPTED && <p>You're playing. See you on the court!</p>}
+                {invitation.status === PlayerStatus.DECLINED && <p>You declined this invitation.</p>}
+                <div className="invitation-actions">
+                  <button
+                    className="btn btn-primary"
+                    onClick={() => answer(true)}
+                    disabled={answering || invitation.status === PlayerStatus.ACCEPTED}
+                  >
+                    Accept
+                  </button>
+                  <button
+                    className="btn btn-secondary"
+                    onClick={() => answer(false)}
+                    disabled={answering || invitation.status === PlayerStatus.DECLINED}
+                  >
+                    Decline
+                  </button>
+                </div>
+              </>
+            )}
+          </>
+        )}
+
+        <Link to="/courts">Find Courts</Link>
+      </div>
+    </div>
+  );
+};
+
+export default InvitationPage;
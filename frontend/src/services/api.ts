@@ -11,6 +11,7 @@ import {
   GetCourtRequest,
   GetCourtsRequest,
   GetCourtsResponse,
+  Invitation,
   UpdateBookingRequest,
   User,
 } from '../types';
@@ -41,6 +42,39 @@ api.interceptors.request.use(
   }
 );
 
+// Access tokens are short-lived: when one is rejected, get a new one with the
+// refresh token cookie and retry the request once
+let refreshing: Promise<string> | null = null;
+
+const refreshToken = async (): Promise<string> => {
+  const response = await axios.post(`${API_BASE_URL}/auth/refresh`, null, { withCredentials: true });
+  localStorage.setItem('token', response.data.token);
+  return response.data.token;
+};
+
+api.interceptors.response.use(
+  (response) => response,
+  async (error) => {
+    const config = error.config as (AxiosRequestConfig & { _retried?: boolean }) | undefined;
+    if (error.response?.status !== 401 || !config || config._retried || config.url?.startsWith('/auth/')) {
+      return Promise.reject(error);
+    }
+    config._retried = true;
+
+    try {
+      refreshing = refreshing || refreshToken();
+      const token = await refreshing;
+      config.headers = { ...config.headers, Authorization: `Bearer ${token}` };
+      return api(config);
+    } catch {
+      localStorage.removeItem('token');
+      return Promise.reject(error);
+    } finally {
+      refreshing = null;
+    }
+  }
+);
+
 // API service
 export const apiService = {
   // Auth endpoints
@@ -51,11 +85,28 @@ export const apiService = {
       return response.data;
     },
 
+    // Redeem the one-time code the login redirected back with for a token
+    exchangeCode: async (code: string): Promise<string> => {
+      const response = await api.post('/auth/exchange', { code });
+      return response.data.token;
+    },
+
+    // Email a login link
+    sendLoginLink: async (email: string): Promise<void> => {
+      await api.post('/auth/email/login', { email });
+    },
+
     // Log out
     logout: async (): Promise<void> => {
       await api.post('/auth/logout');
       localStorage.removeItem('token');
     },
+
+    // Log out of every session of the user
+    logoutEverywhere: async (): Promise<void> => {
+      await api.post('/auth/logout-all');
+      localStorage.removeItem('token');
+    },
   },
 
   // Court endpoints
@@ -99,6 +150,37 @@ export const apiService = {
       return response.data;
     },
   },
+
+  // Invitation endpoints, authorized by the RSVP token of the invitation link
+  invitations: {
+    // Get the invitation a token was made for
+    getInvitation: async (token: string): Promise<Invitation> => {
+      const response = await api.get(`/api/invitations/${encodeURIComponent(token)}`);
+      return transformInvitation(response.data);
+    },
+
+    // Accept or decline an invitation
+    answerInvitation: async (token: string, accept: boolean): Promise<Invitation> => {
+      const answer = accept ? 'accept' : 'decline';
+      const response = await api.post(`/api/invitations/${encodeURIComponent(token)}/${answer}`);
+      return transformInvitation(response.data);
+    },
+  },
 };
 
+// The API names fields in snake case
+const transformInvitation = (invitation: any): Invitation => ({
+  bookingId: invitation.booking_id,
+  courtId: invitation.court_id,
+  courtName: invitation.court_name,
+  organizerName: invitation.organizer_name,
+  date: invitation.date,
+  startTime: invitation.start_time,
+  endTime: invitation.end_time,
+  email: invitation.email,
+  status: invitation.status,
+  respondedAt: invitation.responded_at || undefined,
+  bookingStatus: invitation.booking_status,
+});
+
 export default apiService;
\ No newline at end of file
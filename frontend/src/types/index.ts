@@ -43,6 +43,19 @@ export interface User {
     CANCELLED = 'CANCELLED',
   }
   
+  export enum PlayerStatus {
+    INVITED = 'INVITED',
+    ACCEPTED = 'ACCEPTED',
+    DECLINED = 'DECLINED',
+  }
+  
+  export interface BookingPlayer {
+    email: string;
+    userId?: string; // Set for registered users
+    status: PlayerStatus;
+    respondedAt?: string;
+  }
+  
   export interface Booking {
     id: string;
     courtId: string;
@@ -52,6 +65,7 @@ export interface User {
     endTime: string;
     numberOfPlayers: number;
     playerEmails: string[];
+    players: BookingPlayer[];
     status: BookingStatus;
     createdAt: string;
     updatedAt: string;
@@ -84,6 +98,21 @@ export interface User {
     playerEmails?: string[];
   }
   
+  // An invitation to play, as seen through its RSVP link
+  export interface Invitation {
+    bookingId: string;
+    courtId: string;
+    courtName: string;
+    organizerName: string;
+    date: string;
+    startTime: string;
+    endTime: string;
+    email: string;
+    status: PlayerStatus;
+    respondedAt?: string;
+    bookingStatus: BookingStatus;
+  }
+  
   export interface CancelBookingRequest {
     bookingId: string;
   }